@@ -0,0 +1,48 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditlog
+
+import (
+	"time"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+var Error = errors.NewClass("auditlog")
+
+// Event records a single change to a queue: who made it, to which BattleTag,
+// and where in the queue.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Queue  string    `json:"queue"`
+	Action string    `json:"action"`
+	// ActorId is the id of the user who made the change, or empty if the
+	// bot made it on its own.
+	ActorId   string `json:"actor_id,omitempty"`
+	Actor     string `json:"actor,omitempty"`
+	BattleTag string `json:"battle_tag,omitempty"`
+	// Position is 1-based, or 0 if the change has no position.
+	Position int `json:"position,omitempty"`
+	// Detail holds anything else worth recording, eg a queue's new name.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Log keeps each guild's most recent events.
+type Log interface {
+	Append(guild_id string, event *Event) error
+	// Recent returns up to n of the guild's most recent events that match,
+	// newest first. A nil match matches every event.
+	Recent(guild_id string, n int, match func(*Event) bool) ([]*Event, error)
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filelog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/util"
+)
+
+// minCompaction is the number of dropped events the file may hold before it's
+// compacted.
+const minCompaction = 1000
+
+var Error = auditlog.Error.NewClass("filelog")
+
+// fileLog keeps each guild's most recent events in memory, appending each
+// event to a file that's replayed when the log is opened. The file is
+// rewritten with only the kept events once it's mostly events that have been
+// dropped.
+type fileLog struct {
+	mu      sync.Mutex
+	events  map[string][]*auditlog.Event
+	max_len int
+	kept    int // events in memory
+	path    string
+	file    *os.File
+	records int // events in the file
+}
+
+var _ auditlog.Log = (*fileLog)(nil)
+
+// record is a line of the file.
+type record struct {
+	GuildId string          `json:"guild_id"`
+	Event   *auditlog.Event `json:"event"`
+}
+
+// New opens the log saved to path, creating it if need be. It keeps up to
+// max_len events per guild.
+func New(path string, max_len int) (*fileLog, error) {
+	l := &fileLog{
+		events:  make(map[string][]*auditlog.Event),
+		max_len: max_len,
+		path:    path,
+	}
+	if err := l.replay(); err != nil {
+		return nil, err
+	}
+	// Compacting straight away drops any record torn by a crash.
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *fileLog) replay() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line_num := 1; ; line_num++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A final line without a newline was torn by a crash
+			// mid-write, so it's dropped.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec := &record{}
+		if err = json.Unmarshal(line, rec); err != nil || rec.Event == nil {
+			return Error.New("%s line %d: invalid event", l.path,
+				line_num)
+		}
+		l.keep(rec.GuildId, rec.Event)
+	}
+}
+
+// keep adds the event to the guild's events in memory, dropping the oldest
+// if there are too many.
+//
+// ensure that you're holding l.mu before calling!
+func (l *fileLog) keep(guild_id string, event *auditlog.Event) {
+	events := append(l.events[guild_id], event)
+	l.kept++
+	if len(events) > l.max_len {
+		l.kept -= len(events) - l.max_len
+		events = events[len(events)-l.max_len:]
+	}
+	l.events[guild_id] = events
+}
+
+// compact rewrites the file with only the kept events.
+//
+// ensure that you're holding l.mu before calling!
+func (l *fileLog) compact() error {
+	buf := &bytes.Buffer{}
+	records := 0
+	for guild_id, events := range l.events {
+		for _, event := range events {
+			line, err := json.Marshal(&record{
+				GuildId: guild_id,
+				Event:   event,
+			})
+			if err != nil {
+				return err
+			}
+			buf.Write(append(line, '\n'))
+			records++
+		}
+	}
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if err := util.WriteFileAtomic(l.path, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.records = records
+	return nil
+}
+
+func (l *fileLog) Append(guild_id string, event *auditlog.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	copied := *event
+	line, err := json.Marshal(&record{GuildId: guild_id, Event: &copied})
+	if err != nil {
+		return err
+	}
+	l.keep(guild_id, &copied)
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.records++
+	if l.records > 2*l.kept+minCompaction {
+		return l.compact()
+	}
+	return l.file.Sync()
+}
+
+func (l *fileLog) Recent(guild_id string, n int,
+	match func(*auditlog.Event) bool) (recent []*auditlog.Event, err error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.events[guild_id]
+	for i := len(events) - 1; i >= 0 && len(recent) < n; i-- {
+		if match == nil || match(events[i]) {
+			copied := *events[i]
+			recent = append(recent, &copied)
+		}
+	}
+	return recent, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filelog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/zentest"
+)
+
+var (
+	testDir   string
+	testFiles = 0
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "filelog")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testDir = dir
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+func TestAppend(t *testing.T) {
+	auditlog.CommonTestAppend(t, newTestLog(t, nextPath(),
+		auditlog.TestMaxLen))
+}
+
+func TestRecent(t *testing.T) {
+	auditlog.CommonTestRecent(t, newTestLog(t, nextPath(), 100))
+}
+
+func TestReopen(t *testing.T) {
+	test := zentest.New(t)
+	path := nextPath()
+	l := newTestLog(t, path, 2)
+	for _, action := range []string{"enqueue", "take", "clear"} {
+		test.AssertNil(l.Append(auditlog.TestGuildId,
+			&auditlog.Event{Action: action}))
+	}
+
+	// A record torn by a crash is dropped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	test.AssertNil(err)
+	_, err = f.Write([]byte(`{"guild_id":"torn","event":`))
+	test.AssertNil(err)
+	test.AssertNil(f.Close())
+
+	events, err := newTestLog(t, path, 2).Recent(auditlog.TestGuildId,
+		10, nil)
+	test.AssertNil(err)
+	test.AssertEqual(len(events), 2)
+	test.AssertEqual(events[0].Action, "clear")
+	test.AssertEqual(events[1].Action, "take")
+}
+
+func TestCorrupt(t *testing.T) {
+	test := zentest.New(t)
+	path := nextPath()
+	test.AssertNil(ioutil.WriteFile(path, []byte("nope\n"), 0600))
+	_, err := New(path, 10)
+	test.AssertErrorContainedBy(err, Error)
+}
+
+func TestCompaction(t *testing.T) {
+	test := zentest.New(t)
+	path := nextPath()
+	l := newTestLog(t, path, 1)
+
+	for i := 0; i < 3*minCompaction; i++ {
+		test.AssertNil(l.Append(auditlog.TestGuildId,
+			&auditlog.Event{Detail: fmt.Sprint(i)}))
+	}
+	test.Assert(l.records <= minCompaction+2)
+
+	events, err := newTestLog(t, path, 1).Recent(auditlog.TestGuildId,
+		10, nil)
+	test.AssertNil(err)
+	test.AssertEqual(len(events), 1)
+	test.AssertEqual(events[0].Detail, fmt.Sprint(3*minCompaction-1))
+}
+
+func newTestLog(t *testing.T, path string, max_len int) *fileLog {
+	l, err := New(path, max_len)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func nextPath() string {
+	testFiles++
+	return filepath.Join(testDir, fmt.Sprintf("audit%d.log", testFiles))
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditlog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ewollesen/zenbot/zentest"
+)
+
+// TestMaxLen is the maximum length that backends should set on the log they
+// pass to CommonTestAppend.
+const TestMaxLen = 5
+
+// TestGuildId is the guild that CommonTest functions append events to.
+// Backends should clear its events before each test.
+const TestGuildId = "test-guild"
+
+func CommonTestAppend(t *testing.T, log_under_test Log) {
+	test := zentest.New(t)
+
+	events, err := log_under_test.Recent(TestGuildId, 10, nil)
+	test.AssertNil(err)
+	test.AssertEqual(len(events), 0)
+
+	now := time.Date(2017, 3, 6, 19, 0, 0, 0, time.UTC)
+	for i := 0; i < TestMaxLen+2; i++ {
+		test.AssertNil(log_under_test.Append(TestGuildId, &Event{
+			Time:      now.Add(time.Duration(i) * time.Minute),
+			Queue:     "scrimmages",
+			Action:    "enqueue",
+			ActorId:   "test-user",
+			BattleTag: fmt.Sprintf("example#%04d", i),
+			Position:  i + 1,
+		}))
+	}
+	test.AssertNil(log_under_test.Append("other-guild", &Event{
+		Action: "clear",
+	}))
+
+	// The oldest events are dropped.
+	events, err = log_under_test.Recent(TestGuildId, 10, nil)
+	test.AssertNil(err)
+	test.AssertEqual(len(events), TestMaxLen)
+	test.AssertEqual(events[0].BattleTag, "example#0006")
+	test.AssertEqual(events[0].Position, 7)
+	test.Assert(events[0].Time.Equal(now.Add(6 * time.Minute)))
+	test.AssertEqual(events[TestMaxLen-1].BattleTag, "example#0002")
+}
+
+func CommonTestRecent(t *testing.T, log_under_test Log) {
+	test := zentest.New(t)
+
+	for i := 0; i < 6; i++ {
+		test.AssertNil(log_under_test.Append(TestGuildId, &Event{
+			Action:    "enqueue",
+			BattleTag: fmt.Sprintf("example#%04d", i%3),
+			Position:  i + 1,
+		}))
+	}
+
+	events, err := log_under_test.Recent(TestGuildId, 2, nil)
+	test.AssertNil(err)
+	test.AssertEqual(len(events), 2)
+	test.AssertEqual(events[0].Position, 6)
+	test.AssertEqual(events[1].Position, 5)
+
+	events, err = log_under_test.Recent(TestGuildId, 10,
+		func(event *Event) bool {
+			return event.BattleTag == "example#0001"
+		})
+	test.AssertNil(err)
+	test.AssertEqual(len(events), 2)
+	test.AssertEqual(events[0].Position, 5)
+	test.AssertEqual(events[1].Position, 2)
+}
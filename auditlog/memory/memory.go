@@ -0,0 +1,66 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"sync"
+
+	"github.com/ewollesen/zenbot/auditlog"
+)
+
+type memLog struct {
+	mu      sync.Mutex
+	events  map[string][]*auditlog.Event
+	max_len int
+}
+
+var _ auditlog.Log = (*memLog)(nil)
+
+// New returns a log that keeps up to max_len events per guild.
+func New(max_len int) *memLog {
+	return &memLog{
+		events:  make(map[string][]*auditlog.Event),
+		max_len: max_len,
+	}
+}
+
+func (l *memLog) Append(guild_id string, event *auditlog.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	copied := *event
+	events := append(l.events[guild_id], &copied)
+	if len(events) > l.max_len {
+		events = events[len(events)-l.max_len:]
+	}
+	l.events[guild_id] = events
+	return nil
+}
+
+func (l *memLog) Recent(guild_id string, n int,
+	match func(*auditlog.Event) bool) (recent []*auditlog.Event, err error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.events[guild_id]
+	for i := len(events) - 1; i >= 0 && len(recent) < n; i-- {
+		if match == nil || match(events[i]) {
+			copied := *events[i]
+			recent = append(recent, &copied)
+		}
+	}
+	return recent, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redislog
+
+import (
+	"encoding/json"
+
+	"github.com/ewollesen/zenbot/auditlog"
+	redis "gopkg.in/redis.v5"
+)
+
+// recentBatch is the number of events read at a time while looking for
+// matches.
+const recentBatch = 100
+
+// RedisLog stores each guild's events in a redis list, newest first.
+type RedisLog struct {
+	client  *redis.Client
+	key     string
+	max_len int
+}
+
+var _ auditlog.Log = (*RedisLog)(nil)
+
+// New returns a log that keeps up to max_len events per guild, under keys
+// prefixed with key.
+func New(client *redis.Client, key string, max_len int) *RedisLog {
+	return &RedisLog{
+		client:  client,
+		key:     key,
+		max_len: max_len,
+	}
+}
+
+func (l *RedisLog) Append(guild_id string, event *auditlog.Event) error {
+	event_bytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	key := l.guildKey(guild_id)
+	_, err = l.client.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.LPush(key, event_bytes)
+		pipe.LTrim(key, 0, int64(l.max_len-1))
+		return nil
+	})
+	return err
+}
+
+func (l *RedisLog) Recent(guild_id string, n int,
+	match func(*auditlog.Event) bool) (recent []*auditlog.Event, err error) {
+
+	key := l.guildKey(guild_id)
+	for start := int64(0); len(recent) < n; start += recentBatch {
+		strs, err := l.client.LRange(key, start,
+			start+recentBatch-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, str := range strs {
+			event := &auditlog.Event{}
+			if err = json.Unmarshal([]byte(str), event); err != nil {
+				return nil, auditlog.Error.Wrap(err)
+			}
+			if match == nil || match(event) {
+				recent = append(recent, event)
+				if len(recent) == n {
+					break
+				}
+			}
+		}
+		if len(strs) < recentBatch {
+			break
+		}
+	}
+
+	return recent, nil
+}
+
+func (l *RedisLog) guildKey(guild_id string) string {
+	return l.key + "." + guild_id
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redislog
+
+import (
+	"testing"
+
+	redis "gopkg.in/redis.v5"
+
+	"github.com/ewollesen/zenbot/auditlog"
+)
+
+var keyPrefix = "test.zenbot.auditlog"
+
+func TestAppend(t *testing.T) {
+	auditlog.CommonTestAppend(t, New(redisTestClient(t), keyPrefix,
+		auditlog.TestMaxLen))
+}
+
+func TestRecent(t *testing.T) {
+	auditlog.CommonTestRecent(t, New(redisTestClient(t), keyPrefix, 100))
+}
+
+func redisTestClient(t *testing.T) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	if client == nil {
+		t.SkipNow()
+	}
+
+	err := client.Del(keyPrefix+"."+auditlog.TestGuildId,
+		keyPrefix+".other-guild").Err()
+	if err != nil {
+		t.SkipNow()
+	}
+
+	return client
+}
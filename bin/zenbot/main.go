@@ -39,6 +39,8 @@ var (
 	redisAddr = flag.String("redis_addr", "localhost:6379",
 		"address of the redis server")
 	redisDB = flag.Int("redis_db", 0, "redis database to use")
+	dataDir = flag.String("data_dir", "", "directory in which to keep "+
+		"queues, caches and the audit log, rather than redis")
 )
 
 func main() {
@@ -50,15 +52,23 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
+	// Setting -data_dir chooses files outright, so that whether redis is
+	// up at startup can't switch the bot between two sets of data.
 	var redis_client *redis.Client
-	if redis_client = newRedisClient(); redis_client != nil {
-		defer func() { logger.Errore(redis_client.Close()) }()
+	if *dataDir == "" {
+		if redis_client = newRedisClient(); redis_client != nil {
+			defer func() { logger.Errore(redis_client.Close()) }()
+		}
 	}
 
 	router := httpapi.New()
 	discord_router := router.ForPath("/discord")
 
-	bot := discord.New(redis_client)
+	bot, err := discord.New(redis_client, *dataDir)
+	if err != nil {
+		logger.Critf("error starting up: %v", err)
+		os.Exit(1)
+	}
 	bot.ReceiveRouter(discord_router)
 
 	var wg sync.WaitGroup
@@ -77,6 +87,7 @@ func newRedisClient() (redis_client *redis.Client) {
 	redis_client = redis.NewClient(&redis.Options{
 		Addr: *redisAddr, DB: *redisDB})
 	if err := redis_client.Ping().Err(); err != nil {
+		logger.Warnf("redis unavailable at %s: %v", *redisAddr, err)
 		redis_client = nil
 	}
 
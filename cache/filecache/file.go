@@ -0,0 +1,229 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filecache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ewollesen/zenbot/cache"
+	"github.com/ewollesen/zenbot/util"
+	"github.com/spacemonkeygo/errors"
+)
+
+// minCompaction is the number of superseded records the log may hold before
+// it's compacted.
+const minCompaction = 1000
+
+var (
+	Error = errors.NewClass("filecache")
+)
+
+// filecache keeps its values in memory, appending each change to a log file
+// that's replayed when the cache is opened. The log is rewritten with only
+// the live values once it's mostly superseded records.
+type filecache struct {
+	mu      sync.Mutex
+	m       map[string]*record
+	path    string
+	log     *os.File
+	records int // records in the log
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+var _ cache.Cache = (*filecache)(nil)
+
+// record is a line of the log, setting a value. The latest record for each
+// key wins.
+type record struct {
+	Key   string    `json:"k"`
+	Value []byte    `json:"v"`
+	At    time.Time `json:"at"`
+}
+
+// New opens the cache logged to path, creating it if need be. Values older
+// than ttl are treated as missing, unless ttl is zero.
+func New(path string, ttl time.Duration) (*filecache, error) {
+	c := &filecache{
+		m:    make(map[string]*record),
+		path: path,
+		ttl:  ttl,
+		now:  time.Now,
+	}
+	if err := c.replay(); err != nil {
+		return nil, err
+	}
+	// Compacting straight away drops expired values, and any record torn
+	// by a crash.
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *filecache) replay() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line_num := 1; ; line_num++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A final line without a newline was torn by a crash
+			// mid-write, so it's dropped.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec := &record{}
+		if err = json.Unmarshal(line, rec); err != nil {
+			return Error.New("%s line %d: %v", c.path, line_num, err)
+		}
+		c.m[rec.Key] = rec
+	}
+}
+
+// ensure that you're holding c.mu before calling!
+func (c *filecache) append(rec *record) error {
+	c.m[rec.Key] = rec
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = c.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	c.records++
+	if c.records > 2*len(c.m)+minCompaction {
+		return c.compact()
+	}
+	return c.log.Sync()
+}
+
+// compact rewrites the log with only the live values.
+//
+// ensure that you're holding c.mu before calling!
+func (c *filecache) compact() error {
+	buf := &bytes.Buffer{}
+	records := 0
+	for key, rec := range c.m {
+		if c.expired(rec) {
+			delete(c.m, key)
+			continue
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+		records++
+	}
+
+	if c.log != nil {
+		c.log.Close()
+		c.log = nil
+	}
+	if err := util.WriteFileAtomic(c.path, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	c.log = log
+	c.records = records
+	return nil
+}
+
+// ensure that you're holding c.mu before calling!
+func (c *filecache) expired(rec *record) bool {
+	return c.ttl > 0 && c.now().Sub(rec.At) > c.ttl
+}
+
+// ensure that you're holding c.mu before calling!
+func (c *filecache) get(key string) []byte {
+	rec, ok := c.m[key]
+	if !ok || c.expired(rec) {
+		return nil
+	}
+	return rec.Value
+}
+
+func (c *filecache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[string]*record)
+	return c.compact()
+}
+
+func (c *filecache) Fetch(key string, fn func() []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if value := c.get(key); value != nil {
+		return value, nil
+	}
+	value := fn()
+	if value == nil {
+		return nil, nil
+	}
+
+	return value, c.append(&record{Key: key, Value: value, At: c.now()})
+}
+
+func (c *filecache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key), nil
+}
+
+// Iter calls fn with each of the cache's values, until fn returns true. fn
+// may modify the cache.
+func (c *filecache) Iter(fn func(key string, value []byte) bool) {
+	c.mu.Lock()
+	values := make(map[string][]byte)
+	for key := range c.m {
+		if value := c.get(key); value != nil {
+			values[key] = value
+		}
+	}
+	c.mu.Unlock()
+
+	for key, value := range values {
+		if fn(key, value) {
+			break
+		}
+	}
+}
+
+func (c *filecache) Set(key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.append(&record{Key: key, Value: value, At: c.now()})
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ewollesen/zenbot/zentest"
+)
+
+var (
+	testDir   string
+	testFiles = 0
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testDir = dir
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+func TestFetch(t *testing.T) {
+	test := zentest.New(t)
+	fc := newTestCache(t, nextPath(), 0)
+
+	value, err := fc.Fetch("foo", func() []byte {
+		return []byte("bar")
+	})
+	test.AssertNil(err)
+	test.Assert(bytes.Equal(value, []byte("bar")))
+
+	value, err = fc.Fetch("foo", func() []byte {
+		return []byte("bar2")
+	})
+	test.AssertNil(err)
+	test.Assert(bytes.Equal(value, []byte("bar")))
+}
+
+func TestGet(t *testing.T) {
+	test := zentest.New(t)
+	fc := newTestCache(t, nextPath(), 0)
+
+	value, err := fc.Get("foo")
+	test.AssertNil(err)
+	test.Assert(bytes.Equal(value, []byte(nil)))
+
+	test.AssertNil(fc.Set("foo", []byte("bar")))
+	value, err = fc.Get("foo")
+	test.AssertNil(err)
+	test.Assert(bytes.Equal(value, []byte("bar")))
+}
+
+func TestSet(t *testing.T) {
+	test := zentest.New(t)
+	fc := newTestCache(t, nextPath(), 0)
+
+	test.AssertNil(fc.Set("foo", []byte("bar")))
+	test.AssertNil(fc.Set("foo", []byte("bar2")))
+	value, err := fc.Get("foo")
+	test.AssertNil(err)
+	test.Assert(bytes.Equal(value, []byte("bar2")))
+}
+
+func TestReopen(t *testing.T) {
+	test := zentest.New(t)
+	path := nextPath()
+	fc := newTestCache(t, path, 0)
+
+	test.AssertNil(fc.Set("foo", []byte("bar")))
+	test.AssertNil(fc.Set("foo", []byte("bar2")))
+	test.AssertNil(fc.Set("baz", []byte("qux")))
+
+	// A record torn by a crash is dropped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	test.AssertNil(err)
+	_, err = f.Write([]byte(`{"k":"torn","v":`))
+	test.AssertNil(err)
+	test.AssertNil(f.Close())
+
+	reopened := newTestCache(t, path, 0)
+	value, err := reopened.Get("foo")
+	test.AssertNil(err)
+	test.Assert(bytes.Equal(value, []byte("bar2")))
+	keys := 0
+	reopened.Iter(func(key string, value []byte) bool {
+		keys++
+		return false
+	})
+	test.AssertEqual(keys, 2)
+
+	test.AssertNil(reopened.Clear())
+	value, err = newTestCache(t, path, 0).Get("foo")
+	test.AssertNil(err)
+	test.Assert(value == nil)
+}
+
+func TestCompaction(t *testing.T) {
+	test := zentest.New(t)
+	path := nextPath()
+	fc := newTestCache(t, path, 0)
+
+	for i := 0; i < 3*minCompaction; i++ {
+		test.AssertNil(fc.Set("foo", []byte(fmt.Sprint(i))))
+	}
+	test.Assert(fc.records <= minCompaction+2)
+
+	value, err := newTestCache(t, path, 0).Get("foo")
+	test.AssertNil(err)
+	test.AssertEqual(string(value), fmt.Sprint(3*minCompaction-1))
+}
+
+func TestTTL(t *testing.T) {
+	test := zentest.New(t)
+	fc := newTestCache(t, nextPath(), time.Hour)
+	now := time.Now()
+	fc.now = func() time.Time { return now }
+
+	test.AssertNil(fc.Set("foo", []byte("bar")))
+	now = now.Add(2 * time.Hour)
+	value, err := fc.Fetch("foo", func() []byte {
+		return []byte("bar2")
+	})
+	test.AssertNil(err)
+	test.Assert(bytes.Equal(value, []byte("bar2")))
+}
+
+func newTestCache(t *testing.T, path string, ttl time.Duration) *filecache {
+	fc, err := New(path, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fc
+}
+
+func nextPath() string {
+	testFiles++
+	return filepath.Join(testDir, fmt.Sprintf("cache%d.log", testFiles))
+}
@@ -17,6 +17,7 @@ package discord
 import (
 	"encoding/json"
 	"regexp"
+	"sort"
 
 	"github.com/ewollesen/zenbot/cache"
 	"github.com/ewollesen/zenbot/queue"
@@ -60,54 +61,298 @@ func (c *BattleTagCache) Set(key string, value string) error {
 }
 
 type BattleTagQueue struct {
-	q queue.Queue
+	q        queue.Queue
+	name     string
+	guild_id string
+	// games, if set, returns the number of games each BattleTag has played
+	// this session, or nil if players should be taken in queue order.
+	games func(guild_id string) (map[string]int, error)
+	// waitlist holds players who enqueued once the queue was full. Waitlists
+	// don't have waitlists of their own.
+	waitlist *BattleTagQueue
+	// hooks, if set, is called after the queue's contents change.
+	hooks func(q *BattleTagQueue, taken []*userBattleTag)
 }
 
-func newBattleTagQueue(q queue.Queue) *BattleTagQueue {
-	return &BattleTagQueue{q: q}
+func newBattleTagQueue(q queue.Queue, name string) *BattleTagQueue {
+	return &BattleTagQueue{q: q, name: name}
 }
 
+// Clear empties the queue, and its waitlist.
 func (q *BattleTagQueue) Clear() error {
-	return q.q.Clear()
+	if q.waitlist != nil {
+		if err := q.waitlist.Clear(); err != nil {
+			return err
+		}
+	}
+	if err := q.q.Clear(); err != nil {
+		return err
+	}
+	q.changed(nil)
+	return nil
 }
 
+// changed calls the queue's hooks, with any entries taken by the change.
+func (q *BattleTagQueue) changed(taken []*userBattleTag) {
+	if q.hooks != nil {
+		q.hooks(q, taken)
+	}
+}
+
+// DequeueN takes up to n players from the front of the queue. Parties are
+// taken whole, or skipped if they don't fit. num_left counts players, not
+// entries. If fair rotation is enabled, players who've played fewer games
+// this session are taken first.
 func (q *BattleTagQueue) DequeueN(n int) (
 	taken []*userBattleTag, num_left int, err error) {
 
-	takens_bytes, num_left, err := q.q.DequeueN(n)
+	games, err := q.sessionGames()
 	if err != nil {
 		return nil, -1, err
 	}
 
-	for _, taken_bytes := range takens_bytes {
-		tq := &userBattleTag{}
-		err := json.Unmarshal(taken_bytes, tq)
+	if games == nil {
+		var takens_bytes [][]byte
+		takens_bytes, num_left, err = q.q.DequeueFit(n, playersSize)
 		if err != nil {
 			return nil, -1, err
 		}
-		taken = append(taken, tq)
+		taken, err = decodeBattleTags(takens_bytes)
+		if err != nil {
+			return nil, -1, err
+		}
+		q.changed(taken)
+		return taken, num_left, nil
 	}
 
+	taken, num_left, err = q.dequeueChosen(games,
+		func(ubt *userBattleTag, num_taken int) bool {
+			return num_taken+len(ubt.Players()) <= n
+		})
+	if err != nil {
+		return nil, -1, err
+	}
+	q.changed(taken)
 	return taken, num_left, nil
 }
 
+// DequeueRoles takes players from the queue to fill the given number of slots
+// in each role, choosing the earliest enqueued players who can cover them, or
+// those who've played the fewest games if fair rotation is enabled. Parties
+// are taken whole, or skipped. assigned maps each taken BattleTag to its role,
+// and num_left counts players, not entries.
+func (q *BattleTagQueue) DequeueRoles(slots map[string]int) (
+	taken []*userBattleTag, assigned map[string]string, num_left int,
+	err error) {
+
+	games, err := q.sessionGames()
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	wanted := 0
+	for _, n := range slots {
+		wanted += n
+	}
+
+	var matcher *roleMatcher
+	var players []string
+	taken, num_left, err = q.dequeueChosen(games,
+		func(ubt *userBattleTag, num_taken int) bool {
+			if num_taken == 0 {
+				// The selection may be retried from scratch.
+				matcher, players = newRoleMatcher(slots), nil
+			}
+			if num_taken+len(ubt.Players()) > wanted ||
+				!matcher.add(ubt.playerRoles()) {
+				return false
+			}
+			players = append(players, ubt.Players()...)
+			return true
+		})
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	assigned = make(map[string]string)
+	for i, btag := range players {
+		assigned[btag] = matcher.role(i)
+	}
+	q.changed(taken)
+
+	return taken, assigned, num_left, nil
+}
+
+// dequeueChosen offers each entry to accept, along with the number of players
+// accepted so far, and takes the entries it accepts. Entries are offered in
+// queue order, or, given session games, in order of the most games played by
+// any of the entry's players, then queue order. num_left counts players.
+func (q *BattleTagQueue) dequeueChosen(games map[string]int,
+	accept func(ubt *userBattleTag, num_taken int) bool) (
+	taken []*userBattleTag, num_left int, err error) {
+
+	takens_bytes, _, err := q.q.DequeueSelect(func(data [][]byte) []int {
+		order := &byGames{games: games}
+		for i, datum := range data {
+			ubt := &userBattleTag{}
+			logger.Errore(json.Unmarshal(datum, ubt))
+			order.ubts = append(order.ubts, ubt)
+			order.indices = append(order.indices, i)
+		}
+		sort.Stable(order)
+
+		chosen := []int{}
+		num_taken := 0
+		num_left = 0
+		for i, ubt := range order.ubts {
+			size := len(ubt.Players())
+			if !accept(ubt, num_taken) {
+				num_left += size
+				continue
+			}
+			chosen = append(chosen, order.indices[i])
+			num_taken += size
+		}
+		return chosen
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+
+	taken, err = decodeBattleTags(takens_bytes)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return taken, num_left, nil
+}
+
+func (q *BattleTagQueue) sessionGames() (map[string]int, error) {
+	if q.games == nil {
+		return nil, nil
+	}
+	return q.games(q.guild_id)
+}
+
+// byGames sorts queue entries by the most games played by any of the entry's
+// players. Use with sort.Stable to preserve queue order otherwise.
+type byGames struct {
+	games   map[string]int
+	ubts    []*userBattleTag
+	indices []int
+}
+
+func (b *byGames) Len() int { return len(b.ubts) }
+
+func (b *byGames) Less(i, j int) bool {
+	return b.mostGames(b.ubts[i]) < b.mostGames(b.ubts[j])
+}
+
+func (b *byGames) Swap(i, j int) {
+	b.ubts[i], b.ubts[j] = b.ubts[j], b.ubts[i]
+	b.indices[i], b.indices[j] = b.indices[j], b.indices[i]
+}
+
+func (b *byGames) mostGames(ubt *userBattleTag) (most int) {
+	for _, btag := range ubt.Players() {
+		if b.games[btag] > most {
+			most = b.games[btag]
+		}
+	}
+	return most
+}
+
+// playersSize sizes an encoded entry by its number of players.
+func playersSize(datum []byte) int {
+	ubt := &userBattleTag{}
+	logger.Errore(json.Unmarshal(datum, ubt))
+	return len(ubt.Players())
+}
+
+func decodeBattleTags(ubts_bytes [][]byte) (ubts []*userBattleTag, err error) {
+	for _, ubt_bytes := range ubts_bytes {
+		ubt := &userBattleTag{}
+		err := json.Unmarshal(ubt_bytes, ubt)
+		if err != nil {
+			return nil, err
+		}
+		ubts = append(ubts, ubt)
+	}
+
+	return ubts, nil
+}
+
 func (q *BattleTagQueue) Enqueue(datum *userBattleTag) (int, error) {
 	datum_bytes, err := json.Marshal(datum)
 	if err != nil {
 		return -1, err
 	}
 
-	return q.q.Enqueue(datum_bytes)
+	pos, err := q.q.Enqueue(datum_bytes)
+	if err != nil {
+		return -1, err
+	}
+	q.changed(nil)
+	return pos, nil
+}
+
+// Find returns the queued entry, which may be a party, containing the given
+// BattleTag, or nil if there is none.
+func (q *BattleTagQueue) Find(btag string) (found *userBattleTag, err error) {
+	err = q.Iter(func(index int, ubt *userBattleTag) bool {
+		for _, player := range ubt.Players() {
+			if player == btag {
+				found = ubt
+				return true
+			}
+		}
+		return false
+	})
+
+	return found, err
+}
+
+func (q *BattleTagQueue) Insert(pos int, ubt *userBattleTag) (int, error) {
+	ubt_bytes, err := json.Marshal(ubt)
+	if err != nil {
+		return -1, err
+	}
+
+	pos, err = q.q.Insert(pos, ubt_bytes)
+	if err != nil {
+		return pos, err
+	}
+	q.changed(nil)
+	return pos, nil
 }
 
 func (q *BattleTagQueue) Iter(fn func(int, *userBattleTag) bool) error {
-	return q.q.Iter(func(index int, datum []byte) bool {
+	return q.q.Iter(func(index int, entry *queue.Entry) bool {
 		tq := &userBattleTag{}
-		logger.Errore(json.Unmarshal(datum, tq))
+		logger.Errore(json.Unmarshal(entry.Datum, tq))
+		tq.EnqueuedAt = entry.EnqueuedAt
 		return fn(index, tq)
 	})
 }
 
+func (q *BattleTagQueue) Move(ubt *userBattleTag, pos int) (int, error) {
+	ubt_bytes, err := json.Marshal(ubt)
+	if err != nil {
+		return -1, err
+	}
+
+	pos, err = q.q.Move(ubt_bytes, pos)
+	if err != nil {
+		return pos, err
+	}
+	q.changed(nil)
+	return pos, nil
+}
+
+func (q *BattleTagQueue) Name() string {
+	return q.name
+}
+
 func (q *BattleTagQueue) Position(ubt *userBattleTag) (int, error) {
 	tq_bytes, err := json.Marshal(ubt)
 	if err != nil {
@@ -116,14 +361,69 @@ func (q *BattleTagQueue) Position(ubt *userBattleTag) (int, error) {
 	return q.q.Position(tq_bytes)
 }
 
+// Positions maps the BattleTag of each entry in the queue to its position, eg
+// to record where taken entries were.
+func (q *BattleTagQueue) Positions() (map[string]int, error) {
+	positions := make(map[string]int)
+	err := q.Iter(func(index int, ubt *userBattleTag) bool {
+		positions[ubt.BattleTag] = index
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
 func (q *BattleTagQueue) Remove(ubt *userBattleTag) error {
 	ubt_bytes, err := json.Marshal(ubt)
 	if err != nil {
 		return err
 	}
-	return q.q.Remove(ubt_bytes)
+	if err = q.q.Remove(ubt_bytes); err != nil {
+		return err
+	}
+	q.changed(nil)
+	return nil
+}
+
+// Swap exchanges the positions of two queued entries. Each move is atomic, but
+// the swap as a whole is not.
+func (q *BattleTagQueue) Swap(a, b *userBattleTag) error {
+	pos_a, err := q.Position(a)
+	if err != nil {
+		return err
+	}
+	pos_b, err := q.Position(b)
+	if err != nil {
+		return err
+	}
+	if pos_a < 0 || pos_b < 0 {
+		return queue.NotFound.New("")
+	}
+	if pos_a > pos_b {
+		a, b = b, a
+		pos_a, pos_b = pos_b, pos_a
+	}
+
+	// Moving the earlier entry back first leaves the later one at pos_b-1,
+	// and moving that one forward then shifts the first back to pos_b.
+	if _, err = q.Move(a, pos_b); err != nil {
+		return err
+	}
+	_, err = q.Move(b, pos_a)
+	return err
 }
 
 func (q *BattleTagQueue) Size() (int, error) {
 	return q.q.Size()
 }
+
+// Players counts the players in the queue, including parties' members.
+func (q *BattleTagQueue) Players() (n int, err error) {
+	err = q.Iter(func(index int, ubt *userBattleTag) bool {
+		n += len(ubt.Players())
+		return false
+	})
+	return n, err
+}
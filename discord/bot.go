@@ -16,13 +16,20 @@ package discord
 
 import (
 	"flag"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/auditlog/filelog"
+	memorylog "github.com/ewollesen/zenbot/auditlog/memory"
+	"github.com/ewollesen/zenbot/auditlog/redislog"
 	"github.com/ewollesen/zenbot/cache"
+	"github.com/ewollesen/zenbot/cache/filecache"
 	memorycache "github.com/ewollesen/zenbot/cache/memory"
 	"github.com/ewollesen/zenbot/cache/rediscache"
 	"github.com/ewollesen/zenbot/commands"
@@ -31,6 +38,7 @@ import (
 	"github.com/ewollesen/zenbot/overwatch/blizzard"
 	"github.com/ewollesen/zenbot/overwatch/owapi"
 	"github.com/ewollesen/zenbot/queue"
+	"github.com/ewollesen/zenbot/queue/filequeue"
 	memoryqueue "github.com/ewollesen/zenbot/queue/memory"
 	"github.com/ewollesen/zenbot/queue/redisqueue"
 	"github.com/spacemonkeygo/errors"
@@ -51,6 +59,9 @@ var (
 	whitelistedChannels = flag.String("discord.whitelisted_channels", "",
 		"Channel ids on which to listen for commands")
 
+	legacyQueueGuild = flag.String("discord.legacy_queue_guild", "",
+		"id of the guild to which to move the redis queue kept by "+
+			"versions without per-guild queues, if any")
 	owApiHost = flag.String("discord.owapi-host", "https://owapi.net",
 		"protocol, host and port to query")
 	lootBoxHost = flag.String("discord.lootbox-host", "https://api.lootbox.eu",
@@ -64,13 +75,23 @@ type bot struct {
 	handler_callbacks []func()
 	user_id           string
 
+	ready_checks *readyChecks
+	presence     *presenceTracker
+	schedules    *queueSchedules
+	notifier     *queueNotifier
+	queues       *BattleTagQueues
+
 	session_cache cache.Cache
+	audit_log     auditlog.Log
 
 	oauth_mu     sync.Mutex
 	oauth_states map[string]string
 }
 
-func New(redis_client *redis.Client) *bot {
+// New returns a bot that keeps its queues, caches and audit log in files in
+// data_dir, if it's set, otherwise in redis, if redis_client isn't nil,
+// otherwise in memory.
+func New(redis_client *redis.Client, data_dir string) (*bot, error) {
 	b := &bot{
 		command_handlers: make(map[string]DiscordHandler),
 		oauth_states:     make(map[string]string),
@@ -79,42 +100,141 @@ func New(redis_client *redis.Client) *bot {
 	b.RegisterCommand("ping", &discordHandler{commands.Pong})
 	b.RegisterCommand("pong", &discordHandler{commands.Bomb})
 
-	var q queue.Queue
-	var c, owc, vbtc cache.Cache
-	if redis_client != nil {
+	var new_queue func(guild_id, name string) queue.Queue
+	var c, owc, vbtc, qc, sc cache.Cache
+	var err error
+	switch {
+	case redis_client != nil && data_dir == "":
 		logger.Infof("using redis queue and cache")
-		q = redisqueue.New(redis_client, *redisKeySpace+".queues.scrimmages")
+		queue_key := func(guild_id, name string) string {
+			return *redisKeySpace + ".guilds." + guild_id +
+				".queues." + name
+		}
+		if *legacyQueueGuild != "" {
+			moved, err := redisqueue.Move(redis_client,
+				*redisKeySpace+".queues.scrimmages",
+				queue_key(*legacyQueueGuild, defaultQueueName))
+			if err != nil {
+				return nil, err
+			}
+			if moved {
+				logger.Infof("moved the legacy queue to guild %s",
+					*legacyQueueGuild)
+			}
+		}
+		new_queue = func(guild_id, name string) queue.Queue {
+			key := queue_key(guild_id, name)
+			q := redisqueue.New(redis_client, key)
+			q.SetMaxAge(*queueMaxAge)
+			return queue.Watch(q, redisqueue.NewEventBus(
+				redis_client, key+".events"))
+		}
 		c = rediscache.New(redis_client, *redisKeySpace+".caches.battletags", 0)
 		owc = rediscache.New(redis_client, *redisKeySpace+".caches.overwatch", time.Hour*12)
 		vbtc = rediscache.New(redis_client, *redisKeySpace+".cached.blizzard.battletags", 0)
-	} else {
+		qc = rediscache.New(redis_client, *redisKeySpace+".caches.queues", 0)
+		sc = rediscache.New(redis_client, *redisKeySpace+".caches.settings", 0)
+		b.audit_log = redislog.New(redis_client, *redisKeySpace+".audit",
+			*auditLogSize)
+	case data_dir != "":
+		logger.Infof("using file queue and cache in %s", data_dir)
+		queue_dir := filepath.Join(data_dir, "queues")
+		if err = os.MkdirAll(queue_dir, 0700); err != nil {
+			return nil, err
+		}
+		new_queue = func(guild_id, name string) queue.Queue {
+			path := filepath.Join(queue_dir,
+				url.QueryEscape(guild_id+"."+name)+".json")
+			q, err := filequeue.New(path)
+			if err != nil {
+				// The queue is refused, and the file left as it
+				// is, for an admin to recover, rather than
+				// being overwritten by an empty queue.
+				logger.Errorf("error loading queue from %s, "+
+					"which won't be served until it's "+
+					"fixed and the bot restarted: %v",
+					path, err)
+				return queue.Watch(queue.NewUnavailable(err),
+					memoryqueue.NewEventBus())
+			}
+			q.SetMaxAge(*queueMaxAge)
+			return queue.Watch(q, memoryqueue.NewEventBus())
+		}
+		if c, err = openFileCache(data_dir, "battletags", 0); err != nil {
+			return nil, err
+		}
+		owc, err = openFileCache(data_dir, "overwatch", time.Hour*12)
+		if err != nil {
+			return nil, err
+		}
+		vbtc, err = openFileCache(data_dir, "blizzard_battletags", 0)
+		if err != nil {
+			return nil, err
+		}
+		if qc, err = openFileCache(data_dir, "queues", 0); err != nil {
+			return nil, err
+		}
+		if sc, err = openFileCache(data_dir, "settings", 0); err != nil {
+			return nil, err
+		}
+		b.audit_log, err = filelog.New(filepath.Join(data_dir,
+			"audit.log"), *auditLogSize)
+		if err != nil {
+			return nil, err
+		}
+	default:
 		logger.Infof("using memory queue and cache")
-		q = memoryqueue.New()
+		new_queue = func(guild_id, name string) queue.Queue {
+			q := memoryqueue.New()
+			q.SetMaxAge(*queueMaxAge)
+			return queue.Watch(q, memoryqueue.NewEventBus())
+		}
 		c = memorycache.New()
 		owc = memorycache.New()
 		vbtc = memorycache.New()
+		qc = memorycache.New()
+		sc = memorycache.New()
+		b.audit_log = memorylog.New(*auditLogSize)
 	}
 
 	b.session_cache = memorycache.New()
 
-	btq := newBattleTagQueue(q)
+	btq := newBattleTagQueues(qc, new_queue)
+	settings := newGuildSettings(sc)
+	b.presence = newPresenceTracker(btq, settings, b.audit_log,
+		*presenceGracePeriod)
 	btc := NewBattleTagCache(c)
 	gow := owapi.New(blizzard.NewCaching(vbtc), *owApiHost)
 	cow := overwatch.NewCaching(gow, owc)
-	qh := newQueueHandler(btq, btc, cow)
+	qh := newQueueHandler(btq, settings, btc, cow, b.audit_log)
 	b.RegisterCommand("dequeue", qh)
 	b.RegisterCommand("enqueue", qh)
 	b.RegisterCommand("queue", qh)
+	b.RegisterCommand("ready", qh)
+	b.ready_checks = qh.ready_checks
+	b.schedules = qh.schedules
+	b.notifier = qh.notifier
+	b.queues = btq
 
 	dh := newDebugHandler(btq, btc)
 	b.RegisterCommand("debug", dh)
 
-	srh := newSkillRankHandler(btc, cow)
+	srh := newSkillRankHandler(btc, settings, cow)
 	b.RegisterCommand("sr", srh)
 	b.RegisterCommand("teams", srh)
 	b.RegisterCommand("help", b.help())
 
-	return b
+	return b, nil
+}
+
+func openFileCache(data_dir, name string, ttl time.Duration) (
+	cache.Cache, error) {
+
+	c, err := filecache.New(filepath.Join(data_dir, name+".log"), ttl)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func (b *bot) help() *discordHandler {
@@ -147,6 +267,12 @@ func (b *bot) Run(quit chan os.Signal) error {
 		logger.Warne(session.UpdateStatus(0, *game))
 	}
 
+	s := newCachingSession(session, b.session_cache)
+	b.notifier.setSession(s)
+	stop := make(chan struct{})
+	go b.schedules.run(s, time.Minute, stop)
+	go b.notifier.run(stop)
+
 	signal, closed := <-quit
 	if closed {
 		logger.Debugf("quit channel closed, shutting down")
@@ -156,6 +282,7 @@ func (b *bot) Run(quit chan os.Signal) error {
 	}
 
 	logger.Info("shutting down")
+	close(stop)
 	b.logOut(session)
 
 	return nil
@@ -201,7 +328,8 @@ func getToken() (token string, err error) {
 func (b *bot) addHandlers(session *discordgo.Session) error {
 	b.handler_callbacks = append(b.handler_callbacks,
 		session.AddHandler(b.messageHandler),
-		session.AddHandler(b.presenceHandler))
+		session.AddHandler(b.presenceHandler),
+		session.AddHandler(b.reactionHandler))
 
 	return nil
 }
@@ -269,8 +397,27 @@ func (b *bot) myUserId(s Session) string {
 	return user.ID
 }
 
-func (b *bot) presenceHandler(s *discordgo.Session, m *discordgo.PresenceUpdate) {
-	return
+func (b *bot) presenceHandler(ds *discordgo.Session,
+	p *discordgo.PresenceUpdate) {
+
+	b.presence.update(newCachingSession(ds, b.session_cache), p)
+}
+
+// reactionHandler treats a reaction in the private channel a ready check was
+// sent to as confirmation.
+func (b *bot) reactionHandler(ds *discordgo.Session,
+	r *discordgo.MessageReactionAdd) {
+
+	s := newCachingSession(ds, b.session_cache)
+	if r.UserID == b.myUserId(s) {
+		return
+	}
+
+	btags := b.ready_checks.confirmReaction(r.ChannelID, r.UserID)
+	if len(btags) > 0 {
+		logger.Warne(s.ChannelMessageSend(r.ChannelID,
+			b.ready_checks.confirmed(r.UserID, btags)))
+	}
 }
 
 func isPrivateMessage(s Session, m *discordgo.MessageCreate) bool {
@@ -284,4 +431,8 @@ func isPrivateMessage(s Session, m *discordgo.MessageCreate) bool {
 func (b *bot) ReceiveRouter(router httpapi.Router) {
 	router.HandleFunc("/", b.handleHTTP)
 	router.HandleFunc("/oauth/redirect", b.oauthRedirect)
+	router.HandleFunc("/queue/events", b.handleEventsHTTP)
+	router.HandleFunc("/queue/export", b.handleExportHTTP)
+	router.HandleFunc("/queue/history", b.handleHistoryHTTP)
+	router.HandleFunc("/queue/import", b.handleImportHTTP)
 }
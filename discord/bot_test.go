@@ -0,0 +1,60 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/queue"
+	"github.com/ewollesen/zenbot/zentest"
+)
+
+func TestDataDir(t *testing.T) {
+	test := zentest.New(t)
+	dir, err := ioutil.TempDir("", "zenbot")
+	test.AssertNil(err)
+	defer os.RemoveAll(dir)
+
+	// A queue whose file can't be loaded is refused, rather than replaced
+	// by an empty one, and its file is left for an admin to recover.
+	test.AssertNil(os.MkdirAll(filepath.Join(dir, "queues"), 0700))
+	path := filepath.Join(dir, "queues", url.QueryEscape(
+		testGuildId+"."+defaultQueueName)+".json")
+	test.AssertNil(ioutil.WriteFile(path, []byte("nope"), 0600))
+
+	b, err := New(nil, dir)
+	test.AssertNil(err)
+	_, err = b.queues.Get(testGuildId, defaultQueueName).Enqueue(
+		generateUsers(1)[0])
+	test.AssertErrorContainedBy(err, queue.Unavailable)
+	data, err := ioutil.ReadFile(path)
+	test.AssertNil(err)
+	test.AssertEqual(string(data), "nope")
+
+	// The audit log survives a restart.
+	test.AssertNil(b.audit_log.Append(testGuildId,
+		&auditlog.Event{Action: "clear"}))
+	b, err = New(nil, dir)
+	test.AssertNil(err)
+	events, err := b.audit_log.Recent(testGuildId, 10, nil)
+	test.AssertNil(err)
+	test.AssertEqual(len(events), 1)
+	test.AssertEqual(events[0].Action, "clear")
+}
@@ -15,6 +15,8 @@
 package discord
 
 import (
+	"io"
+
 	"github.com/ewollesen/discordgo"
 	"github.com/ewollesen/zenbot/commands"
 )
@@ -25,6 +27,7 @@ type Message interface {
 
 type Session interface {
 	Channel(channel_id string) (*discordgo.Channel, error)
+	ChannelFileSend(channel_id, name string, r io.Reader) error
 	ChannelMessageSend(channel_id, message string) error
 	Member(guild_id, user_id string) (*discordgo.Member, error)
 	User(user_id string) (*discordgo.User, error)
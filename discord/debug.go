@@ -22,12 +22,12 @@ import (
 
 type debugHandler struct {
 	btags *BattleTagCache
-	q     *BattleTagQueue
+	q     *BattleTagQueues
 }
 
 var _ DiscordHandler = (*discordHandler)(nil)
 
-func newDebugHandler(q *BattleTagQueue, b *BattleTagCache) *debugHandler {
+func newDebugHandler(q *BattleTagQueues, b *BattleTagCache) *debugHandler {
 	return &debugHandler{
 		q:     q,
 		btags: b,
@@ -16,6 +16,8 @@ package discord
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
@@ -53,6 +55,7 @@ type mockSession struct {
 	channels    map[string]*discordgo.Channel
 	members     map[string]*discordgo.Member
 	sends       []string
+	files       map[string][]byte
 }
 
 var _ Session = (*mockSession)(nil)
@@ -61,6 +64,17 @@ func (s *mockSession) Channel(channel_id string) (*discordgo.Channel, error) {
 	return s.channels[channel_id], nil
 }
 
+func (s *mockSession) ChannelFileSend(channel_id, name string,
+	r io.Reader) error {
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.files[name] = data
+	return nil
+}
+
 func (s *mockSession) ChannelMessageSend(channel_id, msg string) error {
 	s.sends = append(s.sends, msg)
 	return nil
@@ -116,6 +130,7 @@ func (t *discordTest) mockSession() *mockSession {
 		channels: make(map[string]*discordgo.Channel),
 		members:  make(map[string]*discordgo.Member),
 		sends:    []string{},
+		files:    make(map[string][]byte),
 	}
 	s.setChannel(testChannelId, &discordgo.Channel{
 		GuildID: testGuildId,
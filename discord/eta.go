@@ -0,0 +1,290 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+)
+
+const (
+	takeHistorySetting = "take_history"
+	// maxTakeHistory is the number of each queue's most recent takes kept
+	// for estimating wait times.
+	maxTakeHistory = 20
+)
+
+type takeRecord struct {
+	At    time.Time `json:"at"`
+	Count int       `json:"count"`
+}
+
+// takeHistory records when, and how many players, were taken from each of a
+// guild's queues, and estimates wait times from it.
+type takeHistory struct {
+	mu       sync.Mutex
+	settings *guildSettings
+	now      func() time.Time
+}
+
+func newTakeHistory(settings *guildSettings) *takeHistory {
+	return &takeHistory{
+		settings: settings,
+		now:      time.Now,
+	}
+}
+
+// record adds a take to the queue's history, returning a function that
+// removes it again, eg if the take is undone.
+func (t *takeHistory) record(guild_id, name string, count int) (
+	undo func() error, err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history, err := t.load(guild_id)
+	if err != nil {
+		return nil, err
+	}
+	record := takeRecord{At: t.now(), Count: count}
+	records := append(history[name], record)
+	if len(records) > maxTakeHistory {
+		records = records[len(records)-maxTakeHistory:]
+	}
+	history[name] = records
+
+	err = t.settings.save(guild_id, takeHistorySetting, history)
+	if err != nil {
+		return nil, err
+	}
+	return func() error { return t.unrecord(guild_id, name, record) }, nil
+}
+
+func (t *takeHistory) unrecord(guild_id, name string,
+	record takeRecord) error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history, err := t.load(guild_id)
+	if err != nil {
+		return err
+	}
+	records := []takeRecord{}
+	for _, existing := range history[name] {
+		if existing.At.Equal(record.At) && existing.Count == record.Count {
+			continue
+		}
+		records = append(records, existing)
+	}
+	history[name] = records
+
+	return t.settings.save(guild_id, takeHistorySetting, history)
+}
+
+// takeRate is how often a queue's takes happen, and how many players they
+// take, on average.
+type takeRate struct {
+	next     time.Duration // until the next take
+	interval time.Duration
+	size     int
+}
+
+// eta returns how long until a player with ahead players in front of them
+// will be taken, assuming takes continue at the rate.
+func (r *takeRate) eta(ahead int) time.Duration {
+	return r.next + time.Duration(ahead/r.size)*r.interval
+}
+
+// estimate returns how long until a player with ahead players in front of
+// them will be taken, assuming takes continue at their average size and
+// interval. It returns false until there are at least two takes to go on.
+func (t *takeHistory) estimate(guild_id, name string, ahead int) (
+	time.Duration, bool, error) {
+
+	rate, ok, err := t.rate(guild_id, name)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return rate.eta(ahead), true, nil
+}
+
+// rate returns the average size and interval of the queue's takes, for
+// estimating the wait of many players at once. It returns false until there
+// are at least two takes to go on.
+func (t *takeHistory) rate(guild_id, name string) (*takeRate, bool, error) {
+	t.mu.Lock()
+	history, err := t.load(guild_id)
+	t.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+
+	records := history[name]
+	if len(records) < 2 {
+		return nil, false, nil
+	}
+	first, last := records[0], records[len(records)-1]
+	interval := last.At.Sub(first.At) / time.Duration(len(records)-1)
+	total := 0
+	for _, record := range records {
+		total += record.Count
+	}
+	size := total / len(records)
+	if size <= 0 || interval <= 0 {
+		return nil, false, nil
+	}
+
+	next := last.At.Add(interval).Sub(t.now())
+	if next < 0 {
+		next = 0
+	}
+	return &takeRate{next: next, interval: interval, size: size}, true,
+		nil
+}
+
+// rename keeps a queue's history when the queue is renamed.
+func (t *takeHistory) rename(guild_id, old_name, new_name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history, err := t.load(guild_id)
+	if err != nil {
+		return err
+	}
+	records, ok := history[old_name]
+	if !ok {
+		return nil
+	}
+	delete(history, old_name)
+	history[new_name] = records
+
+	return t.settings.save(guild_id, takeHistorySetting, history)
+}
+
+func (t *takeHistory) remove(guild_id, name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history, err := t.load(guild_id)
+	if err != nil {
+		return err
+	}
+	if _, ok := history[name]; !ok {
+		return nil
+	}
+	delete(history, name)
+
+	return t.settings.save(guild_id, takeHistorySetting, history)
+}
+
+// ensure that you're holding t.mu before calling!
+func (t *takeHistory) load(guild_id string) (map[string][]takeRecord, error) {
+	history := make(map[string][]takeRecord)
+	err := t.settings.load(guild_id, takeHistorySetting, &history)
+	return history, err
+}
+
+func formatETA(d time.Duration) string {
+	if d < time.Minute {
+		return "under a minute"
+	}
+	return "about " + waitTime(d)
+}
+
+// playersAhead counts the players in entries before pos.
+func playersAhead(q *BattleTagQueue, pos int) (ahead int, err error) {
+	err = q.Iter(func(index int, ubt *userBattleTag) bool {
+		if index >= pos {
+			return true
+		}
+		ahead += len(ubt.Players())
+		return false
+	})
+	return ahead, err
+}
+
+// etaSuffix returns a sentence estimating the wait for the entry at pos, or
+// "" if there's no estimate.
+func (h *queueHandler) etaSuffix(q *BattleTagQueue, pos int) string {
+	ahead, err := playersAhead(q, pos)
+	if err != nil {
+		logger.Warne(err)
+		return ""
+	}
+	eta, ok, err := h.takes.estimate(q.guild_id, q.Name(), ahead)
+	if err != nil {
+		logger.Warne(err)
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	return " Estimated wait: " + formatETA(eta) + "."
+}
+
+func (h *queueHandler) handleETA(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	q, _, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	btag := ""
+	pos := -1
+	if btag, err = h.discoverBattleTag(s, m); err == nil {
+		ubt, err := q.Find(btag)
+		if err != nil {
+			return err
+		}
+		if ubt != nil {
+			if pos, err = q.Position(ubt); err != nil {
+				return err
+			}
+		}
+	}
+
+	ahead := 0
+	if pos >= 0 {
+		ahead, err = playersAhead(q, pos)
+	} else {
+		ahead, err = q.Players()
+	}
+	if err != nil {
+		return err
+	}
+
+	eta, ok, err := h.takes.estimate(q.guild_id, q.Name(), ahead)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		reply(s, m, "There haven't been enough takes from the %s queue "+
+			"to estimate wait times yet.", q.Name())
+		return nil
+	}
+
+	if pos >= 0 {
+		reply(s, m, "%s is in position %d of the %s queue, and should be "+
+			"taken in %s.", btag, pos+1, q.Name(), formatETA(eta))
+		return nil
+	}
+	reply(s, m, "Players enqueueing in the %s queue now should be taken "+
+		"in %s.", q.Name(), formatETA(eta))
+	return nil
+}
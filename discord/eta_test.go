@@ -0,0 +1,67 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestETA(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+	now := time.Date(2017, 3, 6, 19, 0, 0, 0, time.UTC)
+	qh.takes.now = func() time.Time { return now }
+
+	m := test.testMessage("!queue eta")
+	test.AssertNil(qh.handleETA(s, m))
+	test.AssertContains(s.sends, "There haven't been enough takes from "+
+		"the scrimmages queue to estimate wait times yet.")
+
+	users := generateUsers(6)
+	test.enqueue(users...)
+	m = test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	now = now.Add(30 * time.Minute)
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	now = now.Add(10 * time.Minute)
+
+	// Takes of 2 every 30m, the last 10m ago.
+	eta, ok, err := qh.takes.estimate(testGuildId, defaultQueueName, 0)
+	test.AssertNil(err)
+	test.Assert(ok)
+	test.AssertEqual(eta, 20*time.Minute)
+	eta, ok, err = qh.takes.estimate(testGuildId, defaultQueueName, 3)
+	test.AssertNil(err)
+	test.Assert(ok)
+	test.AssertEqual(eta, 50*time.Minute)
+
+	m = test.testMessage("!enqueue example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	test.AssertContainsRe(s.sends, "Enqueued example#1234 .* in the "+
+		"scrimmages queue in position 3. Estimated wait: about 50m.")
+
+	m = test.testMessage("!queue eta")
+	test.AssertNil(qh.handleETA(s, m))
+	test.AssertContains(s.sends, "example#1234 is in position 3 of the "+
+		"scrimmages queue, and should be taken in about 50m.")
+
+	m = test.testMessage("!queue list")
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContainsRe(s.sends, users[4].BattleTag+
+		` \(<1m, ETA 20m\)  `+users[5].BattleTag+` \(<1m, ETA 20m\)  `+
+		`example#1234 \(<1m, ETA 50m\)`)
+}
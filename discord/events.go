@@ -0,0 +1,123 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ewollesen/zenbot/queue"
+)
+
+// eventsKeepAlive is how often an idle event stream is sent a comment, so
+// that proxies don't close it.
+const eventsKeepAlive = 30 * time.Second
+
+// Subscribe subscribes to the changes to the queue, not including its
+// waitlist.
+func (q *BattleTagQueue) Subscribe() (queue.Subscription, error) {
+	watched, ok := q.q.(*queue.WatchedQueue)
+	if !ok {
+		return nil, Error.New("the %s queue doesn't publish events",
+			q.name)
+	}
+	return watched.Subscribe()
+}
+
+// apiEvent is a queue event, as streamed by the HTTP API. Position is 1-based,
+// and omitted for events without a datum.
+type apiEvent struct {
+	Time      time.Time       `json:"time"`
+	Queue     string          `json:"queue"`
+	Type      queue.EventType `json:"type"`
+	BattleTag string          `json:"battle_tag,omitempty"`
+	UserId    string          `json:"user_id,omitempty"`
+	Position  int             `json:"position,omitempty"`
+}
+
+func newAPIEvent(q *BattleTagQueue, event *queue.Event) *apiEvent {
+	api_event := &apiEvent{
+		Time:  event.Time,
+		Queue: q.Name(),
+		Type:  event.Type,
+	}
+	if event.Datum != nil {
+		ubt := &userBattleTag{}
+		logger.Errore(json.Unmarshal(event.Datum, ubt))
+		api_event.BattleTag = ubt.label()
+		api_event.UserId = ubt.UserId
+		api_event.Position = event.Position + 1
+	}
+	return api_event
+}
+
+// handleEventsHTTP streams a queue's changes as server-sent events, until the
+// client disconnects. It accepts guild_id, and optionally queue, query
+// parameters.
+func (b *bot) handleEventsHTTP(w http.ResponseWriter, req *http.Request) {
+	if !authorizedAPIRequest(w, req) {
+		return
+	}
+	q, ok := b.apiQueue(w, req)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	sub, err := q.Subscribe()
+	if err != nil {
+		logger.Errore(err)
+		http.Error(w, "failed to subscribe to queue events",
+			http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// The initial comment lets clients know they're subscribed.
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	keep_alive := time.NewTicker(eventsKeepAlive)
+	defer keep_alive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keep_alive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(newAPIEvent(q, event))
+			if err != nil {
+				logger.Errore(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type,
+				data)
+		}
+		flusher.Flush()
+	}
+}
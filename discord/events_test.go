@@ -0,0 +1,74 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventsHTTP(t *testing.T) {
+	test, qh := newQueueTest(t)
+	b := &bot{audit_log: qh.audit_log, queues: qh.queues}
+	users := generateUsers(2)
+
+	old_token := *apiToken
+	defer func() { *apiToken = old_token }()
+	*apiToken = "secret"
+
+	server := httptest.NewServer(http.HandlerFunc(b.handleEventsHTTP))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"?guild_id="+
+		testGuildId, nil)
+	test.AssertNil(err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	test.AssertNil(err)
+	defer resp.Body.Close()
+	test.AssertEqual(resp.StatusCode, http.StatusOK)
+
+	lines := bufio.NewReader(resp.Body)
+	line, err := lines.ReadString('\n')
+	test.AssertNil(err)
+	test.AssertEqual(line, ": subscribed\n")
+
+	test.enqueue(users...)
+	test.AssertNil(test.queue().Remove(users[0]))
+
+	events := []*apiEvent{}
+	for len(events) < 3 {
+		line, err = lines.ReadString('\n')
+		test.AssertNil(err)
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		event := &apiEvent{}
+		test.AssertNil(json.Unmarshal(
+			[]byte(strings.TrimPrefix(line, "data: ")), event))
+		events = append(events, event)
+	}
+	test.AssertEqual(string(events[0].Type), "enqueued")
+	test.AssertEqual(events[0].BattleTag, users[0].BattleTag)
+	test.AssertEqual(events[0].Position, 1)
+	test.AssertEqual(events[1].Position, 2)
+	test.AssertEqual(string(events[2].Type), "removed")
+	test.AssertEqual(events[2].Queue, defaultQueueName)
+	test.AssertEqual(events[2].UserId, users[0].UserId)
+}
@@ -0,0 +1,552 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/queue"
+	"github.com/spacemonkeygo/errors"
+)
+
+// maxImportSize is the largest import accepted, in bytes.
+const maxImportSize = 1 << 20
+
+var (
+	ImportInvalid = Error.NewClass("import invalid",
+		errors.NoCaptureStack())
+
+	// attachmentClient gives up on stalled downloads, rather than holding
+	// up the command indefinitely.
+	attachmentClient = &http.Client{Timeout: 30 * time.Second}
+
+	// fetchAttachment downloads an attachment's contents. Tests replace
+	// it.
+	fetchAttachment = func(url string) (io.ReadCloser, error) {
+		resp, err := attachmentClient.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, Error.New("fetching attachment: %s",
+				resp.Status)
+		}
+		return resp.Body, nil
+	}
+
+	exportColumns = []string{"battle_tag", "user_id", "guild_id",
+		"enqueued_at", "party", "roles", "platform", "region"}
+)
+
+// exportEntry is a queue entry as exported by `!queue export`, and accepted
+// by `!queue import`.
+type exportEntry struct {
+	BattleTag  string    `json:"battle_tag"`
+	UserId     string    `json:"user_id"`
+	GuildId    string    `json:"guild_id"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	Party      []string  `json:"party,omitempty"`
+	Roles      []string  `json:"roles,omitempty"`
+	Platform   string    `json:"platform,omitempty"`
+	Region     string    `json:"region,omitempty"`
+}
+
+// exportFormat returns the export format named by name, if any.
+func exportFormat(name string) (string, bool) {
+	switch format := strings.ToLower(name); format {
+	case "json", "csv":
+		return format, true
+	}
+	return "", false
+}
+
+// splitFormat removes a trailing export format from args, returning it, or
+// def if there isn't one.
+func splitFormat(args []string, def string) ([]string, string) {
+	if len(args) > 0 {
+		if format, ok := exportFormat(args[len(args)-1]); ok {
+			return args[:len(args)-1], format
+		}
+	}
+	return args, def
+}
+
+func (q *BattleTagQueue) export() (entries []*exportEntry, err error) {
+	entries = []*exportEntry{}
+	err = q.Iter(func(_ int, ubt *userBattleTag) bool {
+		entries = append(entries, &exportEntry{
+			BattleTag:  ubt.BattleTag,
+			UserId:     ubt.UserId,
+			GuildId:    ubt.GuildId,
+			EnqueuedAt: ubt.EnqueuedAt,
+			Party:      ubt.Party,
+			Roles:      ubt.Roles,
+			Platform:   ubt.Platform,
+			Region:     ubt.Region,
+		})
+		return false
+	})
+	return entries, err
+}
+
+func writeExport(w io.Writer, format string, entries []*exportEntry) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportColumns); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := cw.Write([]string{
+			entry.BattleTag,
+			entry.UserId,
+			entry.GuildId,
+			entry.EnqueuedAt.UTC().Format(time.RFC3339),
+			strings.Join(entry.Party, " "),
+			strings.Join(entry.Roles, ","),
+			entry.Platform,
+			entry.Region,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readImport parses an export. If format is empty, it's guessed from the
+// data.
+func readImport(r io.Reader, format string) ([]*exportEntry, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxImportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImportSize {
+		return nil, ImportInvalid.New("imports are limited to %d KiB",
+			maxImportSize/1024)
+	}
+	data = bytes.TrimSpace(data)
+	if format == "" {
+		format = "csv"
+		if bytes.HasPrefix(data, []byte("[")) {
+			format = "json"
+		}
+	}
+
+	if format == "json" {
+		entries := []*exportEntry{}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, ImportInvalid.New("invalid JSON: %v", err)
+		}
+		return entries, nil
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, ImportInvalid.New("invalid CSV: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, ImportInvalid.New("no CSV header")
+	}
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := columns["battle_tag"]; !ok {
+		return nil, ImportInvalid.New("no battle_tag column")
+	}
+	field := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	entries := []*exportEntry{}
+	for n, row := range rows[1:] {
+		entry := &exportEntry{
+			BattleTag: field(row, "battle_tag"),
+			UserId:    field(row, "user_id"),
+			GuildId:   field(row, "guild_id"),
+			Party:     strings.Fields(field(row, "party")),
+			Platform:  field(row, "platform"),
+			Region:    field(row, "region"),
+		}
+		if roles := field(row, "roles"); roles != "" {
+			entry.Roles = strings.Split(roles, ",")
+		}
+		if at := field(row, "enqueued_at"); at != "" {
+			entry.EnqueuedAt, err = time.Parse(time.RFC3339, at)
+			if err != nil {
+				return nil, ImportInvalid.New("line %d: invalid "+
+					"enqueued_at %q", n+2, at)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// importEntries validates exported entries, converting them to queue entries
+// for the guild. Entries without an enqueue time are treated as enqueued now.
+func importEntries(guild_id string, entries []*exportEntry, now time.Time) (
+	[]*queue.Entry, error) {
+
+	seen := make(map[string]bool)
+	imported := []*queue.Entry{}
+	for _, entry := range entries {
+		ubt := &userBattleTag{
+			BattleTag: entry.BattleTag,
+			GuildId:   guild_id,
+			UserId:    entry.UserId,
+			Party:     entry.Party,
+		}
+		if len(ubt.Players()) > maxPartySize {
+			return nil, ImportInvalid.New("%s's party is larger "+
+				"than %d", ubt.BattleTag, maxPartySize)
+		}
+		for _, btag := range ubt.Players() {
+			if !btagRe.MatchString(btag) {
+				return nil, ImportInvalid.New(
+					"invalid BattleTag %q", btag)
+			}
+			if seen[strings.ToLower(btag)] {
+				return nil, ImportInvalid.New(
+					"%s appears more than once", btag)
+			}
+			seen[strings.ToLower(btag)] = true
+		}
+		if ubt.UserId == "" {
+			return nil, ImportInvalid.New("%s has no user_id",
+				ubt.BattleTag)
+		}
+		if len(entry.Roles) > 0 {
+			roles, ok := parseRoles(strings.Join(entry.Roles, ","))
+			if !ok {
+				return nil, ImportInvalid.New("invalid roles "+
+					"for %s", ubt.BattleTag)
+			}
+			ubt.Roles = roles
+		}
+		if entry.Platform != "" {
+			ubt.Platform = platformAliases[strings.ToLower(
+				entry.Platform)]
+			if ubt.Platform == "" {
+				return nil, ImportInvalid.New("invalid platform "+
+					"%q for %s", entry.Platform, ubt.BattleTag)
+			}
+		}
+		if entry.Region != "" {
+			ubt.Region = regionAliases[strings.ToLower(entry.Region)]
+			if ubt.Region == "" {
+				return nil, ImportInvalid.New("invalid region "+
+					"%q for %s", entry.Region, ubt.BattleTag)
+			}
+		}
+
+		datum, err := json.Marshal(ubt)
+		if err != nil {
+			return nil, err
+		}
+		enqueued_at := entry.EnqueuedAt
+		if enqueued_at.IsZero() {
+			enqueued_at = now
+		}
+		imported = append(imported, &queue.Entry{
+			Datum:      datum,
+			EnqueuedAt: enqueued_at,
+		})
+	}
+	return imported, nil
+}
+
+// stripCodeBlock removes the markdown code block, if any, around text pasted
+// into a message.
+func stripCodeBlock(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	// The opening line may name a language, eg ```json.
+	if i := strings.Index(text, "\n"); i >= 0 {
+		text = text[i+1:]
+	} else {
+		text = strings.TrimPrefix(text, "```")
+	}
+	return strings.TrimSuffix(strings.TrimSpace(text), "```")
+}
+
+// importQueue replaces the queue's contents with the import read from r,
+// returning the number of players the queue kept, and the number dropped
+// because they'd been queued for longer than the queue's max age.
+func importQueue(q *BattleTagQueue, r io.Reader, format string) (
+	players, expired int, err error) {
+
+	entries, err := readImport(r, format)
+	if err != nil {
+		return 0, 0, err
+	}
+	imported, err := importEntries(q.guild_id, entries, time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = q.Replace(imported); err != nil {
+		return 0, 0, err
+	}
+	if players, err = q.Players(); err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range imported {
+		expired += playersSize(entry.Datum)
+	}
+	return players, expired - players, nil
+}
+
+func (h *queueHandler) handleExportUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	args, format := splitFormat(commandArgs(m, 2), "json")
+	q, _, err := h.guildQueue(s, m, args)
+	if err != nil {
+		return err
+	}
+
+	entries, err := q.export()
+	if err != nil {
+		reply(s, m, "Error exporting the %s queue.", q.Name())
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err = writeExport(buf, format, entries); err != nil {
+		reply(s, m, "Error exporting the %s queue.", q.Name())
+		return err
+	}
+
+	return s.ChannelFileSend(m.ChannelID, q.Name()+"."+format, buf)
+}
+
+// handleImportUnsafe imports an attached export, or one pasted on the lines
+// following the command, replacing the queue's contents.
+func (h *queueHandler) handleImportUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	lines := strings.SplitN(m.Content, "\n", 2)
+	args := strings.Fields(lines[0])
+	if len(args) > 2 {
+		args = args[2:]
+	} else {
+		args = []string{}
+	}
+	args, format := splitFormat(args, "")
+	q, _, err := h.guildQueue(s, m, args)
+	if err != nil {
+		return err
+	}
+
+	var data io.Reader
+	switch {
+	case len(m.Attachments) > 0:
+		attachment := m.Attachments[0]
+		if format == "" {
+			format, _ = exportFormat(strings.TrimPrefix(
+				path.Ext(attachment.Filename), "."))
+		}
+		if attachment.Size > maxImportSize {
+			reply(s, m, "Imports are limited to %d KiB.",
+				maxImportSize/1024)
+			return ImportInvalid.New("attachment too large")
+		}
+		body, err := fetchAttachment(attachment.URL)
+		if err != nil {
+			reply(s, m, "Error downloading %s.", attachment.Filename)
+			return err
+		}
+		defer body.Close()
+		data = body
+	case len(lines) == 2:
+		data = strings.NewReader(stripCodeBlock(lines[1]))
+	default:
+		reply(s, m, "Attach a JSON or CSV file from `!queue export`, "+
+			"or paste its contents on the lines after the command.")
+		return nil
+	}
+
+	players, expired, err := importQueue(q, data, format)
+	if err != nil {
+		if ImportInvalid.Contains(err) {
+			reply(s, m, "Couldn't import into the %s queue: %s.",
+				q.Name(), errors.GetMessage(err))
+			return nil
+		}
+		reply(s, m, "Error importing into the %s queue.", q.Name())
+		return err
+	}
+
+	h.record(s, m, q.guild_id, &auditlog.Event{
+		Queue:  q.Name(),
+		Action: "import",
+		Detail: fmt.Sprintf("%d BattleTags", players),
+	})
+	msg := fmt.Sprintf("Imported %d BattleTags into the %s queue, "+
+		"replacing its contents.", players, q.Name())
+	if expired > 0 {
+		msg += fmt.Sprintf(" %d more had been queued for longer than "+
+			"%s, so were dropped.", expired, waitTime(*queueMaxAge))
+	}
+	reply(s, m, "%s", msg)
+	return nil
+}
+
+// apiQueue returns the queue named by the request's guild_id and queue query
+// parameters, responding with an error if there isn't one. Without a queue
+// parameter, the guild's first queue is used.
+func (b *bot) apiQueue(w http.ResponseWriter, req *http.Request) (
+	*BattleTagQueue, bool) {
+
+	values := req.URL.Query()
+	guild_id := values.Get("guild_id")
+	if guild_id == "" {
+		http.Error(w, "missing guild_id query parameter",
+			http.StatusBadRequest)
+		return nil, false
+	}
+
+	var q *BattleTagQueue
+	var err error
+	if name := values.Get("queue"); name != "" {
+		q, err = b.queues.Lookup(guild_id, name)
+	} else {
+		q, err = b.queues.Default(guild_id, "")
+	}
+	if err != nil {
+		if QueueNotFound.Contains(err) {
+			http.Error(w, "no such queue", http.StatusNotFound)
+			return nil, false
+		}
+		logger.Errore(err)
+		http.Error(w, "failed to look up queue",
+			http.StatusInternalServerError)
+		return nil, false
+	}
+	return q, true
+}
+
+// handleExportHTTP serves a queue's contents. It accepts guild_id, and
+// optionally queue and format (json or csv) query parameters.
+func (b *bot) handleExportHTTP(w http.ResponseWriter, req *http.Request) {
+	if !authorizedAPIRequest(w, req) {
+		return
+	}
+	q, ok := b.apiQueue(w, req)
+	if !ok {
+		return
+	}
+	format := "json"
+	if name := req.URL.Query().Get("format"); name != "" {
+		if format, ok = exportFormat(name); !ok {
+			http.Error(w, "invalid format query parameter",
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := q.export()
+	if err != nil {
+		logger.Errore(err)
+		http.Error(w, "failed to export queue",
+			http.StatusInternalServerError)
+		return
+	}
+
+	content_type := "application/json"
+	if format == "csv" {
+		content_type = "text/csv"
+	}
+	w.Header().Set("Content-Type", content_type)
+	logger.Errore(writeExport(w, format, entries))
+}
+
+// handleImportHTTP replaces a queue's contents with the POSTed export. It
+// accepts the same query parameters as handleExportHTTP, guessing the format
+// if it's not given.
+func (b *bot) handleImportHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "imports must be POSTed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizedAPIRequest(w, req) {
+		return
+	}
+	q, ok := b.apiQueue(w, req)
+	if !ok {
+		return
+	}
+	format := ""
+	if name := req.URL.Query().Get("format"); name != "" {
+		if format, ok = exportFormat(name); !ok {
+			http.Error(w, "invalid format query parameter",
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	players, expired, err := importQueue(q, req.Body, format)
+	if err != nil {
+		if ImportInvalid.Contains(err) {
+			http.Error(w, errors.GetMessage(err),
+				http.StatusBadRequest)
+			return
+		}
+		logger.Errore(err)
+		http.Error(w, "failed to import queue",
+			http.StatusInternalServerError)
+		return
+	}
+
+	logger.Errore(b.audit_log.Append(q.guild_id, &auditlog.Event{
+		Time:   time.Now(),
+		Queue:  q.Name(),
+		Action: "import",
+		Actor:  "HTTP API",
+		Detail: fmt.Sprintf("%d BattleTags", players),
+	}))
+	w.Header().Set("Content-Type", "application/json")
+	logger.Errore(json.NewEncoder(w).Encode(map[string]int{
+		"imported": players,
+		"expired":  expired,
+	}))
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+	memorycache "github.com/ewollesen/zenbot/cache/memory"
+	"github.com/ewollesen/zenbot/queue"
+	memoryqueue "github.com/ewollesen/zenbot/queue/memory"
+)
+
+func TestExportImport(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(3)
+	users[1].Party = []string{nextBattleTag()}
+	users[2].Roles = []string{"support"}
+	test.enqueue(users...)
+
+	for _, format := range []string{"json", "csv"} {
+		m := test.testMessage("!queue export " + format)
+		test.AssertNil(qh.handleExportUnsafe(s, m))
+		data, ok := s.files["scrimmages."+format]
+		test.Assert(ok)
+
+		m = test.testMessage("!queue create ranked" + format)
+		test.AssertNil(qh.handleCreateUnsafe(s, m))
+		m = test.testMessage("!queue import ranked" + format + "\n" +
+			"```" + format + "\n" + string(data) + "```")
+		test.AssertNil(qh.handleImportUnsafe(s, m))
+		test.AssertContains(s.sends, "Imported 4 BattleTags into the "+
+			"ranked"+format+" queue, replacing its contents.")
+
+		q, err := qh.queues.Lookup(testGuildId, "ranked"+format)
+		test.AssertNil(err)
+		for i, user := range users {
+			pos, err := q.Position(user)
+			test.AssertNil(err)
+			test.AssertEqual(pos, i)
+		}
+	}
+}
+
+func TestImportAttachment(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	test.enqueue(generateUsers(1)...)
+
+	old_fetch := fetchAttachment
+	defer func() { fetchAttachment = old_fetch }()
+	fetchAttachment = func(url string) (io.ReadCloser, error) {
+		test.AssertEqual(url, "https://cdn.example.com/queue.csv")
+		return ioutil.NopCloser(bytes.NewBufferString(
+			"battle_tag,user_id\nexample#1234,1\nother#5678,2\n")), nil
+	}
+
+	m := test.testMessage("!queue import")
+	m.Attachments = []*discordgo.Attachment{{
+		URL:      "https://cdn.example.com/queue.csv",
+		Filename: "queue.csv",
+	}}
+	test.AssertNil(qh.handleImportUnsafe(s, m))
+	test.AssertContains(s.sends, "Imported 2 BattleTags into the "+
+		"scrimmages queue, replacing its contents.")
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 2)
+}
+
+func TestImportExpired(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	old_max_age := *queueMaxAge
+	defer func() { *queueMaxAge = old_max_age }()
+	*queueMaxAge = time.Hour
+	qh.queues = newBattleTagQueues(memorycache.New(),
+		func(guild_id, name string) queue.Queue {
+			q := memoryqueue.New()
+			q.SetMaxAge(*queueMaxAge)
+			return q
+		})
+
+	// An export from a day ago, moved between servers.
+	old := time.Now().Add(-24 * time.Hour).Format(time.RFC3339)
+	m := test.testMessage("!queue import\n" +
+		"battle_tag,user_id,enqueued_at\n" +
+		"example#1234,1,\n" +
+		"other#5678,2," + old + "\n")
+	test.AssertNil(qh.handleImportUnsafe(s, m))
+	test.AssertContains(s.sends, "Imported 1 BattleTags into the "+
+		"scrimmages queue, replacing its contents. 1 more had been "+
+		"queued for longer than 1h00m, so were dropped.")
+}
+
+func TestImportInvalid(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(1)
+	test.enqueue(users...)
+
+	for input, msg := range map[string]string{
+		"battle_tag,user_id\nexample#1234,1\nexample#1234,2": "example#1234 appears more than once",
+		"battle_tag,user_id\nnope,1":                         "invalid BattleTag \"nope\"",
+		"battle_tag\nexample#1234":                           "example#1234 has no user_id",
+		"user_id\n1":                                         "no battle_tag column",
+		`[{"battle_tag": "example#1234", "user_id": "1", "roles": ["bard"]}]`: "invalid roles for example#1234",
+	} {
+		m := test.testMessage("!queue import\n" + input)
+		test.AssertNil(qh.handleImportUnsafe(s, m))
+		test.AssertContains(s.sends, "Couldn't import into the "+
+			"scrimmages queue: "+msg+".")
+	}
+
+	// The queue is left as it was.
+	pos, err := test.queue().Position(users[0])
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+}
+
+func TestExportImportHTTP(t *testing.T) {
+	test, qh := newQueueTest(t)
+	b := &bot{audit_log: qh.audit_log, queues: qh.queues}
+	users := generateUsers(2)
+	test.enqueue(users...)
+
+	old_token := *apiToken
+	defer func() { *apiToken = old_token }()
+	*apiToken = "secret"
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/queue/export?guild_id="+
+		testGuildId, nil)
+	b.handleExportHTTP(w, req)
+	test.AssertEqual(w.Code, http.StatusUnauthorized)
+
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer secret")
+	b.handleExportHTTP(w, req)
+	test.AssertEqual(w.Code, http.StatusOK)
+	entries := []*exportEntry{}
+	test.AssertNil(json.Unmarshal(w.Body.Bytes(), &entries))
+	test.AssertEqual(len(entries), 2)
+	test.AssertEqual(entries[0].BattleTag, users[0].BattleTag)
+
+	// Import the queue reversed, into another server.
+	entries[0], entries[1] = entries[1], entries[0]
+	body, err := json.Marshal(entries)
+	test.AssertNil(err)
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/queue/import?guild_id=other-guild",
+		bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	b.handleImportHTTP(w, req)
+	test.AssertEqual(w.Code, http.StatusOK)
+
+	q := qh.queues.Get("other-guild", defaultQueueName)
+	err = q.Iter(func(i int, ubt *userBattleTag) bool {
+		test.AssertEqual(ubt.BattleTag, users[1-i].BattleTag)
+		test.AssertEqual(ubt.GuildId, "other-guild")
+		return false
+	})
+	test.AssertNil(err)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/queue/import?guild_id=other-guild",
+		bytes.NewBufferString("battle_tag\nnope"))
+	req.Header.Set("Authorization", "Bearer secret")
+	b.handleImportHTTP(w, req)
+	test.AssertEqual(w.Code, http.StatusBadRequest)
+}
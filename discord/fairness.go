@@ -0,0 +1,155 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ewollesen/discordgo"
+)
+
+// sessionGames counts the games each BattleTag has played in a guild's
+// current session, for fair rotation. When fair rotation is enabled, players
+// who've played fewer games are taken from the queues first. Counts are
+// stored as guild settings, until an admin resets them.
+type sessionGames struct {
+	mu       sync.Mutex
+	settings *guildSettings
+}
+
+func newSessionGames(settings *guildSettings) *sessionGames {
+	return &sessionGames{
+		settings: settings,
+	}
+}
+
+func (g *sessionGames) enabled(guild_id string) (enabled bool, err error) {
+	err = g.settings.load(guild_id, "fair_rotation", &enabled)
+	return enabled, err
+}
+
+func (g *sessionGames) setEnabled(guild_id string, enabled bool) error {
+	return g.settings.save(guild_id, "fair_rotation", enabled)
+}
+
+// counts returns the number of games each BattleTag has played this session,
+// or nil if fair rotation is disabled.
+func (g *sessionGames) counts(guild_id string) (map[string]int, error) {
+	enabled, err := g.enabled(guild_id)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.load(guild_id)
+}
+
+// record counts a game for each of the BattleTags, if fair rotation is
+// enabled, returning a function that uncounts them again, eg if the take is
+// undone.
+func (g *sessionGames) record(guild_id string, btags []string) (
+	undo func() error, err error) {
+
+	enabled, err := g.enabled(guild_id)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	if err = g.add(guild_id, btags, 1); err != nil {
+		return nil, err
+	}
+	return func() error { return g.add(guild_id, btags, -1) }, nil
+}
+
+func (g *sessionGames) add(guild_id string, btags []string, n int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	counts, err := g.load(guild_id)
+	if err != nil {
+		return err
+	}
+	for _, btag := range btags {
+		counts[btag] += n
+		if counts[btag] <= 0 {
+			delete(counts, btag)
+		}
+	}
+
+	return g.settings.save(guild_id, "session_games", counts)
+}
+
+func (g *sessionGames) reset(guild_id string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.settings.save(guild_id, "session_games", map[string]int{})
+}
+
+// ensure that you're holding g.mu before calling!
+func (g *sessionGames) load(guild_id string) (map[string]int, error) {
+	counts := make(map[string]int)
+	err := g.settings.load(guild_id, "session_games", &counts)
+	return counts, err
+}
+
+func (h *queueHandler) handleFairUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs(m, 2)
+	sub_cmd := ""
+	if len(args) > 0 {
+		sub_cmd = strings.ToLower(args[0])
+	}
+
+	switch sub_cmd {
+	case "on":
+		if err = h.games.setEnabled(guild_id, true); err != nil {
+			return err
+		}
+		reply(s, m, "Fair rotation is on. Players who've played fewer "+
+			"games this session will be taken first.")
+	case "off":
+		if err = h.games.setEnabled(guild_id, false); err != nil {
+			return err
+		}
+		reply(s, m, "Fair rotation is off. Players will be taken in "+
+			"queue order.")
+	case "reset":
+		if err = h.games.reset(guild_id); err != nil {
+			return err
+		}
+		reply(s, m, "Reset this session's game counts.")
+	default:
+		enabled, err := h.games.enabled(guild_id)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			reply(s, m, "Fair rotation is on. Try `!queue fair off` "+
+				"or `!queue fair reset`.")
+		} else {
+			reply(s, m, "Fair rotation is off. Try `!queue fair on`.")
+		}
+	}
+
+	return nil
+}
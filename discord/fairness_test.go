@@ -0,0 +1,67 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFairRotation(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+	users := generateUsers(5)
+	test.enqueue(users[:4]...)
+
+	m := test.testMessage("!queue fair on")
+	test.AssertNil(qh.handleFairUnsafe(s, m))
+	test.AssertContains(s.sends, "Fair rotation is on. Players who've "+
+		"played fewer games this session will be taken first.")
+
+	m = test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContainsRe(s.sends, "Took 2 BattleTags from the "+
+		"scrimmages queue: "+users[0].BattleTag+"  "+users[1].BattleTag)
+
+	// users[0] re-enqueues ahead of the newcomer, but has already played.
+	test.enqueue(users[0], users[4])
+	m = test.testMessage("!queue take 3")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContains(s.sends, "Took 3 BattleTags from the scrimmages "+
+		"queue: "+strings.Join(toBattleTags([]*userBattleTag{
+		users[2], users[3], users[4]}), "  ")+". 1 BattleTags remain "+
+		"in the scrimmages queue.")
+
+	m = test.testMessage("!queue fair reset")
+	test.AssertNil(qh.handleFairUnsafe(s, m))
+	test.AssertContains(s.sends, "Reset this session's game counts.")
+
+	test.enqueue(users[2])
+	m = test.testMessage("!queue take 1")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContainsRe(s.sends, "Took 1 BattleTags from the "+
+		"scrimmages queue: "+users[0].BattleTag+"\\.")
+
+	m = test.testMessage("!queue fair off")
+	test.AssertNil(qh.handleFairUnsafe(s, m))
+	games, err := qh.games.counts(testGuildId)
+	test.AssertNil(err)
+	test.Assert(games == nil)
+	m = test.testMessage("!queue fair")
+	test.AssertNil(qh.handleFairUnsafe(s, m))
+	test.AssertContains(s.sends, "Fair rotation is off. Try "+
+		"`!queue fair on`.")
+}
@@ -0,0 +1,261 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/blizzard"
+)
+
+var (
+	auditLogSize = flag.Int("discord.audit_log_size", 1000,
+		"number of queue events kept per guild for `!queue history`")
+	apiToken = flag.String("discord.api_token", "",
+		"bearer token required by the queue HTTP API (the API is "+
+			"disabled if empty)")
+)
+
+const (
+	defaultHistoryLength = 10
+	maxHistoryLength     = 25
+
+	// botActor is the actor of events the bot made on its own.
+	botActor = "zenbot"
+)
+
+// record appends an event made by the message's author to the guild's audit
+// log, or by the bot, if m is nil.
+func (h *queueHandler) record(s Session, m *discordgo.MessageCreate,
+	guild_id string, event *auditlog.Event) {
+
+	if m == nil {
+		recordBotEvent(h.audit_log, guild_id, event)
+		return
+	}
+	event.Time = time.Now()
+	event.ActorId = m.Author.ID
+	event.Actor = h.lookupNickOrUsername(s, m)
+	logger.Errore(h.audit_log.Append(guild_id, event))
+}
+
+// recordBotEvent appends an event the bot made on its own, rather than at a
+// user's command, to the guild's audit log.
+func recordBotEvent(audit_log auditlog.Log, guild_id string,
+	event *auditlog.Event) {
+
+	event.Time = time.Now()
+	event.Actor = botActor
+	logger.Errore(audit_log.Append(guild_id, event))
+}
+
+// recordEnqueue records the message's author enqueueing a BattleTag, or a
+// party, at pos in the queue or its waitlist.
+func (h *queueHandler) recordEnqueue(s Session, m *discordgo.MessageCreate,
+	q *BattleTagQueue, label string, pos int, waitlisted bool) {
+
+	event := &auditlog.Event{
+		Queue:     q.Name(),
+		Action:    "enqueue",
+		BattleTag: label,
+		Position:  pos + 1,
+	}
+	if waitlisted {
+		event.Detail = "waitlist"
+	}
+	h.record(s, m, q.guild_id, event)
+}
+
+// recordRemoval records the message's author removing an entry from pos in
+// holder, which is either the queue or its waitlist.
+func (h *queueHandler) recordRemoval(s Session, m *discordgo.MessageCreate,
+	q, holder *BattleTagQueue, action string, ubt *userBattleTag, pos int) {
+
+	event := &auditlog.Event{
+		Queue:     q.Name(),
+		Action:    action,
+		BattleTag: ubt.label(),
+		Position:  pos + 1,
+	}
+	if holder != q {
+		event.Detail = "waitlist"
+	}
+	h.record(s, m, q.guild_id, event)
+}
+
+// promote promotes players from the queue's waitlist.
+func (h *queueHandler) promote(s Session, q *BattleTagQueue) (
+	promoted []*userBattleTag) {
+
+	return promoteWaitlisted(s, h.queues, h.audit_log, q)
+}
+
+// historyMatcher matches events in the named queue, involving the BattleTag.
+// Either may be empty to match any.
+func historyMatcher(name, btag string) func(*auditlog.Event) bool {
+	return func(event *auditlog.Event) bool {
+		if name != "" && event.Queue != name {
+			return false
+		}
+		if btag == "" {
+			return true
+		}
+		for _, player := range strings.Split(event.BattleTag, "+") {
+			if player == btag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func formatEvent(event *auditlog.Event) string {
+	parts := []string{
+		"`" + event.Time.UTC().Format("Jan 2 15:04 MST") + "`",
+		event.Action,
+	}
+	if event.BattleTag != "" {
+		parts = append(parts, event.BattleTag)
+	}
+	parts = append(parts, "in", event.Queue)
+	if event.Position > 0 {
+		parts = append(parts, fmt.Sprintf("at position %d",
+			event.Position))
+	}
+	if event.Detail != "" {
+		parts = append(parts, "("+event.Detail+")")
+	}
+	actor := botActor
+	if event.ActorId != "" {
+		actor = event.Actor
+	}
+	return strings.Join(append(parts, "by", actor), " ")
+}
+
+// handleHistoryUnsafe handles `!queue history [name] [n] [btag]`.
+func (h *queueHandler) handleHistoryUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	n := defaultHistoryLength
+	name, btag := "", ""
+	for _, arg := range commandArgs(m, 2) {
+		if parsed, err := strconv.Atoi(arg); err == nil && parsed > 0 {
+			n = parsed
+			continue
+		}
+		if found := blizzard.FirstBattleTag(arg); found != "" {
+			btag = found
+			continue
+		}
+		q, err := h.queues.Lookup(guild_id, arg)
+		if err != nil {
+			reply(s, m, "There is no queue named %q. "+
+				"Try `!queue queues`.", arg)
+			return err
+		}
+		name = q.Name()
+	}
+	if n > maxHistoryLength {
+		n = maxHistoryLength
+	}
+
+	events, err := h.audit_log.Recent(guild_id, n,
+		historyMatcher(name, btag))
+	if err != nil {
+		reply(s, m, "Error reading the queue history. Please try again.")
+		return err
+	}
+	if len(events) == 0 {
+		reply(s, m, "No matching queue history found.")
+		return nil
+	}
+
+	lines := []string{"Recent queue history, newest first:"}
+	for _, event := range events {
+		lines = append(lines, formatEvent(event))
+	}
+	reply(s, m, strings.Join(lines, "\n"))
+	return nil
+}
+
+// handleHistoryHTTP serves a guild's queue history as JSON, newest first. It
+// accepts guild_id, and optionally n, queue and btag query parameters.
+func (b *bot) handleHistoryHTTP(w http.ResponseWriter, req *http.Request) {
+	if !authorizedAPIRequest(w, req) {
+		return
+	}
+
+	values := req.URL.Query()
+	guild_id := values.Get("guild_id")
+	if guild_id == "" {
+		http.Error(w, "missing guild_id query parameter",
+			http.StatusBadRequest)
+		return
+	}
+	n := *auditLogSize
+	if values.Get("n") != "" {
+		parsed, err := strconv.Atoi(values.Get("n"))
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid n query parameter",
+				http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	events, err := b.audit_log.Recent(guild_id, n,
+		historyMatcher(values.Get("queue"), values.Get("btag")))
+	if err != nil {
+		logger.Errore(err)
+		http.Error(w, "failed to read queue history",
+			http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []*auditlog.Event{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	logger.Errore(json.NewEncoder(w).Encode(events))
+}
+
+// authorizedAPIRequest checks the request's bearer token against the
+// configured API token, responding with an error if it doesn't match.
+func authorizedAPIRequest(w http.ResponseWriter, req *http.Request) bool {
+	if *apiToken == "" {
+		http.Error(w, "the queue API is disabled", http.StatusNotFound)
+		return false
+	}
+	given := []byte(req.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(given, []byte("Bearer "+*apiToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ewollesen/zenbot/auditlog"
+)
+
+func TestHistory(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+	users := generateUsers(3)
+	test.enqueue(users...)
+
+	m := test.testMessage("!enqueue example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	m = test.testMessage("!queue kick " + users[1].BattleTag)
+	test.AssertNil(qh.handleKickUnsafe(s, m))
+	m = test.testMessage("!queue take 1")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+
+	s.clearSends()
+	m = test.testMessage("!queue history")
+	test.AssertNil(qh.handleHistoryUnsafe(s, m))
+	test.AssertEqual(len(s.sends), 1)
+	lines := strings.Split(s.sends[0], "\n")
+	test.AssertEqual(len(lines), 4)
+	test.AssertContainsRe(lines[1:2], "take "+users[0].BattleTag+
+		" in scrimmages at position 1 by example#1234 \\[tank\\]$")
+	test.AssertContainsRe(lines[2:3], "kick "+users[1].BattleTag+
+		" in scrimmages at position 2 by example#1234 \\[tank\\]$")
+	test.AssertContainsRe(lines[3:4], "enqueue example#1234 in "+
+		"scrimmages at position 4 by example#1234 \\[tank\\]$")
+
+	s.clearSends()
+	m = test.testMessage("!queue history 5 " + users[1].BattleTag)
+	test.AssertNil(qh.handleHistoryUnsafe(s, m))
+	test.AssertEqual(len(strings.Split(s.sends[0], "\n")), 2)
+
+	m = test.testMessage("!queue history nosuchqueue")
+	test.AssertErrorContainedBy(qh.handleHistoryUnsafe(s, m), QueueNotFound)
+}
+
+func TestHistoryHTTP(t *testing.T) {
+	test, qh := newQueueTest(t)
+	b := &bot{audit_log: qh.audit_log}
+	test.AssertNil(qh.audit_log.Append(testGuildId, &auditlog.Event{
+		Queue:     defaultQueueName,
+		Action:    "enqueue",
+		BattleTag: "example#1234",
+		Position:  1,
+	}))
+
+	old_token := *apiToken
+	defer func() { *apiToken = old_token }()
+	*apiToken = "secret"
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/queue/history?guild_id="+
+		testGuildId, nil)
+	b.handleHistoryHTTP(w, req)
+	test.AssertEqual(w.Code, http.StatusUnauthorized)
+
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer secret")
+	b.handleHistoryHTTP(w, req)
+	test.AssertEqual(w.Code, http.StatusOK)
+	events := []*auditlog.Event{}
+	test.AssertNil(json.Unmarshal(w.Body.Bytes(), &events))
+	test.AssertEqual(len(events), 1)
+	test.AssertEqual(events[0].BattleTag, "example#1234")
+}
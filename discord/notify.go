@@ -0,0 +1,334 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ewollesen/discordgo"
+)
+
+var notifyPosition = flag.Int("discord.notify_position", 12,
+	"default position within which opted in players are DM'd that "+
+		"they're near the front of a queue")
+
+const (
+	notifySetting = "notify"
+	// notifyBacklog is how many queue changes can wait to be notified of
+	// before more are dropped.
+	notifyBacklog = 256
+)
+
+// notifySettings holds a guild's notification position, if it isn't the
+// default, and the users who've opted in to notifications.
+type notifySettings struct {
+	Position int             `json:"position,omitempty"`
+	Users    map[string]bool `json:"users,omitempty"`
+}
+
+func (n *notifySettings) position() int {
+	if n.Position > 0 {
+		return n.Position
+	}
+	return *notifyPosition
+}
+
+// queueNotifier DMs opted in users when they move within the notification
+// position of a queue, and when they're taken from it, unless they're sent a
+// ready check instead. Its changed method is a QueueHook, which only queues
+// the change, so that queue operations don't wait on settings and DMs; run
+// sends the notifications.
+type queueNotifier struct {
+	mu       sync.Mutex
+	settings *guildSettings
+	session  Session
+	pending  chan *queueChange
+	// notified holds the users who've been told they're near the front of
+	// each queue, until they move back or leave the queue.
+	notified map[string]bool
+	// readyChecks returns true if taken players are sent ready checks,
+	// which already tell them they've been taken.
+	readyChecks func() bool
+}
+
+// queueChange is a change to a queue, waiting to be notified of.
+type queueChange struct {
+	q     *BattleTagQueue
+	taken []*userBattleTag
+}
+
+// notification is a DM waiting to be sent.
+type notification struct {
+	user_id string
+	message string
+}
+
+func newQueueNotifier(settings *guildSettings,
+	readyChecks func() bool) *queueNotifier {
+
+	return &queueNotifier{
+		settings:    settings,
+		pending:     make(chan *queueChange, notifyBacklog),
+		notified:    make(map[string]bool),
+		readyChecks: readyChecks,
+	}
+}
+
+// setSession sets the session used to send DMs. Until it's called, no one is
+// notified.
+func (n *queueNotifier) setSession(s Session) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.session = s
+}
+
+func (n *queueNotifier) load(guild_id string) (*notifySettings, error) {
+	settings := &notifySettings{}
+	err := n.settings.load(guild_id, notifySetting, settings)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Users == nil {
+		settings.Users = make(map[string]bool)
+	}
+	return settings, nil
+}
+
+func (n *queueNotifier) update(guild_id string,
+	fn func(settings *notifySettings)) (*notifySettings, error) {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	settings, err := n.load(guild_id)
+	if err != nil {
+		return nil, err
+	}
+	fn(settings)
+	return settings, n.settings.save(guild_id, notifySetting, settings)
+}
+
+func (n *queueNotifier) changed(q *BattleTagQueue, taken []*userBattleTag) {
+	if n.readyChecks() {
+		taken = nil
+	}
+	select {
+	case n.pending <- &queueChange{q: q, taken: taken}:
+	default:
+		logger.Warnf("too many queue changes pending, not notifying "+
+			"players of a change to the %s queue", q.Name())
+	}
+}
+
+// run sends the notifications for queued changes as they arrive, until quit
+// is closed.
+func (n *queueNotifier) run(quit <-chan struct{}) {
+	for {
+		select {
+		case change := <-n.pending:
+			n.notify(change)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// drain sends the notifications for the changes queued so far.
+func (n *queueNotifier) drain() {
+	for {
+		select {
+		case change := <-n.pending:
+			n.notify(change)
+		default:
+			return
+		}
+	}
+}
+
+func (n *queueNotifier) notify(change *queueChange) {
+	n.mu.Lock()
+	s := n.session
+	notifications := n.notifications(change)
+	n.mu.Unlock()
+
+	for _, note := range notifications {
+		dm_channel, err := s.UserChannelCreate(note.user_id)
+		if err != nil {
+			logger.Errore(err)
+			continue
+		}
+		logger.Warne(s.ChannelMessageSend(dm_channel.ID, note.message))
+	}
+}
+
+// ensure that you're holding n.mu before calling!
+func (n *queueNotifier) notifications(change *queueChange) (
+	notifications []*notification) {
+
+	if n.session == nil {
+		return nil
+	}
+	q := change.q
+	settings, err := n.load(q.guild_id)
+	if err != nil {
+		logger.Errore(err)
+		return nil
+	}
+	if len(settings.Users) == 0 {
+		return nil
+	}
+	dm := func(user_id, template string, args ...interface{}) {
+		notifications = append(notifications, &notification{
+			user_id: user_id,
+			message: fmt.Sprintf(template, args...),
+		})
+	}
+
+	prefix := q.guild_id + "." + q.Name() + "."
+	for _, ubt := range change.taken {
+		if settings.Users[ubt.UserId] {
+			dm(ubt.UserId, "%s has been taken from the %s queue!",
+				ubt.label(), q.Name())
+		}
+	}
+
+	near := make(map[string]bool)
+	ahead := 0
+	err = q.Iter(func(index int, ubt *userBattleTag) bool {
+		if ahead >= settings.position() {
+			return true
+		}
+		ahead += len(ubt.Players())
+		if !settings.Users[ubt.UserId] {
+			return false
+		}
+		key := prefix + ubt.UserId
+		near[key] = true
+		if !n.notified[key] {
+			n.notified[key] = true
+			dm(ubt.UserId, "%s is now in position %d of the %s "+
+				"queue. Get ready to play!", ubt.label(), index+1,
+				q.Name())
+		}
+		return false
+	})
+	if err != nil {
+		logger.Errore(err)
+		return notifications
+	}
+
+	for key := range n.notified {
+		if strings.HasPrefix(key, prefix) && !near[key] {
+			delete(n.notified, key)
+		}
+	}
+	return notifications
+}
+
+// handleNotify handles `!queue notify`, with which users opt in or out of
+// DMs, and admins set the notification position.
+func (h *queueHandler) handleNotify(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs(m, 2)
+	sub_cmd := ""
+	if len(args) > 0 {
+		sub_cmd = strings.ToLower(args[0])
+	}
+
+	var settings *notifySettings
+	switch sub_cmd {
+	case "on", "off":
+		settings, err = h.notifier.update(guild_id,
+			func(settings *notifySettings) {
+				if sub_cmd == "on" {
+					settings.Users[m.Author.ID] = true
+				} else {
+					delete(settings.Users, m.Author.ID)
+				}
+			})
+		if err != nil {
+			reply(s, m, "Error updating your notifications. "+
+				"Please try again.")
+			return err
+		}
+		if sub_cmd == "off" {
+			reply(s, m, "OK %s, I'll stop DM'ing you about the "+
+				"queues.", mention(m.Author.ID))
+			return nil
+		}
+		reply(s, m, "OK %s, I'll DM you when you're within the top "+
+			"%d of a queue, and when you're taken from one.",
+			mention(m.Author.ID), settings.position())
+		return nil
+	case "position":
+		return h.auth2KickRequired(s, m, h.handleNotifyPositionUnsafe)
+	}
+
+	settings, err = h.notifier.load(guild_id)
+	if err != nil {
+		return err
+	}
+	if settings.Users[m.Author.ID] {
+		reply(s, m, "Queue notifications are on, within the top %d. "+
+			"Try `!queue notify off`.", settings.position())
+	} else {
+		reply(s, m, "Queue notifications are off. Try "+
+			"`!queue notify on`.")
+	}
+	return nil
+}
+
+func (h *queueHandler) handleNotifyPositionUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs(m, 3)
+	position := 0
+	if len(args) == 1 {
+		position, err = strconv.Atoi(args[0])
+	}
+	if len(args) != 1 || err != nil || position <= 0 {
+		reply(s, m, "Invalid position. Try `!queue notify position "+
+			"12`.")
+		return nil
+	}
+
+	_, err = h.notifier.update(guild_id, func(settings *notifySettings) {
+		settings.Position = position
+	})
+	if err != nil {
+		reply(s, m, "Error setting the notification position. "+
+			"Please try again.")
+		return err
+	}
+
+	reply(s, m, "Players who've opted in will be DM'd when they're "+
+		"within the top %d of a queue.", position)
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+	qh.notifier.setSession(s)
+	users := generateUsers(4)
+
+	m := test.testMessage("!queue notify position 2")
+	test.AssertNil(qh.handleNotifyPositionUnsafe(s, m))
+	m = msgFromUserBattleTag(users[2])
+	m.Content = "!queue notify on"
+	test.AssertNil(qh.handleNotify(s, m))
+	test.AssertContainsRe(s.sends, "I'll DM you when you're within the "+
+		"top 2 of a queue")
+
+	test.enqueue(users...)
+	s.clearSends()
+
+	test.AssertNil(test.queue().Remove(users[0]))
+	qh.notifier.drain()
+	test.AssertContains(s.sends, users[2].BattleTag+" is now in position "+
+		"2 of the scrimmages queue. Get ready to play!")
+
+	// Players are only told once, unless they're pushed back.
+	s.clearSends()
+	test.enqueue(users[0])
+	qh.notifier.drain()
+	test.AssertEqual(len(s.sends), 0)
+	_, err := test.queue().Move(users[3], 0)
+	test.AssertNil(err)
+	qh.notifier.drain()
+	test.AssertEqual(len(s.sends), 0)
+	_, err = test.queue().Move(users[3], 2)
+	test.AssertNil(err)
+	qh.notifier.drain()
+	test.AssertContains(s.sends, users[2].BattleTag+" is now in position "+
+		"2 of the scrimmages queue. Get ready to play!")
+
+	s.clearSends()
+	m = test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	qh.notifier.drain()
+	test.AssertContains(s.sends, users[2].BattleTag+" has been taken "+
+		"from the scrimmages queue!")
+	for _, send := range s.sends {
+		test.Assert(!strings.HasPrefix(send, users[1].BattleTag))
+	}
+
+	m = msgFromUserBattleTag(users[2])
+	m.Content = "!queue notify off"
+	test.AssertNil(qh.handleNotify(s, m))
+	m.Content = "!queue notify"
+	test.AssertNil(qh.handleNotify(s, m))
+	test.AssertContains(s.sends, "Queue notifications are off. Try "+
+		"`!queue notify on`.")
+}
+
+func TestNotifyReadyCheck(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	qh.notifier.setSession(s)
+	users := generateUsers(2)
+
+	m := msgFromUserBattleTag(users[0])
+	m.Content = "!queue notify on"
+	test.AssertNil(qh.handleNotify(s, m))
+	test.enqueue(users...)
+
+	// The ready check tells the player they've been taken, so the
+	// notification would only repeat it.
+	s.clearSends()
+	m = test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	qh.notifier.drain()
+	test.AssertContainsRe(s.sends, users[0].BattleTag+" has been taken "+
+		"from the scrimmages queue! Reply `!ready`")
+	for _, send := range s.sends {
+		test.Assert(send != users[0].BattleTag+" has been taken from "+
+			"the scrimmages queue!")
+	}
+}
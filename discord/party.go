@@ -0,0 +1,125 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/blizzard"
+	"github.com/ewollesen/zenbot/overwatch"
+	"github.com/ewollesen/zenbot/queue"
+	"github.com/spacemonkeygo/errors"
+)
+
+// A party can't be larger than a team.
+const maxPartySize = 6
+
+var (
+	PartySizeInvalid = Error.NewClass("party size invalid",
+		errors.NoCaptureStack())
+)
+
+// handleEnqueueParty enqueues several BattleTags as a single entry, which is
+// attributed to the user who enqueued it. Failures are returned as errors, so
+// that they don't count against the enqueue rate limit.
+func (h *queueHandler) handleEnqueueParty(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+	if err = h.checkOpen(s, m, q); err != nil {
+		return err
+	}
+
+	pref, args, explicit := parsePlatform(args)
+	if !explicit {
+		saved, err := h.platforms.get(q.guild_id, m.Author.ID)
+		if err == nil {
+			pref = saved
+		}
+		logger.Warne(err)
+	}
+
+	btags := []string{}
+	seen := make(map[string]bool)
+	for _, btag := range blizzard.FindBattleTags(strings.Join(args, " ")) {
+		if !seen[btag] {
+			seen[btag] = true
+			btags = append(btags, btag)
+		}
+	}
+	if len(btags) < 2 || len(btags) > maxPartySize {
+		reply(s, m, "A party must have between 2 and %d BattleTags. "+
+			"Try `!enqueue party example#1234 example#5678`.",
+			maxPartySize)
+		return PartySizeInvalid.New("%d BattleTags", len(btags))
+	}
+
+	for _, btag := range btags {
+		valid, err := h.validateBattleTag(pref, btag)
+		if err != nil {
+			reply(s, m, "Error validating BattleTag %q. "+
+				"Please try again.", btag)
+			return err
+		}
+		if !valid {
+			reply(s, m, "Invalid BattleTag %q. "+
+				"Remember, BattleTags are CaSe-SeNsItIvE!", btag)
+			return overwatch.BattleTagInvalid.New(btag)
+		}
+
+		// There's a race condition here, but not worth worrying about.
+		queued, _, err := q.Locate(btag)
+		if err != nil {
+			reply(s, m, "Error enqueueing the party. "+
+				"Please try again.")
+			return err
+		}
+		if queued != nil {
+			reply(s, m, "BattleTag %s is already enqueued in the %s "+
+				"queue as %s.", btag, q.Name(), queued.label())
+			return queue.AlreadyEnqueued.New(btag)
+		}
+	}
+
+	party := h.wrapBattleTag(s, m, btags[0])
+	party.Party = btags[1:]
+	party.setPlatform(pref)
+	pos, waitlisted, err := h.enqueue(q, party)
+	if err != nil {
+		reply(s, m, "Error enqueueing the party into the %s queue. "+
+			"Please try again.", q.Name())
+		return err
+	}
+
+	if explicit {
+		logger.Errore(h.platforms.set(q.guild_id, m.Author.ID, pref))
+	}
+	h.lookupSkillRank(party)
+	h.recordEnqueue(s, m, q, party.label(), pos, waitlisted)
+
+	if waitlisted {
+		reply(s, m, "The %s queue is full, so party %s has been added "+
+			"to its waitlist in position %d. You'll get a DM when a "+
+			"spot opens up.", q.Name(), party.label(), pos+1)
+		return nil
+	}
+	reply(s, m, "Enqueued party %s in the %s queue in position %d.%s",
+		party.label(), q.Name(), pos+1, h.etaSuffix(q, pos))
+	return nil
+}
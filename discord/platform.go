@@ -0,0 +1,208 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ewollesen/zenbot/overwatch"
+	"github.com/ewollesen/zenbot/partition"
+)
+
+const platformSetting = "platforms"
+
+var (
+	platformAliases = map[string]string{
+		"pc":   overwatch.PlatformPC,
+		"psn":  overwatch.PlatformPSN,
+		"ps4":  overwatch.PlatformPSN,
+		"xbl":  overwatch.PlatformXBL,
+		"xbox": overwatch.PlatformXBL,
+	}
+	regionAliases = map[string]string{
+		"us":     overwatch.RegionUS,
+		"na":     overwatch.RegionUS,
+		"eu":     overwatch.RegionEU,
+		"kr":     overwatch.RegionKR,
+		"cn":     overwatch.RegionCN,
+		"global": overwatch.RegionGlobal,
+	}
+)
+
+// platformPreference is the platform and region a user last enqueued with.
+// Empty values are the defaults: PC, and no particular region.
+type platformPreference struct {
+	Platform string `json:"platform,omitempty"`
+	Region   string `json:"region,omitempty"`
+}
+
+// platform returns the preferred platform, which defaults to PC.
+func (p *platformPreference) platform() string {
+	if p.Platform == "" {
+		return overwatch.PlatformPC
+	}
+	return p.Platform
+}
+
+func isPlatformOrRegion(word string) bool {
+	word = strings.ToLower(word)
+	return platformAliases[word] != "" || regionAliases[word] != ""
+}
+
+// parsePlatform consumes a leading platform and region, in either order, from
+// args. ok is false if neither was given.
+func parsePlatform(args []string) (pref *platformPreference, rest []string,
+	ok bool) {
+
+	pref = &platformPreference{}
+	for len(args) > 0 {
+		word := strings.ToLower(args[0])
+		if platform := platformAliases[word]; platform != "" &&
+			pref.Platform == "" {
+
+			pref.Platform = platform
+		} else if region := regionAliases[word]; region != "" &&
+			pref.Region == "" {
+
+			pref.Region = region
+		} else {
+			break
+		}
+		args, ok = args[1:], true
+	}
+	return pref, args, ok
+}
+
+// platformPreferences stores each guild's users' platform preferences.
+type platformPreferences struct {
+	mu       sync.Mutex
+	settings *guildSettings
+}
+
+func newPlatformPreferences(settings *guildSettings) *platformPreferences {
+	return &platformPreferences{settings: settings}
+}
+
+func (p *platformPreferences) load(guild_id string) (
+	map[string]*platformPreference, error) {
+
+	prefs := make(map[string]*platformPreference)
+	err := p.settings.load(guild_id, platformSetting, &prefs)
+	return prefs, err
+}
+
+// get returns the user's preference, which is the default if they haven't
+// got one.
+func (p *platformPreferences) get(guild_id, user_id string) (
+	*platformPreference, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prefs, err := p.load(guild_id)
+	if err != nil {
+		return nil, err
+	}
+	if pref := prefs[user_id]; pref != nil {
+		return pref, nil
+	}
+	return &platformPreference{}, nil
+}
+
+func (p *platformPreferences) set(guild_id, user_id string,
+	pref *platformPreference) error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prefs, err := p.load(guild_id)
+	if err != nil {
+		return err
+	}
+	if *pref == (platformPreference{}) {
+		delete(prefs, user_id)
+	} else {
+		prefs[user_id] = pref
+	}
+	return p.settings.save(guild_id, platformSetting, prefs)
+}
+
+// platform returns the entry's platform, which defaults to PC.
+func (ubt *userBattleTag) platform() string {
+	if ubt.Platform == "" {
+		return overwatch.PlatformPC
+	}
+	return ubt.Platform
+}
+
+// platformLabel formats the entry's platform and region for display, or
+// returns "" if neither has been set.
+func (ubt *userBattleTag) platformLabel() string {
+	switch {
+	case ubt.Region == "" && ubt.Platform == "":
+		return ""
+	case ubt.Region == "":
+		return ubt.platform()
+	}
+	return ubt.platform() + "/" + ubt.Region
+}
+
+// setPlatform sets the entry's platform and region from a preference.
+func (ubt *userBattleTag) setPlatform(pref *platformPreference) {
+	ubt.Platform, ubt.Region = pref.Platform, pref.Region
+}
+
+// mixedPlatforms returns the platforms of the players, sorted, if there's more
+// than one.
+func mixedPlatforms(players []*partition.Player) []string {
+	seen := make(map[string]bool)
+	platforms := []string{}
+	for _, player := range players {
+		platform := player.Attributes["platform"]
+		if !seen[platform] {
+			seen[platform] = true
+			platforms = append(platforms, platform)
+		}
+	}
+	if len(platforms) < 2 {
+		return nil
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// playerEntries maps each player's BattleTag to their queue entry.
+func playerEntries(ubts []*userBattleTag) map[string]*userBattleTag {
+	entries := make(map[string]*userBattleTag)
+	for _, ubt := range ubts {
+		for _, btag := range ubt.Players() {
+			entries[btag] = ubt
+		}
+	}
+	return entries
+}
+
+// skillRank looks up a player's skill rank on their entry's platform,
+// preferring its region. Players without entries are looked up on PC.
+func skillRank(ow overwatch.OverwatchAPI, btag string,
+	entries map[string]*userBattleTag) (int, error) {
+
+	if ubt := entries[btag]; ubt != nil {
+		return ow.PreferredSkillRank(ubt.platform(), ubt.Region, btag)
+	}
+	return ow.SkillRank(overwatch.PlatformPC, btag)
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	test := newDiscordTest(t)
+
+	pref, rest, ok := parsePlatform([]string{"EU", "ps4", "tank"})
+	test.Assert(ok)
+	test.AssertEqual(*pref, platformPreference{Platform: "psn", Region: "eu"})
+	test.AssertEqual(strings.Join(rest, " "), "tank")
+
+	pref, rest, ok = parsePlatform([]string{"xbl", "xbox", "a#1"})
+	test.Assert(ok)
+	test.AssertEqual(pref.Platform, "xbl")
+	test.AssertEqual(strings.Join(rest, " "), "xbox a#1")
+
+	pref, _, ok = parsePlatform([]string{"example#1234"})
+	test.Assert(!ok)
+	test.AssertEqual(pref.platform(), "pc")
+}
+
+func TestEnqueuePlatform(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+
+	m := test.testMessage("!enqueue psn eu example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	test.AssertContainsRe(s.sends, "Enqueued example#1234 .* on psn/eu "+
+		"in the scrimmages queue in position 1.")
+
+	ubt, err := test.queue().Find("example#1234")
+	test.AssertNil(err)
+	test.AssertEqual(ubt.Platform, "psn")
+	test.AssertEqual(ubt.Region, "eu")
+
+	test.AssertNil(qh.handleList(s, test.testMessage("!queue list")))
+	test.AssertContainsRe(s.sends, "example#1234 \\(psn/eu")
+
+	// The platform and region are remembered.
+	test.AssertNil(qh.handleDequeue(s, test.testMessage("!dequeue")))
+	m = test.testMessage("!enqueue example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	ubt, err = test.queue().Find("example#1234")
+	test.AssertNil(err)
+	test.AssertEqual(ubt.platformLabel(), "psn/eu")
+
+	// Naming a platform replaces the whole preference.
+	test.AssertNil(qh.handleDequeue(s, test.testMessage("!dequeue")))
+	m = test.testMessage("!enqueue pc example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	ubt, err = test.queue().Find("example#1234")
+	test.AssertNil(err)
+	test.AssertEqual(ubt.platformLabel(), "pc")
+	test.AssertEqual(ubt.Region, "")
+}
+
+func TestPartitionMixedPlatforms(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+
+	users := generateUsers(4)
+	test.AssertNil(qh.replyPartition(s, test.testMessage("!queue teams"),
+		users, nil, guildTeamOptions(qh.settings, testGuildId, 2)))
+	for _, send := range s.sends {
+		test.Assert(!strings.Contains(send, "Heads up"))
+	}
+
+	users[1].Platform = "xbl"
+	users[2].Platform = "psn"
+	users[2].Region = "eu"
+	test.AssertNil(qh.replyPartition(s, test.testMessage("!queue teams"),
+		users, nil, guildTeamOptions(qh.settings, testGuildId, 2)))
+	test.AssertContains(s.sends, "Heads up: these players are on "+
+		"different platforms (pc, psn, xbl), so they can't all join "+
+		"the same lobby.")
+}
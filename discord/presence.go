@@ -0,0 +1,325 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/spacemonkeygo/spacelog"
+)
+
+var (
+	presenceGracePeriod = flag.Duration("discord.presence_grace_period",
+		15*time.Minute, "how long a queued player may be offline or "+
+			"idle before being removed from the queues (0 disables)")
+
+	auditLogger = spacelog.GetLoggerNamed("audit")
+)
+
+const presenceExemptionsSetting = "presence_exemptions"
+
+// presenceExemptions exempts a whole guild, or members with certain roles,
+// from being removed from the queues when they go offline or idle.
+type presenceExemptions struct {
+	Guild bool     `json:"guild"`
+	Roles []string `json:"roles"`
+}
+
+func (e *presenceExemptions) exempts(roles []string) bool {
+	if e.Guild {
+		return true
+	}
+	for _, role := range roles {
+		for _, exempt := range e.Roles {
+			if role == exempt {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// presenceTracker removes queued players from all of a guild's queues once
+// they've been offline or idle for longer than the grace period.
+type presenceTracker struct {
+	mu        sync.Mutex
+	timers    map[string]*time.Timer
+	grace     time.Duration
+	queues    *BattleTagQueues
+	settings  *guildSettings
+	audit_log auditlog.Log
+}
+
+func newPresenceTracker(queues *BattleTagQueues, settings *guildSettings,
+	audit_log auditlog.Log, grace time.Duration) *presenceTracker {
+
+	return &presenceTracker{
+		timers:    make(map[string]*time.Timer),
+		grace:     grace,
+		queues:    queues,
+		settings:  settings,
+		audit_log: audit_log,
+	}
+}
+
+func (t *presenceTracker) update(s Session, p *discordgo.PresenceUpdate) {
+	if t.grace <= 0 || p.User == nil || p.GuildID == "" {
+		return
+	}
+	user_id := p.User.ID
+
+	switch p.Status {
+	case "offline", "idle":
+		exempt, err := t.exempt(s, p.GuildID, user_id, p.Roles)
+		if err != nil {
+			logger.Errore(err)
+			return
+		}
+		if exempt {
+			t.cancel(p.GuildID, user_id)
+			return
+		}
+		t.schedule(s, p.GuildID, user_id)
+	default:
+		t.cancel(p.GuildID, user_id)
+	}
+}
+
+func (t *presenceTracker) schedule(s Session, guild_id, user_id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := guild_id + "-" + user_id
+	if _, ok := t.timers[key]; ok {
+		// The grace period started when they first went away.
+		return
+	}
+
+	entries, err := t.queuedEntries(guild_id, user_id)
+	if err != nil {
+		logger.Errore(err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	t.timers[key] = time.AfterFunc(t.grace, func() {
+		t.expire(s, guild_id, user_id)
+	})
+}
+
+func (t *presenceTracker) cancel(guild_id, user_id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := guild_id + "-" + user_id
+	if timer, ok := t.timers[key]; ok {
+		timer.Stop()
+		delete(t.timers, key)
+	}
+}
+
+// expire removes the user's BattleTags from each of the guild's queues, and
+// lets them know why.
+func (t *presenceTracker) expire(s Session, guild_id, user_id string) {
+	t.mu.Lock()
+	delete(t.timers, guild_id+"-"+user_id)
+	t.mu.Unlock()
+
+	exempt, err := t.exempt(s, guild_id, user_id, nil)
+	if err != nil {
+		logger.Errore(err)
+		return
+	}
+	if exempt {
+		return
+	}
+
+	entries, err := t.queuedEntries(guild_id, user_id)
+	if err != nil {
+		logger.Errore(err)
+		return
+	}
+
+	removed := []string{}
+	for _, entry := range entries {
+		if err := entry.q.Remove(entry.ubt); err != nil {
+			logger.Warne(err)
+			continue
+		}
+		auditLogger.Noticef("removed %s (user %s) from guild %s's %s "+
+			"queue after %s offline or idle", entry.ubt.label(),
+			user_id, guild_id, entry.q.Name(), t.grace)
+		detail := "offline or idle"
+		if entry.waitlisted {
+			detail = "waitlist, offline or idle"
+		}
+		recordBotEvent(t.audit_log, guild_id, &auditlog.Event{
+			Queue:     entry.q.Name(),
+			Action:    "remove",
+			BattleTag: entry.ubt.label(),
+			Detail:    detail,
+		})
+		promoteWaitlisted(s, t.queues, t.audit_log, entry.q)
+		removed = append(removed, fmt.Sprintf("%s from the %s queue",
+			entry.ubt.label(), entry.q.Name()))
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	dm_channel, err := s.UserChannelCreate(user_id)
+	if err != nil {
+		logger.Errore(err)
+		return
+	}
+	logger.Warne(s.ChannelMessageSend(dm_channel.ID, fmt.Sprintf(
+		"You've been offline or idle for more than %s, so I've "+
+			"removed %s. Feel free to `!enqueue` again when you're "+
+			"back!", t.grace, strings.Join(removed, ", "))))
+}
+
+// exempt reports whether the guild, or one of the member's roles, is exempt.
+// If roles is nil, the member's roles are looked up.
+func (t *presenceTracker) exempt(s Session, guild_id, user_id string,
+	roles []string) (bool, error) {
+
+	exemptions := &presenceExemptions{}
+	err := t.settings.load(guild_id, presenceExemptionsSetting, exemptions)
+	if err != nil {
+		return false, err
+	}
+	if exemptions.Guild {
+		return true, nil
+	}
+	if len(exemptions.Roles) == 0 {
+		return false, nil
+	}
+
+	if roles == nil {
+		member, err := s.Member(guild_id, user_id)
+		if err != nil {
+			logger.Warne(err)
+			return false, nil
+		}
+		roles = member.Roles
+	}
+
+	return exemptions.exempts(roles), nil
+}
+
+type queuedEntry struct {
+	q          *BattleTagQueue
+	ubt        *userBattleTag
+	waitlisted bool
+}
+
+func (t *presenceTracker) queuedEntries(guild_id, user_id string) (
+	entries []queuedEntry, err error) {
+
+	names, err := t.queues.Names(guild_id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		btq := t.queues.Get(guild_id, name)
+		for _, q := range []*BattleTagQueue{btq, btq.waitlist} {
+			err = q.Iter(func(index int, ubt *userBattleTag) bool {
+				if ubt.UserId == user_id {
+					entries = append(entries, queuedEntry{
+						q:          q,
+						ubt:        ubt,
+						waitlisted: q != btq,
+					})
+				}
+				return false
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// handleExemptUnsafe handles `!queue exempt` and `!queue unexempt`, which
+// exempt the whole server, or a role, from removal when offline or idle.
+func (h *queueHandler) handleExemptUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	words := commandArgs(m, 1)
+	exempt := strings.ToLower(words[0]) == "exempt"
+	args := words[1:]
+	if len(args) == 0 || (args[0] != "server" &&
+		!(args[0] == "role" && len(args) == 2)) {
+
+		reply(s, m, "Try `!queue %s server` or `!queue %s role @role`.",
+			words[0], words[0])
+		return nil
+	}
+
+	exemptions := &presenceExemptions{}
+	err = h.settings.load(guild_id, presenceExemptionsSetting, exemptions)
+	if err != nil {
+		return err
+	}
+
+	what := "This server"
+	if args[0] == "server" {
+		exemptions.Guild = exempt
+	} else {
+		role_id := strings.Trim(args[1], "<@&>")
+		what = fmt.Sprintf("The role %s", args[1])
+		roles := []string{}
+		for _, role := range exemptions.Roles {
+			if role != role_id {
+				roles = append(roles, role)
+			}
+		}
+		if exempt {
+			roles = append(roles, role_id)
+		}
+		exemptions.Roles = roles
+	}
+
+	err = h.settings.save(guild_id, presenceExemptionsSetting, exemptions)
+	if err != nil {
+		reply(s, m, "Error saving exemptions. Please try again.")
+		return err
+	}
+
+	if exempt {
+		reply(s, m, "%s is now exempt from removal from the queues "+
+			"when offline or idle.", what)
+	} else {
+		reply(s, m, "%s is no longer exempt from removal from the "+
+			"queues when offline or idle.", what)
+	}
+	return nil
+}
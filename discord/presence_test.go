@@ -0,0 +1,112 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+)
+
+func TestPresenceTrackerRemovesAwayPlayers(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	tracker := newPresenceTracker(qh.queues, qh.settings, qh.audit_log,
+		time.Hour)
+	users := generateUsers(2)
+	test.enqueue(users...)
+
+	tracker.update(s, testPresence(users[0].UserId, "idle"))
+	tracker.update(s, testPresence(users[1].UserId, "offline"))
+	test.AssertEqual(len(tracker.timers), 2)
+
+	// Coming back online resets the grace period.
+	tracker.update(s, testPresence(users[1].UserId, "online"))
+	test.AssertEqual(len(tracker.timers), 1)
+
+	tracker.expire(s, testGuildId, users[0].UserId)
+	test.AssertEqual(len(tracker.timers), 0)
+	test.AssertContainsRe(s.sends, "You've been offline or idle for more "+
+		"than 1h0m0s, so I've removed "+users[0].BattleTag+" from the "+
+		"scrimmages queue.")
+	pos, err := test.queue().Position(users[0])
+	test.AssertNil(err)
+	test.AssertEqual(pos, -1)
+	events, err := qh.audit_log.Recent(testGuildId, 1, nil)
+	test.AssertNil(err)
+	test.AssertEqual(events[0].Action, "remove")
+	test.AssertEqual(events[0].BattleTag, users[0].BattleTag)
+	test.AssertEqual(events[0].Actor, botActor)
+	pos, err = test.queue().Position(users[1])
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+}
+
+func TestPresenceTrackerIgnoresUnqueuedPlayers(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	tracker := newPresenceTracker(qh.queues, qh.settings, qh.audit_log,
+		time.Hour)
+
+	tracker.update(s, testPresence(testUserId, "offline"))
+	test.AssertEqual(len(tracker.timers), 0)
+}
+
+func TestPresenceTrackerExemptions(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	s.grantPermission(discordgo.PermissionKickMembers)
+	tracker := newPresenceTracker(qh.queues, qh.settings, qh.audit_log,
+		time.Hour)
+	users := generateUsers(1)
+	test.enqueue(users...)
+
+	m := test.testMessage("!queue exempt role <@&coaches>")
+	test.AssertNil(qh.Handle(s, m, "queue", "exempt"))
+	test.AssertContains(s.sends, "The role <@&coaches> is now exempt "+
+		"from removal from the queues when offline or idle.")
+
+	p := testPresence(users[0].UserId, "offline")
+	p.Roles = []string{"coaches"}
+	tracker.update(s, p)
+	test.AssertEqual(len(tracker.timers), 0)
+
+	m = test.testMessage("!queue unexempt role <@&coaches>")
+	test.AssertNil(qh.Handle(s, m, "queue", "unexempt"))
+	tracker.update(s, p)
+	test.AssertEqual(len(tracker.timers), 1)
+
+	m = test.testMessage("!queue exempt server")
+	test.AssertNil(qh.Handle(s, m, "queue", "exempt"))
+	test.AssertContains(s.sends, "This server is now exempt from "+
+		"removal from the queues when offline or idle.")
+
+	// Exemptions are checked again once the grace period expires.
+	tracker.expire(s, testGuildId, users[0].UserId)
+	pos, err := test.queue().Position(users[0])
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+}
+
+func testPresence(user_id, status string) *discordgo.PresenceUpdate {
+	return &discordgo.PresenceUpdate{
+		Presence: discordgo.Presence{
+			User:   &discordgo.User{ID: user_id},
+			Status: status,
+		},
+		GuildID: testGuildId,
+	}
+}
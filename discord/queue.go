@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
 	"github.com/ewollesen/zenbot/blizzard"
 	"github.com/ewollesen/zenbot/overwatch"
 	"github.com/ewollesen/zenbot/queue"
@@ -33,39 +34,93 @@ import (
 var (
 	enqueueRateLimit = flag.Duration("discord.enqueue_rate_limit",
 		5*time.Minute, "minimum duration between enqueue attempts")
+	queueMaxAge = flag.Duration("discord.queue_max_age", 0,
+		"duration after which queued BattleTags expire (0 disables)")
 	helpMsg = strings.Join([]string{
-		"Manipulates the scrimmages queue.",
-		"`!dequeue` - removes your BattleTag from the scrimmages queue",
-		"`!enqueue example#1234` - adds your BattleTag to the scrimmages queue",
-		"`!queue add example#1234` - adds a BattleTag to the scrimmages queue (admin-only)",
-		"`!queue clear` - clears the scrimmages queue (admin-only)",
-		"`!queue kick example#1234` - removes a BattleTag from the scrimmages queue (admin-only)",
-		"`!queue list` - lists the BattleTags in the scrimmages queue.",
-		"`!queue teams` - splits the BattleTags into two teams by Skill Rank.",
-		"`!queue take <n>` - takes the first <n> BattleTags from the scrimmages queue (default: 12, admin-only)",
+		"Manipulates the scrimmages queue, or any other named queue.",
+		"Commands accept an optional queue [name], otherwise the channel's default queue is used.",
+		"`!dequeue [name]` - removes your BattleTag from the queue",
+		"`!enqueue [name] [platform] [region] [roles] example#1234` - adds your BattleTag to the queue, optionally with your platform (pc, psn or xbl) and region (us, eu, kr, cn or global), which are remembered for next time, and your preferred roles, eg `tank,support`",
+		"`!enqueue party [name] [platform] [region] example#1234 example#5678` - adds a party of up to 6 BattleTags to the queue, to be taken and put on a team together",
+		"`!queue add [name] [platform] [region] example#1234` - adds a BattleTag to the queue (admin-only)",
+		"`!queue capacity [name] <n>` - limits the queue to <n> BattleTags, after which players are added to a waitlist, and promoted as spots open up (0 for no limit, admin-only)",
+		"`!queue clear [name]` - clears the queue and its waitlist (admin-only)",
+		"`!queue kick [name] example#1234` - removes a BattleTag from the queue (admin-only)",
+		"`!queue list [name]` - lists the BattleTags in the queue, how long they've waited, and how long until they're likely to be taken.",
+		"`!queue eta [name]` - estimates how long until you're taken from the queue, based on its recent takes",
+		"`!queue history [name] [n] [example#1234]` - lists the queues' most recent changes, optionally only those to one queue or BattleTag (admin-only)",
+		"`!queue export [name] [json|csv]` - uploads the queue's BattleTags, user ids, server id and enqueue times as a file (default: json, admin-only)",
+		"`!queue import [name] [json|csv]` - replaces the queue's contents with an attached export, or one pasted on the lines after the command (admin-only)",
+		"`!queue insert [name] [platform] [region] example#1234 <position>` - adds a BattleTag to the queue at <position> (admin-only)",
+		"`!queue move [name] example#1234 <position>` - moves a queued BattleTag to <position> (admin-only)",
+		"`!queue swap [name] example#1234 example#5678` - swaps the positions of two queued BattleTags (admin-only)",
+		"`!queue teams [name] [teams=<k>] [--strategy=<strategy>] [together(a#1234,b#5678)] [apart(c#1234,d#5678)]` - splits the BattleTags into two teams by Skill Rank, or <k> teams, using the server's default strategy unless another is given, keeping the BattleTags in each `together(...)` on the same team, and those in each `apart(...)` on different teams",
+		"`!queue strategy [strategy]` - describes the server's default team balancing strategy, or sets it to exact, variance, snake, random or stars (admin-only to set)",
+		"`!queue take [name] <n> [teams=<k>]` - takes the first <n> BattleTags from the queue, once they've confirmed they're ready, and splits them into two teams, or <k> teams of equal size (default: 12, admin-only). When <n> is a multiple of 6, two of each role are taken per team of six",
+		"`!queue undo [name]` - restores the queue, its waitlist and enqueue rate limits to how they were before the last add, clear, import, insert, kick, move, swap or take, if it was made within the last few minutes. If the queue has changed since, only what a clear, kick or take removed is put back (admin-only)",
+		"`!queue notify [on|off]` - DMs you when you're near the front of a queue, and when you're taken from one",
+		"`!queue notify position <n>` - sets how near the front of a queue players are DM'd (default: 12, admin-only)",
+		"`!ready` - confirms you're ready to play, after being taken from the queue",
+		"`!queue queues` - lists this server's queues",
+		"`!queue create <name>` - creates a new queue (admin-only)",
+		"`!queue rename <name> <new name>` - renames a queue (admin-only)",
+		"`!queue delete <name>` - deletes a queue and its contents (admin-only)",
+		"`!queue default <name>` - sets this channel's default queue (admin-only)",
+		"`!queue open [name]` or `!queue close [name]` - opens or closes the queue to `!enqueue`, until its next scheduled window starts or ends (admin-only)",
+		"`!queue schedule [name] add mon 19:00-22:00` - opens the queue each week during the window, and announces it here (admin-only, see also `!queue schedule [name] clear` and `!queue schedule [name] timezone America/Denver`)",
+		"`!queue fair [on|off|reset]` - takes players who've played fewer games this session first, or resets the session's game counts (admin-only)",
+		"`!queue exempt server` or `!queue exempt role @role` - exempts players from removal from the queues when offline or idle (admin-only, see also `!queue unexempt`)",
 		"`!queue help` - displays this help message",
 	}, "\n")
 	PermissionDenied = Error.NewClass("permission denied")
 )
 
 type queueHandler struct {
-	q          *BattleTagQueue
+	queues     *BattleTagQueues
+	settings   *guildSettings
+	games      *sessionGames
+	schedules  *queueSchedules
+	notifier   *queueNotifier
+	takes      *takeHistory
+	undos      *queueSnapshots
+	platforms  *platformPreferences
+	audit_log  auditlog.Log
 	btags      *BattleTagCache
 	enqueue_rl ratelimiter.RateLimiter
 	overwatch  overwatch.OverwatchAPI
+
+	ready_checks        *readyChecks
+	ready_check_timeout time.Duration
 }
 
 var _ DiscordHandler = (*queueHandler)(nil)
 
-func newQueueHandler(q *BattleTagQueue, b *BattleTagCache,
-	o overwatch.OverwatchAPI) *queueHandler {
+func newQueueHandler(q *BattleTagQueues, g *guildSettings, b *BattleTagCache,
+	o overwatch.OverwatchAPI, a auditlog.Log) *queueHandler {
 
-	return &queueHandler{
+	h := &queueHandler{
 		btags:      b,
-		q:          q,
+		queues:     q,
+		settings:   g,
+		games:      newSessionGames(g),
+		schedules:  newQueueSchedules(q, g),
+		takes:      newTakeHistory(g),
+		undos:      newQueueSnapshots(*undoWindow),
+		platforms:  newPlatformPreferences(g),
+		audit_log:  a,
 		enqueue_rl: concretelimiter.New(*enqueueRateLimit),
 		overwatch:  o,
+
+		ready_check_timeout: *readyCheckTimeout,
 	}
+	h.ready_checks = newReadyChecks(a, h.enqueue)
+	h.notifier = newQueueNotifier(g, func() bool {
+		return h.ready_check_timeout > 0
+	})
+	q.SetGames(h.games.counts)
+	q.AddHook(h.notifier.changed)
+
+	return h
 }
 
 func (h *queueHandler) Handle(s Session, m *discordgo.MessageCreate,
@@ -76,7 +131,14 @@ func (h *queueHandler) Handle(s Session, m *discordgo.MessageCreate,
 	case "dequeue":
 		err = h.handleDequeue(s, m)
 	case "enqueue":
-		err = h.enqueueRateLimited(s, m, h.handleEnqueueUnlimited)
+		if len(argv) > 1 && strings.ToLower(argv[1]) == "party" {
+			err = h.enqueueRateLimited(s, m, 2,
+				h.handleEnqueueParty)
+			break
+		}
+		err = h.enqueueRateLimited(s, m, 1, h.handleEnqueueUnlimited)
+	case "ready":
+		err = h.handleReady(s, m)
 	case "queue":
 		sub_cmd := "help"
 		if len(argv) > 1 {
@@ -84,18 +146,67 @@ func (h *queueHandler) Handle(s Session, m *discordgo.MessageCreate,
 		}
 		switch sub_cmd {
 		case "add":
-			err = h.auth2KickRequired(s, m, h.handleAddUnsafe)
+			err = h.auth2KickRequired(s, m,
+				h.undoable("add", h.handleAddUnsafe))
+		case "capacity":
+			err = h.auth2KickRequired(s, m, h.handleCapacityUnsafe)
 		case "clear":
+			err = h.auth2KickRequired(s, m, h.undoable("clear",
+				h.clearEnqueueRateLimits(h.handleClearUnsafe)))
+		case "close":
+			err = h.auth2KickRequired(s, m, h.handleCloseUnsafe)
+		case "create":
+			err = h.auth2KickRequired(s, m, h.handleCreateUnsafe)
+		case "default":
+			err = h.auth2KickRequired(s, m, h.handleDefaultUnsafe)
+		case "delete":
+			err = h.auth2KickRequired(s, m, h.handleDeleteUnsafe)
+		case "eta":
+			err = h.handleETA(s, m)
+		case "exempt", "unexempt":
+			err = h.auth2KickRequired(s, m, h.handleExemptUnsafe)
+		case "export":
+			err = h.auth2KickRequired(s, m, h.handleExportUnsafe)
+		case "fair":
+			err = h.auth2KickRequired(s, m, h.handleFairUnsafe)
+		case "history":
+			err = h.auth2KickRequired(s, m, h.handleHistoryUnsafe)
+		case "import":
+			err = h.auth2KickRequired(s, m,
+				h.undoable("import", h.handleImportUnsafe))
+		case "insert":
 			err = h.auth2KickRequired(s, m,
-				h.clearEnqueueRateLimits(h.handleClearUnsafe))
+				h.undoable("insert", h.handleInsertUnsafe))
 		case "kick", "remove":
-			err = h.auth2KickRequired(s, m, h.handleKickUnsafe)
+			err = h.auth2KickRequired(s, m,
+				h.undoable("kick", h.handleKickUnsafe))
 		case "list":
 			err = h.handleList(s, m)
+		case "move":
+			err = h.auth2KickRequired(s, m,
+				h.undoable("move", h.handleMoveUnsafe))
+		case "notify":
+			err = h.handleNotify(s, m)
+		case "open":
+			err = h.auth2KickRequired(s, m, h.handleOpenUnsafe)
 		case "partition", "teams":
 			err = h.handleQueuePartition(s, m)
+		case "strategy":
+			err = h.handleStrategy(s, m)
+		case "queues":
+			err = h.handleQueues(s, m)
+		case "rename":
+			err = h.auth2KickRequired(s, m, h.handleRenameUnsafe)
+		case "schedule":
+			err = h.auth2KickRequired(s, m, h.handleScheduleUnsafe)
+		case "swap":
+			err = h.auth2KickRequired(s, m,
+				h.undoable("swap", h.handleSwapUnsafe))
 		case "take", "pick":
-			err = h.auth2KickRequired(s, m, h.handleTakeUnsafe)
+			err = h.auth2KickRequired(s, m,
+				h.undoable("take", h.handleTakeUnsafe))
+		case "undo":
+			err = h.auth2KickRequired(s, m, h.handleUndoUnsafe)
 		default:
 			reply(s, m, helpMsg)
 		}
@@ -110,18 +221,36 @@ func (h *queueHandler) Help(argv ...string) string {
 		return fmt.Sprintf("`!%s` - %s. See `!queue help` for more info",
 			term, msg)
 	}
-	return wrap("manipulates the scrimmages queue")
+	switch term {
+	case "ready":
+		return wrap("confirms you're ready to play, after being " +
+			"taken from a queue. Give a queue name to confirm " +
+			"for that queue, if you've been taken from more " +
+			"than one")
+	default:
+		return wrap("manipulates the scrimmages queue, or other " +
+			"named queues")
+	}
 }
 
 func (h *queueHandler) handleClearUnsafe(s Session,
 	m *discordgo.MessageCreate) (err error) {
 
-	err = h.q.Clear()
+	q, _, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	err = q.Clear()
 	if err != nil {
 		return err
 	}
+	h.record(s, m, q.guild_id, &auditlog.Event{
+		Queue:  q.Name(),
+		Action: "clear",
+	})
 
-	reply(s, m, "Scrimmages queue cleared.")
+	reply(s, m, "%s queue cleared.", strings.Title(q.Name()))
 	return nil
 }
 
@@ -189,11 +318,16 @@ func (h *queueHandler) lookupNickOrUsername(s Session,
 	return nick
 }
 
-func (h *queueHandler) lookupSkillRank(btag string) {
-	go func(btag string) {
-		_, err := h.overwatch.SkillRank(overwatch.PlatformPC, btag)
-		logger.Warne(err)
-	}(btag)
+// lookupSkillRank looks up the skill ranks of the entry's players in the
+// background, so that they're cached by the time teams are made.
+func (h *queueHandler) lookupSkillRank(ubt *userBattleTag) {
+	go func(ubt *userBattleTag) {
+		for _, btag := range ubt.Players() {
+			_, err := h.overwatch.PreferredSkillRank(ubt.platform(),
+				ubt.Region, btag)
+			logger.Warne(err)
+		}
+	}(ubt)
 }
 
 func (h *queueHandler) handleDequeue(s Session,
@@ -203,6 +337,11 @@ func (h *queueHandler) handleDequeue(s Session,
 	// themselves. Admins can use the `!queue kick` command to remove people
 	// other than themselves.
 
+	q, _, err := h.guildQueue(s, m, commandArgs(m, 1))
+	if err != nil {
+		return err
+	}
+
 	nick := h.lookupNickOrUsername(s, m)
 	btag, err := h.discoverBattleTag(s, m)
 	if err != nil {
@@ -210,27 +349,57 @@ func (h *queueHandler) handleDequeue(s Session,
 		return err
 	}
 
-	err = h.q.Remove(h.wrapBattleTag(s, m, string(btag)))
+	// The BattleTag may be part of a party that the user enqueued, or on
+	// the waitlist.
+	ubt, holder, err := q.Locate(string(btag))
+	if err != nil {
+		reply(s, m, "Error dequeueing %s from the %s queue. "+
+			"Please try again.", btag, q.Name())
+		return err
+	}
+	if ubt == nil || ubt.UserId != m.Author.ID {
+		reply(s, m, "BattleTag %s was not found in the "+
+			"%s queue.", btag, q.Name())
+		return queue.NotFound.New(string(btag))
+	}
+
+	pos, err := holder.Position(ubt)
+	if err == nil {
+		err = holder.Remove(ubt)
+	}
 	if err != nil {
 		if queue.NotFound.Contains(err) {
 			reply(s, m, "BattleTag %s was not found in the "+
-				"scrimmages queue.", btag)
+				"%s queue.", btag, q.Name())
 			return err
 		}
-		reply(s, m, "Error dequeueing %s from the scrimmages queue. "+
-			"Please try again.", btag)
+		reply(s, m, "Error dequeueing %s from the %s queue. "+
+			"Please try again.", btag, q.Name())
 		return err
 	}
+	h.recordRemoval(s, m, q, holder, "dequeue", ubt, pos)
 
-	reply(s, m, "Dequeued %s (%s) from the scrimmages queue.", btag, nick)
+	if holder != q {
+		reply(s, m, "Dequeued %s (%s) from the %s queue's waitlist.",
+			ubt.label(), nick, q.Name())
+		return nil
+	}
+	reply(s, m, "Dequeued %s (%s) from the %s queue.", ubt.label(), nick,
+		q.Name())
+	h.replyPromoted(s, m, q, h.promote(s, q))
 	return nil
 }
 
-func (h *queueHandler) validateBattleTag(battle_tag string) (
-	valid bool, err error) {
+// validateBattleTag checks that the BattleTag exists on the platform, in any
+// region, starting with the preferred one.
+func (h *queueHandler) validateBattleTag(pref *platformPreference,
+	battle_tag string) (valid bool, err error) {
 
-	for _, region := range overwatch.Regions {
-		valid, err = h.overwatch.IsValidBattleTag("pc", region, battle_tag)
+	for _, region := range overwatch.PreferRegion(overwatch.Regions,
+		pref.Region) {
+
+		valid, err = h.overwatch.IsValidBattleTag(pref.platform(), region,
+			battle_tag)
 		if err != nil {
 			logger.Errore(err)
 			continue
@@ -248,12 +417,35 @@ func (h *queueHandler) validateBattleTag(battle_tag string) (
 func (h *queueHandler) handleEnqueueUnlimited(s Session,
 	m *discordgo.MessageCreate) (err error) {
 
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 1))
+	if err != nil {
+		return err
+	}
+	if err = h.checkOpen(s, m, q); err != nil {
+		return err
+	}
+
 	btag := ""
-	args := strings.Split(m.Content, " ")
 	nick := h.lookupNickOrUsername(s, m)
 
-	if len(args) > 1 {
-		text := strings.Join(args[1:], " ")
+	pref, args, explicit := parsePlatform(args)
+	if !explicit {
+		saved, err := h.platforms.get(q.guild_id, m.Author.ID)
+		if err == nil {
+			pref = saved
+		}
+		logger.Warne(err)
+	}
+
+	var preferred []string
+	if len(args) > 0 {
+		if parsed, ok := parseRoles(args[0]); ok {
+			preferred, args = parsed, args[1:]
+		}
+	}
+
+	if len(args) > 0 {
+		text := strings.Join(args, " ")
 		if btag = blizzard.FirstBattleTag(text); btag == "" {
 			reply(s, m, "Invalid BattleTag %q. "+
 				"Try `!enqueue example#1234`.", text)
@@ -272,7 +464,7 @@ func (h *queueHandler) handleEnqueueUnlimited(s Session,
 		}
 	}
 
-	valid, err := h.validateBattleTag(btag)
+	valid, err := h.validateBattleTag(pref, btag)
 	if err != nil {
 		reply(s, m, "Error validating BattleTag %q. "+
 			"Please try again.", btag)
@@ -294,17 +486,17 @@ func (h *queueHandler) handleEnqueueUnlimited(s Session,
 	if btag_in_cache != btag {
 		// Its possible that the user is already enqueued with a
 		// different BattleTag, so let's check...
-		pos, err := h.q.Position(h.wrapBattleTag(s, m, btag_in_cache))
+		pos, err := h.userPosition(q, m, btag_in_cache)
 		if err != nil {
 			reply(s, m, "Error enqueueing BattleTag %q. "+
-				"Please try again.")
+				"Please try again.", btag)
 			return err
 		}
 		if pos != -1 {
-			reply(s, m, "%s is already enqueued in the scrimmages "+
+			reply(s, m, "%s is already enqueued in the %s "+
 				"queue with BattleTag %s. Please `!dequeue` "+
 				"before re-enqueueing with a different "+
-				"BattleTag.", nick, btag_in_cache)
+				"BattleTag.", nick, q.Name(), btag_in_cache)
 			msg := fmt.Sprintf("%+v in position %d",
 				btag_in_cache, pos+1)
 			return queue.AlreadyEnqueued.NewWith(msg,
@@ -312,38 +504,97 @@ func (h *queueHandler) handleEnqueueUnlimited(s Session,
 		}
 	} // There's a race condition here, but not worth worrying about.
 
-	pos, err := h.q.Enqueue(h.wrapBattleTag(s, m, btag))
+	// Entries with different roles are distinct, so check for the
+	// BattleTag itself.
+	pos, err := h.userPosition(q.waitlist, m, btag)
+	if err == nil && pos != -1 {
+		reply(s, m, "BattleTag %s (%s) is already on the %s queue's "+
+			"waitlist in position %d.", btag, nick, q.Name(), pos+1)
+		return queue.AlreadyEnqueued.NewWith(btag, queue.SetPosition(pos))
+	}
+	if err == nil {
+		pos, err = h.userPosition(q, m, btag)
+	}
+	if err == nil && pos != -1 {
+		err = queue.AlreadyEnqueued.NewWith(btag, queue.SetPosition(pos))
+	}
+	ubt := h.wrapBattleTag(s, m, btag)
+	ubt.Roles = preferred
+	ubt.setPlatform(pref)
+	waitlisted := false
+	if err == nil {
+		pos, waitlisted, err = h.enqueue(q, ubt)
+	}
 	if err != nil {
 		if queue.AlreadyEnqueued.Contains(err) {
 			reply(s, m, "BattleTag %s (%s) is already enqueued "+
-				"in the scrimmages queue in position %d.",
-				btag, nick, queue.GetPosition(err)+1)
+				"in the %s queue in position %d.",
+				btag, nick, q.Name(), queue.GetPosition(err)+1)
 			return err
 		}
-		reply(s, m, "Error enqueueing %s (%s) into the scrimmages "+
-			"queue. Please try again.", btag, nick)
+		reply(s, m, "Error enqueueing %s (%s) into the %s "+
+			"queue. Please try again.", btag, nick, q.Name())
 		return err
 	}
 
 	logger.Errore(h.cacheBattleTag(s, m, btag))
-	h.lookupSkillRank(btag)
+	if explicit {
+		logger.Errore(h.platforms.set(q.guild_id, m.Author.ID, pref))
+	}
+	h.lookupSkillRank(ubt)
+	h.recordEnqueue(s, m, q, btag, pos, waitlisted)
 
-	reply(s, m, "Enqueued %s (%s) in the scrimmages queue in position %d.",
-		btag, nick, pos+1)
+	where := ""
+	if label := ubt.platformLabel(); label != "" {
+		where = " on " + label
+	}
+	if waitlisted {
+		reply(s, m, "The %s queue is full, so %s (%s)%s has been added "+
+			"to its waitlist in position %d. You'll get a DM when a "+
+			"spot opens up.", q.Name(), btag, nick, where, pos+1)
+		return nil
+	}
+	if len(preferred) > 0 {
+		reply(s, m, "Enqueued %s (%s)%s as %s in the %s queue in "+
+			"position %d.%s", btag, nick, where,
+			strings.Join(preferred, "/"), q.Name(), pos+1,
+			h.etaSuffix(q, pos))
+		return nil
+	}
+	reply(s, m, "Enqueued %s (%s)%s in the %s queue in position %d.%s",
+		btag, nick, where, q.Name(), pos+1, h.etaSuffix(q, pos))
 	return nil
 }
 
+// userPosition returns the position of the user's queue entry for the given
+// BattleTag, whatever its roles, or -1.
+func (h *queueHandler) userPosition(q *BattleTagQueue,
+	m *discordgo.MessageCreate, btag string) (int, error) {
+
+	ubt, err := q.Find(btag)
+	if err != nil || ubt == nil || ubt.UserId != m.Author.ID {
+		return -1, err
+	}
+
+	return q.Position(ubt)
+}
+
 func (h *queueHandler) handleAddUnsafe(s Session,
 	m *discordgo.MessageCreate) (err error) {
 
-	args := strings.Split(m.Content, " ")
-	if len(args) < 3 {
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	pref, args, _ := parsePlatform(args)
+	if len(args) == 0 {
 		reply(s, m, "No BattleTag specified. "+
 			"Try `!queue add example#1234`.")
 		return nil
 	}
 
-	btags := blizzard.FindBattleTags(m.Content)
+	btags := blizzard.FindBattleTags(strings.Join(args, " "))
 	if len(btags) == 0 {
 		reply(s, m, "No valid BattleTags specified."+
 			"Try `!queue add example#1234`.")
@@ -352,7 +603,7 @@ func (h *queueHandler) handleAddUnsafe(s Session,
 
 	added_btags := []string{}
 	for _, btag := range btags {
-		valid, err := h.validateBattleTag(btag)
+		valid, err := h.validateBattleTag(pref, btag)
 		if err != nil {
 			reply(s, m, "Error validating BattleTag %q.", btag)
 			continue
@@ -364,27 +615,36 @@ func (h *queueHandler) handleAddUnsafe(s Session,
 			continue
 		}
 
-		_, err = h.q.Enqueue(h.wrapBattleTag(s, m, btag))
+		ubt := h.wrapBattleTag(s, m, btag)
+		ubt.setPlatform(pref)
+		pos, err := q.Enqueue(ubt)
 		if err != nil {
 			if queue.AlreadyEnqueued.Contains(err) {
 				reply(s, m, "BattleTag %q is already enqueued "+
-					"in the scrimmages queue in position "+
-					"%d.", btag, queue.GetPosition(err)+1)
+					"in the %s queue in position %d.",
+					btag, q.Name(), queue.GetPosition(err)+1)
 				continue
 			}
-			reply(s, m, "Error adding %q to the scrimmages queue.", btag)
+			reply(s, m, "Error adding %q to the %s queue.",
+				btag, q.Name())
 			logger.Errore(err)
 			continue
 		}
 
 		added_btags = append(added_btags, btag)
+		h.record(s, m, q.guild_id, &auditlog.Event{
+			Queue:     q.Name(),
+			Action:    "add",
+			BattleTag: btag,
+			Position:  pos + 1,
+		})
 		// DO NOT cache BattleTags added in this way.
-		h.lookupSkillRank(btag)
+		h.lookupSkillRank(ubt)
 	}
 
 	if len(added_btags) > 0 {
-		reply(s, m, "Added %s to the scrimmages queue.",
-			util.ToList(added_btags))
+		reply(s, m, "Added %s to the %s queue.",
+			util.ToList(added_btags), q.Name())
 	}
 
 	return nil
@@ -393,14 +653,18 @@ func (h *queueHandler) handleAddUnsafe(s Session,
 func (h *queueHandler) handleKickUnsafe(s Session,
 	m *discordgo.MessageCreate) (err error) {
 
-	args := strings.Split(m.Content, " ")
-	if len(args) < 3 {
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
 		reply(s, m, "No BattleTag specified. "+
 			"Try `!queue kick example#1234`.")
 		return nil
 	}
 
-	btags := blizzard.FindBattleTags(m.Content)
+	btags := blizzard.FindBattleTags(strings.Join(args, " "))
 	if len(btags) == 0 {
 		reply(s, m, "No valid BattleTags specified."+
 			"Try `!queue kick example#1234`.")
@@ -409,51 +673,137 @@ func (h *queueHandler) handleKickUnsafe(s Session,
 
 	// There's no need to validate the BattleTags, since the user is kicking
 	// them. In theory, if the BattleTag is invalid, it won't be in the
-	// queue, so no harm, no foul.
+	// queue, so no harm, no foul. Kicking a member of a party kicks the
+	// whole party.
 	kicked_btags := []string{}
 	for _, btag := range btags {
-		if err = h.q.Remove(h.wrapBattleTag(s, m, btag)); err != nil {
+		ubt, holder, err := q.Locate(btag)
+		if err != nil {
+			logger.Warne(err)
+			reply(s, m, "Error kicking %s from the %s queue.",
+				btag, q.Name())
+			continue
+		}
+		if ubt == nil {
+			reply(s, m, "BattleTag %q was not found in "+
+				"the %s queue.", btag, q.Name())
+			continue
+		}
+		pos, err := holder.Position(ubt)
+		if err == nil {
+			err = holder.Remove(ubt)
+		}
+		if err != nil {
 			if queue.NotFound.Contains(err) {
 				reply(s, m, "BattleTag %q was not found in "+
-					"the scrimmages queue.", btag)
+					"the %s queue.", btag, q.Name())
 				continue
 			}
 			logger.Warne(err)
-			reply(s, m, "Error kicking %s from the scrimmages "+
-				"queue.", btag)
+			reply(s, m, "Error kicking %s from the %s queue.",
+				btag, q.Name())
 			continue
 		}
-		kicked_btags = append(kicked_btags, btag)
+		kicked_btags = append(kicked_btags, ubt.label())
+		h.recordRemoval(s, m, q, holder, "kick", ubt, pos)
 	}
 
-	reply(s, m, "Kicked %s from the scrimmages queue.",
-		util.ToList(kicked_btags))
+	reply(s, m, "Kicked %s from the %s queue.",
+		util.ToList(kicked_btags), q.Name())
+	h.replyPromoted(s, m, q, h.promote(s, q))
 	return nil
 }
 
 func (h *queueHandler) handleList(s Session,
 	m *discordgo.MessageCreate) (err error) {
 
-	btags, err := h.queueBattleTags()
+	q, _, err := h.guildQueue(s, m, commandArgs(m, 2))
 	if err != nil {
 		return err
 	}
+
+	now := time.Now()
+	entries := []*userBattleTag{}
+	err = q.Iter(func(index int, btag *userBattleTag) bool {
+		entries = append(entries, btag)
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	rate, has_rate, err := h.takes.rate(q.guild_id, q.Name())
+	if err != nil {
+		return err
+	}
+
+	btags := []string{}
+	ahead := 0
+	for _, btag := range entries {
+		details := []string{}
+		if label := btag.platformLabel(); label != "" {
+			details = append(details, label)
+		}
+		if !btag.EnqueuedAt.IsZero() {
+			details = append(details, waitTime(now.Sub(btag.EnqueuedAt)))
+		}
+		if has_rate {
+			details = append(details,
+				"ETA "+waitTime(rate.eta(ahead)))
+		}
+		ahead += len(btag.Players())
+
+		if len(details) == 0 {
+			btags = append(btags, btag.label())
+		} else {
+			btags = append(btags, fmt.Sprintf("%s (%s)", btag.label(),
+				strings.Join(details, ", ")))
+		}
+	}
+	// Parties are counted by their players, as take and capacity count
+	// them.
+	waiting := []string{}
+	num_waiting := 0
+	err = q.waitlist.Iter(func(index int, btag *userBattleTag) bool {
+		waiting = append(waiting, btag.label())
+		num_waiting += len(btag.Players())
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
 	if len(btags) == 0 {
-		reply(s, m, "The scrimmages queue is empty.")
+		reply(s, m, "The %s queue is empty.", q.Name())
 		return nil
 	}
-	reply(s, m, "The scrimmages queue contains %d "+
-		"BattleTags: %s", len(btags), util.ToList(btags))
+	if len(waiting) > 0 {
+		reply(s, m, "The %s queue contains %d BattleTags: %s. Its "+
+			"waitlist contains %d: %s", q.Name(), ahead,
+			util.ToList(btags), num_waiting, util.ToList(waiting))
+		return nil
+	}
+	reply(s, m, "The %s queue contains %d "+
+		"BattleTags: %s", q.Name(), ahead, util.ToList(btags))
 	return nil
 }
 
 func (h *queueHandler) handleTakeUnsafe(s Session,
 	m *discordgo.MessageCreate) (err error) {
+
+	num_teams, args, err := chooseNumTeams(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+	q, args, err := h.guildQueue(s, m, args)
+	if err != nil {
+		return err
+	}
+
 	num_to_take := 12
 
-	argv := strings.Split(m.Content, " ")
-	if len(argv) > 2 {
-		n, err := strconv.ParseInt(argv[2], 10, 32)
+	if len(args) > 0 {
+		n, err := strconv.ParseInt(args[0], 10, 32)
 		logger.Warne(err)
 		if err == nil {
 			num_to_take = int(n)
@@ -466,57 +816,273 @@ func (h *queueHandler) handleTakeUnsafe(s Session,
 		return nil
 	}
 
-	taken, num_left, err := h.q.DequeueN(num_to_take)
+	// Two teams may differ by a player, as they always have.
+	if num_teams > 2 && num_to_take%num_teams != 0 {
+		reply(s, m, "%d BattleTags can't be split evenly into %d "+
+			"teams.", num_to_take, num_teams)
+		return nil
+	}
+
+	positions, err := q.Positions()
+	if err != nil {
+		return err
+	}
+
+	// Lobbies that can be split into full teams are filled by role.
+	var taken []*userBattleTag
+	var assigned map[string]string
+	var num_left int
+	if slots := lobbySlots(num_to_take); slots != nil {
+		taken, assigned, num_left, err = q.DequeueRoles(slots)
+	} else {
+		taken, num_left, err = q.DequeueN(num_to_take)
+	}
 	if err != nil {
 		return err
 	}
 
 	if len(taken) == 0 {
-		reply(s, m, "Took 0 BattleTags from the scrimmages "+
-			"queue. %d BattleTags remain in the scrimmages queue.",
-			num_left)
+		reply(s, m, "Took 0 BattleTags from the %s "+
+			"queue. %d BattleTags remain in the %s queue.",
+			q.Name(), num_left, q.Name())
 		return nil
 	}
 
-	btags := []string{}
-	for _, btag := range taken {
-		btags = append(btags, btag.BattleTag)
+	btags := toBattleTags(taken)
+	snap := h.undos.current(q.guild_id, q.Name())
+	undo, err := h.takes.record(q.guild_id, q.Name(), len(btags))
+	logger.Errore(err)
+	h.undos.onUndo(snap, undo)
+	for _, ubt := range taken {
+		event := &auditlog.Event{
+			Queue:     q.Name(),
+			Action:    "take",
+			BattleTag: ubt.label(),
+			Position:  positions[ubt.BattleTag] + 1,
+		}
+		if role := assigned[ubt.BattleTag]; role != "" {
+			event.Detail = role
+		}
+		h.record(s, m, q.guild_id, event)
+	}
+	for _, ubt := range h.promote(s, q) {
+		num_left += len(ubt.Players())
 	}
 
-	// TODO: move me to a wrapper?
-	go func() { logger.Warne(h.replyPartition(s, m, btags)) }()
+	if h.ready_check_timeout <= 0 {
+		undo, err := h.games.record(q.guild_id, btags)
+		logger.Errore(err)
+		h.undos.onUndo(snap, undo)
+		// TODO: move me to a wrapper?
+		opts := guildTeamOptions(h.settings, q.guild_id, num_teams)
+		go func() {
+			logger.Warne(h.replyPartition(s, m, taken, assigned,
+				opts))
+		}()
+
+		reply(s, m, "Took %d BattleTags from the %s queue: %s. "+
+			"%d BattleTags remain in the %s queue.",
+			len(btags), q.Name(),
+			util.ToList(withRoles(btags, assigned)), num_left,
+			q.Name())
+		return nil
+	}
 
-	reply(s, m, "Took %d BattleTags from the scrimmages queue: %s. "+
-		"%d BattleTags remain in the scrimmages queue.",
-		len(taken), util.ToList(btags), num_left)
+	reply(s, m, "Took %d BattleTags from the %s queue: %s. "+
+		"%d BattleTags remain in the %s queue. Waiting %s for them "+
+		"to confirm they're ready.",
+		len(btags), q.Name(), util.ToList(withRoles(btags, assigned)),
+		num_left, q.Name(), h.ready_check_timeout)
+
+	h.ready_checks.start(s, q, taken, assigned, h.ready_check_timeout,
+		*readyCheckRequeue, func(ready []*userBattleTag,
+			assigned map[string]string) {
+
+			h.replyReady(s, m, q, snap, len(btags), ready,
+				assigned, num_teams)
+		})
 	return nil
 }
 
-func (h *queueHandler) queueBattleTags() (btags []string, err error) {
-	err = h.q.Iter(func(index int, btag *userBattleTag) bool {
-		btags = append(btags, btag.BattleTag)
+// replyReady reports the outcome of a ready check, and suggests num_teams
+// teams made up of the players who confirmed. snap, if given, is the snapshot
+// taken before the take, so that undoing it can uncount their games.
+func (h *queueHandler) replyReady(s Session, m *discordgo.MessageCreate,
+	q *BattleTagQueue, snap *queueSnapshot, wanted int,
+	ready []*userBattleTag, assigned map[string]string, num_teams int) {
+
+	if len(ready) == 0 {
+		reply(s, m, "None of the BattleTags taken from the %s queue "+
+			"confirmed they're ready.", q.Name())
+		return
+	}
+
+	btags := toBattleTags(ready)
+	undo, err := h.games.record(q.guild_id, btags)
+	logger.Errore(err)
+	h.undos.onUndo(snap, undo)
+	// Topping up the lobby may have made room.
+	h.promote(s, q)
+	listed := util.ToList(withRoles(btags, assigned))
+	if len(btags) < wanted {
+		reply(s, m, "Only %d of %d BattleTags taken from the %s queue "+
+			"are ready, as the queue ran out: %s.",
+			len(btags), wanted, q.Name(), listed)
+	} else {
+		reply(s, m, "All %d BattleTags taken from the %s queue are "+
+			"ready: %s.", len(btags), q.Name(), listed)
+	}
+
+	opts := guildTeamOptions(h.settings, q.guild_id, num_teams)
+	go func() {
+		logger.Warne(h.replyPartition(s, m, ready, assigned, opts))
+	}()
+}
+
+func (h *queueHandler) handleReady(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	name := ""
+	if args := commandArgs(m, 1); len(args) > 0 {
+		name = args[0]
+	}
+
+	rc := h.ready_checks.lookupQueue(m.Author.ID, name)
+	if rc == nil {
+		if name != "" {
+			reply(s, m, "You don't have a pending ready check for "+
+				"the %s queue.", name)
+			return nil
+		}
+		reply(s, m, "You don't have a pending ready check.")
+		return nil
+	}
+
+	btags := rc.confirm(m.Author.ID)
+	reply(s, m, "%s", h.ready_checks.confirmed(m.Author.ID, btags))
+	return nil
+}
+
+// waitTime formats a duration spent waiting in a queue, to the minute.
+func waitTime(d time.Duration) string {
+	if d < time.Minute {
+		return "<1m"
+	}
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	}
+	return fmt.Sprintf("%dh%02dm", int(d/time.Hour),
+		int(d%time.Hour/time.Minute))
+}
+
+func toBattleTags(ubts []*userBattleTag) (btags []string) {
+	for _, ubt := range ubts {
+		btags = append(btags, ubt.Players()...)
+	}
+	return btags
+}
+
+func toParties(ubts []*userBattleTag) (parties [][]string) {
+	for _, ubt := range ubts {
+		if len(ubt.Party) > 0 {
+			parties = append(parties, ubt.Players())
+		}
+	}
+	return parties
+}
+
+func (h *queueHandler) queueEntries(q *BattleTagQueue) (
+	ubts []*userBattleTag, err error) {
+
+	err = q.Iter(func(index int, ubt *userBattleTag) bool {
+		ubts = append(ubts, ubt)
 		return false
 	})
 
-	return btags, err
+	return ubts, err
+}
+
+func (h *queueHandler) queueBattleTags(q *BattleTagQueue) (
+	btags []string, err error) {
+
+	ubts, err := h.queueEntries(q)
+	return toBattleTags(ubts), err
 }
 
 func (h *queueHandler) handleQueuePartition(s Session,
 	m *discordgo.MessageCreate) (err error) {
 
-	btags, err := h.queueBattleTags()
+	opts, args, err := chooseTeamOptions(s, m, h.settings,
+		commandArgs(m, 2))
 	if err != nil {
 		return err
 	}
-	if len(btags) == 0 {
-		reply(s, m, "The scrimmages queue is empty.")
+	q, _, err := h.guildQueue(s, m, args)
+	if err != nil {
+		return err
+	}
+
+	ubts, err := h.queueEntries(q)
+	if err != nil {
+		return err
+	}
+	if len(ubts) == 0 {
+		reply(s, m, "The %s queue is empty.", q.Name())
 		return nil
 	}
-	go func() { logger.Warne(h.replyPartition(s, m, btags)) }()
+	go func() { logger.Warne(h.replyPartition(s, m, ubts, nil, opts)) }()
 
 	return nil
 }
 
+// guildQueue returns the queue a command applies to, along with the command's
+// remaining arguments. If the first argument names one of the guild's queues,
+// it's consumed, otherwise the channel's default queue is used. Each guild has
+// its own queues, so queue commands sent via private message are refused.
+func (h *queueHandler) guildQueue(s Session, m *discordgo.MessageCreate,
+	args []string) (q *BattleTagQueue, rest []string, err error) {
+
+	q, rest, err = h.findGuildQueue(s, m, args)
+	if NoGuild.Contains(err) {
+		reply(s, m, "Queues are only available in guild channels.")
+	} else if QueueNotFound.Contains(err) {
+		reply(s, m, "There is no queue named %q. Try `!queue queues`.",
+			args[0])
+	}
+	return q, rest, err
+}
+
+// findGuildQueue is guildQueue, without replying.
+func (h *queueHandler) findGuildQueue(s Session, m *discordgo.MessageCreate,
+	args []string) (q *BattleTagQueue, rest []string, err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(args) > 0 && queueNameRe.MatchString(strings.ToLower(args[0])) {
+		q, err = h.queues.Lookup(guild_id, args[0])
+		if err == nil {
+			return q, args[1:], nil
+		}
+		// Unless there's a queue by that name, roles, platforms and
+		// regions are left for the command to parse.
+		_, is_roles := parseRoles(args[0])
+		if !QueueNotFound.Contains(err) ||
+			!(is_roles || isPlatformOrRegion(args[0])) {
+			return nil, nil, err
+		}
+	}
+
+	q, err = h.queues.Default(guild_id, m.ChannelID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return q, args, nil
+}
+
 func (h *queueHandler) auth2KickRequired(s Session,
 	m *discordgo.MessageCreate, fn bareHandler) error {
 
@@ -534,10 +1100,14 @@ func (h *queueHandler) auth2KickRequired(s Session,
 	return fn(s, m)
 }
 
+// enqueueRateLimited limits the user's enqueues in the queue named by the
+// command's arguments, after skipping skip words.
 func (h *queueHandler) enqueueRateLimited(s Session, m *discordgo.MessageCreate,
-	handler bareHandler) error {
+	skip int, handler bareHandler) error {
 
-	trigger, err := h.enqueue_rl.Limit(userKey(s, m))
+	// The handler replies, if the queue can't be found.
+	q, _, _ := h.findGuildQueue(s, m, commandArgs(m, skip))
+	trigger, err := h.enqueue_rl.Limit(enqueueKey(s, m, q))
 	if err != nil {
 		if ratelimiter.TooSoon.Contains(err) {
 			reply(s, m,
@@ -563,12 +1133,36 @@ type userBattleTag struct {
 	BattleTag string
 	GuildId   string
 	UserId    string
+	// Party holds the rest of a party's BattleTags. A party holds a single
+	// queue position, and is taken from the queue, and put on a team,
+	// together.
+	Party []string `json:",omitempty"`
+	// Roles are the roles BattleTag would prefer to play. None means any.
+	Roles []string `json:",omitempty"`
+	// Platform and Region apply to the whole party. Entries without them
+	// are on PC, in no particular region.
+	Platform string `json:",omitempty"`
+	Region   string `json:",omitempty"`
+
+	// EnqueuedAt is filled in by BattleTagQueue.Iter. It isn't marshaled,
+	// as queues compare entries by their marshaled bytes.
+	EnqueuedAt time.Time `json:"-"`
+}
+
+// Players returns the BattleTags of everyone in the entry.
+func (ubt *userBattleTag) Players() []string {
+	return append([]string{ubt.BattleTag}, ubt.Party...)
+}
+
+// label formats the entry for display, joining a party's BattleTags with "+".
+func (ubt *userBattleTag) label() string {
+	return strings.Join(ubt.Players(), "+")
 }
 
 func (h *queueHandler) wrapBattleTag(s Session, m *discordgo.MessageCreate,
 	btag string) *userBattleTag {
 
-	ch, err := s.Channel(m.ChannelID)
+	guild_id, err := guildId(s, m)
 	if err != nil {
 		logger.Errore(err)
 		return nil
@@ -576,7 +1170,7 @@ func (h *queueHandler) wrapBattleTag(s Session, m *discordgo.MessageCreate,
 
 	return &userBattleTag{
 		BattleTag: btag,
-		GuildId:   ch.GuildID,
+		GuildId:   guild_id,
 		UserId:    m.Author.ID,
 	}
 }
@@ -589,8 +1183,29 @@ func (h *queueHandler) clearEnqueueRateLimits(fn bareHandler) bareHandler {
 			return err
 		}
 
-		return h.enqueue_rl.Clear()
+		q := h.commandQueue(s, m)
+		if q == nil {
+			return nil
+		}
+		return h.enqueue_rl.ClearPrefix(enqueueKeyPrefix(q))
+	}
+}
+
+// enqueueKey identifies the user's enqueue rate limit in q, so that clearing
+// one queue leaves other queues' limits alone. q may be nil, if the message
+// doesn't name a queue.
+func enqueueKey(s Session, m *discordgo.MessageCreate,
+	q *BattleTagQueue) string {
+
+	if q == nil {
+		return userKey(s, m)
 	}
+	return enqueueKeyPrefix(q) + userKey(s, m)
+}
+
+// enqueueKeyPrefix prefixes the keys of every enqueue rate limit in q.
+func enqueueKeyPrefix(q *BattleTagQueue) string {
+	return q.guild_id + ":" + q.Name() + ":"
 }
 
 func mention(user_id string) string {
@@ -598,7 +1213,9 @@ func mention(user_id string) string {
 }
 
 func (h *queueHandler) replyPartition(s Session,
-	m *discordgo.MessageCreate, btags []string) error {
+	m *discordgo.MessageCreate, ubts []*userBattleTag,
+	assigned map[string]string, opts *teamOptions) error {
 
-	return replyPartition(s, m, h.overwatch, btags)
+	return replyPartition(s, m, h.overwatch, toBattleTags(ubts),
+		toParties(ubts), playerEntries(ubts), assigned, opts)
 }
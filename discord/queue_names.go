@@ -0,0 +1,210 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/util"
+)
+
+const reservedQueueNameMsg = "%q can't be used as a queue name, as it's a " +
+	"role, platform, region or command word."
+
+func (h *queueHandler) handleQueues(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	names, err := h.queues.Names(guild_id)
+	if err != nil {
+		return err
+	}
+
+	def, err := h.queues.Default(guild_id, m.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	reply(s, m, "This server's queues: %s. This channel's default "+
+		"queue is %s.", util.ToList(names), def.Name())
+	return nil
+}
+
+func (h *queueHandler) handleCreateUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs(m, 2)
+	if len(args) != 1 {
+		reply(s, m, "No queue name specified. "+
+			"Try `!queue create ranked`.")
+		return nil
+	}
+
+	err = h.queues.Create(guild_id, args[0])
+	if err != nil {
+		if QueueExists.Contains(err) {
+			reply(s, m, "A queue named %q already exists.", args[0])
+			return err
+		}
+		if QueueNameInvalid.Contains(err) {
+			reply(s, m, "Invalid queue name %q. Queue names must "+
+				"start with a letter, and may contain only "+
+				"letters, numbers, dashes and underscores.",
+				args[0])
+			return err
+		}
+		if QueueNameReserved.Contains(err) {
+			reply(s, m, reservedQueueNameMsg, args[0])
+			return err
+		}
+		reply(s, m, "Error creating the %s queue.", args[0])
+		return err
+	}
+
+	h.record(s, m, guild_id, &auditlog.Event{
+		Queue:  strings.ToLower(args[0]),
+		Action: "create",
+	})
+	reply(s, m, "Created the %s queue.", args[0])
+	return nil
+}
+
+func (h *queueHandler) handleRenameUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs(m, 2)
+	if len(args) != 2 {
+		reply(s, m, "No queue names specified. "+
+			"Try `!queue rename scrimmages casual`.")
+		return nil
+	}
+
+	err = h.queues.Rename(guild_id, args[0], args[1])
+	if err != nil {
+		switch {
+		case QueueNotFound.Contains(err):
+			reply(s, m, "There is no queue named %q.", args[0])
+		case QueueExists.Contains(err):
+			reply(s, m, "A queue named %q already exists.", args[1])
+		case QueueNameInvalid.Contains(err):
+			reply(s, m, "Invalid queue name %q.", args[1])
+		case QueueNameReserved.Contains(err):
+			reply(s, m, reservedQueueNameMsg, args[1])
+		default:
+			reply(s, m, "Error renaming the %s queue.", args[0])
+		}
+		return err
+	}
+
+	logger.Errore(h.schedules.rename(guild_id, strings.ToLower(args[0]),
+		strings.ToLower(args[1])))
+	logger.Errore(h.takes.rename(guild_id, strings.ToLower(args[0]),
+		strings.ToLower(args[1])))
+	h.undos.forget(guild_id, strings.ToLower(args[0]))
+
+	h.record(s, m, guild_id, &auditlog.Event{
+		Queue:  strings.ToLower(args[1]),
+		Action: "rename",
+		Detail: "from " + strings.ToLower(args[0]),
+	})
+	reply(s, m, "Renamed the %s queue to %s.", args[0], args[1])
+	return nil
+}
+
+func (h *queueHandler) handleDeleteUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs(m, 2)
+	if len(args) != 1 {
+		reply(s, m, "No queue name specified. "+
+			"Try `!queue delete ranked`.")
+		return nil
+	}
+
+	err = h.queues.Delete(guild_id, args[0])
+	if err != nil {
+		switch {
+		case QueueNotFound.Contains(err):
+			reply(s, m, "There is no queue named %q.", args[0])
+		case LastQueue.Contains(err):
+			reply(s, m, "The %s queue is this server's only queue, "+
+				"and can't be deleted.", args[0])
+		default:
+			reply(s, m, "Error deleting the %s queue.", args[0])
+		}
+		return err
+	}
+
+	logger.Errore(h.schedules.remove(guild_id, strings.ToLower(args[0])))
+	logger.Errore(h.takes.remove(guild_id, strings.ToLower(args[0])))
+	h.undos.forget(guild_id, strings.ToLower(args[0]))
+
+	h.record(s, m, guild_id, &auditlog.Event{
+		Queue:  strings.ToLower(args[0]),
+		Action: "delete",
+	})
+	reply(s, m, "Deleted the %s queue.", args[0])
+	return nil
+}
+
+func (h *queueHandler) handleDefaultUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	args := commandArgs(m, 2)
+	if len(args) != 1 {
+		reply(s, m, "No queue name specified. "+
+			"Try `!queue default ranked`.")
+		return nil
+	}
+
+	err = h.queues.SetDefault(guild_id, m.ChannelID, args[0])
+	if err != nil {
+		if QueueNotFound.Contains(err) {
+			reply(s, m, "There is no queue named %q.", args[0])
+			return err
+		}
+		reply(s, m, "Error setting this channel's default queue.")
+		return err
+	}
+
+	reply(s, m, "This channel's default queue is now %s.", args[0])
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/blizzard"
+	"github.com/ewollesen/zenbot/queue"
+)
+
+// parseBattleTagPosition parses the arguments to `!queue insert` and `!queue
+// move`: a BattleTag followed by a 1-based queue position.
+func parseBattleTagPosition(args []string) (btag string, pos int, ok bool) {
+	if len(args) != 2 {
+		return "", -1, false
+	}
+
+	btags := blizzard.FindBattleTags(args[0])
+	if len(btags) != 1 {
+		return "", -1, false
+	}
+
+	pos, err := strconv.Atoi(args[1])
+	if err != nil || pos < 1 {
+		return "", -1, false
+	}
+
+	return btags[0], pos - 1, true
+}
+
+func (h *queueHandler) handleInsertUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	pref, args, _ := parsePlatform(args)
+	btag, pos, ok := parseBattleTagPosition(args)
+	if !ok {
+		reply(s, m, "No BattleTag and position specified. "+
+			"Try `!queue insert example#1234 1`.")
+		return nil
+	}
+
+	valid, err := h.validateBattleTag(pref, btag)
+	if err != nil {
+		reply(s, m, "Error validating BattleTag %q.", btag)
+		return err
+	}
+	if !valid {
+		reply(s, m, "Invalid BattleTag %q. "+
+			"Try `!queue insert example#1234 1`. "+
+			"Remember, BattleTags are CaSe-SeNsItIvE!", btag)
+		return nil
+	}
+
+	ubt := h.wrapBattleTag(s, m, btag)
+	ubt.setPlatform(pref)
+	pos, err = q.Insert(pos, ubt)
+	if err != nil {
+		if queue.AlreadyEnqueued.Contains(err) {
+			reply(s, m, "BattleTag %q is already enqueued in the "+
+				"%s queue in position %d.",
+				btag, q.Name(), queue.GetPosition(err)+1)
+			return nil
+		}
+		reply(s, m, "Error inserting %q into the %s queue.",
+			btag, q.Name())
+		return err
+	}
+	// DO NOT cache BattleTags added in this way.
+	h.lookupSkillRank(ubt)
+	h.record(s, m, q.guild_id, &auditlog.Event{
+		Queue:     q.Name(),
+		Action:    "insert",
+		BattleTag: btag,
+		Position:  pos + 1,
+	})
+
+	reply(s, m, "Inserted %s into the %s queue in position %d.",
+		btag, q.Name(), pos+1)
+	return nil
+}
+
+func (h *queueHandler) handleMoveUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	btag, pos, ok := parseBattleTagPosition(args)
+	if !ok {
+		reply(s, m, "No BattleTag and position specified. "+
+			"Try `!queue move example#1234 1`.")
+		return nil
+	}
+
+	ubt, err := q.Find(btag)
+	if err != nil {
+		return err
+	}
+	if ubt == nil {
+		reply(s, m, "BattleTag %q was not found in the %s queue.",
+			btag, q.Name())
+		return nil
+	}
+
+	from, err := q.Position(ubt)
+	if err != nil {
+		return err
+	}
+	pos, err = q.Move(ubt, pos)
+	if err != nil {
+		reply(s, m, "Error moving %q in the %s queue.", btag, q.Name())
+		return err
+	}
+	h.record(s, m, q.guild_id, &auditlog.Event{
+		Queue:     q.Name(),
+		Action:    "move",
+		BattleTag: ubt.label(),
+		Position:  pos + 1,
+		Detail:    fmt.Sprintf("from position %d", from+1),
+	})
+
+	reply(s, m, "Moved %s to position %d in the %s queue.",
+		btag, pos+1, q.Name())
+	return nil
+}
+
+func (h *queueHandler) handleSwapUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	btags := []string{}
+	if len(args) == 2 {
+		btags = append(blizzard.FindBattleTags(args[0]),
+			blizzard.FindBattleTags(args[1])...)
+	}
+	if len(btags) != 2 || btags[0] == btags[1] {
+		reply(s, m, "Two different BattleTags must be specified. "+
+			"Try `!queue swap example#1234 example#5678`.")
+		return nil
+	}
+
+	ubts := []*userBattleTag{}
+	for _, btag := range btags {
+		ubt, err := q.Find(btag)
+		if err != nil {
+			return err
+		}
+		if ubt == nil {
+			reply(s, m, "BattleTag %q was not found in the %s "+
+				"queue.", btag, q.Name())
+			return nil
+		}
+		ubts = append(ubts, ubt)
+	}
+
+	err = q.Swap(ubts[0], ubts[1])
+	if err != nil {
+		reply(s, m, "Error swapping %s and %s in the %s queue.",
+			btags[0], btags[1], q.Name())
+		return err
+	}
+	h.record(s, m, q.guild_id, &auditlog.Event{
+		Queue:     q.Name(),
+		Action:    "swap",
+		BattleTag: ubts[0].label(),
+		Detail:    "with " + ubts[1].label(),
+	})
+
+	reply(s, m, "Swapped %s and %s in the %s queue.",
+		btags[0], btags[1], q.Name())
+	return nil
+}
@@ -16,17 +16,22 @@ package discord
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ewollesen/discordgo"
 
+	memorylog "github.com/ewollesen/zenbot/auditlog/memory"
 	memorycache "github.com/ewollesen/zenbot/cache/memory"
 	"github.com/ewollesen/zenbot/overwatch"
 	"github.com/ewollesen/zenbot/overwatch/global"
 	"github.com/ewollesen/zenbot/overwatch/mockoverwatch"
+	"github.com/ewollesen/zenbot/partition"
 	"github.com/ewollesen/zenbot/queue"
 	memoryqueue "github.com/ewollesen/zenbot/queue/memory"
 	"github.com/ewollesen/zenbot/ratelimiter"
+	"github.com/ewollesen/zenbot/ratelimiter/concretelimiter"
 	"github.com/ewollesen/zenbot/ratelimiter/mocklimiter"
 )
 
@@ -34,9 +39,10 @@ func TestHandleClear(t *testing.T) {
 	test := newDiscordTest(t)
 
 	c := memorycache.New()
-	qh := newQueueHandler(newBattleTagQueue(memoryqueue.New()),
+	qh := newQueueHandler(newMemoryQueues(),
+		newGuildSettings(memorycache.New()),
 		NewBattleTagCache(c),
-		global.New(mockoverwatch.NewRandom()))
+		global.New(mockoverwatch.NewRandom()), memorylog.New(100))
 	s := test.mockSession()
 	m := test.testMessage("!queue clear")
 	test.AssertNil(qh.Handle(s, m, "!queue", "clear"))
@@ -71,7 +77,33 @@ func TestClearEnqueueRateLimits(t *testing.T) {
 	qh.enqueue_rl = rl
 	qh.clearEnqueueRateLimits(f)(s, m)
 	test.AssertEqual(calls, 1)
-	test.AssertEqual(rl.Clears, 1)
+	test.AssertEqual(rl.Clears, 0)
+	test.AssertEqual(strings.Join(rl.Prefixes, " "),
+		testGuildId+":"+defaultQueueName+":")
+
+	// Other guilds' and queues' limits are left alone.
+	m = test.testMessage("!queue create ranked")
+	test.AssertNil(qh.handleCreateUnsafe(s, m))
+	qh.enqueue_rl = concretelimiter.New(time.Hour)
+	trigger, err := qh.enqueue_rl.Limit("other:" + defaultQueueName +
+		":" + m.Author.ID)
+	test.AssertNil(err)
+	test.AssertNil(trigger())
+	test.AssertNil(qh.enqueueRateLimited(s, test.testMessage(
+		"!enqueue example#1234"), 1, f))
+	test.AssertNil(qh.enqueueRateLimited(s, test.testMessage(
+		"!enqueue ranked example#1234"), 1, f))
+	test.AssertTooSoon(qh.enqueueRateLimited(s, test.testMessage(
+		"!enqueue ranked example#1234"), 1, f))
+	m = test.testMessage("!queue clear")
+	test.AssertNil(qh.clearEnqueueRateLimits(f)(s, m))
+	_, err = qh.enqueue_rl.Limit("other:" + defaultQueueName + ":" +
+		m.Author.ID)
+	test.AssertTooSoon(err)
+	_, err = qh.enqueue_rl.Limit(enqueueKey(s, m, test.queue()))
+	test.AssertNil(err)
+	test.AssertTooSoon(qh.enqueueRateLimited(s, test.testMessage(
+		"!enqueue ranked example#1234"), 1, f))
 }
 
 func TestEnqueueRateLimited(t *testing.T) {
@@ -85,15 +117,15 @@ func TestEnqueueRateLimited(t *testing.T) {
 		return nil
 	}
 
-	test.AssertNil(qh.enqueueRateLimited(s, m, f))
+	test.AssertNil(qh.enqueueRateLimited(s, m, 1, f))
 	test.AssertEqual(calls, 1)
 
-	test.AssertTooSoon(qh.enqueueRateLimited(s, m, f))
+	test.AssertTooSoon(qh.enqueueRateLimited(s, m, 1, f))
 	test.AssertEqual(calls, 1)
 	test.AssertContainsRe(s.sends, "You may enqueue at most once every")
 
 	test.AssertNil(qh.enqueue_rl.Clear())
-	test.AssertNil(qh.enqueueRateLimited(s, m, f))
+	test.AssertNil(qh.enqueueRateLimited(s, m, 1, f))
 	test.AssertEqual(calls, 2)
 }
 
@@ -105,7 +137,7 @@ func TestHandleClearUnsafe(t *testing.T) {
 	test.enqueue(qh.wrapBattleTag(s, m, string(testBattleTag)))
 
 	test.AssertNil(qh.handleClearUnsafe(s, m))
-	size, err := qh.q.Size()
+	size, err := test.queue().Size()
 	test.AssertNil(err)
 	test.AssertEqual(size, 0)
 }
@@ -127,7 +159,7 @@ func TestHandleDequeue(t *testing.T) {
 	s.setMember(testGuildId, testUserId, &discordgo.Member{Nick: testNick})
 	test.enqueue(qh.wrapBattleTag(s, m, string(testBattleTag)))
 	test.AssertNil(qh.handleDequeue(s, m))
-	size, err := qh.q.Size()
+	size, err := test.queue().Size()
 	test.AssertNil(err)
 	test.AssertEqual(size, 0)
 	test.AssertContainsRe(s.sends, "Dequeued .* from the scrimmages queue.")
@@ -275,6 +307,60 @@ func TestHandleKickUnsafe(t *testing.T) {
 		"Kicked example#1234 from the scrimmages queue.")
 }
 
+func TestReorderQueueUnsafe(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(3)
+	test.enqueue(users...)
+	btags := toBattleTags(users)
+	order := func() string {
+		queued, err := qh.queueBattleTags(test.queue())
+		test.AssertNil(err)
+		return strings.Join(queued, " ")
+	}
+
+	m := test.testMessage("!queue move " + btags[2])
+	test.AssertNil(qh.handleMoveUnsafe(s, m))
+	test.AssertContains(s.sends, "No BattleTag and position specified. "+
+		"Try `!queue move example#1234 1`.")
+
+	m = test.testMessage("!queue move " + btags[2] + " 1")
+	test.AssertNil(qh.handleMoveUnsafe(s, m))
+	test.AssertContains(s.sends, fmt.Sprintf("Moved %s to position 1 "+
+		"in the scrimmages queue.", btags[2]))
+	test.AssertEqual(order(), strings.Join(
+		[]string{btags[2], btags[0], btags[1]}, " "))
+
+	m = test.testMessage("!queue move example#1234 1")
+	test.AssertNil(qh.handleMoveUnsafe(s, m))
+	test.AssertContains(s.sends, "BattleTag \"example#1234\" was not "+
+		"found in the scrimmages queue.")
+
+	m = test.testMessage("!queue swap " + btags[2] + " " + btags[1])
+	test.AssertNil(qh.handleSwapUnsafe(s, m))
+	test.AssertContains(s.sends, fmt.Sprintf("Swapped %s and %s in the "+
+		"scrimmages queue.", btags[2], btags[1]))
+	test.AssertEqual(order(), strings.Join(
+		[]string{btags[1], btags[0], btags[2]}, " "))
+
+	m = test.testMessage("!queue swap " + btags[1] + " " + btags[1])
+	test.AssertNil(qh.handleSwapUnsafe(s, m))
+	test.AssertContains(s.sends, "Two different BattleTags must be "+
+		"specified. Try `!queue swap example#1234 example#5678`.")
+
+	m = test.testMessage("!queue insert example#1234 2")
+	test.AssertNil(qh.handleInsertUnsafe(s, m))
+	test.AssertContains(s.sends, "Inserted example#1234 into the "+
+		"scrimmages queue in position 2.")
+	test.AssertEqual(order(), strings.Join(
+		[]string{btags[1], "example#1234", btags[0], btags[2]}, " "))
+
+	s.clearSends()
+	test.AssertNil(qh.handleInsertUnsafe(s, m))
+	test.AssertContains(s.sends, "BattleTag \"example#1234\" is already "+
+		"enqueued in the scrimmages queue in position 2.")
+}
+
 func TestHandleList(t *testing.T) {
 	test, qh := newQueueTest(t)
 	s := test.mockSession()
@@ -286,7 +372,7 @@ func TestHandleList(t *testing.T) {
 	test.enqueue(qh.wrapBattleTag(s, m, string(testBattleTag)))
 	test.AssertNil(qh.handleList(s, m))
 	test.AssertContains(s.sends, "The scrimmages queue contains "+
-		"1 BattleTags: example#1234")
+		"1 BattleTags: example#1234 (<1m)")
 
 	s2 := test.mockSession()
 	m2 := test.testMessage("!enqueue example#5678")
@@ -295,7 +381,7 @@ func TestHandleList(t *testing.T) {
 
 	test.AssertNil(qh.handleList(s, m))
 	test.AssertContains(s.sends, "The scrimmages queue contains "+
-		"2 BattleTags: example#1234  example#5678")
+		"2 BattleTags: example#1234 (<1m)  example#5678 (<1m)")
 }
 
 func TestTakeUnsafe(t *testing.T) {
@@ -330,6 +416,334 @@ func TestTakeUnsafe(t *testing.T) {
 	test.AssertContainsRe(s.sends, ": "+users[12].BattleTag+"  "+users[0].BattleTag)
 }
 
+func TestPerGuildQueues(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	s.setChannel("other-channel", &discordgo.Channel{
+		GuildID: "other-guild",
+	})
+
+	m := test.testMessage("!enqueue example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+
+	m2 := test.testMessage("!queue list")
+	m2.ChannelID = "other-channel"
+	test.AssertNil(qh.handleList(s, m2))
+	test.AssertContains(s.sends, "The scrimmages queue is empty.")
+
+	m2.Content = "!queue clear"
+	test.AssertNil(qh.handleClearUnsafe(s, m2))
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 1)
+}
+
+func TestPrivateMessageQueue(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	s.setChannel(testPrivateChannelId, &discordgo.Channel{
+		ID:        testPrivateChannelId,
+		IsPrivate: true,
+	})
+
+	m := test.testMessage("!queue list")
+	m.ChannelID = testPrivateChannelId
+	test.AssertErrorContainedBy(qh.handleList(s, m), NoGuild)
+	test.AssertContainsRe(s.sends, "only available in guild channels")
+}
+
+func TestNamedQueues(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+
+	m := test.testMessage("!queue create Ranked")
+	test.AssertNil(qh.handleCreateUnsafe(s, m))
+	test.AssertContains(s.sends, "Created the Ranked queue.")
+	test.AssertErrorContainedBy(qh.handleCreateUnsafe(s, m), QueueExists)
+
+	m = test.testMessage("!queue create 2fast")
+	test.AssertErrorContainedBy(qh.handleCreateUnsafe(s, m),
+		QueueNameInvalid)
+
+	// Names that would be mistaken for roles, platforms, regions or
+	// keywords are refused.
+	for _, name := range []string{"tank", "psn", "eu", "party", "json"} {
+		m = test.testMessage("!queue create " + name)
+		test.AssertErrorContainedBy(qh.handleCreateUnsafe(s, m),
+			QueueNameReserved)
+	}
+	test.AssertContains(s.sends, "\"json\" can't be used as a queue "+
+		"name, as it's a role, platform, region or command word.")
+	m = test.testMessage("!queue rename ranked tank")
+	test.AssertErrorContainedBy(qh.handleRenameUnsafe(s, m),
+		QueueNameReserved)
+
+	m = test.testMessage("!enqueue ranked example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	test.AssertContains(s.sends, "Enqueued example#1234 (example#1234 "+
+		"[tank]) in the ranked queue in position 1.")
+
+	m = test.testMessage("!queue list")
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue is empty.")
+
+	m = test.testMessage("!queue list ranked")
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContains(s.sends, "The ranked queue contains "+
+		"1 BattleTags: example#1234 (<1m)")
+
+	m = test.testMessage("!queue list casual")
+	test.AssertErrorContainedBy(qh.handleList(s, m), QueueNotFound)
+	test.AssertContains(s.sends, "There is no queue named \"casual\". "+
+		"Try `!queue queues`.")
+
+	m = test.testMessage("!queue rename ranked competitive")
+	test.AssertNil(qh.handleRenameUnsafe(s, m))
+	m = test.testMessage("!queue list competitive")
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContains(s.sends, "The competitive queue contains "+
+		"1 BattleTags: example#1234 (<1m)")
+
+	m = test.testMessage("!queue default competitive")
+	test.AssertNil(qh.handleDefaultUnsafe(s, m))
+	m = test.testMessage("!queue list")
+	s.clearSends()
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContains(s.sends, "The competitive queue contains "+
+		"1 BattleTags: example#1234 (<1m)")
+
+	m = test.testMessage("!queue queues")
+	test.AssertNil(qh.handleQueues(s, m))
+	test.AssertContains(s.sends, "This server's queues: scrimmages  "+
+		"competitive. This channel's default queue is competitive.")
+
+	m = test.testMessage("!queue delete competitive")
+	test.AssertNil(qh.handleDeleteUnsafe(s, m))
+	m = test.testMessage("!queue delete scrimmages")
+	test.AssertErrorContainedBy(qh.handleDeleteUnsafe(s, m), LastQueue)
+
+	m = test.testMessage("!queue list")
+	s.clearSends()
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue is empty.")
+}
+
+func TestRenameKeepsWaitTimes(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(1)
+	test.enqueue(users...)
+
+	entries, err := test.queue().entries()
+	test.AssertNil(err)
+	entries[0].EnqueuedAt = time.Now().Add(-90 * time.Minute)
+	test.AssertNil(test.queue().Replace(entries))
+
+	m := test.testMessage("!queue rename scrimmages casual")
+	test.AssertNil(qh.handleRenameUnsafe(s, m))
+	m = test.testMessage("!queue list casual")
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContainsRe(s.sends, users[0].BattleTag+` \(1h30m\)`)
+}
+
+func TestWaitTime(t *testing.T) {
+	test := newDiscordTest(t)
+
+	test.AssertEqual(waitTime(30*time.Second), "<1m")
+	test.AssertEqual(waitTime(5*time.Minute+10*time.Second), "5m")
+	test.AssertEqual(waitTime(time.Hour+2*time.Minute), "1h02m")
+	test.AssertEqual(waitTime(26*time.Hour), "26h00m")
+}
+
+func TestEnqueueParty(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+	users := generateUsers(4)
+	test.enqueue(users[0])
+	btags := toBattleTags(users[1:])
+	label := strings.Join(btags, "+")
+
+	m := test.testMessage("!enqueue party " + strings.Join(btags, " "))
+	test.AssertNil(qh.handleEnqueueParty(s, m))
+	test.AssertContains(s.sends, "Enqueued party "+label+" in the "+
+		"scrimmages queue in position 2.")
+
+	test.AssertErrorContainedBy(qh.handleEnqueueParty(s, m),
+		queue.AlreadyEnqueued)
+	test.AssertContains(s.sends, "BattleTag "+btags[0]+" is already "+
+		"enqueued in the scrimmages queue as "+label+".")
+
+	m = test.testMessage("!enqueue party example#1234")
+	test.AssertErrorContainedBy(qh.handleEnqueueParty(s, m),
+		PartySizeInvalid)
+
+	m = test.testMessage("!queue list")
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue contains 4 "+
+		"BattleTags: "+users[0].BattleTag+" (<1m)  "+label+" (<1m)")
+
+	// The party doesn't fit in the two remaining spots, so it's skipped.
+	m = test.testMessage("!queue take 3")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContains(s.sends, "Took 1 BattleTags from the scrimmages "+
+		"queue: "+users[0].BattleTag+". 3 BattleTags remain in the "+
+		"scrimmages queue.")
+
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContains(s.sends, "Took 3 BattleTags from the scrimmages "+
+		"queue: "+strings.Join(btags, "  ")+". 0 BattleTags remain in "+
+		"the scrimmages queue.")
+
+	m = test.testMessage("!enqueue party " + strings.Join(btags, " "))
+	test.AssertNil(qh.handleEnqueueParty(s, m))
+	m = test.testMessage("!queue kick " + btags[1])
+	test.AssertNil(qh.handleKickUnsafe(s, m))
+	test.AssertContains(s.sends, "Kicked "+label+" from the scrimmages "+
+		"queue.")
+}
+
+func TestPartitionParties(t *testing.T) {
+	test, _ := newQueueTest(t)
+	btags := toBattleTags(generateUsers(12))
+	parties := [][]string{btags[0:3], btags[5:7]}
+
+	// Parties are kept together, even if the chosen strategy wouldn't.
+	strategy, _ := partition.Strategy("random")
+	together := &partition.Constraints{Together: parties}
+	teams, _, _, err := partitionBattleTags(global.New(test.overwatch),
+		btags, parties, nil, nil, &teamOptions{strategy: strategy, num_teams: 2})
+	test.AssertNil(err)
+	test.AssertEqual(len(teams), 2)
+	test.AssertEqual(len(teams[0]), 6)
+	test.AssertEqual(len(teams[1]), 6)
+	test.Assert(together.Met(teams))
+
+	// And when there are more teams.
+	teams, _, _, err = partitionBattleTags(global.New(test.overwatch),
+		btags, parties, nil, nil, &teamOptions{strategy: strategy, num_teams: 3})
+	test.AssertNil(err)
+	test.AssertEqual(len(teams), 3)
+	for _, team := range teams {
+		test.AssertEqual(len(team), 4)
+	}
+	test.Assert(together.Met(teams))
+}
+
+func TestTakeReadyCheck(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(3)
+	test.enqueue(users...)
+
+	m := test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContainsRe(s.sends, "Took 2 BattleTags.* 1 BattleTags "+
+		"remain.* Waiting .* to confirm they're ready.")
+	test.AssertContainsRe(s.sends, users[0].BattleTag+" has been taken "+
+		"from the scrimmages queue! Reply `!ready`")
+
+	test.AssertNil(qh.handleReady(s, msgFromUserBattleTag(users[0])))
+	test.AssertContains(s.sends, "Thanks! "+users[0].BattleTag+
+		" is ready.")
+
+	// users[1] doesn't confirm in time, so users[2] takes their place.
+	rc := qh.ready_checks.lookup(users[1].UserId)
+	test.Assert(rc != nil)
+	rc.expire()
+	test.AssertContainsRe(s.sends, users[1].BattleTag+" didn't confirm "+
+		"in time, and has been returned to the back of the "+
+		"scrimmages queue.")
+	test.AssertContainsRe(s.sends, users[2].BattleTag+" has been taken")
+	pos, err := test.queue().Position(users[1])
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+	events, err := qh.audit_log.Recent(testGuildId, 2, nil)
+	test.AssertNil(err)
+	test.AssertEqual(events[0].Action, "requeue")
+	test.AssertEqual(events[0].BattleTag, users[1].BattleTag)
+	test.AssertEqual(events[0].Actor, botActor)
+	test.AssertEqual(events[1].Action, "take")
+	test.AssertEqual(events[1].BattleTag, users[2].BattleTag)
+	test.AssertEqual(events[1].Detail, "replacement")
+	test.AssertEqual(events[1].Position, 1)
+
+	s.clearSends()
+	test.AssertNil(qh.handleReady(s, msgFromUserBattleTag(users[1])))
+	test.AssertContains(s.sends, "You don't have a pending ready check.")
+
+	confirmed := qh.ready_checks.confirmReaction(testPrivateChannelId,
+		users[2].UserId)
+	test.AssertEqual(len(confirmed), 1)
+	test.AssertContains(s.sends, "All 2 BattleTags taken from the "+
+		"scrimmages queue are ready: "+users[0].BattleTag+"  "+
+		users[2].BattleTag+".")
+}
+
+func TestTakeReadyCheckQueueRunsDry(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(2)
+	test.enqueue(users...)
+
+	*readyCheckRequeue = false
+	defer func() { *readyCheckRequeue = true }()
+
+	m := test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertNil(qh.handleReady(s, msgFromUserBattleTag(users[0])))
+
+	qh.ready_checks.lookup(users[1].UserId).expire()
+	test.AssertContainsRe(s.sends, users[1].BattleTag+" didn't confirm "+
+		"in time, and has been removed from the scrimmages queue.")
+	test.AssertContains(s.sends, "Only 1 of 2 BattleTags taken from the "+
+		"scrimmages queue are ready, as the queue ran out: "+
+		users[0].BattleTag+".")
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 0)
+}
+
+func TestConcurrentReadyChecks(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(1)
+	test.enqueue(users...)
+	test.AssertNil(qh.queues.Create(testGuildId, "ranked"))
+	ranked := qh.queues.Get(testGuildId, "ranked")
+	_, err := ranked.Enqueue(users[0])
+	test.AssertNil(err)
+
+	test.AssertNil(qh.handleTakeUnsafe(s,
+		test.testMessage("!queue take 1")))
+	test.AssertNil(qh.handleTakeUnsafe(s,
+		test.testMessage("!queue take ranked 1")))
+
+	// The second check mustn't replace the first.
+	m := msgFromUserBattleTag(users[0])
+	m.Content = "!ready ranked"
+	s.clearSends()
+	test.AssertNil(qh.handleReady(s, m))
+	test.AssertContains(s.sends, "Thanks! "+users[0].BattleTag+
+		" is ready. You've also been taken from the scrimmages "+
+		"queue; reply `!ready` again to confirm that too.")
+	test.AssertContainsRe(s.sends, "All 1 BattleTags taken from the "+
+		"ranked queue are ready")
+
+	s.clearSends()
+	test.AssertNil(qh.handleReady(s, m))
+	test.AssertContains(s.sends,
+		"You don't have a pending ready check for the ranked queue.")
+
+	s.clearSends()
+	test.AssertNil(qh.handleReady(s, msgFromUserBattleTag(users[0])))
+	test.AssertContains(s.sends, "Thanks! "+users[0].BattleTag+
+		" is ready.")
+	test.AssertContainsRe(s.sends, "All 1 BattleTags taken from the "+
+		"scrimmages queue are ready")
+	test.Assert(qh.ready_checks.lookup(users[0].UserId) == nil)
+}
+
 func TestHelp(t *testing.T) {
 	test, qh := newQueueTest(t)
 	s := test.mockSession()
@@ -388,8 +802,10 @@ type queueTest struct {
 
 func newQueueTest(t *testing.T) (*queueTest, *queueHandler) {
 	ow := mockoverwatch.NewRandom()
-	qh := newQueueHandler(newBattleTagQueue(memoryqueue.New()),
-		NewBattleTagCache(memorycache.New()), global.New(ow))
+	qh := newQueueHandler(newMemoryQueues(),
+		newGuildSettings(memorycache.New()),
+		NewBattleTagCache(memorycache.New()), global.New(ow),
+		memorylog.New(100))
 
 	return &queueTest{
 		discordTest: newDiscordTest(t),
@@ -400,18 +816,30 @@ func newQueueTest(t *testing.T) (*queueTest, *queueHandler) {
 
 func (t *queueTest) enqueue(btags ...*userBattleTag) {
 	for _, btag := range btags {
-		pre_size, err := t.handler.q.Size()
+		pre_size, err := t.queue().Size()
 		t.AssertNil(err)
 
-		pos, err := t.handler.q.Enqueue(btag)
+		pos, err := t.queue().Enqueue(btag)
 		t.AssertNil(err)
 		t.AssertEqual(pos, pre_size)
-		size, err := t.handler.q.Size()
+		size, err := t.queue().Size()
 		t.AssertNil(err)
 		t.AssertEqual(size, pre_size+1)
 	}
 }
 
+func (t *queueTest) queue() *BattleTagQueue {
+	return t.handler.queues.Get(testGuildId, defaultQueueName)
+}
+
+func newMemoryQueues() *BattleTagQueues {
+	return newBattleTagQueues(memorycache.New(),
+		func(guild_id, name string) queue.Queue {
+			return queue.Watch(memoryqueue.New(),
+				memoryqueue.NewEventBus())
+		})
+}
+
 func (t *queueTest) AssertTooSoon(err error) {
 	t.AssertErrorContainedBy(err, ratelimiter.TooSoon)
 }
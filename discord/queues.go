@@ -0,0 +1,454 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ewollesen/zenbot/cache"
+	"github.com/ewollesen/zenbot/queue"
+	"github.com/spacemonkeygo/errors"
+)
+
+const defaultQueueName = "scrimmages"
+
+var (
+	queueNameRe = regexp.MustCompile("^[a-z][a-z0-9_-]{0,31}$")
+	// reservedQueueNames are the subcommands, and the keywords in their
+	// arguments, that a queue of the same name would shadow.
+	reservedQueueNames = map[string]bool{
+		"add": true, "capacity": true, "clear": true, "close": true,
+		"create": true, "csv": true, "default": true, "delete": true,
+		"eta": true, "exempt": true, "export": true, "fair": true,
+		"help": true, "history": true, "import": true, "insert": true,
+		"json": true, "kick": true, "list": true, "move": true,
+		"notify": true, "off": true, "on": true, "open": true,
+		"partition": true, "party": true, "pick": true,
+		"position": true, "queues": true, "remove": true,
+		"rename": true, "reset": true, "role": true, "schedule": true,
+		"server": true, "strategy": true, "swap": true, "take": true,
+		"teams": true, "unexempt": true, "undo": true,
+	}
+
+	QueueNotFound = Error.NewClass("queue not found",
+		errors.NoCaptureStack())
+	QueueExists = Error.NewClass("queue already exists",
+		errors.NoCaptureStack())
+	QueueNameInvalid = Error.NewClass("queue name invalid",
+		errors.NoCaptureStack())
+	QueueNameReserved = Error.NewClass("queue name reserved",
+		errors.NoCaptureStack())
+	LastQueue = Error.NewClass("last remaining queue",
+		errors.NoCaptureStack())
+)
+
+// guildQueueConfig is persisted once per guild. Guilds that have never
+// configured their queues get a single queue named "scrimmages".
+type guildQueueConfig struct {
+	Queues          []string          `json:"queues"`
+	ChannelDefaults map[string]string `json:"channel_defaults"`
+	// Capacities limits the number of players in a queue. Once it's full,
+	// players are added to its waitlist instead.
+	Capacities map[string]int `json:"capacities,omitempty"`
+}
+
+func (c *guildQueueConfig) has(name string) bool {
+	for _, candidate := range c.Queues {
+		if candidate == name {
+			return true
+		}
+	}
+	return false
+}
+
+// BattleTagQueues manages each guild's named queues. Queue contents are
+// created on first use by new_fn, while the names of each guild's queues and
+// each channel's default queue are stored in configs.
+type BattleTagQueues struct {
+	mu      sync.Mutex
+	configs cache.Cache
+	queues  map[string]*BattleTagQueue
+	new_fn  func(guild_id, name string) queue.Queue
+	games   func(guild_id string) (map[string]int, error)
+
+	hooks_mu sync.Mutex
+	hooks    []QueueHook
+}
+
+// QueueHook is called after a queue's contents change, whichever command
+// changed them. taken holds any entries taken from the queue by the change.
+type QueueHook func(q *BattleTagQueue, taken []*userBattleTag)
+
+func newBattleTagQueues(configs cache.Cache,
+	new_fn func(guild_id, name string) queue.Queue) *BattleTagQueues {
+
+	return &BattleTagQueues{
+		configs: configs,
+		queues:  make(map[string]*BattleTagQueue),
+		new_fn:  new_fn,
+	}
+}
+
+// SetGames sets the function each queue uses to look up the games each
+// BattleTag has played this session, for fair rotation. Call it before using
+// any of the queues.
+func (q *BattleTagQueues) SetGames(
+	games func(guild_id string) (map[string]int, error)) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.games = games
+}
+
+// AddHook adds a hook to be called after any of the queues change. Waitlists
+// don't call hooks.
+func (q *BattleTagQueues) AddHook(hook QueueHook) {
+	q.hooks_mu.Lock()
+	defer q.hooks_mu.Unlock()
+	q.hooks = append(q.hooks, hook)
+}
+
+func (q *BattleTagQueues) runHooks(btq *BattleTagQueue,
+	taken []*userBattleTag) {
+
+	q.hooks_mu.Lock()
+	hooks := q.hooks
+	q.hooks_mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(btq, taken)
+	}
+}
+
+// Get returns the named queue, without checking that the guild has a queue by
+// that name.
+func (q *BattleTagQueues) Get(guild_id, name string) *BattleTagQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.get(guild_id, name)
+}
+
+// ensure that you're holding q.mu before calling!
+func (q *BattleTagQueues) get(guild_id, name string) *BattleTagQueue {
+	key := guild_id + "." + name
+	btq, ok := q.queues[key]
+	if !ok {
+		btq = newBattleTagQueue(q.new_fn(guild_id, name), name)
+		btq.guild_id = guild_id
+		btq.games = q.games
+		btq.hooks = q.runHooks
+		// Queue names can't contain dots, so this can't collide.
+		btq.waitlist = newBattleTagQueue(
+			q.new_fn(guild_id, name+".waitlist"), name)
+		btq.waitlist.guild_id = guild_id
+		q.queues[key] = btq
+	}
+
+	return btq
+}
+
+// Lookup returns the guild's queue with the given name, or a QueueNotFound
+// error.
+func (q *BattleTagQueues) Lookup(guild_id, name string) (
+	*BattleTagQueue, error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name = strings.ToLower(name)
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return nil, err
+	}
+	if !config.has(name) {
+		return nil, QueueNotFound.New(name)
+	}
+
+	return q.get(guild_id, name), nil
+}
+
+// Default returns the channel's default queue, falling back to the guild's
+// first queue if the channel has none.
+func (q *BattleTagQueues) Default(guild_id, channel_id string) (
+	*BattleTagQueue, error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := config.ChannelDefaults[channel_id]
+	if !ok || !config.has(name) {
+		name = config.Queues[0]
+	}
+
+	return q.get(guild_id, name), nil
+}
+
+func (q *BattleTagQueues) Names(guild_id string) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Queues, nil
+}
+
+// queueNameReserved returns true if name is a subcommand, keyword, role,
+// platform or region, which the queue's name would be mistaken for, or vice
+// versa.
+func queueNameReserved(name string) bool {
+	_, is_roles := parseRoles(name)
+	return reservedQueueNames[name] || is_roles || isPlatformOrRegion(name)
+}
+
+func (q *BattleTagQueues) Create(guild_id, name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name = strings.ToLower(name)
+	if !queueNameRe.MatchString(name) {
+		return QueueNameInvalid.New(name)
+	}
+	if queueNameReserved(name) {
+		return QueueNameReserved.New(name)
+	}
+
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return err
+	}
+	if config.has(name) {
+		return QueueExists.New(name)
+	}
+
+	// There may be leftovers from a deleted queue of the same name.
+	if err = q.get(guild_id, name).Clear(); err != nil {
+		return err
+	}
+
+	config.Queues = append(config.Queues, name)
+	return q.saveConfig(guild_id, config)
+}
+
+// Rename moves the contents of the old queue to the new one, preserving their
+// order and when they were enqueued, and points channels that defaulted to the
+// old queue at the new one.
+func (q *BattleTagQueues) Rename(guild_id, old_name, new_name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	old_name = strings.ToLower(old_name)
+	new_name = strings.ToLower(new_name)
+	if !queueNameRe.MatchString(new_name) {
+		return QueueNameInvalid.New(new_name)
+	}
+	if queueNameReserved(new_name) {
+		return QueueNameReserved.New(new_name)
+	}
+
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return err
+	}
+	if !config.has(old_name) {
+		return QueueNotFound.New(old_name)
+	}
+	if config.has(new_name) {
+		return QueueExists.New(new_name)
+	}
+
+	old_q := q.get(guild_id, old_name)
+	new_q := q.get(guild_id, new_name)
+	if err = new_q.Clear(); err != nil {
+		return err
+	}
+	if err = moveEntries(old_q, new_q); err != nil {
+		return err
+	}
+	if err = moveEntries(old_q.waitlist, new_q.waitlist); err != nil {
+		return err
+	}
+	if err = old_q.Clear(); err != nil {
+		return err
+	}
+
+	for i, name := range config.Queues {
+		if name == old_name {
+			config.Queues[i] = new_name
+		}
+	}
+	for channel_id, name := range config.ChannelDefaults {
+		if name == old_name {
+			config.ChannelDefaults[channel_id] = new_name
+		}
+	}
+	if capacity, ok := config.Capacities[old_name]; ok {
+		delete(config.Capacities, old_name)
+		config.Capacities[new_name] = capacity
+	}
+
+	return q.saveConfig(guild_id, config)
+}
+
+func moveEntries(from, to *BattleTagQueue) error {
+	entries, err := from.entries()
+	if err != nil {
+		return err
+	}
+	return to.q.Replace(entries)
+}
+
+// Delete removes the queue and its contents. A guild's last queue can't be
+// deleted.
+func (q *BattleTagQueues) Delete(guild_id, name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name = strings.ToLower(name)
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return err
+	}
+	if !config.has(name) {
+		return QueueNotFound.New(name)
+	}
+	if len(config.Queues) == 1 {
+		return LastQueue.New(name)
+	}
+
+	if err = q.get(guild_id, name).Clear(); err != nil {
+		return err
+	}
+
+	queues := []string{}
+	for _, candidate := range config.Queues {
+		if candidate != name {
+			queues = append(queues, candidate)
+		}
+	}
+	config.Queues = queues
+	for channel_id, candidate := range config.ChannelDefaults {
+		if candidate == name {
+			delete(config.ChannelDefaults, channel_id)
+		}
+	}
+	delete(config.Capacities, name)
+
+	return q.saveConfig(guild_id, config)
+}
+
+func (q *BattleTagQueues) SetDefault(guild_id, channel_id, name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name = strings.ToLower(name)
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return err
+	}
+	if !config.has(name) {
+		return QueueNotFound.New(name)
+	}
+
+	config.ChannelDefaults[channel_id] = name
+	return q.saveConfig(guild_id, config)
+}
+
+// Capacity returns the maximum number of players in the queue, or 0 if it's
+// unlimited.
+func (q *BattleTagQueues) Capacity(guild_id, name string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return 0, err
+	}
+	return config.Capacities[strings.ToLower(name)], nil
+}
+
+// SetCapacity limits the number of players in the queue. A capacity of 0
+// removes the limit.
+func (q *BattleTagQueues) SetCapacity(guild_id, name string,
+	capacity int) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name = strings.ToLower(name)
+	config, err := q.loadConfig(guild_id)
+	if err != nil {
+		return err
+	}
+	if !config.has(name) {
+		return QueueNotFound.New(name)
+	}
+
+	if capacity <= 0 {
+		delete(config.Capacities, name)
+	} else {
+		config.Capacities[name] = capacity
+	}
+	return q.saveConfig(guild_id, config)
+}
+
+// ensure that you're holding q.mu before calling!
+func (q *BattleTagQueues) loadConfig(guild_id string) (
+	*guildQueueConfig, error) {
+
+	config := &guildQueueConfig{}
+	config_bytes, err := q.configs.Get(guild_id)
+	if err != nil {
+		return nil, err
+	}
+	if len(config_bytes) > 0 {
+		if err = json.Unmarshal(config_bytes, config); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Queues) == 0 {
+		config.Queues = []string{defaultQueueName}
+	}
+	if config.ChannelDefaults == nil {
+		config.ChannelDefaults = make(map[string]string)
+	}
+	if config.Capacities == nil {
+		config.Capacities = make(map[string]int)
+	}
+
+	return config, nil
+}
+
+// ensure that you're holding q.mu before calling!
+func (q *BattleTagQueues) saveConfig(guild_id string,
+	config *guildQueueConfig) error {
+
+	config_bytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return q.configs.Set(guild_id, config_bytes)
+}
@@ -0,0 +1,441 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/queue"
+	"github.com/ewollesen/zenbot/util"
+)
+
+var (
+	readyCheckTimeout = flag.Duration("discord.ready_check_timeout",
+		2*time.Minute, "how long players taken from a queue have to "+
+			"confirm they're ready (0 disables ready checks)")
+	readyCheckRequeue = flag.Bool("discord.ready_check_requeue", true,
+		"return players who miss a ready check to the back of the "+
+			"queue, rather than dropping them")
+)
+
+// readyChecks tracks the ready checks each user has been invited to, so that
+// their confirmations can be routed to them. A user can be waiting on checks
+// for more than one queue at once.
+type readyChecks struct {
+	mu        sync.Mutex
+	checks    map[string][]*readyCheck // oldest first
+	audit_log auditlog.Log
+	// enqueue returns players who miss a check to the queue, or its
+	// waitlist, if the queue is full.
+	enqueue func(q *BattleTagQueue, ubt *userBattleTag) (pos int,
+		waitlisted bool, err error)
+}
+
+func newReadyChecks(audit_log auditlog.Log,
+	enqueue func(q *BattleTagQueue, ubt *userBattleTag) (pos int,
+		waitlisted bool, err error)) *readyChecks {
+
+	return &readyChecks{
+		checks:    make(map[string][]*readyCheck),
+		audit_log: audit_log,
+		enqueue:   enqueue,
+	}
+}
+
+// start DMs each of the taken players, asking them to confirm they're ready.
+// Players who haven't confirmed once the timeout expires are replaced with the
+// next players in the queue, who can fill the same roles if assigned maps the
+// taken players' BattleTags to roles. done is called once wanted players have
+// confirmed, or the queue runs dry.
+func (r *readyChecks) start(s Session, q *BattleTagQueue,
+	taken []*userBattleTag, assigned map[string]string,
+	timeout time.Duration, requeue bool,
+	done func(ready []*userBattleTag, assigned map[string]string)) *readyCheck {
+
+	rc := &readyCheck{
+		checks:      r,
+		s:           s,
+		q:           q,
+		timeout:     timeout,
+		requeue:     requeue,
+		wanted:      len(toBattleTags(taken)),
+		assigned:    assigned,
+		dm_channels: make(map[string]string),
+		done:        done,
+	}
+
+	rc.mu.Lock()
+	dms := rc.invite(taken)
+	rc.mu.Unlock()
+	rc.send(dms)
+
+	return rc
+}
+
+// lookup returns the oldest ready check the user has pending.
+func (r *readyChecks) lookup(user_id string) *readyCheck {
+	return r.lookupQueue(user_id, "")
+}
+
+// lookupQueue returns the oldest ready check the user has pending for the named
+// queue, or for any queue if name is empty.
+func (r *readyChecks) lookupQueue(user_id, name string) *readyCheck {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rc := range r.checks[user_id] {
+		if name == "" || strings.EqualFold(rc.q.Name(), name) {
+			return rc
+		}
+	}
+	return nil
+}
+
+func (r *readyChecks) add(user_id string, rc *readyCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.checks[user_id] {
+		if existing == rc {
+			return
+		}
+	}
+	r.checks[user_id] = append(r.checks[user_id], rc)
+}
+
+func (r *readyChecks) remove(user_id string, rc *readyCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	remaining := []*readyCheck{}
+	for _, existing := range r.checks[user_id] {
+		if existing != rc {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(r.checks, user_id)
+		return
+	}
+	r.checks[user_id] = remaining
+}
+
+// confirmed thanks the user for confirming btags are ready, reminding them of
+// any other ready check they have pending.
+func (r *readyChecks) confirmed(user_id string, btags []string) string {
+	msg := fmt.Sprintf("Thanks! %s is ready.", util.ToList(btags))
+	if next := r.lookup(user_id); next != nil {
+		msg += fmt.Sprintf(" You've also been taken from the %s "+
+			"queue; reply `!ready` again to confirm that too.",
+			next.q.Name())
+	}
+	return msg
+}
+
+// cancel ends the ready checks for a guild's queue without calling done,
+// telling the players invited to them, eg because the take was undone. It
+// returns the BattleTags of every entry invited to them, including
+// replacements.
+func (r *readyChecks) cancel(guild_id, name string) (invited map[string]bool) {
+	r.mu.Lock()
+	cancelled := make(map[*readyCheck]bool)
+	for _, rcs := range r.checks {
+		for _, rc := range rcs {
+			if rc.q.guild_id == guild_id && rc.q.Name() == name {
+				cancelled[rc] = true
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	invited = make(map[string]bool)
+	for rc := range cancelled {
+		var dms []readyCheckDM
+		rc.mu.Lock()
+		if rc.markFinished() {
+			for _, ubt := range rc.invited {
+				invited[ubt.BattleTag] = true
+			}
+			for _, ubt := range rc.pending {
+				r.remove(ubt.UserId, rc)
+			}
+			for user_id := range rc.dm_channels {
+				dms = append(dms, readyCheckDM{user_id,
+					fmt.Sprintf("The take from the %s queue "+
+						"was undone, so there's no need "+
+						"to confirm you're ready.",
+						rc.q.Name())})
+			}
+		}
+		rc.mu.Unlock()
+		rc.send(dms)
+	}
+	return invited
+}
+
+// confirmReaction confirms the user's oldest pending ready check, if the
+// reaction was made in the private channel the ready check was sent to. The
+// private channel is the same for every check, so a user with more than one
+// pending confirms them one reaction at a time.
+func (r *readyChecks) confirmReaction(channel_id, user_id string) []string {
+	rc := r.lookup(user_id)
+	if rc == nil || !rc.isDMChannel(user_id, channel_id) {
+		return nil
+	}
+
+	return rc.confirm(user_id)
+}
+
+// Entries are identified by the user who enqueued them. BattleTags added by
+// an admin are attributed to that admin, so the admin confirms on their
+// behalf.
+type readyCheck struct {
+	mu          sync.Mutex
+	checks      *readyChecks
+	s           Session
+	q           *BattleTagQueue
+	timeout     time.Duration
+	requeue     bool
+	wanted      int // players, rather than entries
+	assigned    map[string]string
+	invited     []*userBattleTag
+	confirmed   []*userBattleTag
+	pending     []*userBattleTag
+	dm_channels map[string]string
+	timer       *time.Timer
+	finished    bool
+	done        func(ready []*userBattleTag, assigned map[string]string)
+}
+
+// readyCheckDM is a DM to a user invited to a ready check. DMs are sent once
+// rc.mu is released, so that users confirming needn't wait on the network.
+type readyCheckDM struct {
+	user_id string
+	text    string
+}
+
+// send sends the DMs, opening a private channel to each user who hasn't been
+// DM'd yet. Don't hold rc.mu when calling.
+func (rc *readyCheck) send(dms []readyCheckDM) {
+	for _, dm := range dms {
+		rc.mu.Lock()
+		channel_id, ok := rc.dm_channels[dm.user_id]
+		rc.mu.Unlock()
+		if !ok {
+			channel, err := rc.s.UserChannelCreate(dm.user_id)
+			if err != nil {
+				logger.Errore(err)
+				continue
+			}
+			channel_id = channel.ID
+			rc.mu.Lock()
+			rc.dm_channels[dm.user_id] = channel_id
+			rc.mu.Unlock()
+		}
+		logger.Warne(rc.s.ChannelMessageSend(channel_id, dm.text))
+	}
+}
+
+// invite adds the entries to the check, and restarts its timer, returning the
+// DMs inviting their users to confirm. ensure that you're holding rc.mu
+// before calling!
+func (rc *readyCheck) invite(ubts []*userBattleTag) (dms []readyCheckDM) {
+	by_user := make(map[string][]string)
+	users := []string{}
+	for _, ubt := range ubts {
+		if _, ok := by_user[ubt.UserId]; !ok {
+			users = append(users, ubt.UserId)
+		}
+		by_user[ubt.UserId] = append(by_user[ubt.UserId],
+			ubt.Players()...)
+		rc.pending = append(rc.pending, ubt)
+		rc.invited = append(rc.invited, ubt)
+	}
+
+	for _, user_id := range users {
+		rc.checks.add(user_id, rc)
+		dms = append(dms, readyCheckDM{user_id, fmt.Sprintf(
+			"%s has been taken from the %s queue! Reply `!ready` "+
+				"here, or react to this message, within %s to "+
+				"confirm you're ready to play.",
+			util.ToList(withRoles(by_user[user_id], rc.assigned)),
+			rc.q.Name(), rc.timeout)})
+	}
+
+	if rc.timer != nil {
+		rc.timer.Stop()
+	}
+	rc.timer = time.AfterFunc(rc.timeout, rc.expire)
+	return dms
+}
+
+func (rc *readyCheck) isDMChannel(user_id, channel_id string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.dm_channels[user_id] == channel_id
+}
+
+// confirm marks all of the user's pending BattleTags as ready, returning them.
+func (rc *readyCheck) confirm(user_id string) (btags []string) {
+	rc.mu.Lock()
+
+	pending := []*userBattleTag{}
+	for _, ubt := range rc.pending {
+		if ubt.UserId == user_id {
+			rc.confirmed = append(rc.confirmed, ubt)
+			btags = append(btags, ubt.Players()...)
+			continue
+		}
+		pending = append(pending, ubt)
+	}
+	rc.pending = pending
+	rc.checks.remove(user_id, rc)
+
+	finished := len(rc.pending) == 0 && rc.markFinished()
+	rc.mu.Unlock()
+
+	if finished {
+		rc.done(rc.confirmed, rc.assigned)
+	}
+
+	return btags
+}
+
+// expire replaces the players who haven't confirmed with the next players in
+// the queue, then returns the laggards to the queue or drops them.
+func (rc *readyCheck) expire() {
+	rc.mu.Lock()
+
+	if rc.finished {
+		rc.mu.Unlock()
+		return
+	}
+
+	laggards := rc.pending
+	rc.pending = nil
+
+	// Replacements are taken before the laggards are requeued, so that they
+	// aren't simply picked again.
+	var replacements []*userBattleTag
+	positions, err := rc.q.Positions()
+	logger.Errore(err)
+	if rc.assigned != nil {
+		open := make(map[string]int)
+		for _, btag := range toBattleTags(laggards) {
+			open[rc.assigned[btag]]++
+			delete(rc.assigned, btag)
+		}
+		var assigned map[string]string
+		replacements, assigned, _, err = rc.q.DequeueRoles(open)
+		for btag, role := range assigned {
+			rc.assigned[btag] = role
+		}
+	} else {
+		replacements, _, err = rc.q.DequeueN(
+			rc.wanted - len(toBattleTags(rc.confirmed)))
+	}
+	logger.Errore(err)
+	for _, ubt := range replacements {
+		detail := "replacement"
+		if role := rc.assigned[ubt.BattleTag]; role != "" {
+			detail = role + " replacement"
+		}
+		rc.record(&auditlog.Event{
+			Action:    "take",
+			BattleTag: ubt.label(),
+			Position:  positions[ubt.BattleTag] + 1,
+			Detail:    detail,
+		})
+	}
+
+	var dms []readyCheckDM
+	for _, ubt := range laggards {
+		rc.checks.remove(ubt.UserId, rc)
+		if dm := rc.returnLaggard(ubt); dm != nil {
+			dms = append(dms, *dm)
+		}
+	}
+
+	finished := false
+	if len(replacements) > 0 {
+		dms = append(dms, rc.invite(replacements)...)
+	} else {
+		finished = rc.markFinished()
+	}
+	rc.mu.Unlock()
+	rc.send(dms)
+
+	if finished {
+		rc.done(rc.confirmed, rc.assigned)
+	}
+}
+
+// returnLaggard requeues or drops the entry, returning the DM telling its
+// user, if they were DM'd the invitation. ensure that you're holding rc.mu
+// before calling!
+func (rc *readyCheck) returnLaggard(ubt *userBattleTag) *readyCheckDM {
+	msg := "%s didn't confirm in time, and has been removed from the " +
+		"%s queue."
+	event := &auditlog.Event{
+		Action:    "remove",
+		BattleTag: ubt.label(),
+		Detail:    "didn't confirm",
+	}
+	if rc.requeue {
+		pos, waitlisted, err := rc.checks.enqueue(rc.q, ubt)
+		if err != nil && !queue.AlreadyEnqueued.Contains(err) {
+			logger.Errore(err)
+		}
+		if err == nil {
+			event.Action = "requeue"
+			event.Position = pos + 1
+		}
+		msg = "%s didn't confirm in time, and has been returned to " +
+			"the back of the %s queue."
+		if waitlisted {
+			event.Detail = "waitlist, didn't confirm"
+			msg = "%s didn't confirm in time, and, as the %s queue " +
+				"is full, has been added to its waitlist."
+		}
+	}
+	rc.record(event)
+
+	if _, ok := rc.dm_channels[ubt.UserId]; !ok {
+		return nil
+	}
+	return &readyCheckDM{ubt.UserId,
+		fmt.Sprintf(msg, ubt.label(), rc.q.Name())}
+}
+
+// record appends an event in the check's queue, made by the bot, to the
+// guild's audit log.
+func (rc *readyCheck) record(event *auditlog.Event) {
+	event.Queue = rc.q.Name()
+	recordBotEvent(rc.checks.audit_log, rc.q.guild_id, event)
+}
+
+// ensure that you're holding rc.mu before calling!
+func (rc *readyCheck) markFinished() bool {
+	if rc.finished {
+		return false
+	}
+	rc.finished = true
+	if rc.timer != nil {
+		rc.timer.Stop()
+	}
+	return true
+}
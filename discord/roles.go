@@ -0,0 +1,156 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+)
+
+// Overwatch teams are made up of two players in each role.
+var (
+	roles       = []string{"tank", "damage", "support"}
+	roleAliases = map[string]string{
+		"tank":    "tank",
+		"damage":  "damage",
+		"dps":     "damage",
+		"support": "support",
+		"healer":  "support",
+	}
+)
+
+// parseRoles parses a comma separated list of roles, eg "tank,support". ok is
+// false if any of them isn't a role.
+func parseRoles(text string) (parsed []string, ok bool) {
+	seen := make(map[string]bool)
+	for _, word := range strings.Split(strings.ToLower(text), ",") {
+		role, ok := roleAliases[strings.TrimSpace(word)]
+		if !ok {
+			return nil, false
+		}
+		if !seen[role] {
+			seen[role] = true
+			parsed = append(parsed, role)
+		}
+	}
+
+	return parsed, len(parsed) > 0
+}
+
+// lobbySlots returns the number of players wanted in each role when taking n
+// players, or nil if n players can't be split into teams of two of each role.
+func lobbySlots(n int) map[string]int {
+	if n <= 0 || n%(2*len(roles)) != 0 {
+		return nil
+	}
+
+	slots := make(map[string]int)
+	for _, role := range roles {
+		slots[role] = n / len(roles)
+	}
+	return slots
+}
+
+// roleMatcher assigns players to role slots, moving previously assigned
+// players between their preferred roles to make room where needed. Players
+// without preferred roles can fill any role.
+type roleMatcher struct {
+	slots     map[string]int
+	allowed   [][]string
+	occupants map[string][]int
+}
+
+func newRoleMatcher(slots map[string]int) *roleMatcher {
+	return &roleMatcher{
+		slots:     slots,
+		occupants: make(map[string][]int),
+	}
+}
+
+// add assigns all of the given players a role, or none of them if that isn't
+// possible.
+func (rm *roleMatcher) add(players [][]string) bool {
+	saved_allowed := rm.allowed
+	saved := make(map[string][]int)
+	for role, occupants := range rm.occupants {
+		saved[role] = append([]int(nil), occupants...)
+	}
+
+	for _, preferred := range players {
+		if len(preferred) == 0 {
+			preferred = roles
+		}
+		rm.allowed = append(rm.allowed, preferred)
+		if !rm.assign(len(rm.allowed)-1, make(map[string]bool)) {
+			rm.allowed, rm.occupants = saved_allowed, saved
+			return false
+		}
+	}
+
+	return true
+}
+
+func (rm *roleMatcher) assign(player int, visited map[string]bool) bool {
+	for _, role := range rm.allowed[player] {
+		if visited[role] {
+			continue
+		}
+		visited[role] = true
+		if len(rm.occupants[role]) < rm.slots[role] {
+			rm.occupants[role] = append(rm.occupants[role], player)
+			return true
+		}
+		for i, occupant := range rm.occupants[role] {
+			if rm.assign(occupant, visited) {
+				rm.occupants[role][i] = player
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// role returns the role the player, by order of addition, was assigned.
+func (rm *roleMatcher) role(player int) string {
+	for role, occupants := range rm.occupants {
+		for _, occupant := range occupants {
+			if occupant == player {
+				return role
+			}
+		}
+	}
+	return ""
+}
+
+// playerRoles returns the preferred roles of each of the entry's players.
+// Only the entry's own BattleTag has preferences; party members can fill any
+// role.
+func (ubt *userBattleTag) playerRoles() [][]string {
+	player_roles := make([][]string, len(ubt.Players()))
+	player_roles[0] = ubt.Roles
+	return player_roles
+}
+
+// withRoles formats BattleTags along with their assigned roles, if any.
+func withRoles(btags []string, assigned map[string]string) []string {
+	formatted := []string{}
+	for _, btag := range btags {
+		if role, ok := assigned[btag]; ok {
+			btag = btag + " (" + role + ")"
+		}
+		formatted = append(formatted, btag)
+	}
+	return formatted
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ewollesen/zenbot/overwatch/global"
+	"github.com/ewollesen/zenbot/partition"
+	"github.com/ewollesen/zenbot/queue"
+)
+
+func TestParseRoles(t *testing.T) {
+	test := newDiscordTest(t)
+
+	parsed, ok := parseRoles("Tank,dps,healer,tank")
+	test.Assert(ok)
+	test.AssertEqual(strings.Join(parsed, ","), "tank,damage,support")
+
+	_, ok = parseRoles("tank,sniper")
+	test.Assert(!ok)
+	_, ok = parseRoles("scrimmages")
+	test.Assert(!ok)
+
+	test.Assert(lobbySlots(12) != nil)
+	test.AssertEqual(lobbySlots(12)["tank"], 4)
+	test.Assert(lobbySlots(8) == nil)
+}
+
+func TestEnqueueRoles(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+
+	m := test.testMessage("!enqueue tank,support example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	test.AssertContainsRe(s.sends, "Enqueued example#1234 .* as "+
+		"tank/support in the scrimmages queue in position 1.")
+
+	ubt, err := test.queue().Find("example#1234")
+	test.AssertNil(err)
+	test.AssertEqual(strings.Join(ubt.Roles, ","), "tank,support")
+
+	m = test.testMessage("!enqueue damage example#1234")
+	test.AssertErrorContainedBy(qh.handleEnqueueUnlimited(s, m),
+		queue.AlreadyEnqueued)
+	test.AssertContainsRe(s.sends, "BattleTag example#1234 .* is "+
+		"already enqueued in the scrimmages queue in position 1.")
+}
+
+func TestTakeRoles(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+
+	users := generateUsers(8)
+	preferred := [][]string{{"tank"}, {"tank"}, {"tank"}, {"damage"},
+		{"support"}, nil, {"damage"}, {"support"}}
+	for i, user := range users {
+		user.Roles = preferred[i]
+	}
+	test.enqueue(users...)
+
+	// The third tank is skipped, and the flex player is moved to support
+	// to make room for the second damage player.
+	m := test.testMessage("!queue take 6")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContains(s.sends, "Took 6 BattleTags from the scrimmages "+
+		"queue: "+strings.Join([]string{
+		users[0].BattleTag + " (tank)",
+		users[1].BattleTag + " (tank)",
+		users[3].BattleTag + " (damage)",
+		users[4].BattleTag + " (support)",
+		users[5].BattleTag + " (support)",
+		users[6].BattleTag + " (damage)",
+	}, "  ")+". 2 BattleTags remain in the scrimmages queue.")
+
+	remaining, err := qh.queueBattleTags(test.queue())
+	test.AssertNil(err)
+	test.AssertEqual(strings.Join(remaining, " "),
+		users[2].BattleTag+" "+users[7].BattleTag)
+}
+
+func TestTakeRolesReadyCheck(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+
+	users := generateUsers(8)
+	preferred := [][]string{{"tank"}, {"damage"}, {"damage"}, {"support"},
+		{"support"}, {"tank"}, {"damage"}, {"tank"}}
+	for i, user := range users {
+		user.Roles = preferred[i]
+	}
+	test.enqueue(users...)
+
+	m := test.testMessage("!queue take 6")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContainsRe(s.sends, users[0].BattleTag+" \\(tank\\) has "+
+		"been taken from the scrimmages queue!")
+	for _, user := range users[1:6] {
+		qh.ready_checks.lookup(user.UserId).confirm(user.UserId)
+	}
+
+	// The tank who didn't confirm is replaced by the next tank, rather
+	// than the next player.
+	qh.ready_checks.lookup(users[0].UserId).expire()
+	test.AssertContainsRe(s.sends, users[7].BattleTag+" \\(tank\\) has "+
+		"been taken")
+	qh.ready_checks.lookup(users[7].UserId).confirm(users[7].UserId)
+	test.AssertContainsRe(s.sends, "All 6 BattleTags taken from the "+
+		"scrimmages queue are ready: .*"+users[7].BattleTag+" \\(tank\\)")
+
+	remaining, err := qh.queueBattleTags(test.queue())
+	test.AssertNil(err)
+	test.AssertEqual(strings.Join(remaining, " "),
+		users[6].BattleTag+" "+users[0].BattleTag)
+}
+
+func TestPartitionRoles(t *testing.T) {
+	for _, num_teams := range []int{2, 4} {
+		for _, name := range []string{"exact", "snake", "random"} {
+			test, _ := newQueueTest(t)
+			users := generateUsers(6 * num_teams)
+			for i, user := range users {
+				role := roles[i*len(roles)/len(users)]
+				user.Roles = []string{role}
+			}
+			test.enqueue(users...)
+
+			slots := lobbySlots(len(users))
+			taken, assigned, _, err :=
+				test.queue().DequeueRoles(slots)
+			test.AssertNil(err)
+			test.AssertEqual(len(assigned), len(users))
+
+			strategy, _ := partition.Strategy(name)
+			teams, _, _, err := partitionBattleTags(
+				global.New(test.overwatch), toBattleTags(taken),
+				nil, playerEntries(taken), assigned, &teamOptions{
+					strategy:  strategy,
+					num_teams: num_teams,
+				})
+			test.AssertNil(err)
+			test.AssertEqual(len(teams), num_teams)
+			for _, team := range teams {
+				counts := make(map[string]int)
+				for _, player := range team {
+					counts[player.Attributes["role"]]++
+				}
+				for _, role := range roles {
+					test.AssertEqual(counts[role],
+						slots[role]/num_teams)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,613 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/spacemonkeygo/errors"
+)
+
+const (
+	schedulesSetting = "queue_schedules"
+	// scheduledGuildsSetting lists the guilds with schedules, so that window
+	// starts can be announced without waiting for a message from the guild.
+	scheduledGuildsSetting = "scheduled_guilds"
+	globalSettings         = "global"
+
+	scheduleOpen   = "open"
+	scheduleClosed = "closed"
+)
+
+var (
+	QueueClosed = Error.NewClass("queue closed", errors.NoCaptureStack())
+
+	scheduleDays = map[string]time.Weekday{
+		"sun": time.Sunday, "sunday": time.Sunday,
+		"mon": time.Monday, "monday": time.Monday,
+		"tue": time.Tuesday, "tuesday": time.Tuesday,
+		"wed": time.Wednesday, "wednesday": time.Wednesday,
+		"thu": time.Thursday, "thursday": time.Thursday,
+		"fri": time.Friday, "friday": time.Friday,
+		"sat": time.Saturday, "saturday": time.Saturday,
+	}
+)
+
+// scheduleWindow is a weekly period during which a queue is open. Start is
+// in minutes after midnight, and windows may run past midnight.
+type scheduleWindow struct {
+	Day      time.Weekday `json:"day"`
+	Start    int          `json:"start"`
+	Duration int          `json:"duration"`
+}
+
+func (w scheduleWindow) String() string {
+	end := (w.Start + w.Duration) % (24 * 60)
+	return fmt.Sprintf("%s %02d:%02d-%02d:%02d", w.Day,
+		w.Start/60, w.Start%60, end/60, end%60)
+}
+
+// queueSchedule is a queue's recurring weekly windows, in its timezone. A
+// queue without windows is always open, unless closed by an admin. An admin's
+// override lasts until the next window starts or ends, or indefinitely if the
+// queue has no windows.
+type queueSchedule struct {
+	Timezone      string           `json:"timezone,omitempty"`
+	Windows       []scheduleWindow `json:"windows,omitempty"`
+	Override      string           `json:"override,omitempty"`
+	OverrideUntil time.Time        `json:"override_until,omitempty"`
+	// ChannelId is where window starts are announced.
+	ChannelId string `json:"channel_id,omitempty"`
+	// Announced is the start of the last window announced.
+	Announced time.Time `json:"announced,omitempty"`
+}
+
+type scheduleOccurrence struct {
+	start, end time.Time
+}
+
+type byStart []scheduleOccurrence
+
+func (b byStart) Len() int           { return len(b) }
+func (b byStart) Less(i, j int) bool { return b[i].start.Before(b[j].start) }
+func (b byStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (sc *queueSchedule) location() *time.Location {
+	if sc.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(sc.Timezone)
+	if err != nil {
+		logger.Warne(err)
+		return time.UTC
+	}
+	return loc
+}
+
+// occurrences returns the windows starting from the day before t until a week
+// after it, ordered by their start.
+func (sc *queueSchedule) occurrences(t time.Time) []scheduleOccurrence {
+	loc := sc.location()
+	y, mo, d := t.In(loc).Date()
+
+	occurrences := []scheduleOccurrence{}
+	for k := -1; k <= 7; k++ {
+		day := time.Date(y, mo, d+k, 0, 0, 0, 0, loc).Weekday()
+		for _, w := range sc.Windows {
+			if w.Day != day {
+				continue
+			}
+			start := time.Date(y, mo, d+k, 0, w.Start, 0, 0, loc)
+			occurrences = append(occurrences, scheduleOccurrence{
+				start: start,
+				end:   start.Add(time.Duration(w.Duration) * time.Minute),
+			})
+		}
+	}
+	sort.Sort(byStart(occurrences))
+
+	return occurrences
+}
+
+// current returns the window that t falls within, if any.
+func (sc *queueSchedule) current(t time.Time) (scheduleOccurrence, bool) {
+	for _, occ := range sc.occurrences(t) {
+		if !t.Before(occ.start) && t.Before(occ.end) {
+			return occ, true
+		}
+	}
+	return scheduleOccurrence{}, false
+}
+
+func (sc *queueSchedule) overridden(t time.Time) bool {
+	return sc.Override != "" &&
+		(sc.OverrideUntil.IsZero() || t.Before(sc.OverrideUntil))
+}
+
+func (sc *queueSchedule) open(t time.Time) bool {
+	if sc.overridden(t) {
+		return sc.Override == scheduleOpen
+	}
+	if len(sc.Windows) == 0 {
+		return true
+	}
+	_, ok := sc.current(t)
+	return ok
+}
+
+// nextOpen returns when a closed queue will next open. It returns false if
+// the queue won't open until an admin opens it.
+func (sc *queueSchedule) nextOpen(t time.Time) (time.Time, bool) {
+	for _, occ := range sc.occurrences(t) {
+		if !occ.start.Before(t) && sc.open(occ.start) {
+			return occ.start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// nextBoundary returns the next time after t that a window starts or ends, or
+// the zero time if the queue has no windows.
+func (sc *queueSchedule) nextBoundary(t time.Time) time.Time {
+	var next time.Time
+	for _, occ := range sc.occurrences(t) {
+		for _, b := range []time.Time{occ.start, occ.end} {
+			if b.After(t) && (next.IsZero() || b.Before(next)) {
+				next = b
+			}
+		}
+	}
+	return next
+}
+
+func (sc *queueSchedule) setOverride(override string, now time.Time) {
+	sc.Override = override
+	sc.OverrideUntil = sc.nextBoundary(now)
+}
+
+// format formats t in the schedule's timezone.
+func (sc *queueSchedule) format(t time.Time) string {
+	return t.In(sc.location()).Format("Monday 15:04 MST")
+}
+
+// parseScheduleWindow parses a day and a range of times, eg "mon
+// 19:00-22:00".
+func parseScheduleWindow(day, times string) (scheduleWindow, bool) {
+	weekday, ok := scheduleDays[strings.ToLower(day)]
+	if !ok {
+		return scheduleWindow{}, false
+	}
+	parts := strings.Split(times, "-")
+	if len(parts) != 2 {
+		return scheduleWindow{}, false
+	}
+	start, ok := parseClock(parts[0])
+	if !ok {
+		return scheduleWindow{}, false
+	}
+	end, ok := parseClock(parts[1])
+	if !ok || end == start {
+		return scheduleWindow{}, false
+	}
+
+	return scheduleWindow{
+		Day:      weekday,
+		Start:    start,
+		Duration: (end - start + 24*60) % (24 * 60),
+	}, true
+}
+
+// parseClock parses a 24-hour time, eg "19:30", into minutes after midnight.
+func parseClock(text string) (int, bool) {
+	parts := strings.Split(text, ":")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 23 {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, false
+	}
+	return hours*60 + minutes, true
+}
+
+// queueSchedules stores each guild's queue schedules as a guild setting,
+// keyed by queue name.
+type queueSchedules struct {
+	mu       sync.Mutex
+	settings *guildSettings
+	queues   *BattleTagQueues
+	now      func() time.Time
+}
+
+func newQueueSchedules(queues *BattleTagQueues,
+	settings *guildSettings) *queueSchedules {
+
+	return &queueSchedules{
+		settings: settings,
+		queues:   queues,
+		now:      time.Now,
+	}
+}
+
+func (q *queueSchedules) get(guild_id, name string) (*queueSchedule, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	schedules, err := q.load(guild_id)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := schedules[name]
+	if !ok {
+		return &queueSchedule{}, nil
+	}
+	return sc, nil
+}
+
+// check returns a QueueClosed error if the queue is closed, along with when
+// it opens next, if it's scheduled to.
+func (q *queueSchedules) check(guild_id, name string) (
+	next string, err error) {
+
+	sc, err := q.get(guild_id, name)
+	if err != nil {
+		return "", err
+	}
+	now := q.now()
+	if sc.open(now) {
+		return "", nil
+	}
+	if t, ok := sc.nextOpen(now); ok {
+		next = sc.format(t)
+	}
+	return next, QueueClosed.New(name)
+}
+
+// update applies fn to the queue's schedule, and saves the result.
+func (q *queueSchedules) update(guild_id, name string,
+	fn func(sc *queueSchedule, now time.Time) error) (*queueSchedule, error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	schedules, err := q.load(guild_id)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := schedules[name]
+	if !ok {
+		sc = &queueSchedule{}
+		schedules[name] = sc
+	}
+	if err = fn(sc, q.now()); err != nil {
+		return nil, err
+	}
+	if err = q.settings.save(guild_id, schedulesSetting, schedules); err != nil {
+		return nil, err
+	}
+
+	return sc, q.addGuild(guild_id)
+}
+
+// rename keeps a queue's schedule when the queue is renamed.
+func (q *queueSchedules) rename(guild_id, old_name, new_name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	schedules, err := q.load(guild_id)
+	if err != nil {
+		return err
+	}
+	sc, ok := schedules[old_name]
+	if !ok {
+		return nil
+	}
+	delete(schedules, old_name)
+	schedules[new_name] = sc
+
+	return q.settings.save(guild_id, schedulesSetting, schedules)
+}
+
+func (q *queueSchedules) remove(guild_id, name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	schedules, err := q.load(guild_id)
+	if err != nil {
+		return err
+	}
+	if _, ok := schedules[name]; !ok {
+		return nil
+	}
+	delete(schedules, name)
+
+	return q.settings.save(guild_id, schedulesSetting, schedules)
+}
+
+// tick announces each window that has started since it was last called, in
+// the channel the queue's schedule was last changed from.
+func (q *queueSchedules) tick(s Session) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	guild_ids := []string{}
+	err := q.settings.load(globalSettings, scheduledGuildsSetting, &guild_ids)
+	if err != nil {
+		logger.Errore(err)
+		return
+	}
+
+	now := q.now()
+	for _, guild_id := range guild_ids {
+		schedules, err := q.load(guild_id)
+		if err != nil {
+			logger.Errore(err)
+			continue
+		}
+		announced := false
+		for name, sc := range schedules {
+			if sc.ChannelId == "" || !sc.open(now) {
+				continue
+			}
+			occ, ok := sc.current(now)
+			if !ok || !occ.start.After(sc.Announced) {
+				continue
+			}
+			sc.Announced = occ.start
+			announced = true
+			logger.Warne(s.ChannelMessageSend(sc.ChannelId, fmt.Sprintf(
+				"The %s queue is now open, until %s! Try `!enqueue`.",
+				name, sc.format(occ.end))))
+		}
+		if announced {
+			logger.Errore(q.settings.save(guild_id, schedulesSetting,
+				schedules))
+		}
+	}
+}
+
+// run calls tick every interval, until quit is closed.
+func (q *queueSchedules) run(s Session, interval time.Duration,
+	quit <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.tick(s)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// ensure that you're holding q.mu before calling!
+func (q *queueSchedules) load(guild_id string) (
+	map[string]*queueSchedule, error) {
+
+	schedules := make(map[string]*queueSchedule)
+	err := q.settings.load(guild_id, schedulesSetting, &schedules)
+	return schedules, err
+}
+
+// ensure that you're holding q.mu before calling!
+func (q *queueSchedules) addGuild(guild_id string) error {
+	guild_ids := []string{}
+	err := q.settings.load(globalSettings, scheduledGuildsSetting, &guild_ids)
+	if err != nil {
+		return err
+	}
+	for _, candidate := range guild_ids {
+		if candidate == guild_id {
+			return nil
+		}
+	}
+
+	return q.settings.save(globalSettings, scheduledGuildsSetting,
+		append(guild_ids, guild_id))
+}
+
+// checkOpen replies and returns a QueueClosed error if the queue is closed.
+func (h *queueHandler) checkOpen(s Session, m *discordgo.MessageCreate,
+	q *BattleTagQueue) error {
+
+	next, err := h.schedules.check(q.guild_id, q.Name())
+	if err == nil {
+		return nil
+	}
+	if !QueueClosed.Contains(err) {
+		reply(s, m, "Error checking the %s queue's schedule. "+
+			"Please try again.", q.Name())
+		return err
+	}
+	if next == "" {
+		reply(s, m, "The %s queue is closed.", q.Name())
+		return err
+	}
+	reply(s, m, "The %s queue is closed. It opens next %s.", q.Name(), next)
+	return err
+}
+
+func (h *queueHandler) handleOpenUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	return h.overrideSchedule(s, m, scheduleOpen)
+}
+
+func (h *queueHandler) handleCloseUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	return h.overrideSchedule(s, m, scheduleClosed)
+}
+
+func (h *queueHandler) overrideSchedule(s Session, m *discordgo.MessageCreate,
+	override string) (err error) {
+
+	q, _, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	sc, err := h.schedules.update(q.guild_id, q.Name(),
+		func(sc *queueSchedule, now time.Time) error {
+			sc.setOverride(override, now)
+			sc.ChannelId = m.ChannelID
+			return nil
+		})
+	if err != nil {
+		reply(s, m, "Error updating the %s queue's schedule. "+
+			"Please try again.", q.Name())
+		return err
+	}
+
+	if sc.OverrideUntil.IsZero() {
+		reply(s, m, "The %s queue is now %s.", q.Name(), override)
+		return nil
+	}
+	reply(s, m, "The %s queue is now %s, until %s.", q.Name(), override,
+		sc.format(sc.OverrideUntil))
+	return nil
+}
+
+func (h *queueHandler) handleScheduleUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	args := commandArgs(m, 2)
+	is_action := func(args []string) bool {
+		if len(args) == 0 {
+			return false
+		}
+		switch strings.ToLower(args[0]) {
+		case "add", "clear", "timezone":
+			return true
+		}
+		return false
+	}
+
+	var q *BattleTagQueue
+	if is_action(args) {
+		q, _, err = h.guildQueue(s, m, nil)
+	} else {
+		q, args, err = h.guildQueue(s, m, args)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return h.replySchedule(s, m, q)
+	}
+
+	action, args := strings.ToLower(args[0]), args[1:]
+	var fn func(sc *queueSchedule, now time.Time) error
+	switch action {
+	case "add":
+		var w scheduleWindow
+		ok := len(args) == 2
+		if ok {
+			w, ok = parseScheduleWindow(args[0], args[1])
+		}
+		if !ok {
+			reply(s, m, "Invalid window. Try `!queue schedule "+
+				"add mon 19:00-22:00`.")
+			return nil
+		}
+		fn = func(sc *queueSchedule, now time.Time) error {
+			sc.Windows = append(sc.Windows, w)
+			sc.Override = ""
+			return nil
+		}
+	case "clear":
+		fn = func(sc *queueSchedule, now time.Time) error {
+			sc.Windows = nil
+			sc.Override = ""
+			return nil
+		}
+	case "timezone":
+		if len(args) != 1 {
+			reply(s, m, "No timezone specified. Try `!queue "+
+				"schedule timezone America/Denver`.")
+			return nil
+		}
+		if _, err := time.LoadLocation(args[0]); err != nil {
+			reply(s, m, "Invalid timezone %q. Try `!queue "+
+				"schedule timezone America/Denver`.", args[0])
+			return nil
+		}
+		fn = func(sc *queueSchedule, now time.Time) error {
+			sc.Timezone = args[0]
+			return nil
+		}
+	default:
+		reply(s, m, "Invalid schedule command %q. Try `!queue "+
+			"schedule add`, `clear` or `timezone`.", action)
+		return nil
+	}
+
+	_, err = h.schedules.update(q.guild_id, q.Name(),
+		func(sc *queueSchedule, now time.Time) error {
+			sc.ChannelId = m.ChannelID
+			return fn(sc, now)
+		})
+	if err != nil {
+		reply(s, m, "Error updating the %s queue's schedule. "+
+			"Please try again.", q.Name())
+		return err
+	}
+
+	return h.replySchedule(s, m, q)
+}
+
+func (h *queueHandler) replySchedule(s Session, m *discordgo.MessageCreate,
+	q *BattleTagQueue) error {
+
+	sc, err := h.schedules.get(q.guild_id, q.Name())
+	if err != nil {
+		reply(s, m, "Error loading the %s queue's schedule. "+
+			"Please try again.", q.Name())
+		return err
+	}
+
+	now := h.schedules.now()
+	state := "closed"
+	if sc.open(now) {
+		state = "open"
+	}
+	if len(sc.Windows) == 0 {
+		reply(s, m, "The %s queue is %s, and has no schedule. Try "+
+			"`!queue schedule add mon 19:00-22:00`.", q.Name(), state)
+		return nil
+	}
+
+	windows := []string{}
+	for _, w := range sc.Windows {
+		windows = append(windows, w.String())
+	}
+	reply(s, m, "The %s queue is %s. It's scheduled to open %s (%s).",
+		q.Name(), state, strings.Join(windows, ", "),
+		sc.location())
+	return nil
+}
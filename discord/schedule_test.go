@@ -0,0 +1,124 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindows(t *testing.T) {
+	test := newDiscordTest(t)
+
+	w, ok := parseScheduleWindow("Fri", "22:00-02:00")
+	test.Assert(ok)
+	test.AssertEqual(w.String(), "Friday 22:00-02:00")
+	test.AssertEqual(w.Duration, 4*60)
+	_, ok = parseScheduleWindow("fri", "22:00-22:00")
+	test.Assert(!ok)
+	_, ok = parseScheduleWindow("someday", "19:00-22:00")
+	test.Assert(!ok)
+	_, ok = parseScheduleWindow("mon", "19:00-24:00")
+	test.Assert(!ok)
+
+	sc := &queueSchedule{
+		Timezone: "America/Denver",
+		Windows:  []scheduleWindow{w},
+	}
+	loc := sc.location()
+	// 2017-03-03 is a Friday.
+	friday := time.Date(2017, 3, 3, 21, 0, 0, 0, loc)
+	test.Assert(!sc.open(friday))
+	next, ok := sc.nextOpen(friday)
+	test.Assert(ok)
+	test.AssertEqual(sc.format(next), "Friday 22:00 MST")
+	test.Assert(sc.open(friday.Add(2 * time.Hour)))
+	// The window runs past midnight.
+	test.Assert(sc.open(friday.Add(4 * time.Hour)))
+	test.Assert(!sc.open(friday.Add(5 * time.Hour)))
+	next, ok = sc.nextOpen(friday.Add(5 * time.Hour))
+	test.Assert(ok)
+	test.Assert(next.Equal(friday.Add(7*24*time.Hour + time.Hour)))
+
+	// Closing the queue lasts until the next window starts or ends.
+	sc.setOverride(scheduleClosed, friday.Add(2*time.Hour))
+	test.Assert(!sc.open(friday.Add(2 * time.Hour)))
+	test.Assert(sc.OverrideUntil.Equal(friday.Add(5 * time.Hour)))
+	next, ok = sc.nextOpen(friday.Add(2 * time.Hour))
+	test.Assert(ok)
+	test.Assert(next.Equal(friday.Add(7*24*time.Hour + time.Hour)))
+
+	// Without windows, the queue is open until it's closed.
+	sc = &queueSchedule{}
+	test.Assert(sc.open(friday))
+	sc.setOverride(scheduleClosed, friday)
+	test.Assert(!sc.open(friday.Add(1000 * time.Hour)))
+	_, ok = sc.nextOpen(friday)
+	test.Assert(!ok)
+}
+
+func TestQueueSchedule(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	// 2017-03-06 is a Monday.
+	now := time.Date(2017, 3, 6, 18, 0, 0, 0, time.UTC)
+	qh.schedules.now = func() time.Time { return now }
+
+	m := test.testMessage("!queue close")
+	test.AssertNil(qh.handleCloseUnsafe(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue is now closed.")
+
+	m = test.testMessage("!enqueue example#1234")
+	test.AssertErrorContainedBy(qh.handleEnqueueUnlimited(s, m),
+		QueueClosed)
+	test.AssertContains(s.sends, "The scrimmages queue is closed.")
+
+	m = test.testMessage("!queue open")
+	test.AssertNil(qh.handleOpenUnsafe(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue is now open.")
+	m = test.testMessage("!enqueue example#1234")
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+
+	m = test.testMessage("!queue schedule add mon 19:00-22:00")
+	test.AssertNil(qh.handleScheduleUnsafe(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue is closed. It's "+
+		"scheduled to open Monday 19:00-22:00 (UTC).")
+
+	m = test.testMessage("!enqueue example#5678")
+	test.AssertErrorContainedBy(qh.handleEnqueueUnlimited(s, m),
+		QueueClosed)
+	test.AssertContains(s.sends, "The scrimmages queue is closed. It "+
+		"opens next Monday 19:00 UTC.")
+
+	s.clearSends()
+	qh.schedules.tick(s)
+	test.AssertEqual(len(s.sends), 0)
+
+	now = now.Add(90 * time.Minute)
+	qh.schedules.tick(s)
+	test.AssertContains(s.sends, "The scrimmages queue is now open, until "+
+		"Monday 22:00 UTC! Try `!enqueue`.")
+	// Each window is announced once.
+	s.clearSends()
+	qh.schedules.tick(s)
+	test.AssertEqual(len(s.sends), 0)
+
+	m = test.testMessage("!queue rename scrimmages casual")
+	test.AssertNil(qh.handleRenameUnsafe(s, m))
+	m = test.testMessage("!queue schedule casual")
+	test.AssertNil(qh.handleScheduleUnsafe(s, m))
+	test.AssertContains(s.sends, "The casual queue is open. It's "+
+		"scheduled to open Monday 19:00-22:00 (UTC).")
+}
@@ -14,7 +14,11 @@
 
 package discord
 
-import "github.com/ewollesen/discordgo"
+import (
+	"io"
+
+	"github.com/ewollesen/discordgo"
+)
 
 type session struct {
 	*discordgo.Session
@@ -26,6 +30,13 @@ func (s *session) Channel(channel_id string) (*discordgo.Channel, error) {
 	return s.Session.Channel(channel_id)
 }
 
+func (s *session) ChannelFileSend(channel_id, name string,
+	r io.Reader) error {
+
+	_, err := s.Session.ChannelFileSend(channel_id, name, r)
+	return err
+}
+
 func (s *session) ChannelMessageSend(channel_id, msg string) error {
 	_, err := s.Session.ChannelMessageSend(channel_id, msg)
 	return err
@@ -0,0 +1,56 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"encoding/json"
+
+	"github.com/ewollesen/zenbot/cache"
+)
+
+// guildSettings persists small per-guild settings, each stored as a JSON
+// document under its own name.
+type guildSettings struct {
+	c cache.Cache
+}
+
+func newGuildSettings(c cache.Cache) *guildSettings {
+	return &guildSettings{
+		c: c,
+	}
+}
+
+// load unmarshals the named setting into value. If the setting has never been
+// saved, value is left untouched.
+func (g *guildSettings) load(guild_id, name string, value interface{}) error {
+	value_bytes, err := g.c.Get(guild_id + "." + name)
+	if err != nil {
+		return err
+	}
+	if len(value_bytes) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(value_bytes, value)
+}
+
+func (g *guildSettings) save(guild_id, name string, value interface{}) error {
+	value_bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return g.c.Set(guild_id+"."+name, value_bytes)
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/ewollesen/zenbot/overwatch"
 	"github.com/ewollesen/zenbot/partition"
 	"github.com/ewollesen/zenbot/util"
+	"github.com/spacemonkeygo/errors"
 )
 
 var (
@@ -32,16 +33,16 @@ var (
 
 	skillRankHelpMsg = strings.TrimSpace(strings.Join([]string{
 		"Looks up the Skill Rank for a BattleTag. BattleTags are CaSe-SeNsiTiVe! Ranks are cached, and therefore may be slightly out of date.",
-		"`!sr example#1234` - looks up the skill rank for example#1234 (PC only for now)",
+		"`!sr [platform] [region] example#1234` - looks up the skill rank for example#1234, on pc unless psn or xbl is given, in any region, starting with the one given",
 		"`!sr help` - displays this help message",
 	}, "\n"))
 
 	TooManyLookupFailures = Error.NewClass("too many skill rank lookup failures")
-	BTagNotFound          = Error.NewClass("couldn't find a BattleTag for rank")
 )
 
 type skillRankHandler struct {
 	btags     *BattleTagCache
+	settings  *guildSettings
 	overwatch overwatch.OverwatchAPI
 }
 
@@ -61,7 +62,7 @@ func (sr *skillRankHandler) Handle(s Session, m *discordgo.MessageCreate,
 		case "help":
 			reply(s, m, skillRankHelpMsg)
 		default:
-			err = sr.handleSkillRank(s, m, argv[1])
+			err = sr.handleSkillRank(s, m, argv[1:])
 		}
 	case "teams":
 		err = sr.handleTeams(s, m)
@@ -77,27 +78,36 @@ func (sr *skillRankHandler) Help(argv ...string) string {
 	}
 	switch term {
 	case "sr":
-		return wrap("looks up the skill rank for the given BattleTag (PC, US only for now)")
+		return wrap("looks up the skill rank for the given BattleTag, optionally on a platform or in a region, eg `!sr psn eu example#1234`")
 	case "teams":
-		return wrap("given a list of BattleTags, divides them into two balanced teams")
+		return wrap("given a list of BattleTags, divides them into two balanced teams, or more with `teams=<n>`, optionally with a `--strategy=` of " + strategyNames() + ", and constraints such as `together(a#1234,b#5678)` or `apart(c#1234,d#5678)`")
 	default:
 		return fmt.Sprintf("no help found for %q", term)
 	}
 }
 
-func newSkillRankHandler(btags *BattleTagCache,
+func newSkillRankHandler(btags *BattleTagCache, settings *guildSettings,
 	ow overwatch.OverwatchAPI) *skillRankHandler {
 
 	return &skillRankHandler{
 		btags:     btags,
+		settings:  settings,
 		overwatch: ow,
 	}
 }
 
 func (sr *skillRankHandler) handleSkillRank(s Session,
-	m *discordgo.MessageCreate, btag string) (err error) {
+	m *discordgo.MessageCreate, args []string) (err error) {
 
-	rank, err := sr.overwatch.SkillRank(overwatch.PlatformPC, btag)
+	pref, args, _ := parsePlatform(args)
+	if len(args) == 0 {
+		reply(s, m, skillRankHelpMsg)
+		return nil
+	}
+	btag := args[0]
+
+	rank, err := sr.overwatch.PreferredSkillRank(pref.platform(),
+		pref.Region, btag)
 	if err != nil {
 		if overwatch.BattleTagUnranked.Contains(err) {
 			reply(s, m, "Skill rank for %s: Unranked. "+
@@ -117,14 +127,20 @@ func (sr *skillRankHandler) handleSkillRank(s Session,
 func (sr *skillRankHandler) handleTeams(s Session,
 	m *discordgo.MessageCreate) (err error) {
 
-	words := strings.Split(m.Content, " ")[1:]
-	btags := blizzard.FindBattleTags(sr.replaceMentions(m.Content))
+	// Mentions are replaced first, so that they can be used in
+	// constraints.
+	opts, words, err := chooseTeamOptions(s, m, sr.settings,
+		strings.Split(sr.replaceMentions(m.Content), " ")[1:])
+	if err != nil {
+		return err
+	}
+	btags := blizzard.FindBattleTags(strings.Join(words, " "))
 	if len(btags) != len(words) {
 		replyPrivate(s, m, "Found only %d BattleTags. "+
 			"Just a heads up!", len(btags))
 	}
 
-	return sr.replyPartition(s, m, btags)
+	return sr.replyPartition(s, m, btags, opts)
 }
 
 func (sr *skillRankHandler) replaceMentions(text string) string {
@@ -155,9 +171,9 @@ func (sr *skillRankHandler) lookupBattleTag(s Session,
 
 // TODO: DRY up with queueHandler's version
 func (sr *skillRankHandler) replyPartition(s Session,
-	m *discordgo.MessageCreate, btags []string) error {
+	m *discordgo.MessageCreate, btags []string, opts *teamOptions) error {
 
-	return replyPartition(s, m, sr.overwatch, btags)
+	return replyPartition(s, m, sr.overwatch, btags, nil, nil, nil, opts)
 }
 
 func averageRank(ranks []int) int {
@@ -168,99 +184,154 @@ func averageRank(ranks []int) int {
 	return sum / len(ranks)
 }
 
-type rankBtagPair struct {
-	Rank      int
-	BattleTag string
+// partitionBattleTags splits the BattleTags into teams of players as opts
+// asks, returning the strategy that was actually used, and why, if it isn't
+// the one asked for. The players' ids are their BattleTags, and their weights
+// are their skill ranks. Each player's platform is kept in their "platform"
+// attribute, and the role they were assigned, if any, in their "role"
+// attribute. Each team gets an even share of the players in each role. The
+// default strategy is used instead of the chosen one if it can only make two
+// teams and more are wanted, or if its teams don't meet the constraints,
+// share out the roles, or split up a party. Parties are kept together where
+// possible, but constraints and roles must be met, so an error explains any
+// that can't be.
+func partitionBattleTags(ow overwatch.OverwatchAPI, btags []string,
+	parties [][]string, entries map[string]*userBattleTag,
+	assigned map[string]string, opts *teamOptions) (
+	teams [][]*partition.Player, used partition.Partitioner, why string,
+	err error) {
+
+	btag_ranks, err := lookupRanks(ow, btags, entries)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	players := make([]*partition.Player, len(btags))
+	spread := ""
+	for i, btag := range btags {
+		platform := overwatch.PlatformPC
+		if ubt := entries[btag]; ubt != nil {
+			platform = ubt.platform()
+		}
+		players[i] = &partition.Player{
+			Id:         btag,
+			Weight:     btag_ranks[i],
+			Attributes: map[string]string{"platform": platform},
+		}
+		if role, ok := assigned[btag]; ok {
+			players[i].Attributes["role"] = role
+			spread = "role"
+		}
+	}
+
+	exact, _ := partition.Strategy(partition.DefaultStrategy)
+	used = opts.strategy
+	if opts.num_teams == 2 {
+		team_one, team_two := used.Teams(players)
+		teams = [][]*partition.Player{team_one, team_two}
+	} else if multi, ok := used.(partition.MultiPartitioner); ok {
+		teams = multi.TeamsN(players, opts.num_teams)
+	} else {
+		used, why = exact, "only makes two teams"
+		teams = partition.TeamsN(players, opts.num_teams)
+	}
+
+	constraints := &partition.Constraints{Spread: spread}
+	if opts.constraints != nil {
+		constraints.Together = opts.constraints.Together
+		constraints.Apart = opts.constraints.Apart
+	}
+	with_parties := &partition.Constraints{
+		Together: append(append([][]string{}, parties...),
+			constraints.Together...),
+		Apart:  constraints.Apart,
+		Spread: constraints.Spread,
+	}
+	if with_parties.Met(teams) {
+		return teams, used, why, nil
+	}
+	if why == "" {
+		why = "split up a party"
+		roles := &partition.Constraints{Spread: spread}
+		if !roles.Met(teams) {
+			why = "didn't share out the roles"
+		}
+		if !opts.constraints.Met(teams) {
+			why = "didn't meet the constraints"
+		}
+	}
+
+	constrained, err := partition.ConstrainedTeams(players, opts.num_teams,
+		with_parties)
+	if err != nil && len(parties) > 0 {
+		logger.Warnf("unable to keep parties %v together", parties)
+		if constraints.Met(teams) {
+			return teams, used, why, nil
+		}
+		constrained, err = partition.ConstrainedTeams(players,
+			opts.num_teams, constraints)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return constrained, exact, why, nil
 }
 
-// TODO: DRY up with the queueHandler's version
-func partitionBattleTags(ow overwatch.OverwatchAPI, btags []string) (
-	team_one, team_two []*rankBtagPair, err error) {
+// lookupRanks returns the skill rank of each BattleTag, in order, on the
+// platform of its queue entry, if it has one. BattleTags whose rank can't be
+// looked up are given the average of the others.
+func lookupRanks(ow overwatch.OverwatchAPI, btags []string,
+	entries map[string]*userBattleTag) (btag_ranks []int, err error) {
 
-	ranks := make(map[int][]string)
+	btag_ranks = make([]int, len(btags))
 	all_ranks := []int{}
 	failures := 0
-	no_ranks := []string{}
+	no_ranks := []int{}
 
 	// Optimization: parallelize
-	for _, btag := range btags {
-		rank, err := ow.SkillRank(overwatch.PlatformPC, btag)
+	for i, btag := range btags {
+		rank, err := skillRank(ow, btag, entries)
 		if err != nil {
 			logger.Errore(err)
 			failures++
 			if failures >= len(btags)/4 {
-				return nil, nil, TooManyLookupFailures.Wrap(err)
+				return nil, TooManyLookupFailures.Wrap(err)
 			}
-			no_ranks = append(no_ranks, btag)
+			no_ranks = append(no_ranks, i)
 			continue
 		}
 
 		all_ranks = append(all_ranks, rank)
-
-		_, ok := ranks[rank]
-		if ok {
-			ranks[rank] = append(ranks[rank], btag)
-		} else {
-			ranks[rank] = []string{btag}
-		}
+		btag_ranks[i] = rank
 	}
 
 	if len(no_ranks) > 0 {
 		// Loop through the BattleTags for which we couldn't look up a
 		// skill rank, and give them the average of the other players.
 		average_rank := averageRank(all_ranks)
-		for _, btag := range no_ranks {
+		for _, i := range no_ranks {
 			logger.Debugf("assigning average rank (%d) for btag %s",
-				average_rank, btag)
-			all_ranks = append(all_ranks, average_rank)
-			_, ok := ranks[average_rank]
-			if ok {
-				ranks[average_rank] =
-					append(ranks[average_rank], btag)
-			} else {
-				ranks[average_rank] = []string{btag}
-			}
+				average_rank, btags[i])
+			btag_ranks[i] = average_rank
 		}
 	}
 
-	if len(all_ranks) != len(btags) {
-		logger.Warnf("something is weird, I don't have a rank for "+
-			"each battle tag (%d vs %d)", len(all_ranks), len(btags))
-	}
-
-	logger.Debugf("all_ranks: %v", all_ranks)
-
-	team_one_ranks, team_two_ranks := partition.Partition(all_ranks)
-	for _, team_one_rank := range team_one_ranks {
-		btags, ok := ranks[team_one_rank]
-		if !ok || len(btags) == 0 {
-			return nil, nil, BTagNotFound.New("%d", team_one_rank)
-		}
-		team_one = append(team_one, &rankBtagPair{
-			BattleTag: btags[0],
-			Rank:      team_one_rank,
-		})
-		ranks[team_one_rank] = btags[1:]
-	}
-	for _, team_two_rank := range team_two_ranks {
-		btags, ok := ranks[team_two_rank]
-		if !ok || len(btags) == 0 {
-			return nil, nil, BTagNotFound.New("%d", team_two_rank)
-		}
-		team_two = append(team_two, &rankBtagPair{
-			BattleTag: btags[0],
-			Rank:      team_two_rank,
-		})
-		ranks[team_two_rank] = btags[1:]
-	}
-
-	return team_one, team_two, nil
+	return btag_ranks, nil
 }
 
+// replyPartition suggests teams made up of the BattleTags, made as opts asks,
+// with each team's average skill rank, keeping the members of each party on
+// the same team where possible. entries, if given, maps BattleTags to their
+// queue entries, whose platforms are used to look up skill ranks, and flagged
+// if they're mixed. assigned, if given, maps BattleTags to the roles they were
+// taken to fill, which are shared out evenly between the teams.
 func replyPartition(s Session, m *discordgo.MessageCreate,
-	ow overwatch.OverwatchAPI, btags []string) error {
+	ow overwatch.OverwatchAPI, btags []string, parties [][]string,
+	entries map[string]*userBattleTag, assigned map[string]string,
+	opts *teamOptions) error {
 
-	team_one, team_two, err := partitionBattleTags(ow, btags)
+	teams, used, why, err := partitionBattleTags(ow, btags, parties,
+		entries, assigned, opts)
 	if err != nil {
 		if TooManyLookupFailures.Contains(err) {
 			replyPrivate(s, m, "I failed to look up Skill "+
@@ -268,37 +339,50 @@ func replyPartition(s Session, m *discordgo.MessageCreate,
 				"so I'm giving up. Look up failures are often "+
 				"caused by case-sensitivity errors in "+
 				"BattleTags.")
+		} else if partition.Unsatisfiable.Contains(err) {
+			replyPrivate(s, m, "I can't make teams that meet every "+
+				"constraint, as %s.", errors.GetMessage(err))
 		} else {
 			replyPrivate(s, m, "Error partitioning into teams.")
 		}
 		return err
 	}
 
-	team_one_avg := 0.0
-	team_one_btags := []string{}
-	for _, pair := range team_one {
-		team_one_avg += float64(pair.Rank)
-		team_one_btags = append(team_one_btags, pair.BattleTag)
+	how := fmt.Sprintf("using the %s strategy", used.Name())
+	if used != opts.strategy {
+		how = fmt.Sprintf("using the %s strategy, as the %s strategy %s",
+			used.Name(), opts.strategy.Name(), why)
 	}
-	team_one_avg /= float64(len(team_one))
-
-	team_two_avg := 0.0
-	team_two_btags := []string{}
-	for _, pair := range team_two {
-		team_two_avg += float64(pair.Rank)
-		team_two_btags = append(team_two_btags, pair.BattleTag)
+	lines := []string{fmt.Sprintf("I suggest the following teams based "+
+		"on skill rank, %s:", how)}
+	players := []*partition.Player{}
+	for i, team := range teams {
+		// Don't join with commas, they'll only cause copy pasta errors
+		lines = append(lines, fmt.Sprintf("Team %d (avg. %0.1f): %s",
+			i+1, averageWeight(team), util.ToList(playerIds(team))))
+		players = append(players, team...)
+	}
+	replyPrivate(s, m, "%s", strings.Join(lines, "\n"))
+	if platforms := mixedPlatforms(players); platforms != nil {
+		replyPrivate(s, m, "Heads up: these players are on different "+
+			"platforms (%s), so they can't all join the same lobby.",
+			strings.Join(platforms, ", "))
 	}
-	team_two_avg /= float64(len(team_two))
-
-	sort.Strings(team_one_btags)
-	sort.Strings(team_two_btags)
-
-	// Don't join with commas, they'll only cause copy pasta errors
-	replyPrivate(s, m,
-		`I suggest the following teams based on skill rank:
-Team 1 (avg. %0.1f): %s
-Team 2 (avg. %0.1f): %s`,
-		team_one_avg, util.ToList(team_one_btags),
-		team_two_avg, util.ToList(team_two_btags))
 	return nil
 }
+
+func averageWeight(players []*partition.Player) float64 {
+	if len(players) == 0 {
+		return 0
+	}
+	return float64(partition.TotalWeight(players)) / float64(len(players))
+}
+
+// playerIds returns the players' ids, sorted.
+func playerIds(players []*partition.Player) (ids []string) {
+	for _, player := range players {
+		ids = append(ids, player.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -31,7 +31,9 @@ func TestHandleTeams(t *testing.T) {
 
 	cmdv := append([]string{"teams"}, mockoverwatch.TestBattleTags...)
 	btc := NewBattleTagCache(memorycache.New())
-	srh := newSkillRankHandler(btc, global.New(mockoverwatch.NewRandom()))
+	srh := newSkillRankHandler(btc,
+		newGuildSettings(memorycache.New()),
+		global.New(mockoverwatch.NewRandom()))
 	s := test.mockSession()
 	for i, _ := range mockoverwatch.TestBattleTags {
 		test_user_id := fmt.Sprintf("test-user-%03d", 123+i)
@@ -50,7 +52,9 @@ func TestHandleTeamsReplaceMentions(t *testing.T) {
 	test := newDiscordTest(t)
 
 	btc := NewBattleTagCache(memorycache.New())
-	srh := newSkillRankHandler(btc, global.New(mockoverwatch.NewRandom()))
+	srh := newSkillRankHandler(btc,
+		newGuildSettings(memorycache.New()),
+		global.New(mockoverwatch.NewRandom()))
 	s := test.mockSession()
 	for i, _ := range mockoverwatch.TestBattleTags {
 		test_user_id := fmt.Sprintf("test-user-%03d", 123+i)
@@ -71,7 +75,9 @@ func TestHandleReplaceMentions(t *testing.T) {
 	test := newDiscordTest(t)
 
 	btc := NewBattleTagCache(memorycache.New())
-	srh := newSkillRankHandler(btc, global.New(mockoverwatch.NewRandom()))
+	srh := newSkillRankHandler(btc,
+		newGuildSettings(memorycache.New()),
+		global.New(mockoverwatch.NewRandom()))
 	btc.Set("1234", "example#1234")
 
 	test.AssertEqual(srh.replaceMentions(
@@ -0,0 +1,260 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/partition"
+	"github.com/spacemonkeygo/errors"
+)
+
+const (
+	teamsSetting   = "teams"
+	strategyPrefix = "--strategy="
+	numTeamsPrefix = "teams="
+)
+
+var (
+	constraintRe = regexp.MustCompile(`(?i)\b(together|apart)\(([^)]*)\)`)
+
+	StrategyNotFound = Error.NewClass("partition strategy not found",
+		errors.NoCaptureStack())
+	InvalidNumTeams = Error.NewClass("invalid number of teams",
+		errors.NoCaptureStack())
+	InvalidConstraint = Error.NewClass("invalid team constraint",
+		errors.NoCaptureStack())
+)
+
+// teamOptions are how a command asked for teams to be made.
+type teamOptions struct {
+	strategy    partition.Partitioner
+	num_teams   int
+	constraints *partition.Constraints
+}
+
+// guildTeamOptions returns options for num_teams teams, made using the
+// guild's default strategy, without constraints.
+func guildTeamOptions(settings *guildSettings, guild_id string,
+	num_teams int) *teamOptions {
+
+	return &teamOptions{
+		strategy:  guildStrategy(settings, guild_id),
+		num_teams: num_teams,
+	}
+}
+
+// chooseTeamOptions removes the arguments describing how to make teams from
+// args: together(...) and apart(...) constraints, --strategy=name and teams=n.
+func chooseTeamOptions(s Session, m *discordgo.MessageCreate,
+	settings *guildSettings, args []string) (opts *teamOptions,
+	rest []string, err error) {
+
+	opts = &teamOptions{}
+	opts.constraints, rest, err = chooseConstraints(s, m, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.strategy, rest, err = chooseStrategy(s, m, settings, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.num_teams, rest, err = chooseNumTeams(s, m, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return opts, rest, nil
+}
+
+// teamsSettings holds a guild's default partition strategy, if it isn't the
+// default.
+type teamsSettings struct {
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// guildStrategy returns the guild's default partition strategy.
+func guildStrategy(settings *guildSettings,
+	guild_id string) partition.Partitioner {
+
+	teams := &teamsSettings{}
+	logger.Errore(settings.load(guild_id, teamsSetting, teams))
+	if strategy, ok := partition.Strategy(teams.Strategy); ok {
+		return strategy
+	}
+	strategy, _ := partition.Strategy(partition.DefaultStrategy)
+	return strategy
+}
+
+// chooseStrategy removes a --strategy=name argument from args, returning the
+// strategy it names, or the guild's default if there isn't one. Messages sent
+// outside of a guild use the default strategy.
+func chooseStrategy(s Session, m *discordgo.MessageCreate,
+	settings *guildSettings, args []string) (
+	strategy partition.Partitioner, rest []string, err error) {
+
+	name := ""
+	for _, arg := range args {
+		if strings.HasPrefix(strings.ToLower(arg), strategyPrefix) {
+			name = strings.ToLower(arg[len(strategyPrefix):])
+			continue
+		}
+		rest = append(rest, arg)
+	}
+
+	if name != "" {
+		strategy, ok := partition.Strategy(name)
+		if !ok {
+			reply(s, m, "There's no team balancing strategy named "+
+				"%q. Try one of: %s.", name, strategyNames())
+			return nil, nil, StrategyNotFound.New(name)
+		}
+		return strategy, rest, nil
+	}
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		if !NoGuild.Contains(err) {
+			logger.Errore(err)
+		}
+		strategy, _ = partition.Strategy(partition.DefaultStrategy)
+		return strategy, rest, nil
+	}
+	return guildStrategy(settings, guild_id), rest, nil
+}
+
+// chooseNumTeams removes a teams=n argument from args, returning n, or 2 if
+// there isn't one.
+func chooseNumTeams(s Session, m *discordgo.MessageCreate, args []string) (
+	num_teams int, rest []string, err error) {
+
+	num_teams, rest, err = parseNumTeams(args)
+	if InvalidNumTeams.Contains(err) {
+		reply(s, m, "The number of teams must be 2 or more, eg "+
+			"`teams=4`, not %q.", errors.GetMessage(err))
+	}
+	return num_teams, rest, err
+}
+
+// parseNumTeams is chooseNumTeams, without replying.
+func parseNumTeams(args []string) (num_teams int, rest []string, err error) {
+	num_teams = 2
+	for _, arg := range args {
+		if !strings.HasPrefix(strings.ToLower(arg), numTeamsPrefix) {
+			rest = append(rest, arg)
+			continue
+		}
+		value := arg[len(numTeamsPrefix):]
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 2 {
+			return 0, nil, InvalidNumTeams.New("%s", value)
+		}
+		num_teams = n
+	}
+
+	return num_teams, rest, nil
+}
+
+// chooseConstraints removes together(...) and apart(...) arguments from args,
+// returning the constraints they give. The BattleTags in them may be separated
+// by commas or spaces.
+func chooseConstraints(s Session, m *discordgo.MessageCreate, args []string) (
+	constraints *partition.Constraints, rest []string, err error) {
+
+	constraints = &partition.Constraints{}
+	text := strings.Join(args, " ")
+	for _, match := range constraintRe.FindAllStringSubmatch(text, -1) {
+		kind := strings.ToLower(match[1])
+		btags := strings.FieldsFunc(match[2], func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		if len(btags) < 2 {
+			reply(s, m, "`%s` needs at least two BattleTags, eg "+
+				"`%s(example#1234,example#5678)`.", match[0], kind)
+			return nil, nil, InvalidConstraint.New(match[0])
+		}
+		if kind == "together" {
+			constraints.Together = append(constraints.Together,
+				btags)
+		} else {
+			constraints.Apart = append(constraints.Apart, btags)
+		}
+	}
+
+	return constraints, strings.Fields(constraintRe.ReplaceAllString(text,
+		" ")), nil
+}
+
+func strategyNames() string {
+	names := []string{}
+	for _, strategy := range partition.Strategies() {
+		names = append(names, strategy.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+// handleStrategy handles `!queue strategy`, which describes the guild's
+// default partition strategy, or, for admins, sets it.
+func (h *queueHandler) handleStrategy(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	if len(commandArgs(m, 2)) > 0 {
+		return h.auth2KickRequired(s, m, h.handleStrategyUnsafe)
+	}
+
+	strategy := guildStrategy(h.settings, guild_id)
+	reply(s, m, "Teams are balanced using the %s strategy, which %s. "+
+		"Try `!queue strategy <name>` to change it, with one of: %s.",
+		strategy.Name(), strategy.Description(), strategyNames())
+	return nil
+}
+
+func (h *queueHandler) handleStrategyUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	guild_id, err := guildId(s, m)
+	if err != nil {
+		return err
+	}
+
+	name := strings.ToLower(commandArgs(m, 2)[0])
+	strategy, ok := partition.Strategy(name)
+	if !ok {
+		reply(s, m, "There's no team balancing strategy named %q. "+
+			"Try one of: %s.", name, strategyNames())
+		return StrategyNotFound.New(name)
+	}
+
+	err = h.settings.save(guild_id, teamsSetting, &teamsSettings{
+		Strategy: strategy.Name(),
+	})
+	if err != nil {
+		reply(s, m, "Error setting the team balancing strategy. "+
+			"Please try again.")
+		return err
+	}
+
+	reply(s, m, "Teams will be balanced using the %s strategy, which %s.",
+		strategy.Name(), strategy.Description())
+	return nil
+}
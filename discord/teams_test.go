@@ -0,0 +1,195 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"strings"
+	"testing"
+
+	memorycache "github.com/ewollesen/zenbot/cache/memory"
+	"github.com/ewollesen/zenbot/overwatch/global"
+	"github.com/ewollesen/zenbot/overwatch/mockoverwatch"
+	"github.com/ewollesen/zenbot/partition"
+)
+
+func TestTeamsStrategy(t *testing.T) {
+	test := newDiscordTest(t)
+
+	srh := newSkillRankHandler(NewBattleTagCache(memorycache.New()),
+		newGuildSettings(memorycache.New()),
+		global.New(mockoverwatch.NewRandom()))
+	s := test.mockSession()
+	btags := strings.Join(mockoverwatch.TestBattleTags, " ")
+
+	m := test.testMessage("!teams --strategy=snake " + btags)
+	test.AssertNil(srh.handleTeams(s, m))
+	test.AssertContainsRe(s.sends, "I suggest the following teams based "+
+		"on skill rank, using the snake strategy:")
+	for _, send := range s.sends {
+		test.Assert(!strings.Contains(send, "Found only"))
+	}
+
+	m = test.testMessage("!teams --strategy=bogus " + btags)
+	test.AssertErrorContainedBy(srh.handleTeams(s, m), StrategyNotFound)
+	test.AssertContains(s.sends, "There's no team balancing strategy "+
+		"named \"bogus\". Try one of: exact, random, snake, stars, "+
+		"variance.")
+}
+
+func TestQueueStrategy(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+
+	test.AssertNil(qh.handleStrategy(s, test.testMessage("!queue strategy")))
+	test.AssertContainsRe(s.sends, "Teams are balanced using the exact "+
+		"strategy, which makes")
+
+	m := test.testMessage("!queue strategy Stars")
+	test.AssertNil(qh.handleStrategyUnsafe(s, m))
+	test.AssertContainsRe(s.sends, "Teams will be balanced using the "+
+		"stars strategy")
+	test.AssertEqual(guildStrategy(qh.settings, testGuildId).Name(),
+		"stars")
+
+	// The guild's default is used unless another is chosen.
+	users := generateUsers(4)
+	test.AssertNil(qh.replyPartition(s, test.testMessage("!queue teams"),
+		users, nil, guildTeamOptions(qh.settings, testGuildId, 2)))
+	test.AssertContainsRe(s.sends, "using the stars strategy:")
+
+	m = test.testMessage("!queue strategy bogus")
+	test.AssertErrorContainedBy(qh.handleStrategyUnsafe(s, m),
+		StrategyNotFound)
+}
+
+func TestTeamsNumTeams(t *testing.T) {
+	test := newDiscordTest(t)
+
+	srh := newSkillRankHandler(NewBattleTagCache(memorycache.New()),
+		newGuildSettings(memorycache.New()),
+		global.New(mockoverwatch.NewRandom()))
+	s := test.mockSession()
+	btags := strings.Join(mockoverwatch.TestBattleTags, " ")
+
+	m := test.testMessage("!teams teams=3 " + btags)
+	test.AssertNil(srh.handleTeams(s, m))
+	test.AssertContainsRe(s.sends, `(?s)using the exact strategy:\n`+
+		`Team 1 \(avg. [0-9.]+\): .*\nTeam 2 .*\nTeam 3 `)
+
+	// The stars strategy can only make two teams.
+	m = test.testMessage("!teams --strategy=stars teams=3 " + btags)
+	test.AssertNil(srh.handleTeams(s, m))
+	test.AssertContainsRe(s.sends, "using the exact strategy, as the "+
+		"stars strategy only makes two teams:")
+
+	m = test.testMessage("!teams teams=1 " + btags)
+	test.AssertErrorContainedBy(srh.handleTeams(s, m), InvalidNumTeams)
+	test.AssertContains(s.sends, "The number of teams must be 2 or more, "+
+		"eg `teams=4`, not \"1\".")
+}
+
+func TestTakeNumTeams(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	test.enqueue(generateUsers(8)...)
+
+	m := test.testMessage("!queue take 6 teams=4")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContains(s.sends, "6 BattleTags can't be split evenly "+
+		"into 4 teams.")
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 8)
+
+	m = test.testMessage("!queue take 8 teams=four")
+	test.AssertErrorContainedBy(qh.handleTakeUnsafe(s, m),
+		InvalidNumTeams)
+	size, err = test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 8)
+
+	users := generateUsers(8)
+	test.AssertNil(qh.replyPartition(s, test.testMessage("!queue take"),
+		users, nil, guildTeamOptions(qh.settings, testGuildId, 4)))
+	test.AssertContainsRe(s.sends, `Team 4 \(avg. [0-9.]+\): \S+  \S+$`)
+}
+
+func TestTeamsConstraints(t *testing.T) {
+	test := newDiscordTest(t)
+
+	srh := newSkillRankHandler(NewBattleTagCache(memorycache.New()),
+		newGuildSettings(memorycache.New()),
+		global.New(mockoverwatch.NewRandom()))
+	s := test.mockSession()
+	btags := strings.Join(mockoverwatch.TestBattleTags, " ")
+
+	m := test.testMessage("!teams together(testuser1#1111, testuser2#2222) " +
+		"APART(testuser1#1111,testuser3#3333) apart(testuser4#4444 " +
+		"testuser2#2222) " + btags)
+	test.AssertNil(srh.handleTeams(s, m))
+	test.AssertEqual(len(s.sends), 1)
+	team := func(btag string) int {
+		for i, line := range strings.Split(s.sends[0], "\n") {
+			for _, field := range strings.Fields(line) {
+				if field == btag {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	test.Assert(team("testuser1#1111") > 0)
+	test.AssertEqual(team("testuser1#1111"), team("testuser2#2222"))
+	test.Assert(team("testuser3#3333") > 0)
+	test.Assert(team("testuser1#1111") != team("testuser3#3333"))
+	test.AssertEqual(team("testuser3#3333"), team("testuser4#4444"))
+
+	m = test.testMessage("!teams apart(testuser1#1111,testuser2#2222," +
+		"testuser3#3333) " + btags)
+	test.AssertErrorContainedBy(srh.handleTeams(s, m),
+		partition.Unsatisfiable)
+	test.AssertContains(s.sends, "I can't make teams that meet every "+
+		"constraint, as apart(testuser1#1111,testuser2#2222,"+
+		"testuser3#3333) needs 3 teams, but there are only 2.")
+
+	m = test.testMessage("!teams together(testuser1#1111) " + btags)
+	test.AssertErrorContainedBy(srh.handleTeams(s, m), InvalidConstraint)
+	test.AssertContains(s.sends, "`together(testuser1#1111)` needs at "+
+		"least two BattleTags, eg `together(example#1234,example#5678)`.")
+}
+
+func TestQueueTeamsConstraints(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(6)
+
+	opts, rest, err := chooseTeamOptions(s, test.testMessage(""),
+		qh.settings, strings.Fields("scrimmages apart("+
+			users[0].BattleTag+", "+users[1].BattleTag+") teams=3"))
+	test.AssertNil(err)
+	test.AssertEqual(strings.Join(rest, " "), "scrimmages")
+	test.AssertEqual(opts.num_teams, 3)
+	test.AssertEqual(len(opts.constraints.Apart), 1)
+	test.AssertEqual(len(opts.constraints.Together), 0)
+
+	// Parties that can't be kept together along with the constraints are
+	// split up.
+	parties := [][]string{{users[0].BattleTag, users[1].BattleTag}}
+	opts.num_teams = 2
+	teams, _, _, err := partitionBattleTags(global.New(test.overwatch),
+		toBattleTags(users), parties, nil, nil, opts)
+	test.AssertNil(err)
+	test.Assert(opts.constraints.Met(teams))
+}
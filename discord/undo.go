@@ -0,0 +1,410 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/queue"
+)
+
+var (
+	undoWindow = flag.Duration("discord.undo_window", 5*time.Minute,
+		"how long after an admin changes a queue that `!queue undo` "+
+			"can restore it (0 disables undo)")
+)
+
+// entries returns a copy of the queue's entries, in order.
+func (q *BattleTagQueue) entries() (entries []*queue.Entry, err error) {
+	err = q.q.Iter(func(_ int, entry *queue.Entry) bool {
+		entries = append(entries, &queue.Entry{
+			Datum:      append([]byte(nil), entry.Datum...),
+			EnqueuedAt: entry.EnqueuedAt,
+		})
+		return false
+	})
+	return entries, err
+}
+
+// Replace replaces the queue's entries with entries, eg as returned by
+// BattleTagQueue.entries.
+func (q *BattleTagQueue) Replace(entries []*queue.Entry) error {
+	if err := q.q.Replace(entries); err != nil {
+		return err
+	}
+	q.changed(nil)
+	return nil
+}
+
+// queueSnapshot holds a queue's contents from before and after an admin's
+// change.
+type queueSnapshot struct {
+	action         string
+	at             time.Time
+	entries        []*queue.Entry
+	waitlist       []*queue.Entry
+	after          []*queue.Entry
+	after_waitlist []*queue.Entry
+	restore_limits func() error
+	// reverts undo changes made along with the queue's, eg recording the
+	// take in the take history.
+	reverts []func() error
+}
+
+// removalsOnly returns true if the change only removed entries from the queue
+// and its waitlist, including promoting them from one to the other, so that it
+// can be undone by putting them back, even if the queue has changed since.
+func (snap *queueSnapshot) removalsOnly() bool {
+	return isSubsequence(
+		entryBattleTags(snap.after, snap.after_waitlist),
+		entryBattleTags(snap.entries, snap.waitlist))
+}
+
+// removed returns the entries of before, at their indices, that the change
+// removed, or that are among taken, eg as replacements in a ready check, and
+// that aren't among present.
+func (snap *queueSnapshot) removed(before []*queue.Entry,
+	taken, present map[string]bool) map[int]*queue.Entry {
+
+	kept := battleTagSet(snap.after, snap.after_waitlist)
+	removed := make(map[int]*queue.Entry)
+	for i, entry := range before {
+		btag := entryBattleTag(entry)
+		if (!kept[btag] || taken[btag]) && !present[btag] {
+			removed[i] = entry
+		}
+	}
+	return removed
+}
+
+// reinsert returns entries with each of removed inserted at its index, or at
+// the end if entries has since become shorter.
+func reinsert(entries []*queue.Entry,
+	removed map[int]*queue.Entry) []*queue.Entry {
+
+	indices := []int{}
+	for i := range removed {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+
+	result := append([]*queue.Entry{}, entries...)
+	for _, i := range indices {
+		if i > len(result) {
+			i = len(result)
+		}
+		result = append(result[:i], append([]*queue.Entry{removed[i]},
+			result[i:]...)...)
+	}
+	return result
+}
+
+func entryBattleTag(entry *queue.Entry) string {
+	ubt := &userBattleTag{}
+	logger.Errore(json.Unmarshal(entry.Datum, ubt))
+	return ubt.BattleTag
+}
+
+func entryBattleTags(lists ...[]*queue.Entry) (btags []string) {
+	for _, entries := range lists {
+		for _, entry := range entries {
+			btags = append(btags, entryBattleTag(entry))
+		}
+	}
+	return btags
+}
+
+func battleTagSet(lists ...[]*queue.Entry) map[string]bool {
+	set := make(map[string]bool)
+	for _, btag := range entryBattleTags(lists...) {
+		set[btag] = true
+	}
+	return set
+}
+
+// isSubsequence returns true if sub's elements are all in seq, in the same
+// order.
+func isSubsequence(sub, seq []string) bool {
+	for _, elem := range seq {
+		if len(sub) > 0 && sub[0] == elem {
+			sub = sub[1:]
+		}
+	}
+	return len(sub) == 0
+}
+
+func sameEntries(a, b []*queue.Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Datum, b[i].Datum) ||
+			!a[i].EnqueuedAt.Equal(b[i].EnqueuedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// queueSnapshots holds the most recent snapshot of each guild's queues. They
+// aren't persisted, as undo is only meant for recent mistakes.
+type queueSnapshots struct {
+	mu        sync.Mutex
+	snapshots map[string]*queueSnapshot
+	// changing holds the snapshots of the commands changing each queue.
+	changing map[string]*queueSnapshot
+	window   time.Duration
+	now      func() time.Time
+}
+
+func newQueueSnapshots(window time.Duration) *queueSnapshots {
+	return &queueSnapshots{
+		snapshots: make(map[string]*queueSnapshot),
+		changing:  make(map[string]*queueSnapshot),
+		window:    window,
+		now:       time.Now,
+	}
+}
+
+func snapshotKey(guild_id, name string) string {
+	return guild_id + "." + name
+}
+
+func (u *queueSnapshots) save(guild_id, name string, snap *queueSnapshot) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	snap.at = u.now()
+	u.snapshots[snapshotKey(guild_id, name)] = snap
+}
+
+// take removes and returns the queue's snapshot, or nil if there isn't one
+// from within the undo window.
+func (u *queueSnapshots) take(guild_id, name string) *queueSnapshot {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	key := snapshotKey(guild_id, name)
+	snap := u.snapshots[key]
+	delete(u.snapshots, key)
+	if snap == nil || u.now().Sub(snap.at) > u.window {
+		return nil
+	}
+	return snap
+}
+
+// begin notes that an undoable command is changing the queue, so that the
+// command can find its snapshot with current.
+func (u *queueSnapshots) begin(guild_id, name string, snap *queueSnapshot) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.changing[snapshotKey(guild_id, name)] = snap
+}
+
+func (u *queueSnapshots) end(guild_id, name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.changing, snapshotKey(guild_id, name))
+}
+
+// current returns the snapshot of the undoable command changing the queue, or
+// nil if there isn't one.
+func (u *queueSnapshots) current(guild_id, name string) *queueSnapshot {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.changing[snapshotKey(guild_id, name)]
+}
+
+// onUndo adds revert to the functions called if the command snap was taken
+// for is undone. Either may be nil, in which case there's nothing to do.
+func (u *queueSnapshots) onUndo(snap *queueSnapshot, revert func() error) {
+	if snap == nil || revert == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	snap.reverts = append(snap.reverts, revert)
+}
+
+// revert calls the snapshot's revert functions, most recent first.
+func (u *queueSnapshots) revert(snap *queueSnapshot) {
+	u.mu.Lock()
+	reverts := snap.reverts
+	snap.reverts = nil
+	u.mu.Unlock()
+
+	for i := len(reverts) - 1; i >= 0; i-- {
+		logger.Errore(reverts[i]())
+	}
+}
+
+// forget drops the queue's snapshot, eg when the queue is renamed or deleted.
+func (u *queueSnapshots) forget(guild_id, name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.snapshots, snapshotKey(guild_id, name))
+}
+
+// commandQueue returns the queue an undoable command applies to, parsing its
+// arguments as the command does, but without replying if the queue can't be
+// found, leaving that for the command itself.
+func (h *queueHandler) commandQueue(s Session,
+	m *discordgo.MessageCreate) *BattleTagQueue {
+
+	_, args, err := parseNumTeams(commandArgs(m, 2))
+	if err != nil {
+		return nil
+	}
+	q, _, err := h.findGuildQueue(s, m, args)
+	if err != nil {
+		return nil
+	}
+	return q
+}
+
+// undoable snapshots the command's queue, and its waitlist and the enqueue
+// rate limits, before and after calling fn, so that a successful change can be
+// undone with `!queue undo`.
+func (h *queueHandler) undoable(action string, fn bareHandler) bareHandler {
+	return func(s Session, m *discordgo.MessageCreate) (err error) {
+		q := h.commandQueue(s, m)
+		if q == nil || h.undos.window <= 0 {
+			return fn(s, m)
+		}
+
+		snap := &queueSnapshot{
+			action:         action,
+			restore_limits: h.enqueue_rl.Snapshot(),
+		}
+		snap.entries, err = q.entries()
+		if err == nil && q.waitlist != nil {
+			snap.waitlist, err = q.waitlist.entries()
+		}
+		if err != nil {
+			logger.Errore(err)
+			return fn(s, m)
+		}
+
+		h.undos.begin(q.guild_id, q.Name(), snap)
+		err = fn(s, m)
+		h.undos.end(q.guild_id, q.Name())
+		if err != nil {
+			return err
+		}
+		snap.after, err = q.entries()
+		if err == nil && q.waitlist != nil {
+			snap.after_waitlist, err = q.waitlist.entries()
+		}
+		if err != nil {
+			logger.Errore(err)
+			return nil
+		}
+		h.undos.save(q.guild_id, q.Name(), snap)
+		return nil
+	}
+}
+
+func (h *queueHandler) handleUndoUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	q, _, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	snap := h.undos.take(q.guild_id, q.Name())
+	if snap == nil {
+		reply(s, m, "There's nothing to undo in the %s queue. Changes "+
+			"can only be undone for %s.", q.Name(), h.undos.window)
+		return nil
+	}
+
+	current, err := q.entries()
+	var current_waitlist []*queue.Entry
+	if err == nil && q.waitlist != nil {
+		current_waitlist, err = q.waitlist.entries()
+	}
+	if err != nil {
+		reply(s, m, "Error undoing the last %s in the %s queue.",
+			snap.action, q.Name())
+		return err
+	}
+
+	// If the queue hasn't changed since, it's simply restored. Otherwise
+	// only what the change removed is put back, so that later changes
+	// aren't lost, which can't undo other kinds of change.
+	unchanged := sameEntries(current, snap.after) &&
+		sameEntries(current_waitlist, snap.after_waitlist)
+	if !unchanged && !snap.removalsOnly() {
+		reply(s, m, "The %s queue has changed since the last %s, so it "+
+			"can't be undone.", q.Name(), snap.action)
+		return nil
+	}
+
+	var taken map[string]bool
+	if snap.action == "take" {
+		taken = h.ready_checks.cancel(q.guild_id, q.Name())
+	}
+	entries, waitlist := snap.entries, snap.waitlist
+	restored := 0
+	if !unchanged {
+		present := battleTagSet(current, current_waitlist)
+		removed := snap.removed(snap.entries, taken, present)
+		removed_waitlist := snap.removed(snap.waitlist, taken, present)
+		entries = reinsert(current, removed)
+		waitlist = reinsert(current_waitlist, removed_waitlist)
+		for _, entry := range removed {
+			restored += playersSize(entry.Datum)
+		}
+		for _, entry := range removed_waitlist {
+			restored += playersSize(entry.Datum)
+		}
+	}
+	err = q.Replace(entries)
+	if err == nil && q.waitlist != nil {
+		err = q.waitlist.Replace(waitlist)
+	}
+	if err != nil {
+		reply(s, m, "Error undoing the last %s in the %s queue.",
+			snap.action, q.Name())
+		return err
+	}
+	logger.Errore(snap.restore_limits())
+	h.undos.revert(snap)
+
+	h.record(s, m, q.guild_id, &auditlog.Event{
+		Queue:  q.Name(),
+		Action: "undo",
+		Detail: snap.action,
+	})
+	if !unchanged {
+		reply(s, m, "Undid the last %s in the %s queue, putting back "+
+			"the %d BattleTags it removed, and keeping the changes "+
+			"made since.", snap.action, q.Name(), restored)
+		return nil
+	}
+	players := 0
+	for _, entry := range snap.entries {
+		players += playersSize(entry.Datum)
+	}
+	reply(s, m, "Undid the last %s in the %s queue, restoring its %d "+
+		"BattleTags.", snap.action, q.Name(), players)
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ewollesen/zenbot/ratelimiter/mocklimiter"
+)
+
+func TestUndoClear(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(3)
+	test.enqueue(users...)
+	rl := mocklimiter.New()
+	qh.enqueue_rl = rl
+
+	m := test.testMessage("!queue clear")
+	test.AssertNil(qh.undoable("clear",
+		qh.clearEnqueueRateLimits(qh.handleClearUnsafe))(s, m))
+	test.AssertEqual(len(rl.Prefixes), 1)
+
+	m = test.testMessage("!queue undo")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	test.AssertContains(s.sends, "Undid the last clear in the "+
+		"scrimmages queue, restoring its 3 BattleTags.")
+	test.AssertEqual(rl.Restores, 1)
+	for i, user := range users {
+		pos, err := test.queue().Position(user)
+		test.AssertNil(err)
+		test.AssertEqual(pos, i)
+	}
+
+	// The snapshot is used up.
+	s.clearSends()
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	test.AssertContains(s.sends, "There's nothing to undo in the "+
+		"scrimmages queue. Changes can only be undone for 5m0s.")
+}
+
+func TestUndoTake(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(3)
+	test.enqueue(users...)
+
+	m := test.testMessage("!queue take 2")
+	test.AssertNil(qh.undoable("take", qh.handleTakeUnsafe)(s, m))
+	test.Assert(qh.ready_checks.lookup(users[0].UserId) != nil)
+
+	m = test.testMessage("!queue undo")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	test.AssertContains(s.sends, "The take from the scrimmages queue "+
+		"was undone, so there's no need to confirm you're ready.")
+	test.Assert(qh.ready_checks.lookup(users[0].UserId) == nil)
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 3)
+}
+
+func TestUndoTakeNamedQueue(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	m := test.testMessage("!queue create ranked")
+	test.AssertNil(qh.handleCreateUnsafe(s, m))
+	ranked, err := qh.queues.Lookup(testGuildId, "ranked")
+	test.AssertNil(err)
+	for _, user := range generateUsers(4) {
+		_, err = ranked.Enqueue(user)
+		test.AssertNil(err)
+	}
+
+	// The queue is named after the teams= argument.
+	m = test.testMessage("!queue take teams=2 ranked 4")
+	test.AssertNil(qh.undoable("take", qh.handleTakeUnsafe)(s, m))
+	size, err := ranked.Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 0)
+
+	m = test.testMessage("!queue undo ranked")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	size, err = ranked.Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 4)
+}
+
+func TestUndoKeepsLaterChanges(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(4)
+	test.enqueue(users[:3]...)
+
+	m := test.testMessage("!queue kick " + users[1].BattleTag)
+	test.AssertNil(qh.undoable("kick", qh.handleKickUnsafe)(s, m))
+	test.enqueue(users[3])
+	test.AssertNil(test.queue().Remove(users[2]))
+
+	// Only the kicked player is put back, where they were.
+	m = test.testMessage("!queue undo")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	test.AssertContains(s.sends, "Undid the last kick in the scrimmages "+
+		"queue, putting back the 1 BattleTags it removed, and keeping "+
+		"the changes made since.")
+	for i, user := range []*userBattleTag{users[0], users[1], users[3]} {
+		pos, err := test.queue().Position(user)
+		test.AssertNil(err)
+		test.AssertEqual(pos, i)
+	}
+	pos, err := test.queue().Position(users[2])
+	test.AssertNil(err)
+	test.AssertEqual(pos, -1)
+}
+
+func TestUndoRefusesChangedQueue(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(3)
+	test.enqueue(users[:2]...)
+
+	m := test.testMessage("!queue move " + users[1].BattleTag + " 1")
+	test.AssertNil(qh.undoable("move", qh.handleMoveUnsafe)(s, m))
+	test.enqueue(users[2])
+
+	m = test.testMessage("!queue undo")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue has changed since "+
+		"the last move, so it can't be undone.")
+	pos, err := test.queue().Position(users[1])
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+}
+
+func TestUndoTakeReplacements(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(4)
+	test.enqueue(users...)
+
+	m := test.testMessage("!queue take 2")
+	test.AssertNil(qh.undoable("take", qh.handleTakeUnsafe)(s, m))
+	qh.ready_checks.lookup(users[1].UserId).expire()
+
+	// users[2] replaced users[1], who was returned to the queue, so both
+	// users[0] and users[2] are put back.
+	m = test.testMessage("!queue undo")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	test.AssertContains(s.sends, "Undid the last take in the scrimmages "+
+		"queue, putting back the 2 BattleTags it removed, and keeping "+
+		"the changes made since.")
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 4)
+	test.Assert(qh.ready_checks.lookup(users[2].UserId) == nil)
+}
+
+func TestUndoTakeRecords(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+	test.AssertNil(qh.games.setEnabled(testGuildId, true))
+	users := generateUsers(3)
+	test.enqueue(users...)
+
+	m := test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertNil(qh.undoable("take", qh.handleTakeUnsafe)(s, m))
+	counts, err := qh.games.counts(testGuildId)
+	test.AssertNil(err)
+	test.AssertEqual(len(counts), 3)
+
+	// Only the undone take's game and history are uncounted.
+	m = test.testMessage("!queue undo")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	counts, err = qh.games.counts(testGuildId)
+	test.AssertNil(err)
+	test.AssertEqual(len(counts), 2)
+	test.AssertEqual(counts[users[0].BattleTag], 1)
+	test.AssertEqual(counts[users[2].BattleTag], 0)
+	qh.takes.mu.Lock()
+	history, err := qh.takes.load(testGuildId)
+	qh.takes.mu.Unlock()
+	test.AssertNil(err)
+	test.AssertEqual(len(history[defaultQueueName]), 1)
+}
+
+func TestUndoExpired(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	test.enqueue(generateUsers(2)...)
+	now := time.Now()
+	qh.undos.now = func() time.Time { return now }
+
+	m := test.testMessage("!queue clear")
+	test.AssertNil(qh.undoable("clear", qh.handleClearUnsafe)(s, m))
+	now = now.Add(qh.undos.window + time.Second)
+
+	m = test.testMessage("!queue undo")
+	test.AssertNil(qh.handleUndoUnsafe(s, m))
+	test.AssertContainsRe(s.sends, "There's nothing to undo")
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 0)
+}
@@ -16,8 +16,14 @@ package discord
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/ewollesen/discordgo"
+	"github.com/spacemonkeygo/errors"
+)
+
+var (
+	NoGuild = Error.NewClass("no guild", errors.NoCaptureStack())
 )
 
 func reply(s Session, m *discordgo.MessageCreate,
@@ -45,3 +51,28 @@ func userKey(s Session, m *discordgo.MessageCreate) string {
 	// guild id.
 	return m.Author.ID
 }
+
+// guildId returns the id of the guild in which the message was sent. Private
+// messages have no guild.
+func guildId(s Session, m *discordgo.MessageCreate) (string, error) {
+	ch, err := s.Channel(m.ChannelID)
+	if err != nil {
+		return "", err
+	}
+	if ch == nil || ch.GuildID == "" {
+		return "", NoGuild.New("channel %s", m.ChannelID)
+	}
+
+	return ch.GuildID, nil
+}
+
+// commandArgs returns the words of the message following the first skip words,
+// eg the command and subcommand.
+func commandArgs(m *discordgo.MessageCreate, skip int) []string {
+	words := strings.Fields(m.Content)
+	if len(words) <= skip {
+		return []string{}
+	}
+
+	return words[skip:]
+}
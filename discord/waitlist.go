@@ -0,0 +1,208 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/ewollesen/discordgo"
+	"github.com/ewollesen/zenbot/auditlog"
+	"github.com/ewollesen/zenbot/util"
+)
+
+// Locate finds the entry containing the given BattleTag in either the queue
+// or its waitlist, returning whichever holds it.
+func (q *BattleTagQueue) Locate(btag string) (
+	found *userBattleTag, holder *BattleTagQueue, err error) {
+
+	found, err = q.Find(btag)
+	if err != nil || found != nil || q.waitlist == nil {
+		return found, q, err
+	}
+
+	found, err = q.waitlist.Find(btag)
+	return found, q.waitlist, err
+}
+
+// Promote moves the longest waiting entries from the waitlist into the queue,
+// until it holds capacity players. Parties that don't fit are left waiting. A
+// capacity of 0 promotes everyone.
+func (q *BattleTagQueue) Promote(capacity int) (
+	promoted []*userBattleTag, err error) {
+
+	if q.waitlist == nil {
+		return nil, nil
+	}
+
+	room := math.MaxInt32
+	if capacity > 0 {
+		players, err := q.Players()
+		if err != nil {
+			return nil, err
+		}
+		room = capacity - players
+	}
+	if room <= 0 {
+		return nil, nil
+	}
+
+	taken_bytes, _, err := q.waitlist.q.DequeueFit(room, playersSize)
+	if err != nil {
+		return nil, err
+	}
+	taken, err := decodeBattleTags(taken_bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ubt := range taken {
+		if _, err = q.Enqueue(ubt); err != nil {
+			logger.Warne(err)
+			continue
+		}
+		promoted = append(promoted, ubt)
+	}
+
+	return promoted, nil
+}
+
+// enqueue adds the entry to the queue, or to its waitlist if the queue is full
+// or others are already waiting.
+func (h *queueHandler) enqueue(q *BattleTagQueue, ubt *userBattleTag) (
+	pos int, waitlisted bool, err error) {
+
+	capacity, err := h.queues.Capacity(q.guild_id, q.Name())
+	if err != nil {
+		return -1, false, err
+	}
+	if capacity > 0 {
+		players, err := q.Players()
+		if err != nil {
+			return -1, false, err
+		}
+		waiting, err := q.waitlist.Size()
+		if err != nil {
+			return -1, false, err
+		}
+		// There's a race condition here, but not worth worrying about.
+		if waiting > 0 || players+len(ubt.Players()) > capacity {
+			pos, err = q.waitlist.Enqueue(ubt)
+			return pos, true, err
+		}
+	}
+
+	pos, err = q.Enqueue(ubt)
+	return pos, false, err
+}
+
+// promoteWaitlisted fills any room in the queue from its waitlist, recording
+// an event for each player promoted, and letting them know by DM.
+func promoteWaitlisted(s Session, queues *BattleTagQueues,
+	audit_log auditlog.Log, q *BattleTagQueue) []*userBattleTag {
+
+	capacity, err := queues.Capacity(q.guild_id, q.Name())
+	if err != nil {
+		logger.Errore(err)
+		return nil
+	}
+	promoted, err := q.Promote(capacity)
+	if err != nil {
+		logger.Errore(err)
+		return nil
+	}
+
+	for _, ubt := range promoted {
+		auditLogger.Noticef("promoted %s (user %s) from guild %s's %s "+
+			"waitlist", ubt.label(), ubt.UserId, q.guild_id, q.Name())
+		recordBotEvent(audit_log, q.guild_id, &auditlog.Event{
+			Queue:     q.Name(),
+			Action:    "promote",
+			BattleTag: ubt.label(),
+		})
+		dm_channel, err := s.UserChannelCreate(ubt.UserId)
+		if err != nil {
+			logger.Errore(err)
+			continue
+		}
+		logger.Warne(s.ChannelMessageSend(dm_channel.ID, fmt.Sprintf(
+			"A spot opened up, so %s has been moved from the waitlist "+
+				"into the %s queue.", ubt.label(), q.Name())))
+	}
+
+	return promoted
+}
+
+func (h *queueHandler) handleCapacityUnsafe(s Session,
+	m *discordgo.MessageCreate) (err error) {
+
+	q, args, err := h.guildQueue(s, m, commandArgs(m, 2))
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		capacity, err := h.queues.Capacity(q.guild_id, q.Name())
+		if err != nil {
+			return err
+		}
+		if capacity == 0 {
+			reply(s, m, "The %s queue has no capacity limit. Try "+
+				"`!queue capacity 12`.", q.Name())
+			return nil
+		}
+		reply(s, m, "The %s queue's capacity is %d BattleTags.",
+			q.Name(), capacity)
+		return nil
+	}
+
+	capacity, err := strconv.Atoi(args[0])
+	if err != nil || capacity < 0 {
+		reply(s, m, "Invalid capacity %q. Try `!queue capacity 12`, "+
+			"or `!queue capacity 0` for no limit.", args[0])
+		return nil
+	}
+
+	if err = h.queues.SetCapacity(q.guild_id, q.Name(), capacity); err != nil {
+		reply(s, m, "Error setting the %s queue's capacity. "+
+			"Please try again.", q.Name())
+		return err
+	}
+
+	if capacity == 0 {
+		reply(s, m, "The %s queue no longer has a capacity limit.",
+			q.Name())
+	} else {
+		reply(s, m, "The %s queue's capacity is now %d BattleTags.",
+			q.Name(), capacity)
+	}
+	h.replyPromoted(s, m, q, h.promote(s, q))
+	return nil
+}
+
+func (h *queueHandler) replyPromoted(s Session, m *discordgo.MessageCreate,
+	q *BattleTagQueue, promoted []*userBattleTag) {
+
+	if len(promoted) == 0 {
+		return
+	}
+	labels := []string{}
+	for _, ubt := range promoted {
+		labels = append(labels, ubt.label())
+	}
+	reply(s, m, "Moved %s from the waitlist into the %s queue.",
+		util.ToList(labels), q.Name())
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discord
+
+import (
+	"testing"
+)
+
+func TestWaitlist(t *testing.T) {
+	test, qh := newQueueTest(t)
+	qh.ready_check_timeout = 0
+	s := test.mockSession()
+	users := generateUsers(4)
+	test.enqueue(users[0])
+
+	m := test.testMessage("!queue capacity 2")
+	test.AssertNil(qh.handleCapacityUnsafe(s, m))
+	test.AssertContains(s.sends, "The scrimmages queue's capacity is now "+
+		"2 BattleTags.")
+
+	for _, user := range users[1:] {
+		m = msgFromUserBattleTag(user)
+		m.Content = "!enqueue " + user.BattleTag
+		test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	}
+	test.AssertContainsRe(s.sends, "Enqueued "+users[1].BattleTag+
+		" .* in the scrimmages queue in position 2.")
+	test.AssertContainsRe(s.sends, "The scrimmages queue is full, so "+
+		users[3].BattleTag+" .* has been added to its waitlist in "+
+		"position 2.")
+	size, err := test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 2)
+
+	m = test.testMessage("!queue list")
+	test.AssertNil(qh.handleList(s, m))
+	test.AssertContainsRe(s.sends, "Its waitlist contains 2: "+
+		users[2].BattleTag+"  "+users[3].BattleTag)
+
+	m = msgFromUserBattleTag(users[0])
+	m.Content = "!dequeue"
+	test.AssertNil(qh.cacheBattleTag(s, m, users[0].BattleTag))
+	s.clearSends()
+	test.AssertNil(qh.handleDequeue(s, m))
+	test.AssertContains(s.sends, "A spot opened up, so "+
+		users[2].BattleTag+" has been moved from the waitlist into "+
+		"the scrimmages queue.")
+	test.AssertContains(s.sends, "Moved "+users[2].BattleTag+
+		" from the waitlist into the scrimmages queue.")
+	events, err := qh.audit_log.Recent(testGuildId, 1, nil)
+	test.AssertNil(err)
+	test.AssertEqual(events[0].Action, "promote")
+	test.AssertEqual(events[0].BattleTag, users[2].BattleTag)
+	test.AssertEqual(events[0].Actor, botActor)
+
+	m = msgFromUserBattleTag(users[3])
+	m.Content = "!dequeue"
+	test.AssertNil(qh.cacheBattleTag(s, m, users[3].BattleTag))
+	test.AssertNil(qh.handleDequeue(s, m))
+	test.AssertContainsRe(s.sends, "Dequeued "+users[3].BattleTag+
+		" .* from the scrimmages queue's waitlist.")
+
+	m = msgFromUserBattleTag(users[3])
+	m.Content = "!enqueue " + users[3].BattleTag
+	test.AssertNil(qh.handleEnqueueUnlimited(s, m))
+	m = test.testMessage("!queue take 1")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	test.AssertContainsRe(s.sends, "Took 1 BattleTags from the "+
+		"scrimmages queue: "+users[1].BattleTag+". 2 BattleTags "+
+		"remain in the scrimmages queue.")
+
+	size, err = test.queue().Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 2)
+	size, err = test.queue().waitlist.Size()
+	test.AssertNil(err)
+	test.AssertEqual(size, 0)
+}
+
+func TestReadyCheckRequeuesToWaitlist(t *testing.T) {
+	test, qh := newQueueTest(t)
+	s := test.mockSession()
+	users := generateUsers(4)
+	test.enqueue(users...)
+
+	m := test.testMessage("!queue take 2")
+	test.AssertNil(qh.handleTakeUnsafe(s, m))
+	m = test.testMessage("!queue capacity 1")
+	test.AssertNil(qh.handleCapacityUnsafe(s, m))
+
+	// users[2] replaces users[1], leaving users[3] filling the queue.
+	qh.ready_checks.lookup(users[1].UserId).expire()
+	test.AssertContainsRe(s.sends, users[1].BattleTag+" didn't confirm "+
+		"in time, and, as the scrimmages queue is full, has been "+
+		"added to its waitlist.")
+	pos, err := test.queue().waitlist.Position(users[1])
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+	events, err := qh.audit_log.Recent(testGuildId, 1, nil)
+	test.AssertNil(err)
+	test.AssertEqual(events[0].Action, "requeue")
+	test.AssertEqual(events[0].Detail, "waitlist, didn't confirm")
+}
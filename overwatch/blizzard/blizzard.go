@@ -46,6 +46,11 @@ func (b *blizzardScrape) SkillRank(platform, battle_tag string) (
 	return overwatch.SkillRankError, fmt.Errorf("not implemented")
 }
 
+func (b *blizzardScrape) PreferredSkillRank(platform, region,
+	battle_tag string) (sr int, err error) {
+	return overwatch.SkillRankError, fmt.Errorf("not implemented")
+}
+
 func (b *blizzardScrape) IsValidBattleTag(platform, region, battle_tag string) (
 	bool, error) {
 
@@ -42,13 +42,26 @@ func NewCaching(overwatch OverwatchAPI, cache cache.Cache) *cachingOverwatch {
 func (c *cachingOverwatch) SkillRank(platform, battle_tag string) (
 	sr int, err error) {
 
+	return c.PreferredSkillRank(platform, "", battle_tag)
+}
+
+// PreferredSkillRank caches ranks separately for each preferred region, as a
+// player may be ranked in more than one.
+func (c *cachingOverwatch) PreferredSkillRank(platform, region,
+	battle_tag string) (sr int, err error) {
+
+	key := c.key("skillRank", platform, battle_tag)
+	if region != "" {
+		key = c.key("skillRank", platform, region, battle_tag)
+	}
+
 	cache_hit := true
-	val_bytes, err := c.cache.Fetch(
-		c.key("skillRank", platform, battle_tag),
+	val_bytes, err := c.cache.Fetch(key,
 		func() []byte {
 			cache_hit = false
 			logger.Debugf("skill rank cache miss for %q", battle_tag)
-			r, err := c.OverwatchAPI.SkillRank(platform, battle_tag)
+			r, err := c.OverwatchAPI.PreferredSkillRank(platform,
+				region, battle_tag)
 			if err != nil {
 				// Is it desirable to cache unranked battle
 				// tags? To reduce traffic if nothing else? If
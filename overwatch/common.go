@@ -57,6 +57,10 @@ type OfficialAPI interface {
 
 type OverwatchAPI interface {
 	SkillRank(platform, battle_tag string) (sr int, err error)
+	// PreferredSkillRank is like SkillRank, but looks in the given region
+	// first. An empty region has no preference.
+	PreferredSkillRank(platform, region, battle_tag string) (sr int,
+		err error)
 	OfficialAPI
 }
 
@@ -84,6 +88,23 @@ func CheckRegion(region string) {
 	}
 }
 
+// PreferRegion reorders regions so that region, if it's among them, comes
+// first.
+func PreferRegion(regions []string, region string) []string {
+	preferred := []string{}
+	for _, candidate := range regions {
+		if candidate == region {
+			preferred = append(preferred, candidate)
+		}
+	}
+	for _, candidate := range regions {
+		if candidate != region {
+			preferred = append(preferred, candidate)
+		}
+	}
+	return preferred
+}
+
 func RankToDivision(rank int) string {
 	switch {
 	case rank < 1500:
@@ -31,13 +31,21 @@ type GlobalOverwatch struct {
 func (o *GlobalOverwatch) SkillRank(platform, battle_tag string) (
 	sr int, err error) {
 
+	return o.PreferredSkillRank(platform, "", battle_tag)
+}
+
+func (o *GlobalOverwatch) PreferredSkillRank(platform, preferred,
+	battle_tag string) (sr int, err error) {
+
 	if !blizzard.WellFormedBattleTag(battle_tag) {
 		return overwatch.SkillRankError,
 			overwatch.BattleTagInvalid.New(battle_tag)
 	}
 
 	// TODO parallelize
-	for _, region := range overwatch.Regions {
+	for _, region := range overwatch.PreferRegion(overwatch.Regions,
+		preferred) {
+
 		sr, err = o.RegionalOverwatchAPI.SkillRank(platform, region,
 			battle_tag)
 		if err != nil {
@@ -15,6 +15,7 @@
 package global
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/ewollesen/zenbot/overwatch"
@@ -43,6 +44,33 @@ func TestSkillRank(t *testing.T) {
 	test.AssertSR("foundeu#2222", 4998)
 }
 
+func TestPreferredSkillRank(t *testing.T) {
+	test, gow := newGlobalTest(t)
+
+	// testuser1#1111 is only ranked in the US, so the preference is a
+	// starting point, not a restriction.
+	sr, err := gow.PreferredSkillRank(overwatch.PlatformPC,
+		overwatch.RegionEU, "testuser1#1111")
+	test.AssertNil(err)
+	test.AssertEqual(sr, 2000)
+
+	sr, err = gow.PreferredSkillRank(overwatch.PlatformPC,
+		overwatch.RegionEU, "foundeu#2222")
+	test.AssertNil(err)
+	test.AssertEqual(sr, 4998)
+}
+
+func TestPreferRegion(t *testing.T) {
+	test := zentest.New(t)
+
+	test.AssertEqual(strings.Join(
+		overwatch.PreferRegion(overwatch.Regions, "kr"), " "),
+		"kr us eu cn global")
+	test.AssertEqual(strings.Join(
+		overwatch.PreferRegion(overwatch.Regions, ""), " "),
+		"us eu kr cn global")
+}
+
 func TestSkillRankNotFound(t *testing.T) {
 	test, _ := newGlobalTest(t)
 
@@ -64,6 +64,12 @@ type regionData struct {
 func (l *owApi) SkillRank(platform, battle_tag string) (
 	sr int, err error) {
 
+	return l.PreferredSkillRank(platform, "", battle_tag)
+}
+
+func (l *owApi) PreferredSkillRank(platform, preferred, battle_tag string) (
+	sr int, err error) {
+
 	if !blizzard.WellFormedBattleTag(battle_tag) {
 		return overwatch.SkillRankError, overwatch.BattleTagInvalid.New(battle_tag)
 	}
@@ -80,7 +86,7 @@ func (l *owApi) SkillRank(platform, battle_tag string) (
 		return overwatch.SkillRankError, err
 	}
 
-	for _, region := range owApiRegions {
+	for _, region := range overwatch.PreferRegion(owApiRegions, preferred) {
 		sr = findRank(stats, region)
 		if sr > 0 {
 			logger.Infof("found %s's SR in region %s", battle_tag, region)
@@ -0,0 +1,327 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+var Unsatisfiable = Error.NewClass("unsatisfiable constraints",
+	errors.NoCaptureStack())
+
+// Constraints restrict which players may share a team. The players in each of
+// Together's groups are put on the same team, and the players in each of
+// Apart's groups on different teams. Players are given by their ids. If Spread
+// names an attribute, eg "role", the players with each value of it are shared
+// out between the teams as evenly as possible, so that no team has more than
+// one more of them than another.
+type Constraints struct {
+	Together [][]string
+	Apart    [][]string
+	Spread   string
+}
+
+// Empty returns true if there are no constraints.
+func (c *Constraints) Empty() bool {
+	return c == nil ||
+		(len(c.Together)+len(c.Apart) == 0 && c.Spread == "")
+}
+
+// Met returns true if the teams meet every constraint.
+func (c *Constraints) Met(teams [][]*Player) bool {
+	if c == nil {
+		return true
+	}
+
+	on_team := make(map[string]int)
+	for i, team := range teams {
+		for _, player := range team {
+			on_team[player.Id] = i
+		}
+	}
+
+	for _, group := range c.Together {
+		for _, id := range group {
+			team, ok := on_team[id]
+			if !ok || team != on_team[group[0]] {
+				return false
+			}
+		}
+	}
+	for _, group := range c.Apart {
+		taken := make(map[int]bool)
+		for _, id := range group {
+			team, ok := on_team[id]
+			if !ok || taken[team] {
+				return false
+			}
+			taken[team] = true
+		}
+	}
+	return c.spreadMet(teams)
+}
+
+// spreadMet returns true if the teams share out the players with each value of
+// the Spread attribute as evenly as possible.
+func (c *Constraints) spreadMet(teams [][]*Player) bool {
+	if c.Spread == "" {
+		return true
+	}
+
+	all := []*Player{}
+	team_of := []int{}
+	for i, team := range teams {
+		all = append(all, team...)
+		for range team {
+			team_of = append(team_of, i)
+		}
+	}
+	classes := spreadClasses(all, c.Spread)
+	totals := classCounts(classes, nil)
+	counts := make([][]int, len(teams))
+	for i := range counts {
+		counts[i] = make([]int, len(totals))
+	}
+	for index, class := range classes {
+		if class >= 0 {
+			counts[team_of[index]][class]++
+		}
+	}
+
+	k := len(teams)
+	for class, total := range totals {
+		for i := range teams {
+			if counts[i][class] != total/k &&
+				counts[i][class] != (total+k-1)/k {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// spreadClasses numbers the values of the players' attribute, in the order
+// they're first seen, returning each player's number, or -1 for players
+// without the attribute. It returns nil if attribute is empty.
+func spreadClasses(players []*Player, attribute string) []int {
+	if attribute == "" {
+		return nil
+	}
+
+	numbers := make(map[string]int)
+	classes := make([]int, len(players))
+	for i, player := range players {
+		value := player.Attributes[attribute]
+		if value == "" {
+			classes[i] = -1
+			continue
+		}
+		number, seen := numbers[value]
+		if !seen {
+			number = len(numbers)
+			numbers[value] = number
+		}
+		classes[i] = number
+	}
+	return classes
+}
+
+// constraint is a single Together or Apart group, written as it would be in a
+// command, eg apart(a#1234,b#5678).
+type constraint struct {
+	apart bool
+	ids   []string
+}
+
+func (c constraint) String() string {
+	kind := "together"
+	if c.apart {
+		kind = "apart"
+	}
+	return fmt.Sprintf("%s(%s)", kind, strings.Join(c.ids, ","))
+}
+
+func (c *Constraints) spread() string {
+	if c == nil {
+		return ""
+	}
+	return c.Spread
+}
+
+func (c *Constraints) list() (all []constraint) {
+	if c == nil {
+		return nil
+	}
+	for _, ids := range c.Together {
+		all = append(all, constraint{ids: ids})
+	}
+	for _, ids := range c.Apart {
+		all = append(all, constraint{apart: true, ids: ids})
+	}
+	return all
+}
+
+// ConstrainedTeams splits players into k teams whose sizes differ by at most
+// one, and whose total weights are as balanced as every constraint allows. Two
+// teams are balanced exactly, as Grouped balances them, unless there are too
+// many players to search. More are balanced as PartitionN balances them. If
+// the constraints can't all be met, the error explains which one made it
+// impossible.
+func ConstrainedTeams(players []*Player, k int, c *Constraints) (
+	teams [][]*Player, err error) {
+
+	if k < 1 {
+		k = 1
+	}
+
+	indices := make(map[string]int)
+	for i, player := range players {
+		if _, dupe := indices[player.Id]; dupe {
+			return nil, Error.New("more than one player with id %q",
+				player.Id)
+		}
+		indices[player.Id] = i
+	}
+
+	// Constraints that can't be met even on their own are easy to explain.
+	max_size := (len(players) + k - 1) / k
+	all := c.list()
+	for _, con := range all {
+		seen := make(map[string]bool)
+		for _, id := range con.ids {
+			if _, found := indices[id]; !found {
+				return nil, Unsatisfiable.New("%s names %s, who "+
+					"isn't playing", con, id)
+			}
+			if seen[id] && con.apart {
+				return nil, Unsatisfiable.New("%s can't keep %s "+
+					"apart from themself", con, id)
+			}
+			seen[id] = true
+		}
+		if con.apart && len(seen) > k {
+			return nil, Unsatisfiable.New("%s needs %d teams, but "+
+				"there are only %d", con, len(seen), k)
+		}
+		if !con.apart && len(seen) > max_size {
+			return nil, Unsatisfiable.New("%s needs %d players on "+
+				"one team, but teams have at most %d", con,
+				len(seen), max_size)
+		}
+	}
+
+	ranks := weights(players)
+	classes := spreadClasses(players, c.spread())
+	team_indices, ok := solveConstraints(ranks, classes, indices, all, k)
+	if ok {
+		for _, team := range team_indices {
+			teams = append(teams, pick(players, team))
+		}
+		return teams, nil
+	}
+
+	// Otherwise, blame the first constraint without which the rest can be
+	// met.
+	for i, con := range all {
+		rest := append(append([]constraint{}, all[:i]...), all[i+1:]...)
+		if _, ok := solveConstraints(ranks, classes, indices, rest,
+			k); ok {
+			return nil, Unsatisfiable.New("%s can't be met along "+
+				"with the other constraints", con)
+		}
+	}
+	return nil, Unsatisfiable.New("the constraints can't all be met at " +
+		"once")
+}
+
+// solveConstraints splits ranks into k teams meeting the constraints, whose
+// ids are mapped to indices into ranks by indices, and sharing out the players
+// of each class evenly, as for groupedApart.
+func solveConstraints(ranks []int, classes []int, indices map[string]int,
+	constraints []constraint, k int) (teams [][]int, ok bool) {
+
+	together := [][]int{}
+	apart := [][2]int{}
+	for _, con := range constraints {
+		if !con.apart {
+			group := []int{}
+			for _, id := range con.ids {
+				group = append(group, indices[id])
+			}
+			together = append(together, group)
+			continue
+		}
+		for i, id := range con.ids {
+			for _, other := range con.ids[i+1:] {
+				apart = append(apart,
+					[2]int{indices[id], indices[other]})
+			}
+		}
+	}
+	together = mergeGroups(len(ranks), together)
+
+	if k == 2 {
+		a, b, ok := groupedApart(ranks, together, apart, classes)
+		if ok {
+			return [][]int{a, b}, true
+		}
+		// There may be too many players to search, so deal them
+		// out instead.
+	}
+	return groupedN(ranks, together, apart, classes, k)
+}
+
+// mergeGroups combines groups of indices into ranks that share a member,
+// dropping duplicates, so that no index is in more than one group.
+func mergeGroups(n int, groups [][]int) (merged [][]int) {
+	parents := make([]int, n)
+	for i := range parents {
+		parents[i] = i
+	}
+	root := func(i int) int {
+		for parents[i] != i {
+			parents[i] = parents[parents[i]]
+			i = parents[i]
+		}
+		return i
+	}
+
+	grouped := make(map[int]bool)
+	for _, group := range groups {
+		for _, index := range group {
+			grouped[index] = true
+			parents[root(index)] = root(group[0])
+		}
+	}
+
+	positions := make(map[int]int)
+	for index := 0; index < n; index++ {
+		if !grouped[index] {
+			continue
+		}
+		r := root(index)
+		position, ok := positions[r]
+		if !ok {
+			position = len(merged)
+			positions[r] = position
+			merged = append(merged, nil)
+		}
+		merged[position] = append(merged[position], index)
+	}
+	return merged
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+func TestConstrainedTeams(t *testing.T) {
+	test := newBalanceTest(t)
+
+	players := weighted(3000, 2900, 2800, 2000, 1900, 1800)
+	c := &Constraints{
+		Together: [][]string{{"2", "3"}},
+		Apart:    [][]string{{"0", "1"}},
+	}
+	teams, err := ConstrainedTeams(players, 2, c)
+	test.AssertNil(err)
+	test.Assert(c.Met(teams))
+	test.AssertEqual(len(teams[0]), 3)
+	test.AssertEqual(len(teams[1]), 3)
+	test.AssertEqual(abs(TotalWeight(teams[0])-TotalWeight(teams[1])),
+		bestConstrainedDiff(players, c))
+
+	// Random constraints still make the most balanced teams that meet
+	// them, when there are any.
+	for round := 0; round < 50; round++ {
+		players := weighted(randomRanks(6 + rand.Intn(7))...)
+		c := &Constraints{}
+		for i := 0; i < 3; i++ {
+			ids := []string{fmt.Sprint(rand.Intn(len(players))),
+				fmt.Sprint(rand.Intn(len(players)))}
+			if ids[0] == ids[1] {
+				continue
+			}
+			if rand.Intn(2) == 0 {
+				c.Together = append(c.Together, ids)
+			} else {
+				c.Apart = append(c.Apart, ids)
+			}
+		}
+
+		best := bestConstrainedDiff(players, c)
+		teams, err := ConstrainedTeams(players, 2, c)
+		if best < 0 {
+			test.AssertErrorContainedBy(err, Unsatisfiable)
+			continue
+		}
+		test.AssertNil(err)
+		test.Assert(c.Met(teams))
+		test.Assert(abs(len(teams[0])-len(teams[1])) <= 1)
+		test.AssertEqual(
+			abs(TotalWeight(teams[0])-TotalWeight(teams[1])), best)
+	}
+}
+
+func TestConstrainedTeamsN(t *testing.T) {
+	test := newBalanceTest(t)
+
+	players := weighted(3000, 2900, 2800, 2000, 1900, 1800, 2500, 2500,
+		2500, 2200, 2300, 2400)
+	c := &Constraints{
+		Together: [][]string{{"3", "4"}, {"4", "6"}},
+		Apart:    [][]string{{"0", "1", "2"}, {"3", "8"}},
+	}
+	teams, err := ConstrainedTeams(players, 3, c)
+	test.AssertNil(err)
+	test.AssertEqual(len(teams), 3)
+	for _, team := range teams {
+		test.AssertEqual(len(team), 4)
+	}
+	test.Assert(c.Met(teams))
+
+	// Without constraints, the teams are as PartitionN makes them.
+	teams, err = ConstrainedTeams(players, 3, nil)
+	test.AssertNil(err)
+	test.AssertEqual(len(teams), 3)
+}
+
+func TestConstrainedTeamsSpread(t *testing.T) {
+	test := newBalanceTest(t)
+
+	roles := []string{"tank", "damage", "support"}
+	for round := 0; round < 20; round++ {
+		for _, k := range []int{2, 3, 4} {
+			players := weighted(randomRanks(6 * k)...)
+			for i, player := range players {
+				player.Attributes = map[string]string{
+					"role": roles[i%len(roles)],
+				}
+			}
+			c := &Constraints{
+				Together: [][]string{{"0", "1"}},
+				Spread:   "role",
+			}
+			teams, err := ConstrainedTeams(players, k, c)
+			test.AssertNil(err)
+			test.Assert(c.Met(teams))
+			for _, team := range teams {
+				counts := make(map[string]int)
+				for _, player := range team {
+					counts[player.Attributes["role"]]++
+				}
+				for _, role := range roles {
+					test.AssertEqual(counts[role], 2)
+				}
+			}
+		}
+	}
+
+	// With two teams, they're as balanced as the roles allow.
+	players := weighted(3000, 2900, 2800, 2000, 1900, 1800)
+	for i, role := range []string{"tank", "tank", "damage", "damage",
+		"support", "support"} {
+
+		players[i].Attributes = map[string]string{"role": role}
+	}
+	c := &Constraints{Spread: "role"}
+	teams, err := ConstrainedTeams(players, 2, c)
+	test.AssertNil(err)
+	test.Assert(c.Met(teams))
+	test.AssertEqual(abs(TotalWeight(teams[0])-TotalWeight(teams[1])),
+		bestConstrainedDiff(players, c))
+	test.Assert(!c.Met([][]*Player{players[:3], players[3:]}))
+}
+
+func TestUnsatisfiable(t *testing.T) {
+	test := newBalanceTest(t)
+
+	players := weighted(3000, 2900, 2800, 2000, 1900, 1800)
+	for _, example := range []struct {
+		c        *Constraints
+		k        int
+		expected string
+	}{
+		{&Constraints{Together: [][]string{{"0", "z"}}}, 2,
+			"together(0,z) names z, who isn't playing"},
+		{&Constraints{Apart: [][]string{{"0", "0"}}}, 2,
+			"apart(0,0) can't keep 0 apart from themself"},
+		{&Constraints{Apart: [][]string{{"0", "1", "2"}}}, 2,
+			"apart(0,1,2) needs 3 teams, but there are only 2"},
+		{&Constraints{Together: [][]string{{"0", "1", "2", "3"}}}, 2,
+			"together(0,1,2,3) needs 4 players on one team, but " +
+				"teams have at most 3"},
+		{&Constraints{
+			Together: [][]string{{"0", "1"}, {"1", "2"}},
+			Apart:    [][]string{{"5", "4"}, {"2", "0"}},
+		}, 2, "together(0,1) can't be met along with the other " +
+			"constraints"},
+		{&Constraints{
+			Together: [][]string{{"0", "1"}, {"2", "3"}, {"4", "0"}},
+		}, 3, "together(0,1) can't be met along with the other " +
+			"constraints"},
+	} {
+		_, err := ConstrainedTeams(players, example.k, example.c)
+		test.AssertErrorContainedBy(err, Unsatisfiable)
+		test.AssertEqual(errors.GetMessage(err), example.expected)
+	}
+}
+
+// bestConstrainedDiff finds the smallest difference between the totals of
+// two teams of len(players)/2 and the rest that meet the constraints, by
+// trying every team, or -1 if none do.
+func bestConstrainedDiff(players []*Player, c *Constraints) int {
+	best := -1
+	for mask := uint(0); mask < 1<<uint(len(players)); mask++ {
+		if bits(mask) != len(players)/2 {
+			continue
+		}
+		teams := [][]*Player{nil, nil}
+		for i, player := range players {
+			if mask&(1<<uint(i)) != 0 {
+				teams[0] = append(teams[0], player)
+			} else {
+				teams[1] = append(teams[1], player)
+			}
+		}
+		if !c.Met(teams) {
+			continue
+		}
+		diff := abs(TotalWeight(teams[0]) - TotalWeight(teams[1]))
+		if best < 0 || diff < best {
+			best = diff
+		}
+	}
+	return best
+}
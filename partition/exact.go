@@ -0,0 +1,194 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// maxExactRanks bounds exact's search, whose time and memory grow with
+// 2^(n/2). Larger inputs are split greedily.
+const maxExactRanks = 40
+
+type subset struct {
+	mask uint
+	sum  int
+}
+
+type bySum []subset
+
+func (s bySum) Len() int           { return len(s) }
+func (s bySum) Less(i, j int) bool { return s[i].sum < s[j].sum }
+func (s bySum) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// exact splits ranks into two teams whose sizes differ by at most one, and
+// whose rank totals are as close as possible. The teams are returned as
+// indices into ranks. When several splits are equally good, one is chosen at
+// random.
+//
+// It meets in the middle: every subset of each half of the ranks is summed,
+// then each subset of the second half is paired with the subset of the first
+// half that brings team a's total closest to half the overall total, while
+// keeping team a's size at len(ranks)/2.
+func exact(ranks []int) (a, b []int) {
+	return exactBiased(ranks, 0)
+}
+
+// exactBiased is exact, with team a given a head start of bias, eg for the
+// ranks of players already placed on each team.
+func exactBiased(ranks []int, bias int) (a, b []int) {
+	// Shuffling breaks ties at random.
+	order := rand.Perm(len(ranks))
+	shuffled := make([]int, len(ranks))
+	total := 0
+	for i, index := range order {
+		shuffled[i] = ranks[index]
+		total += ranks[index]
+	}
+
+	left, right := shuffled[:len(shuffled)/2], shuffled[len(shuffled)/2:]
+	team_size := len(ranks) / 2
+
+	// by_size holds the subsets of the left half with each number of
+	// members, sorted by their totals.
+	by_size := make([][]subset, len(left)+1)
+	for _, s := range subsets(left) {
+		size := bits(s.mask)
+		by_size[size] = append(by_size[size], s)
+	}
+	for _, candidates := range by_size {
+		sort.Sort(bySum(candidates))
+	}
+
+	best_left, best_right, best_diff := uint(0), uint(0), -1
+	for _, r := range subsets(right) {
+		size := team_size - bits(r.mask)
+		if size < 0 || size > len(left) {
+			continue
+		}
+		candidates := by_size[size]
+		// The first candidate that would put team a at or above team b,
+		// and the one before it, are the closest.
+		i := sort.Search(len(candidates), func(i int) bool {
+			return bias+2*(candidates[i].sum+r.sum) >= total
+		})
+		for _, j := range []int{i - 1, i} {
+			if j < 0 || j >= len(candidates) {
+				continue
+			}
+			diff := abs(total - bias - 2*(candidates[j].sum+r.sum))
+			if best_diff < 0 || diff < best_diff {
+				best_left, best_right = candidates[j].mask, r.mask
+				best_diff = diff
+			}
+		}
+		if best_diff == abs(total-bias)%2 {
+			// The difference can't do any better than the
+			// total's parity.
+			break
+		}
+	}
+
+	for i, index := range order {
+		var on_a bool
+		if i < len(left) {
+			on_a = best_left&(1<<uint(i)) != 0
+		} else {
+			on_a = best_right&(1<<uint(i-len(left))) != 0
+		}
+		if on_a {
+			a = append(a, index)
+		} else {
+			b = append(b, index)
+		}
+	}
+
+	return a, b
+}
+
+// subsets returns every subset of ranks, with its total.
+func subsets(ranks []int) []subset {
+	all := make([]subset, 1<<uint(len(ranks)))
+	for i, rank := range ranks {
+		bit := uint(1) << uint(i)
+		// The subsets including rank i are those without it, plus it.
+		for mask := uint(0); mask < bit; mask++ {
+			all[mask|bit] = subset{mask: mask | bit,
+				sum: all[mask].sum + rank}
+		}
+	}
+	return all
+}
+
+// greedy splits ranks into two teams whose sizes differ by at most one,
+// placing each rank, from highest to lowest, on the team with the lower total
+// that has room. The teams are returned as indices into ranks.
+func greedy(ranks []int) (a, b []int) {
+	order := &byRank{ranks: ranks, indices: rand.Perm(len(ranks))}
+	sort.Stable(order)
+
+	a_total, b_total := 0, 0
+	for _, index := range order.indices {
+		if len(b) >= (len(ranks)+1)/2 ||
+			(a_total <= b_total && len(a) < (len(ranks)+1)/2) {
+
+			a = append(a, index)
+			a_total += ranks[index]
+			continue
+		}
+		b = append(b, index)
+		b_total += ranks[index]
+	}
+
+	return a, b
+}
+
+// byRank sorts indices into ranks by descending rank.
+type byRank struct {
+	ranks   []int
+	indices []int
+}
+
+func (b *byRank) Len() int { return len(b.indices) }
+
+func (b *byRank) Less(i, j int) bool {
+	return b.ranks[b.indices[i]] > b.ranks[b.indices[j]]
+}
+
+func (b *byRank) Swap(i, j int) {
+	b.indices[i], b.indices[j] = b.indices[j], b.indices[i]
+}
+
+func bits(mask uint) (n int) {
+	for ; mask != 0; mask &= mask - 1 {
+		n++
+	}
+	return n
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func values(ranks []int, indices []int) (values []int) {
+	for _, index := range indices {
+		values = append(values, ranks[index])
+	}
+	return values
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+// maxGroupedUnits bounds Grouped's search, which examines every subset of the
+// units (groups and ungrouped players) being partitioned.
+const maxGroupedUnits = 24
+
+type unit struct {
+	indices     []int
+	ranks_total int
+}
+
+// Grouped splits ranks into two teams whose sizes differ by at most one, and
+// whose rank totals are as close as possible, while keeping the players in
+// each group on the same team. Groups are lists of indices into ranks, and
+// mustn't overlap. The teams are returned as indices into ranks. ok is false
+// if the groups can't all be kept together, or there are too many players to
+// search.
+func Grouped(ranks []int, groups [][]int) (a, b []int, ok bool) {
+	return groupedApart(ranks, groups, nil, nil)
+}
+
+// groupedApart is Grouped, while also putting the players in each apart pair,
+// given by their indices into ranks, on different teams, and, if classes is
+// given, splitting the players of each class evenly between the teams, as for
+// spreadClasses.
+func groupedApart(ranks []int, groups [][]int, apart [][2]int,
+	classes []int) (a, b []int, ok bool) {
+
+	units, ok := groupUnits(ranks, groups)
+	if !ok || len(units) > maxGroupedUnits {
+		return nil, nil, false
+	}
+	unit_pairs, ok := apartUnits(units, apart)
+	if !ok {
+		return nil, nil, false
+	}
+
+	total := 0
+	for _, rank := range ranks {
+		total += rank
+	}
+	class_totals := classCounts(classes, nil)
+	unit_classes := make([][]int, len(units))
+	for i, u := range units {
+		unit_classes[i] = classCounts(classes, u.indices)
+	}
+
+	best_mask, best_diff := -1, 0
+	// Unit 0 is always placed on team a, as the mirror image of each split
+	// is equally good.
+masks:
+	for mask := 1; mask < twoPow32(len(units)); mask += 2 {
+		for _, pair := range unit_pairs {
+			if (mask&twoPow32(pair[0]) != 0) ==
+				(mask&twoPow32(pair[1]) != 0) {
+				continue masks
+			}
+		}
+
+		size, sum := 0, 0
+		counts := make([]int, len(class_totals))
+		for i, u := range units {
+			if mask&twoPow32(i) != 0 {
+				size += len(u.indices)
+				sum += u.ranks_total
+				for class, count := range unit_classes[i] {
+					counts[class] += count
+				}
+			}
+		}
+		if size != len(ranks)/2 && size != (len(ranks)+1)/2 {
+			continue
+		}
+		for class, count := range counts {
+			if count != class_totals[class]/2 &&
+				count != (class_totals[class]+1)/2 {
+				continue masks
+			}
+		}
+
+		diff := total - 2*sum
+		if diff < 0 {
+			diff = -diff
+		}
+		if best_mask < 0 || diff < best_diff {
+			best_mask, best_diff = mask, diff
+		}
+	}
+	if best_mask < 0 {
+		return nil, nil, false
+	}
+
+	for i, u := range units {
+		if best_mask&twoPow32(i) != 0 {
+			a = append(a, u.indices...)
+		} else {
+			b = append(b, u.indices...)
+		}
+	}
+
+	return a, b, true
+}
+
+func groupUnits(ranks []int, groups [][]int) (units []*unit, ok bool) {
+	grouped := make(map[int]bool)
+	for _, group := range groups {
+		u := &unit{}
+		for _, index := range group {
+			if index < 0 || index >= len(ranks) || grouped[index] {
+				return nil, false
+			}
+			grouped[index] = true
+			u.indices = append(u.indices, index)
+			u.ranks_total += ranks[index]
+		}
+		if len(u.indices) > 0 {
+			units = append(units, u)
+		}
+	}
+
+	for index, rank := range ranks {
+		if !grouped[index] {
+			units = append(units, &unit{
+				indices:     []int{index},
+				ranks_total: rank,
+			})
+		}
+	}
+
+	return units, true
+}
+
+// apartUnits converts pairs of indices into ranks into pairs of indices into
+// units. ok is false if a pair is in the same unit.
+func apartUnits(units []*unit, apart [][2]int) (unit_pairs [][2]int,
+	ok bool) {
+
+	unit_of := make(map[int]int)
+	for i, u := range units {
+		for _, index := range u.indices {
+			unit_of[index] = i
+		}
+	}
+
+	for _, pair := range apart {
+		first, found_first := unit_of[pair[0]]
+		second, found_second := unit_of[pair[1]]
+		if !found_first || !found_second || first == second {
+			return nil, false
+		}
+		unit_pairs = append(unit_pairs, [2]int{first, second})
+	}
+
+	return unit_pairs, true
+}
+
+// classCounts returns the number of players of each class among indices, or
+// among all the players if indices is nil. classes gives each player's class,
+// numbered from zero, or -1 if they don't have one.
+func classCounts(classes []int, indices []int) (counts []int) {
+	if classes == nil {
+		return nil
+	}
+	for _, class := range classes {
+		if class >= len(counts) {
+			counts = append(counts,
+				make([]int, class+1-len(counts))...)
+		}
+	}
+	if indices == nil {
+		for _, class := range classes {
+			if class >= 0 {
+				counts[class]++
+			}
+		}
+		return counts
+	}
+	for _, index := range indices {
+		if class := classes[index]; class >= 0 {
+			counts[class]++
+		}
+	}
+	return counts
+}
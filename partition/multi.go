@@ -0,0 +1,351 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// PartitionN splits ranks into k teams whose sizes differ by at most one, and
+// whose rank totals are balanced. Two teams are split as Partition splits
+// them. More are dealt out greedily, from the highest rank to the lowest, then
+// each pair of teams is re-split between themselves, as Partition would split
+// them, while that brings their totals closer. So no two teams could be
+// balanced any better by trading players with each other, and, as with
+// Partition, equally good splits are chosen between at random.
+func PartitionN(ranks []int, k int) (teams [][]int) {
+	for _, indices := range splitN(ranks, k) {
+		teams = append(teams, values(ranks, indices))
+	}
+	return teams
+}
+
+// splitN is PartitionN, returning the teams as indices into ranks.
+func splitN(ranks []int, k int) [][]int {
+	switch {
+	case k <= 1:
+		return [][]int{rand.Perm(len(ranks))}
+	case k == 2:
+		a, b := split(ranks)
+		return [][]int{a, b}
+	}
+
+	// Without groups, the players can always be dealt out.
+	teams, _ := groupedN(ranks, nil, nil, nil, k)
+	return teams
+}
+
+// groupedN splits ranks into k teams as splitN does, while keeping the
+// players in each group on the same team, the players in each apart pair on
+// different teams, and sharing the players of each class out evenly. Groups
+// are as for Grouped, and apart pairs and classes as for groupedApart. ok is
+// false if the players couldn't be dealt out that way without overfilling a
+// team.
+func groupedN(ranks []int, groups [][]int, apart [][2]int, classes []int,
+	k int) (teams [][]int, ok bool) {
+
+	if k < 1 {
+		k = 1
+	}
+
+	units, ok := groupUnits(ranks, groups)
+	if !ok {
+		return nil, false
+	}
+	unit_pairs, ok := apartUnits(units, apart)
+	if !ok {
+		return nil, false
+	}
+
+	teams, ok = deal(ranks, classes, units, unit_pairs, k)
+	if !ok {
+		return nil, false
+	}
+	rebalance(ranks, classes, groups, apart, teams)
+	return teams, true
+}
+
+// maxDealSteps bounds deal's search for a way to place every unit, which only
+// needs to backtrack when units must be kept apart.
+const maxDealSteps = 100000
+
+// deal places each unit, from the largest to the smallest, on the team with
+// the lowest total that has room for it, and none of the units it must be
+// kept apart from. Teams have room for len(ranks)/k players, and len(ranks)%k
+// of them for one more, and likewise for the players of each class. If a unit
+// can't be placed, the units before it are tried on the teams with the next
+// lowest totals.
+func deal(ranks []int, classes []int, units []*unit, unit_pairs [][2]int,
+	k int) (teams [][]int, ok bool) {
+
+	order := &bySize{units: units, indices: rand.Perm(len(units))}
+	sort.Stable(order)
+
+	max_size := (len(ranks) + k - 1) / k
+	num_full, max_full := 0, len(ranks)%k
+	if max_full == 0 {
+		max_full = k
+	}
+
+	class_totals := classCounts(classes, nil)
+	unit_classes := make([][]int, len(units))
+	for i, u := range units {
+		unit_classes[i] = classCounts(classes, u.indices)
+	}
+	team_classes := make([][]int, k)
+	for i := range team_classes {
+		team_classes[i] = make([]int, len(class_totals))
+	}
+	class_full := make([]int, len(class_totals))
+	hasRoom := func(team, index int) bool {
+		for class, count := range unit_classes[index] {
+			total := class_totals[class]
+			max_count := (total + k - 1) / k
+			max_class_full := total % k
+			if max_class_full == 0 {
+				max_class_full = k
+			}
+			count += team_classes[team][class]
+			if count > max_count || (count == max_count &&
+				unit_classes[index][class] > 0 &&
+				class_full[class] >= max_class_full) {
+				return false
+			}
+		}
+		return true
+	}
+	addClasses := func(team, index, sign int) {
+		for class, count := range unit_classes[index] {
+			if count == 0 {
+				continue
+			}
+			max_count := (class_totals[class] + k - 1) / k
+			if team_classes[team][class] == max_count {
+				class_full[class]--
+			}
+			team_classes[team][class] += sign * count
+			if team_classes[team][class] == max_count {
+				class_full[class]++
+			}
+		}
+	}
+
+	apart := make(map[int][]int)
+	for _, pair := range unit_pairs {
+		apart[pair[0]] = append(apart[pair[0]], pair[1])
+		apart[pair[1]] = append(apart[pair[1]], pair[0])
+	}
+
+	teams = make([][]int, k)
+	totals := make([]int, k)
+	on := make(map[int]int)
+	steps := 0
+
+	var place func(next int) bool
+	place = func(next int) bool {
+		if next == len(order.indices) {
+			return true
+		}
+		steps++
+		if steps > maxDealSteps {
+			return false
+		}
+
+		index := order.indices[next]
+		u := units[index]
+		taken := make(map[int]bool)
+		for _, other := range apart[index] {
+			if team, placed := on[other]; placed {
+				taken[team] = true
+			}
+		}
+		candidates := &byTotal{totals: totals}
+		for i, team := range teams {
+			size := len(team) + len(u.indices)
+			if taken[i] || size > max_size ||
+				(size == max_size && num_full >= max_full) ||
+				!hasRoom(i, index) {
+				continue
+			}
+			candidates.teams = append(candidates.teams, i)
+		}
+		sort.Stable(candidates)
+
+		for _, i := range candidates.teams {
+			teams[i] = append(teams[i], u.indices...)
+			totals[i] += u.ranks_total
+			addClasses(i, index, 1)
+			on[index] = i
+			full := len(teams[i]) == max_size
+			if full {
+				num_full++
+			}
+			if place(next + 1) {
+				return true
+			}
+			if full {
+				num_full--
+			}
+			delete(on, index)
+			addClasses(i, index, -1)
+			totals[i] -= u.ranks_total
+			teams[i] = teams[i][:len(teams[i])-len(u.indices)]
+		}
+		return false
+	}
+
+	if !place(0) {
+		return nil, false
+	}
+	return teams, true
+}
+
+// rebalance re-splits each pair of teams between themselves, keeping groups
+// together, apart pairs apart and classes evenly shared, until no pair's
+// totals can be brought any closer. Each re-split lowers the sum of the
+// squares of the teams' totals, so it finishes.
+func rebalance(ranks []int, classes []int, groups [][]int, apart [][2]int,
+	teams [][]int) {
+
+	for improved := true; improved; {
+		improved = false
+		for i := range teams {
+			for j := i + 1; j < len(teams); j++ {
+				if resplit(ranks, classes, groups, apart,
+					teams, i, j) {
+					improved = true
+				}
+			}
+		}
+	}
+}
+
+// resplit splits the players on teams i and j between them afresh, returning
+// true if their totals are now closer.
+func resplit(ranks []int, classes []int, groups [][]int, apart [][2]int,
+	teams [][]int, i, j int) bool {
+
+	players := append(append([]int{}, teams[i]...), teams[j]...)
+	positions := make(map[int]int)
+	for position, index := range players {
+		positions[index] = position
+	}
+
+	// The groups are each on one team or the other, as they were dealt
+	// out together.
+	local_groups := [][]int{}
+	for _, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		if _, ok := positions[group[0]]; !ok {
+			continue
+		}
+		local_group := []int{}
+		for _, index := range group {
+			local_group = append(local_group, positions[index])
+		}
+		local_groups = append(local_groups, local_group)
+	}
+
+	// Apart pairs on these teams are on one each, as they were dealt out
+	// apart.
+	local_apart := [][2]int{}
+	for _, pair := range apart {
+		first, ok := positions[pair[0]]
+		if !ok {
+			continue
+		}
+		second, ok := positions[pair[1]]
+		if !ok {
+			continue
+		}
+		local_apart = append(local_apart, [2]int{first, second})
+	}
+
+	// Sharing each class's players evenly between the pair keeps them
+	// evenly shared between all the teams.
+	var local_classes []int
+	if classes != nil {
+		local_classes = values(classes, players)
+	}
+
+	local_ranks := values(ranks, players)
+	var a, b []int
+	if len(local_groups) == 0 && len(local_apart) == 0 &&
+		local_classes == nil {
+		a, b = split(local_ranks)
+	} else {
+		var ok bool
+		a, b, ok = groupedApart(local_ranks, local_groups, local_apart,
+			local_classes)
+		if !ok {
+			return false
+		}
+	}
+
+	before := abs(sum(values(ranks, teams[i])) - sum(values(ranks, teams[j])))
+	after := abs(sum(values(local_ranks, a)) - sum(values(local_ranks, b)))
+	if after >= before {
+		return false
+	}
+
+	teams[i], teams[j] = values(players, a), values(players, b)
+	return true
+}
+
+func sum(ranks []int) (total int) {
+	for _, rank := range ranks {
+		total += rank
+	}
+	return total
+}
+
+// byTotal sorts teams by ascending total.
+type byTotal struct {
+	teams  []int
+	totals []int
+}
+
+func (b *byTotal) Len() int { return len(b.teams) }
+
+func (b *byTotal) Less(i, j int) bool {
+	return b.totals[b.teams[i]] < b.totals[b.teams[j]]
+}
+
+func (b *byTotal) Swap(i, j int) {
+	b.teams[i], b.teams[j] = b.teams[j], b.teams[i]
+}
+
+// bySize sorts indices into units by descending size, then descending total.
+type bySize struct {
+	units   []*unit
+	indices []int
+}
+
+func (b *bySize) Len() int { return len(b.indices) }
+
+func (b *bySize) Less(i, j int) bool {
+	u, v := b.units[b.indices[i]], b.units[b.indices[j]]
+	if len(u.indices) != len(v.indices) {
+		return len(u.indices) > len(v.indices)
+	}
+	return u.ranks_total > v.ranks_total
+}
+
+func (b *bySize) Swap(i, j int) {
+	b.indices[i], b.indices[j] = b.indices[j], b.indices[i]
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"testing"
+)
+
+func TestPartitionN(t *testing.T) {
+	test := newBalanceTest(t)
+
+	for _, k := range []int{1, 2, 3, 4, 6} {
+		for _, n := range []int{0, 1, 5, 12, 14, 24} {
+			ranks := randomRanks(n)
+			teams := PartitionN(ranks, k)
+			test.AssertEqual(len(teams), k)
+
+			all := []int{}
+			for i, team := range teams {
+				test.Assert(len(team) == n/k || len(team) == (n+k-1)/k)
+				all = append(all, team...)
+				// No two teams can do any better by trading
+				// players.
+				for _, other := range teams[i+1:] {
+					union := append(append([]int{}, team...),
+						other...)
+					test.AssertEqual(abs(sum(team)-sum(other)),
+						bestDiff(union))
+				}
+			}
+			test.AssertEqualContents(all, ranks)
+		}
+	}
+}
+
+func TestPartitionNExample(t *testing.T) {
+	test := newBalanceTest(t)
+
+	teams := PartitionN([]int{1, 2, 3, 4, 5, 6, 7, 8}, 4)
+	for _, team := range teams {
+		test.AssertEqual(len(team), 2)
+		test.AssertEqual(sum(team), 9)
+	}
+
+	teams = PartitionN([]int{3000, 3000, 2000, 2000, 1000, 1000}, 3)
+	for _, team := range teams {
+		test.AssertEqual(sum(team), 4000)
+	}
+}
+
+func TestGroupedTeamsN(t *testing.T) {
+	test := newBalanceTest(t)
+
+	players := weighted(3000, 2900, 2800, 2000, 1900, 1800, 2500, 2500,
+		2500)
+	teams, ok := GroupedTeamsN(players, [][]string{{"0", "1"}, {"3", "4",
+		"5"}}, 3)
+	test.Assert(ok)
+	test.AssertEqual(len(teams), 3)
+	on := make(map[string]int)
+	for i, team := range teams {
+		test.AssertEqual(len(team), 3)
+		for _, player := range team {
+			on[player.Id] = i
+		}
+	}
+	test.AssertEqual(len(on), 9)
+	test.AssertEqual(on["0"], on["1"])
+	test.AssertEqual(on["3"], on["4"])
+	test.AssertEqual(on["3"], on["5"])
+
+	// A party of four can't fit on a team of three.
+	_, ok = GroupedTeamsN(players, [][]string{{"0", "1", "2", "3"}}, 3)
+	test.Assert(!ok)
+
+	_, ok = GroupedTeamsN(players, [][]string{{"0", "z"}}, 3)
+	test.Assert(!ok)
+}
+
+func BenchmarkPartitionN24x4(b *testing.B) {
+	ranks := randomRanks(24)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		PartitionN(ranks, 4)
+	}
+}
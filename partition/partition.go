@@ -31,22 +31,26 @@ func init() {
 	rand.Seed(time.Now().Unix())
 }
 
+// Partition splits ranks into two teams whose sizes differ by at most one,
+// and whose rank totals are as close as possible. Up to maxExactRanks, the
+// split is optimal.
 func Partition(ranks []int) (a, b []int) {
-	if len(ranks) == 0 {
-		return a, b
-	}
-
-	if len(ranks) == 1 {
-		return ranks, b
-	}
-
-	if len(ranks) == 2 {
-		return ranks[:1], ranks[1:]
-	}
+	a, b = split(ranks)
+	return values(ranks, a), values(ranks, b)
+}
 
-	if len(ranks)%2 != 0 {
-		return kk(ranks)
+// split is Partition, returning the teams as indices into ranks.
+func split(ranks []int) (a, b []int) {
+	switch {
+	case len(ranks) == 0:
+		return nil, nil
+	case len(ranks) == 1:
+		return []int{0}, nil
+	case len(ranks) == 2:
+		return []int{0}, []int{1}
+	case len(ranks) > maxExactRanks:
+		return greedy(ranks)
 	}
 
-	return balancedBrute(ranks)
+	return exact(ranks)
 }
@@ -84,53 +84,56 @@ func TestTwo(t *testing.T) {
 func TestThree(t *testing.T) {
 	test := newBalanceTest(t)
 
-	a, b := Partition([]int{2, 1, 3})
-	test.AssertEqualContents(b, []int{1, 2})
-	test.AssertEqualContents(a, []int{3})
+	ranks := []int{2, 1, 3}
+	a, b := Partition(ranks)
+	test.AssertBalanced(ranks, a, b, []int{3}, []int{1, 2})
 }
 
 func TestExample(t *testing.T) {
 	test := newBalanceTest(t)
 
-	a, b := Partition([]int{8, 7, 6, 5, 4})
-	test.AssertEqualContents(a, []int{4, 5, 7})
-	test.AssertEqualContents(b, []int{6, 8})
+	ranks := []int{8, 7, 6, 5, 4}
+	a, b := Partition(ranks)
+	test.AssertBalanced(ranks, a, b, []int{7, 8}, []int{4, 5, 6})
 }
 
 func TestExample2(t *testing.T) {
 	test := newBalanceTest(t)
 
-	a, b := Partition([]int{3, 6, 13, 20, 30, 40, 73})
-	test.AssertEqualContents(a, []int{3, 20, 30, 40})
-	test.AssertEqualContents(b, []int{6, 13, 73})
+	ranks := []int{3, 6, 13, 20, 30, 40, 73}
+	a, b := Partition(ranks)
+	test.AssertBalanced(ranks, a, b, []int{3, 20, 30, 40}, []int{6, 13, 73})
 }
 
 func TestTwelve(t *testing.T) {
 	test := newBalanceTest(t)
 
-	a, b := Partition([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
-	test.AssertEqualContents(a, []int{2, 4, 5, 6, 10, 12})
-	test.AssertEqualContents(b, []int{1, 3, 7, 8, 9, 11})
+	ranks := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	a, b := Partition(ranks)
+	test.AssertBalanced(ranks, a, b, []int{2, 4, 5, 6, 10, 12},
+		[]int{1, 3, 7, 8, 9, 11})
 }
 
 func TestMultiSet(t *testing.T) {
 	test := newBalanceTest(t)
 
-	a, b := Partition([]int{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6})
-	test.AssertEqualContents(a, []int{1, 2, 3, 4, 5, 6})
-	test.AssertEqualContents(b, []int{1, 2, 3, 4, 5, 6})
+	ranks := []int{1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6}
+	a, b := Partition(ranks)
+	test.AssertBalanced(ranks, a, b, []int{1, 2, 3, 4, 5, 6},
+		[]int{1, 2, 3, 4, 5, 6})
 
-	c, d := Partition([]int{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4})
-	test.AssertEqualContents(c, []int{1, 2, 2, 3, 3, 4})
-	test.AssertEqualContents(d, []int{1, 1, 2, 3, 4, 4})
+	ranks = []int{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4}
+	c, d := Partition(ranks)
+	test.AssertBalanced(ranks, c, d, []int{1, 2, 2, 3, 3, 4},
+		[]int{1, 1, 2, 3, 4, 4})
 }
 
 func TestSixteen(t *testing.T) {
 	test := newBalanceTest(t)
 	all := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 	a, b := Partition(all)
-	test.AssertEqualContents(a, []int{1, 4, 6, 7, 10, 12, 13, 15})
-	test.AssertEqualContents(b, []int{2, 3, 5, 8, 9, 11, 14, 16})
+	test.AssertBalanced(all, a, b, []int{1, 4, 6, 7, 10, 12, 13, 15},
+		[]int{2, 3, 5, 8, 9, 11, 14, 16})
 }
 
 func TestSkillRanks(t *testing.T) {
@@ -140,10 +143,177 @@ func TestSkillRanks(t *testing.T) {
 	// queue, minus one that wasn't properly case-sensitive (I subbed my
 	// own) I have not hand-verified this result, but am using it as a sort
 	// of regression check.
-	a, b := Partition([]int{1836, 1892, 1901, 2176, 2558, 2915,
-		2935, 2968, 3420, 3458, 3723, 3963})
-	test.AssertEqualContents(a, []int{2915, 2558, 3963, 3420, 2176, 1836})
-	test.AssertEqualContents(b, []int{1901, 3458, 3723, 1892, 2968, 2935})
+	ranks := []int{1836, 1892, 1901, 2176, 2558, 2915,
+		2935, 2968, 3420, 3458, 3723, 3963}
+	a, b := Partition(ranks)
+	test.AssertBalanced(ranks, a, b,
+		[]int{2915, 2558, 3963, 3420, 2176, 1836},
+		[]int{1901, 3458, 3723, 1892, 2968, 2935})
+}
+
+func TestExactMatchesBrute(t *testing.T) {
+	test := newBalanceTest(t)
+
+	for n := 3; n <= 14; n++ {
+		ranks := randomRanks(n)
+		a, b := exact(ranks)
+		test.AssertEqual(len(a), n/2)
+		test.AssertEqual(len(b), n-n/2)
+		test.AssertEqual(abs(sum(values(ranks, a))-sum(values(ranks, b))),
+			bestDiff(ranks))
+	}
+}
+
+func TestExactLarge(t *testing.T) {
+	test := newBalanceTest(t)
+
+	// Six teams of four, and 6v6 with a few subs.
+	for _, n := range []int{24, 15, maxExactRanks} {
+		ranks := randomRanks(n)
+		a, b := Partition(ranks)
+		test.AssertEqual(len(a), n/2)
+		test.AssertEqual(len(b), n-n/2)
+	}
+
+	// Past maxExactRanks, teams are still the same size, and their totals
+	// are no further apart than the highest and lowest ranks, which is as
+	// far as a snake draft's can be.
+	for n := maxExactRanks + 1; n <= maxExactRanks+30; n++ {
+		ranks := randomRanks(n)
+		sorted := append([]int{}, ranks...)
+		sort.Ints(sorted)
+		a, b := Partition(ranks)
+		test.AssertBalanced(ranks, a, b, sorted[n-1:], sorted[:1])
+	}
+}
+
+// bestDiff finds the smallest difference between the totals of two teams of
+// len(ranks)/2 and the rest, by trying every team.
+func bestDiff(ranks []int) int {
+	best := -1
+	for mask := uint(0); mask < 1<<uint(len(ranks)); mask++ {
+		if bits(mask) != len(ranks)/2 {
+			continue
+		}
+		diff := 0
+		for i, rank := range ranks {
+			if mask&(1<<uint(i)) != 0 {
+				diff += rank
+			} else {
+				diff -= rank
+			}
+		}
+		if best < 0 || abs(diff) < best {
+			best = abs(diff)
+		}
+	}
+	return best
+}
+
+func randomRanks(n int) (ranks []int) {
+	for i := 0; i < n; i++ {
+		ranks = append(ranks, 1000+rand.Intn(3500))
+	}
+	return ranks
+}
+
+func benchmarkPartition(b *testing.B, n int,
+	partition func([]int) (a, b []int)) {
+
+	rand.Seed(42)
+	ranks := randomRanks(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		partition(ranks)
+	}
+}
+
+func BenchmarkBalancedBrute12(b *testing.B) {
+	benchmarkPartition(b, 12, balancedBrute)
+}
+
+func BenchmarkBalancedBrute16(b *testing.B) {
+	benchmarkPartition(b, 16, balancedBrute)
+}
+
+func BenchmarkExact12(b *testing.B) { benchmarkPartition(b, 12, exact) }
+func BenchmarkExact16(b *testing.B) { benchmarkPartition(b, 16, exact) }
+func BenchmarkExact24(b *testing.B) { benchmarkPartition(b, 24, exact) }
+func BenchmarkExact32(b *testing.B) { benchmarkPartition(b, 32, exact) }
+
+func BenchmarkExact40(b *testing.B) {
+	benchmarkPartition(b, maxExactRanks, exact)
+}
+
+func TestGrouped(t *testing.T) {
+	test := newBalanceTest(t)
+
+	ranks := []int{3000, 2900, 2800, 2000, 1900, 1800}
+	a, b, ok := Grouped(ranks, nil)
+	test.Assert(ok)
+	test.AssertEqual(len(a), 3)
+	test.AssertEqual(len(b), 3)
+
+	// Keeping the top three together makes for lopsided, but legal, teams.
+	a, b, ok = Grouped(ranks, [][]int{{0, 1, 2}})
+	test.Assert(ok)
+	test.AssertEqualContents(a, []int{0, 1, 2})
+	test.AssertEqualContents(b, []int{3, 4, 5})
+
+	a, b, ok = Grouped(ranks, [][]int{{0, 5}, {1, 4}})
+	test.Assert(ok)
+	test.AssertEqual(len(a), 3)
+	test.AssertEqual(len(b), 3)
+	test.AssertEqual(sameTeam(a, b, 0, 5), true)
+	test.AssertEqual(sameTeam(a, b, 1, 4), true)
+
+	_, _, ok = Grouped(ranks, [][]int{{0, 1, 2, 3}})
+	test.Assert(!ok)
+
+	_, _, ok = Grouped(ranks, [][]int{{0, 1}, {1, 2}})
+	test.Assert(!ok)
+}
+
+func TestTeams(t *testing.T) {
+	test := newBalanceTest(t)
+
+	// Repeated weights don't confuse whose is whose.
+	players := []*Player{}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		players = append(players, &Player{Id: id, Weight: 2500,
+			Attributes: map[string]string{"id": id}})
+	}
+	players[5].Weight = 3000
+	a, b := Teams(players)
+	test.AssertEqual(len(a), 3)
+	test.AssertEqual(len(b), 3)
+	seen := make(map[string]bool)
+	for _, player := range append(a, b...) {
+		test.Assert(!seen[player.Id])
+		seen[player.Id] = true
+		test.AssertEqual(player.Attributes["id"], player.Id)
+	}
+	test.AssertEqual(abs(TotalWeight(a)-TotalWeight(b)), 500)
+
+	a, b, ok := GroupedTeams(players, [][]string{{"a", "b", "f"}})
+	test.Assert(ok)
+	test.AssertEqual(TotalWeight(a)+TotalWeight(b), 15500)
+	test.AssertEqual(abs(TotalWeight(a)-TotalWeight(b)), 500)
+
+	_, _, ok = GroupedTeams(players, [][]string{{"a", "z"}})
+	test.Assert(!ok)
+}
+
+func sameTeam(a, b []int, x, y int) bool {
+	in := func(team []int, index int) bool {
+		for _, candidate := range team {
+			if candidate == index {
+				return true
+			}
+		}
+		return false
+	}
+	return in(a, x) == in(a, y) && in(b, x) == in(b, y)
 }
 
 type balanceTest struct {
@@ -169,6 +339,20 @@ func (t *balanceTest) AssertEqualContents(got, expected []int) {
 	}
 }
 
+// AssertBalanced checks that a and b split ranks into teams whose sizes differ
+// by at most one, and whose totals are at least as close as those of the
+// expected teams.
+func (t *balanceTest) AssertBalanced(ranks, a, b, expected_a,
+	expected_b []int) {
+
+	t.AssertEqualContents(append(append([]int{}, a...), b...),
+		append([]int{}, ranks...))
+	t.Assert(abs(len(a)-len(b)) <= 1)
+	t.Logf("difference: %d, expected at most: %d", sum(a)-sum(b),
+		sum(expected_a)-sum(expected_b))
+	t.Assert(abs(sum(a)-sum(b)) <= abs(sum(expected_a)-sum(expected_b)))
+}
+
 func (t *balanceTest) AssertEqualContentsStrings(got, expected []string) {
 	t.AssertEqual(len(got), len(expected))
 
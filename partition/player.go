@@ -0,0 +1,137 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+// Player is someone to be put on a team. Weight is what's balanced, eg their
+// skill rank, and Attributes carry anything else callers want to know about
+// them once the teams are made.
+type Player struct {
+	Id         string
+	Weight     int
+	Attributes map[string]string
+}
+
+// Teams splits players into two teams whose sizes differ by at most one, and
+// whose total weights are as close as possible.
+func Teams(players []*Player) (a, b []*Player) {
+	a_indices, b_indices := split(weights(players))
+	return pick(players, a_indices), pick(players, b_indices)
+}
+
+// GroupedTeams is like Teams, but keeps the players in each group, given by
+// their ids, on the same team. ok is false if the groups can't all be kept
+// together, or name players who aren't among players, or there are too many
+// players to search.
+func GroupedTeams(players []*Player, groups [][]string) (a, b []*Player,
+	ok bool) {
+
+	index_groups, ok := indexGroups(players, groups)
+	if !ok {
+		return nil, nil, false
+	}
+
+	a_indices, b_indices, ok := Grouped(weights(players), index_groups)
+	if !ok {
+		return nil, nil, false
+	}
+	return pick(players, a_indices), pick(players, b_indices), true
+}
+
+// TeamsN splits players into k teams whose sizes differ by at most one, and
+// whose total weights are balanced, as PartitionN balances them.
+func TeamsN(players []*Player, k int) (teams [][]*Player) {
+	for _, indices := range splitN(weights(players), k) {
+		teams = append(teams, pick(players, indices))
+	}
+	return teams
+}
+
+// GroupedTeamsN is like TeamsN, but keeps the players in each group, given by
+// their ids, on the same team. ok is false if the groups can't all be kept
+// together, or name players who aren't among players.
+func GroupedTeamsN(players []*Player, groups [][]string, k int) (
+	teams [][]*Player, ok bool) {
+
+	if k == 2 {
+		a, b, ok := GroupedTeams(players, groups)
+		return [][]*Player{a, b}, ok
+	}
+
+	index_groups, ok := indexGroups(players, groups)
+	if !ok {
+		return nil, false
+	}
+
+	team_indices, ok := groupedN(weights(players), index_groups, nil,
+		nil, k)
+	if !ok {
+		return nil, false
+	}
+	for _, indices := range team_indices {
+		teams = append(teams, pick(players, indices))
+	}
+	return teams, true
+}
+
+// TotalWeight sums the players' weights.
+func TotalWeight(players []*Player) (total int) {
+	for _, player := range players {
+		total += player.Weight
+	}
+	return total
+}
+
+// indexGroups converts groups of player ids into groups of indices into
+// players. ok is false if an id is missing, or shared by several players.
+func indexGroups(players []*Player, groups [][]string) (
+	index_groups [][]int, ok bool) {
+
+	indices := make(map[string]int)
+	for i, player := range players {
+		if _, dupe := indices[player.Id]; dupe {
+			return nil, false
+		}
+		indices[player.Id] = i
+	}
+
+	for _, group := range groups {
+		index_group := []int{}
+		for _, id := range group {
+			i, found := indices[id]
+			if !found {
+				return nil, false
+			}
+			index_group = append(index_group, i)
+		}
+		index_groups = append(index_groups, index_group)
+	}
+
+	return index_groups, true
+}
+
+func weights(players []*Player) []int {
+	weights := make([]int, len(players))
+	for i, player := range players {
+		weights[i] = player.Weight
+	}
+	return weights
+}
+
+func pick(players []*Player, indices []int) (picked []*Player) {
+	for _, index := range indices {
+		picked = append(picked, players[index])
+	}
+	return picked
+}
@@ -0,0 +1,262 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// DefaultStrategy names the Partitioner used unless another is chosen.
+const DefaultStrategy = "exact"
+
+// Partitioner is a strategy for splitting players into two teams whose sizes
+// differ by at most one.
+type Partitioner interface {
+	// Name identifies the strategy, eg in `!teams --strategy=snake`.
+	Name() string
+	// Description briefly explains how the strategy picks teams.
+	Description() string
+	Teams(players []*Player) (a, b []*Player)
+}
+
+// MultiPartitioner is a Partitioner that can also split players into k teams
+// whose sizes differ by at most one.
+type MultiPartitioner interface {
+	Partitioner
+	TeamsN(players []*Player, k int) [][]*Player
+}
+
+var strategies = make(map[string]Partitioner)
+
+func init() {
+	Register(&exactStrategy{})
+	Register(&varianceStrategy{})
+	Register(&snakeStrategy{})
+	Register(&randomStrategy{})
+	Register(&starsStrategy{})
+}
+
+// Register makes a Partitioner available by its name, replacing any other of
+// the same name. It isn't safe to call concurrently with Strategy or
+// Strategies, so call it from an init function.
+func Register(p Partitioner) {
+	strategies[p.Name()] = p
+}
+
+// Strategy returns the Partitioner registered under name, if any.
+func Strategy(name string) (p Partitioner, ok bool) {
+	p, ok = strategies[name]
+	return p, ok
+}
+
+// Strategies returns the registered Partitioners, sorted by name.
+func Strategies() (all []Partitioner) {
+	names := []string{}
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		all = append(all, strategies[name])
+	}
+	return all
+}
+
+type exactStrategy struct{}
+
+func (exactStrategy) Name() string { return "exact" }
+
+func (exactStrategy) Description() string {
+	return "makes the teams' total skill ranks as close as possible"
+}
+
+func (exactStrategy) Teams(players []*Player) (a, b []*Player) {
+	return Teams(players)
+}
+
+func (exactStrategy) TeamsN(players []*Player, k int) [][]*Player {
+	return TeamsN(players, k)
+}
+
+// varianceStrategy starts from the exact split, then swaps players between
+// the teams while doing so brings the spread of their ranks closer, without
+// costing more in average rank than it gains in spread.
+type varianceStrategy struct{}
+
+func (varianceStrategy) Name() string { return "variance" }
+
+func (varianceStrategy) Description() string {
+	return "matches the teams' spreads of skill ranks, as well as their " +
+		"averages"
+}
+
+func (varianceStrategy) Teams(players []*Player) (a, b []*Player) {
+	a, b = Teams(players)
+	if len(a) == 0 || len(b) == 0 {
+		return a, b
+	}
+
+	cost := func() float64 {
+		return math.Abs(mean(a)-mean(b)) +
+			math.Abs(stddev(a)-stddev(b))
+	}
+
+	best := cost()
+	// Each swap must improve the cost, so this terminates, but bound it
+	// all the same.
+	for round := 0; round < len(players)*len(players); round++ {
+		improved := false
+		for i := range a {
+			for j := range b {
+				a[i], b[j] = b[j], a[i]
+				if c := cost(); c < best {
+					best, improved = c, true
+					continue
+				}
+				a[i], b[j] = b[j], a[i]
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+
+	return a, b
+}
+
+// snakeStrategy sorts the players by rank, then has the teams pick in turn,
+// a, b, b, a, a, b, and so on, or with more teams, a, b, c, c, b, a.
+type snakeStrategy struct{}
+
+func (snakeStrategy) Name() string { return "snake" }
+
+func (snakeStrategy) Description() string {
+	return "has the teams take turns picking the best remaining player, " +
+		"snaking back and forth"
+}
+
+func (snake snakeStrategy) Teams(players []*Player) (a, b []*Player) {
+	teams := snake.TeamsN(players, 2)
+	return teams[0], teams[1]
+}
+
+func (snakeStrategy) TeamsN(players []*Player, k int) [][]*Player {
+	if k < 1 {
+		k = 1
+	}
+	teams := make([][]*Player, k)
+	for i, index := range byWeight(players) {
+		team := i % k
+		if (i/k)%2 == 1 {
+			team = k - 1 - team
+		}
+		teams[team] = append(teams[team], players[index])
+	}
+	return teams
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Name() string { return "random" }
+
+func (randomStrategy) Description() string {
+	return "ignores skill ranks, and picks teams at random"
+}
+
+func (randomStrategy) Teams(players []*Player) (a, b []*Player) {
+	order := rand.Perm(len(players))
+	return pick(players, order[:len(players)/2]),
+		pick(players, order[len(players)/2:])
+}
+
+func (randomStrategy) TeamsN(players []*Player, k int) [][]*Player {
+	if k < 1 {
+		k = 1
+	}
+	teams := make([][]*Player, k)
+	for i, index := range rand.Perm(len(players)) {
+		teams[i%k] = append(teams[i%k], players[index])
+	}
+	return teams
+}
+
+// starsStrategy splits the top quarter of players, the stars, evenly between
+// the teams by snake draft, then balances the teams' totals with the rest.
+// Teams can otherwise match totals by stacking one team with stars and the
+// other with depth.
+type starsStrategy struct{}
+
+func (starsStrategy) Name() string { return "stars" }
+
+func (starsStrategy) Description() string {
+	return "splits the top quarter of players evenly between the teams, " +
+		"then balances total skill ranks with the rest"
+}
+
+func (starsStrategy) Teams(players []*Player) (a, b []*Player) {
+	order := byWeight(players)
+	num_stars := len(players) / 4
+	// An even number of stars splits evenly.
+	num_stars -= num_stars % 2
+	if num_stars < 2 && len(players) >= 4 {
+		num_stars = 2
+	}
+
+	bias := 0
+	for i, index := range order[:num_stars] {
+		if i%4 == 0 || i%4 == 3 {
+			a = append(a, players[index])
+			bias += players[index].Weight
+		} else {
+			b = append(b, players[index])
+			bias -= players[index].Weight
+		}
+	}
+
+	rest := pick(players, order[num_stars:])
+	var a_indices, b_indices []int
+	if len(rest) > maxExactRanks {
+		a_indices, b_indices = greedy(weights(rest))
+	} else {
+		a_indices, b_indices = exactBiased(weights(rest), bias)
+	}
+
+	return append(a, pick(rest, a_indices)...),
+		append(b, pick(rest, b_indices)...)
+}
+
+// byWeight returns the indices of players, from the highest weight to the
+// lowest. Ties are broken at random.
+func byWeight(players []*Player) []int {
+	order := &byRank{ranks: weights(players), indices: rand.Perm(len(players))}
+	sort.Stable(order)
+	return order.indices
+}
+
+func mean(players []*Player) float64 {
+	return float64(TotalWeight(players)) / float64(len(players))
+}
+
+func stddev(players []*Player) float64 {
+	m := mean(players)
+	sum := 0.0
+	for _, player := range players {
+		d := float64(player.Weight) - m
+		sum += d * d
+	}
+	return math.Sqrt(sum / float64(len(players)))
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStrategies(t *testing.T) {
+	test := newBalanceTest(t)
+
+	names := []string{}
+	for _, strategy := range Strategies() {
+		names = append(names, strategy.Name())
+		for _, n := range []int{1, 2, 5, 12, 13} {
+			players := weighted(randomRanks(n)...)
+			a, b := strategy.Teams(players)
+			test.Assert(abs(len(a)-len(b)) <= 1)
+			seen := make(map[string]bool)
+			for _, player := range append(a, b...) {
+				test.Assert(!seen[player.Id])
+				seen[player.Id] = true
+			}
+			test.AssertEqual(len(seen), n)
+
+			multi, ok := strategy.(MultiPartitioner)
+			if !ok {
+				continue
+			}
+			teams := multi.TeamsN(players, 3)
+			test.AssertEqual(len(teams), 3)
+			total := 0
+			for _, team := range teams {
+				test.Assert(len(team) == n/3 ||
+					len(team) == (n+2)/3)
+				total += len(team)
+			}
+			test.AssertEqual(total, n)
+		}
+	}
+	test.AssertEqual(fmt.Sprint(names),
+		"[exact random snake stars variance]")
+
+	_, ok := Strategy("bogus")
+	test.Assert(!ok)
+}
+
+func TestSnake(t *testing.T) {
+	test := newBalanceTest(t)
+
+	snake, ok := Strategy("snake")
+	test.Assert(ok)
+	a, b := snake.Teams(weighted(1, 2, 3, 4, 5, 6, 7, 8))
+	test.AssertEqualContents(weights(a), []int{8, 5, 4, 1})
+	test.AssertEqualContents(weights(b), []int{7, 6, 3, 2})
+
+	teams := snake.(MultiPartitioner).TeamsN(weighted(1, 2, 3, 4, 5, 6), 3)
+	test.AssertEqualContents(weights(teams[0]), []int{6, 1})
+	test.AssertEqualContents(weights(teams[1]), []int{5, 2})
+	test.AssertEqualContents(weights(teams[2]), []int{4, 3})
+}
+
+func TestVariance(t *testing.T) {
+	test := newBalanceTest(t)
+
+	// Exact balance puts both outliers on one team, against three
+	// identical players.
+	players := weighted(1500, 3500, 2500, 2500, 2500, 2500)
+	a, b := Teams(players)
+	test.Assert(sameTeam(weights(a), weights(b), 1500, 3500))
+
+	variance, ok := Strategy("variance")
+	test.Assert(ok)
+	a, b = variance.Teams(players)
+	test.Assert(!sameTeam(weights(a), weights(b), 1500, 3500))
+}
+
+func TestStars(t *testing.T) {
+	test := newBalanceTest(t)
+
+	// The stars are split, and the rest make up the difference.
+	players := weighted(4500, 4400, 2000, 2000, 2000, 2000, 2900, 3000)
+	stars, ok := Strategy("stars")
+	test.Assert(ok)
+	a, b := stars.Teams(players)
+	test.Assert(!sameTeam(weights(a), weights(b), 4500, 4400))
+	test.AssertEqual(len(a), 4)
+	test.AssertEqual(abs(TotalWeight(a)-TotalWeight(b)), 0)
+}
+
+// weighted makes players of the given weights, with their indices as ids.
+func weighted(weights ...int) (players []*Player) {
+	for i, weight := range weights {
+		players = append(players, &Player{
+			Id:     fmt.Sprint(i),
+			Weight: weight,
+		})
+	}
+	return players
+}
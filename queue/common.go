@@ -16,6 +16,7 @@ package queue
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spacemonkeygo/errors"
 )
@@ -29,13 +30,47 @@ var (
 		errors.NoCaptureStack())
 )
 
+// Entry is a queued datum, along with the time at which it was enqueued.
+// Entries enqueued before timestamps were recorded have a zero EnqueuedAt, and
+// never expire.
+type Entry struct {
+	Datum      []byte
+	EnqueuedAt time.Time
+}
+
+// Expired reports whether the entry has been queued for longer than max_age.
+// A max_age of zero means entries never expire.
+func (e *Entry) Expired(max_age time.Duration, now time.Time) bool {
+	return max_age > 0 && !e.EnqueuedAt.IsZero() &&
+		now.Sub(e.EnqueuedAt) > max_age
+}
+
 type Queue interface {
 	Clear() error
 	DequeueN(n int) ([][]byte, int, error)
+	// DequeueFit takes entries from the front of the queue whose sizes total
+	// at most n, skipping entries too large to fit in what remains. It
+	// returns the taken data and the total size of the entries left.
+	DequeueFit(n int, size func(datum []byte) int) ([][]byte, int, error)
+	// DequeueSelect passes the queue's data, front first, to choose, and
+	// atomically takes the data at the indices it returns. It returns the
+	// taken data, in queue order, and the number of entries left.
+	DequeueSelect(choose func(data [][]byte) []int) ([][]byte, int, error)
 	Enqueue(datum []byte) (int, error)
-	Iter(fn func(index int, datum []byte) (stop bool)) error
+	// Insert adds datum at pos, shifting later entries back, and returns the
+	// position at which it was inserted. Positions past the end of the queue
+	// insert at the end.
+	Insert(pos int, datum []byte) (int, error)
+	Iter(fn func(index int, entry *Entry) (stop bool)) error
+	// Move moves an enqueued datum to pos, keeping its enqueue time, and
+	// returns its new position. Positions past the end of the queue move it
+	// to the end.
+	Move(datum []byte, pos int) (int, error)
 	Position(datum []byte) (int, error)
 	Remove(datum []byte) error
+	// Replace atomically replaces the queue's contents with entries, which
+	// must be distinct, in order, keeping their enqueue times.
+	Replace(entries []*Entry) error
 	Size() (int, error)
 }
 
@@ -0,0 +1,189 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"time"
+)
+
+// EventType is the kind of change an Event describes.
+type EventType string
+
+const (
+	// Enqueued events are published by Enqueue and Insert.
+	Enqueued EventType = "enqueued"
+	// Removed events are published by Remove.
+	Removed EventType = "removed"
+	// Dequeued events are published for each datum taken by DequeueN,
+	// DequeueFit or DequeueSelect.
+	Dequeued EventType = "dequeued"
+	Moved    EventType = "moved"
+	Cleared  EventType = "cleared"
+	Replaced EventType = "replaced"
+)
+
+// Event describes a change to a queue. Position is the datum's new position
+// for Enqueued and Moved events, and its old position for Removed and
+// Dequeued events, as best as is known. Cleared and Replaced events have no
+// datum.
+type Event struct {
+	Type     EventType `json:"type"`
+	Datum    []byte    `json:"datum,omitempty"`
+	Position int       `json:"position"`
+	Time     time.Time `json:"time"`
+}
+
+// EventBus delivers a queue's events to its subscribers.
+type EventBus interface {
+	Publish(event *Event) error
+	Subscribe() (Subscription, error)
+}
+
+// Subscription receives the events published after it was made. Subscribers
+// that fall behind may miss events.
+type Subscription interface {
+	// Events returns the channel on which events are delivered, which is
+	// closed when the subscription is.
+	Events() <-chan *Event
+	Close() error
+}
+
+// WatchedQueue publishes an event to its bus after each successful change to
+// the queue it wraps. Entries dropped because they expired aren't published.
+type WatchedQueue struct {
+	Queue
+	bus EventBus
+}
+
+var _ Queue = (*WatchedQueue)(nil)
+
+func Watch(q Queue, bus EventBus) *WatchedQueue {
+	return &WatchedQueue{
+		Queue: q,
+		bus:   bus,
+	}
+}
+
+// Subscribe subscribes to the queue's events.
+func (q *WatchedQueue) Subscribe() (Subscription, error) {
+	return q.bus.Subscribe()
+}
+
+// publish publishes events, logging failures, as the change they describe
+// has already been made.
+func (q *WatchedQueue) publish(events ...*Event) {
+	now := time.Now()
+	for _, event := range events {
+		event.Time = now
+		logger.Warne(q.bus.Publish(event))
+	}
+}
+
+func (q *WatchedQueue) publishTaken(taken [][]byte) {
+	events := make([]*Event, 0, len(taken))
+	for i, datum := range taken {
+		events = append(events, &Event{
+			Type:     Dequeued,
+			Datum:    datum,
+			Position: i,
+		})
+	}
+	q.publish(events...)
+}
+
+func (q *WatchedQueue) Clear() error {
+	if err := q.Queue.Clear(); err != nil {
+		return err
+	}
+	q.publish(&Event{Type: Cleared})
+	return nil
+}
+
+func (q *WatchedQueue) DequeueN(n int) ([][]byte, int, error) {
+	taken, num_left, err := q.Queue.DequeueN(n)
+	if err != nil {
+		return nil, num_left, err
+	}
+	q.publishTaken(taken)
+	return taken, num_left, nil
+}
+
+func (q *WatchedQueue) DequeueFit(n int, size func(datum []byte) int) (
+	[][]byte, int, error) {
+
+	taken, size_left, err := q.Queue.DequeueFit(n, size)
+	if err != nil {
+		return nil, size_left, err
+	}
+	q.publishTaken(taken)
+	return taken, size_left, nil
+}
+
+func (q *WatchedQueue) DequeueSelect(choose func(data [][]byte) []int) (
+	[][]byte, int, error) {
+
+	taken, num_left, err := q.Queue.DequeueSelect(choose)
+	if err != nil {
+		return nil, num_left, err
+	}
+	q.publishTaken(taken)
+	return taken, num_left, nil
+}
+
+func (q *WatchedQueue) Enqueue(datum []byte) (int, error) {
+	pos, err := q.Queue.Enqueue(datum)
+	if err != nil {
+		return pos, err
+	}
+	q.publish(&Event{Type: Enqueued, Datum: datum, Position: pos})
+	return pos, nil
+}
+
+func (q *WatchedQueue) Insert(pos int, datum []byte) (int, error) {
+	pos, err := q.Queue.Insert(pos, datum)
+	if err != nil {
+		return pos, err
+	}
+	q.publish(&Event{Type: Enqueued, Datum: datum, Position: pos})
+	return pos, nil
+}
+
+func (q *WatchedQueue) Move(datum []byte, pos int) (int, error) {
+	pos, err := q.Queue.Move(datum, pos)
+	if err != nil {
+		return pos, err
+	}
+	q.publish(&Event{Type: Moved, Datum: datum, Position: pos})
+	return pos, nil
+}
+
+func (q *WatchedQueue) Remove(datum []byte) error {
+	// The position is only informational, so a failure to find it isn't
+	// fatal.
+	pos, _ := q.Queue.Position(datum)
+	if err := q.Queue.Remove(datum); err != nil {
+		return err
+	}
+	q.publish(&Event{Type: Removed, Datum: datum, Position: pos})
+	return nil
+}
+
+func (q *WatchedQueue) Replace(entries []*Entry) error {
+	if err := q.Queue.Replace(entries); err != nil {
+		return err
+	}
+	q.publish(&Event{Type: Replaced})
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filequeue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ewollesen/zenbot/queue"
+	"github.com/ewollesen/zenbot/queue/memory"
+	"github.com/ewollesen/zenbot/util"
+)
+
+// memQueue is the in-memory queue that a fileQueue saves.
+type memQueue interface {
+	queue.Queue
+	SetMaxAge(max_age time.Duration)
+}
+
+// fileQueue keeps its entries in memory, saving them to a file after each
+// change, so that they survive restarts without a redis server. Queues are
+// small, so the whole file is rewritten each time.
+type fileQueue struct {
+	mu   sync.Mutex
+	q    memQueue
+	path string
+}
+
+var _ queue.Queue = (*fileQueue)(nil)
+
+type fileEntry struct {
+	Datum      []byte    `json:"datum"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+}
+
+// New returns a queue saved to path, loading any entries already saved there.
+func New(path string) (*fileQueue, error) {
+	q := &fileQueue{
+		q:    memory.New(),
+		path: path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file_entries := []*fileEntry{}
+	if err = json.Unmarshal(data, &file_entries); err != nil {
+		return nil, err
+	}
+	entries := make([]*queue.Entry, 0, len(file_entries))
+	for _, entry := range file_entries {
+		entries = append(entries, &queue.Entry{
+			Datum:      entry.Datum,
+			EnqueuedAt: entry.EnqueuedAt,
+		})
+	}
+
+	return q, q.q.Replace(entries)
+}
+
+// SetMaxAge causes entries that have been queued for longer than max_age to be
+// dropped from the queue. A max_age of zero, the default, disables expiry.
+func (q *fileQueue) SetMaxAge(max_age time.Duration) {
+	q.q.SetMaxAge(max_age)
+}
+
+// ensure that you're holding q.mu before calling!
+func (q *fileQueue) save() error {
+	entries := []*fileEntry{}
+	err := q.q.Iter(func(_ int, entry *queue.Entry) bool {
+		entries = append(entries, &fileEntry{
+			Datum:      entry.Datum,
+			EnqueuedAt: entry.EnqueuedAt,
+		})
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(q.path, data, 0600)
+}
+
+func (q *fileQueue) Clear() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.q.Clear(); err != nil {
+		return err
+	}
+	return q.save()
+}
+
+func (q *fileQueue) DequeueN(n int) (
+	removed [][]byte, num_left int, err error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed, num_left, err = q.q.DequeueN(n)
+	if err != nil {
+		return nil, 0, err
+	}
+	return removed, num_left, q.save()
+}
+
+func (q *fileQueue) DequeueFit(n int, size func([]byte) int) (
+	taken [][]byte, size_left int, err error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	taken, size_left, err = q.q.DequeueFit(n, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return taken, size_left, q.save()
+}
+
+func (q *fileQueue) DequeueSelect(choose func([][]byte) []int) (
+	taken [][]byte, num_left int, err error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	taken, num_left, err = q.q.DequeueSelect(choose)
+	if err != nil {
+		return nil, 0, err
+	}
+	return taken, num_left, q.save()
+}
+
+func (q *fileQueue) Enqueue(datum []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pos, err := q.q.Enqueue(datum)
+	if err != nil {
+		return pos, err
+	}
+	return pos, q.save()
+}
+
+func (q *fileQueue) Insert(pos int, datum []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pos, err := q.q.Insert(pos, datum)
+	if err != nil {
+		return pos, err
+	}
+	return pos, q.save()
+}
+
+func (q *fileQueue) Iter(fn func(int, *queue.Entry) bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.q.Iter(fn)
+}
+
+func (q *fileQueue) Move(datum []byte, pos int) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pos, err := q.q.Move(datum, pos)
+	if err != nil {
+		return pos, err
+	}
+	return pos, q.save()
+}
+
+func (q *fileQueue) Position(datum []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.q.Position(datum)
+}
+
+func (q *fileQueue) Remove(datum []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.q.Remove(datum); err != nil {
+		return err
+	}
+	return q.save()
+}
+
+func (q *fileQueue) Replace(entries []*queue.Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.q.Replace(entries); err != nil {
+		return err
+	}
+	return q.save()
+}
+
+func (q *fileQueue) Size() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.q.Size()
+}
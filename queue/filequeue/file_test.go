@@ -0,0 +1,145 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filequeue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ewollesen/zenbot/queue"
+	"github.com/ewollesen/zenbot/zentest"
+)
+
+var (
+	testDir   string
+	testFiles = 0
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "filequeue")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testDir = dir
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+func TestClear(t *testing.T) {
+	queue.CommonTestClear(t, newTestQueue(t, nextPath()))
+}
+
+func TestDequeueN(t *testing.T) {
+	queue.CommonTestDequeueN(t, newTestQueue(t, nextPath()))
+}
+
+func TestDequeueFit(t *testing.T) {
+	queue.CommonTestDequeueFit(t, newTestQueue(t, nextPath()))
+}
+
+func TestDequeueSelect(t *testing.T) {
+	queue.CommonTestDequeueSelect(t, newTestQueue(t, nextPath()))
+}
+
+func TestEnqueue(t *testing.T) {
+	queue.CommonTestEnqueue(t, newTestQueue(t, nextPath()))
+}
+
+func TestExpiry(t *testing.T) {
+	q := newTestQueue(t, nextPath())
+	q.SetMaxAge(queue.TestMaxAge)
+	queue.CommonTestExpiry(t, q)
+}
+
+func TestInsert(t *testing.T) {
+	queue.CommonTestInsert(t, newTestQueue(t, nextPath()))
+}
+
+func TestIter(t *testing.T) {
+	queue.CommonTestIter(t, newTestQueue(t, nextPath()))
+}
+
+func TestMove(t *testing.T) {
+	queue.CommonTestMove(t, newTestQueue(t, nextPath()))
+}
+
+func TestPosition(t *testing.T) {
+	queue.CommonTestPosition(t, newTestQueue(t, nextPath()))
+}
+
+func TestRemove(t *testing.T) {
+	queue.CommonTestRemove(t, newTestQueue(t, nextPath()))
+	queue.CommonTestRemoveFirst(t, newTestQueue(t, nextPath()))
+	queue.CommonTestRemoveMiddle(t, newTestQueue(t, nextPath()))
+	queue.CommonTestRemoveLast(t, newTestQueue(t, nextPath()))
+}
+
+func TestReplace(t *testing.T) {
+	queue.CommonTestReplace(t, newTestQueue(t, nextPath()))
+}
+
+func TestSize(t *testing.T) {
+	queue.CommonTestSize(t, newTestQueue(t, nextPath()))
+}
+
+func TestReopen(t *testing.T) {
+	test := zentest.New(t)
+	path := nextPath()
+	q := newTestQueue(t, path)
+
+	_, err := q.Enqueue([]byte("foo"))
+	test.AssertNil(err)
+	_, err = q.Enqueue([]byte("bar"))
+	test.AssertNil(err)
+	_, err = q.Move([]byte("bar"), 0)
+	test.AssertNil(err)
+
+	reopened := newTestQueue(t, path)
+	order := []string{}
+	test.AssertNil(reopened.Iter(func(_ int, entry *queue.Entry) bool {
+		test.Assert(!entry.EnqueuedAt.IsZero())
+		order = append(order, string(entry.Datum))
+		return false
+	}))
+	test.AssertEqual(len(order), 2)
+	test.AssertEqual(order[0], "bar")
+	test.AssertEqual(order[1], "foo")
+}
+
+func TestCorrupt(t *testing.T) {
+	test := zentest.New(t)
+	path := nextPath()
+	test.AssertNil(ioutil.WriteFile(path, []byte("[{"), 0600))
+	_, err := New(path)
+	test.Assert(err != nil)
+}
+
+func newTestQueue(t *testing.T, path string) *fileQueue {
+	q, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func nextPath() string {
+	testFiles++
+	return filepath.Join(testDir, fmt.Sprintf("queue%d.json", testFiles))
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"sync"
+
+	"github.com/ewollesen/zenbot/queue"
+)
+
+// subscriptionBuffer is the number of events a subscription holds before
+// further events are dropped.
+const subscriptionBuffer = 64
+
+// eventBus delivers events to subscribers in the same process, over
+// channels.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*subscription]bool
+}
+
+var _ queue.EventBus = (*eventBus)(nil)
+
+func NewEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*subscription]bool),
+	}
+}
+
+func (b *eventBus) Publish(event *queue.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.events <- event:
+		default:
+			// The subscriber has fallen behind.
+		}
+	}
+	return nil
+}
+
+func (b *eventBus) Subscribe() (queue.Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &subscription{
+		bus:    b,
+		events: make(chan *queue.Event, subscriptionBuffer),
+	}
+	b.subs[sub] = true
+	return sub, nil
+}
+
+type subscription struct {
+	bus    *eventBus
+	events chan *queue.Event
+}
+
+func (s *subscription) Events() <-chan *queue.Event {
+	return s.events
+}
+
+func (s *subscription) Close() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if s.bus.subs[s] {
+		delete(s.bus.subs, s)
+		close(s.events)
+	}
+	return nil
+}
@@ -18,26 +18,38 @@ import (
 	"bytes"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ewollesen/zenbot/queue"
 )
 
 type memQueue struct {
-	mu sync.Mutex
-	q  [][]byte
+	mu      sync.Mutex
+	q       []*queue.Entry
+	max_age time.Duration
+	now     func() time.Time
 }
 
 var _ queue.Queue = (*memQueue)(nil)
 
 func New() *memQueue {
 	return &memQueue{
-		q: [][]byte{},
+		q:   []*queue.Entry{},
+		now: time.Now,
 	}
 }
 
+// SetMaxAge causes entries that have been queued for longer than max_age to be
+// dropped from the queue. A max_age of zero, the default, disables expiry.
+func (q *memQueue) SetMaxAge(max_age time.Duration) {
+	q.mu.Lock()
+	q.max_age = max_age
+	q.mu.Unlock()
+}
+
 func (q *memQueue) Clear() error {
 	q.mu.Lock()
-	q.q = [][]byte{}
+	q.q = []*queue.Entry{}
 	q.mu.Unlock()
 	return nil
 }
@@ -47,17 +59,76 @@ func (q *memQueue) DequeueN(n int) (
 
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	q.prune()
 
 	last := min(len(q.q), n)
-	removed = q.q[:last]
+	removed = make([][]byte, 0, last)
+	for _, entry := range q.q[:last] {
+		removed = append(removed, entry.Datum)
+	}
 	q.q = q.q[last:]
 
 	return removed, len(q.q), nil
 }
 
+func (q *memQueue) DequeueFit(n int, size func([]byte) int) (
+	taken [][]byte, size_left int, err error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+
+	taken = [][]byte{}
+	kept := []*queue.Entry{}
+	for _, entry := range q.q {
+		entry_size := size(entry.Datum)
+		if entry_size <= n {
+			taken = append(taken, entry.Datum)
+			n -= entry_size
+			continue
+		}
+		kept = append(kept, entry)
+		size_left += entry_size
+	}
+	q.q = kept
+
+	return taken, size_left, nil
+}
+
+func (q *memQueue) DequeueSelect(choose func([][]byte) []int) (
+	taken [][]byte, num_left int, err error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+
+	data := make([][]byte, 0, len(q.q))
+	for _, entry := range q.q {
+		data = append(data, entry.Datum)
+	}
+	chosen := make(map[int]bool)
+	for _, index := range choose(data) {
+		chosen[index] = true
+	}
+
+	taken = [][]byte{}
+	kept := []*queue.Entry{}
+	for i, entry := range q.q {
+		if chosen[i] {
+			taken = append(taken, entry.Datum)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	q.q = kept
+
+	return taken, len(q.q), nil
+}
+
 func (q *memQueue) Enqueue(datum []byte) (int, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	q.prune()
 
 	pos, err := q.position(datum)
 	if err != nil {
@@ -69,18 +140,62 @@ func (q *memQueue) Enqueue(datum []byte) (int, error) {
 			queue.SetPosition(pos))
 	}
 
-	q.q = append(q.q, datum)
+	q.q = append(q.q, &queue.Entry{Datum: datum, EnqueuedAt: q.now()})
 
 	return len(q.q) - 1, nil
 }
 
+func (q *memQueue) Replace(entries []*queue.Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.q = make([]*queue.Entry, 0, len(entries))
+	for _, entry := range entries {
+		copied := *entry
+		q.q = append(q.q, &copied)
+	}
+	return nil
+}
+
+func (q *memQueue) Insert(pos int, datum []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+
+	cur_pos, err := q.position(datum)
+	if err != nil {
+		return -1, err
+	}
+	if cur_pos >= 0 {
+		return -1, queue.AlreadyEnqueued.NewWith(
+			fmt.Sprintf("%+v in position %d", datum, cur_pos+1),
+			queue.SetPosition(cur_pos))
+	}
+
+	pos = clamp(pos, len(q.q))
+	q.insert(pos, &queue.Entry{Datum: datum, EnqueuedAt: q.now()})
+
+	return pos, nil
+}
+
+// ensure that you're holding q.mu before calling!
+func (q *memQueue) insert(pos int, entry *queue.Entry) {
+	q.q = append(q.q, nil)
+	copy(q.q[pos+1:], q.q[pos:])
+	q.q[pos] = entry
+}
+
 // TODO: consider returning an interator... is that doable in go?
-func (q *memQueue) Iter(fn func(int, []byte) bool) error {
+func (q *memQueue) Iter(fn func(int, *queue.Entry) bool) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	q.prune()
 
-	for i, item := range q.q {
-		if fn(i, item) {
+	for i, entry := range q.q {
+		if fn(i, &queue.Entry{
+			Datum:      entry.Datum,
+			EnqueuedAt: entry.EnqueuedAt,
+		}) {
 			break
 		}
 	}
@@ -88,16 +203,38 @@ func (q *memQueue) Iter(fn func(int, []byte) bool) error {
 	return nil
 }
 
+func (q *memQueue) Move(datum []byte, pos int) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+
+	cur_pos, err := q.position(datum)
+	if err != nil {
+		return -1, err
+	}
+	if cur_pos < 0 {
+		return -1, queue.NotFound.New("")
+	}
+
+	entry := q.q[cur_pos]
+	q.q = append(q.q[:cur_pos], q.q[cur_pos+1:]...)
+	pos = clamp(pos, len(q.q))
+	q.insert(pos, entry)
+
+	return pos, nil
+}
+
 func (q *memQueue) Position(datum []byte) (pos int, err error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	q.prune()
 	return q.position(datum)
 }
 
 // ensure that you're holding q.mu before calling!
 func (q *memQueue) position(datum []byte) (pos int, err error) {
 	for pos, candidate := range q.q {
-		if bytes.Equal(candidate, datum) {
+		if bytes.Equal(candidate.Datum, datum) {
 			return pos, nil
 		}
 	}
@@ -105,6 +242,22 @@ func (q *memQueue) position(datum []byte) (pos int, err error) {
 	return -1, nil
 }
 
+// ensure that you're holding q.mu before calling!
+func (q *memQueue) prune() {
+	if q.max_age <= 0 {
+		return
+	}
+
+	now := q.now()
+	kept := q.q[:0]
+	for _, entry := range q.q {
+		if !entry.Expired(q.max_age, now) {
+			kept = append(kept, entry)
+		}
+	}
+	q.q = kept
+}
+
 func (q *memQueue) Remove(item []byte) (err error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -129,9 +282,21 @@ func (q *memQueue) Remove(item []byte) (err error) {
 }
 
 func (q *memQueue) Size() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
 	return len(q.q), nil
 }
 
+// clamp limits pos to the positions at which an entry can be inserted into a
+// queue of the given size.
+func clamp(pos, size int) int {
+	if pos < 0 {
+		return 0
+	}
+	return min(pos, size)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -28,14 +28,36 @@ func TestDequeueN(t *testing.T) {
 	queue.CommonTestDequeueN(t, New())
 }
 
+func TestDequeueFit(t *testing.T) {
+	queue.CommonTestDequeueFit(t, New())
+}
+
+func TestDequeueSelect(t *testing.T) {
+	queue.CommonTestDequeueSelect(t, New())
+}
+
 func TestEnqueue(t *testing.T) {
 	queue.CommonTestEnqueue(t, New())
 }
 
+func TestExpiry(t *testing.T) {
+	q := New()
+	q.SetMaxAge(queue.TestMaxAge)
+	queue.CommonTestExpiry(t, q)
+}
+
+func TestInsert(t *testing.T) {
+	queue.CommonTestInsert(t, New())
+}
+
 func TestIter(t *testing.T) {
 	queue.CommonTestIter(t, New())
 }
 
+func TestMove(t *testing.T) {
+	queue.CommonTestMove(t, New())
+}
+
 func TestPosition(t *testing.T) {
 	queue.CommonTestPosition(t, New())
 }
@@ -47,6 +69,14 @@ func TestRemove(t *testing.T) {
 	queue.CommonTestRemoveLast(t, New())
 }
 
+func TestReplace(t *testing.T) {
+	queue.CommonTestReplace(t, New())
+}
+
 func TestSize(t *testing.T) {
 	queue.CommonTestSize(t, New())
 }
+
+func TestWatch(t *testing.T) {
+	queue.CommonTestWatch(t, New(), NewEventBus())
+}
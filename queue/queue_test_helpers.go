@@ -16,13 +16,20 @@ package queue
 
 import (
 	"encoding/json"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/spacemonkeygo/spacelog"
 
 	"github.com/ewollesen/zenbot/zentest"
 )
 
+// TestMaxAge is the maximum age that backends should set on the queue they pass
+// to CommonTestExpiry.
+const TestMaxAge = 50 * time.Millisecond
+
 var (
 	logger = spacelog.GetLogger()
 )
@@ -84,6 +91,75 @@ func CommonTestDequeueN(t *testing.T, queue_under_test Queue) {
 	test.AssertEqual(num_left, 0)
 }
 
+func CommonTestDequeueFit(t *testing.T, queue_under_test Queue) {
+	test := newQueueTest(t)
+	qut := NewTestQueue(queue_under_test)
+
+	// Each queueable's size is given by its value.
+	qut.Enqueue(newQueueable("foo1", "1"))
+	qut.Enqueue(newQueueable("foo2", "3"))
+	qut.Enqueue(newQueueable("foo3", "1"))
+	qut.Enqueue(newQueueable("foo4", "2"))
+	qut.Enqueue(newQueueable("foo5", "1"))
+
+	removed, size_left, err := qut.DequeueFit(3)
+	test.AssertNil(err)
+	test.AssertEqual(len(removed), 3)
+	test.AssertEqual(removed[0].Key_, "foo1")
+	test.AssertEqual(removed[1].Key_, "foo3")
+	test.AssertEqual(removed[2].Key_, "foo5")
+	test.AssertEqual(size_left, 5)
+	test.AssertQueueOrder(qut, newQueueable("foo2", "3"),
+		newQueueable("foo4", "2"))
+
+	removed, size_left, err = qut.DequeueFit(2)
+	test.AssertNil(err)
+	test.AssertEqual(len(removed), 1)
+	test.AssertEqual(removed[0].Key_, "foo4")
+	test.AssertEqual(size_left, 3)
+
+	removed, size_left, err = qut.DequeueFit(10)
+	test.AssertNil(err)
+	test.AssertEqual(len(removed), 1)
+	test.AssertEqual(removed[0].Key_, "foo2")
+	test.AssertEqual(size_left, 0)
+	test.AssertEmpty(qut)
+}
+
+func CommonTestDequeueSelect(t *testing.T, queue_under_test Queue) {
+	test := newQueueTest(t)
+	qut := NewTestQueue(queue_under_test)
+
+	q1 := newQueueable("foo1", "bar1")
+	q2 := newQueueable("foo2", "bar2")
+	q3 := newQueueable("foo3", "bar3")
+	q4 := newQueueable("foo4", "bar4")
+	qut.Enqueue(q1)
+	qut.Enqueue(q2)
+	qut.Enqueue(q3)
+	qut.Enqueue(q4)
+
+	seen := 0
+	removed, num_left, err := qut.DequeueSelect(func(data [][]byte) []int {
+		seen = len(data)
+		return []int{3, 1}
+	})
+	test.AssertNil(err)
+	test.AssertEqual(seen, 4)
+	test.AssertEqual(len(removed), 2)
+	test.AssertEqual(removed[0].Key_, "foo2")
+	test.AssertEqual(removed[1].Key_, "foo4")
+	test.AssertEqual(num_left, 2)
+	test.AssertQueueOrder(qut, q1, q3)
+
+	removed, num_left, err = qut.DequeueSelect(func(data [][]byte) []int {
+		return nil
+	})
+	test.AssertNil(err)
+	test.AssertEqual(len(removed), 0)
+	test.AssertEqual(num_left, 2)
+}
+
 func CommonTestEnqueue(t *testing.T, queue_under_test Queue) {
 	test := newQueueTest(t)
 	qut := NewTestQueue(queue_under_test)
@@ -103,6 +179,71 @@ func CommonTestEnqueue(t *testing.T, queue_under_test Queue) {
 	test.AssertQueueSize(qut, 2)
 }
 
+func CommonTestExpiry(t *testing.T, queue_under_test Queue) {
+	test := newQueueTest(t)
+	qut := NewTestQueue(queue_under_test)
+
+	q1 := newQueueable("foo1", "bar1")
+	q2 := newQueueable("foo2", "bar2")
+
+	_, err := qut.Enqueue(q1)
+	test.AssertNil(err)
+	time.Sleep(2 * TestMaxAge)
+	_, err = qut.Enqueue(q2)
+	test.AssertNil(err)
+
+	test.AssertQueueSize(qut, 1)
+	test.AssertQueueContains(qut, q2)
+	test.AssertQueueDoesNotContain(qut, q1)
+	pos, err := qut.Position(q1)
+	test.AssertNil(err)
+	test.AssertEqual(pos, -1)
+
+	// An expired entry may be enqueued again.
+	pos, err = qut.Enqueue(q1)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 1)
+
+	time.Sleep(2 * TestMaxAge)
+	removed, num_left, err := qut.DequeueN(2)
+	test.AssertNil(err)
+	test.AssertEqual(len(removed), 0)
+	test.AssertEqual(num_left, 0)
+}
+
+func CommonTestInsert(t *testing.T, queue_under_test Queue) {
+	test := newQueueTest(t)
+	qut := NewTestQueue(queue_under_test)
+
+	q1 := newQueueable("foo1", "bar1")
+	q2 := newQueueable("foo2", "bar2")
+	q3 := newQueueable("foo3", "bar3")
+	q4 := newQueueable("foo4", "bar4")
+
+	pos, err := qut.Insert(5, q1)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+
+	pos, err = qut.Insert(0, q2)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+
+	pos, err = qut.Insert(1, q3)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 1)
+
+	pos, err = qut.Insert(-1, q4)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+
+	_, err = qut.Insert(0, q1)
+	test.AssertErrorContainedBy(err, AlreadyEnqueued)
+	test.AssertEqual(GetPosition(err), 3)
+
+	test.AssertQueueSize(qut, 4)
+	test.AssertQueueOrder(qut, q4, q2, q3, q1)
+}
+
 func CommonTestIter(t *testing.T, queue_under_test Queue) {
 	test := newQueueTest(t)
 	qut := NewTestQueue(queue_under_test)
@@ -130,6 +271,51 @@ func CommonTestIter(t *testing.T, queue_under_test Queue) {
 	test.AssertNil(qut.Iter(f))
 	test.AssertEqual(num, 6)
 	test.AssertQueueContains(qut, q1, q2, q3, q4, q5, q6)
+
+	now := time.Now()
+	test.AssertNil(queue_under_test.Iter(func(pos int, entry *Entry) bool {
+		test.Assert(!entry.EnqueuedAt.IsZero())
+		test.Assert(!entry.EnqueuedAt.After(now))
+		return false
+	}))
+}
+
+func CommonTestMove(t *testing.T, queue_under_test Queue) {
+	test := newQueueTest(t)
+	qut := NewTestQueue(queue_under_test)
+
+	q1 := newQueueable("foo1", "bar1")
+	q2 := newQueueable("foo2", "bar2")
+	q3 := newQueueable("foo3", "bar3")
+	q4 := newQueueable("foo4", "bar4")
+
+	qut.Enqueue(q1)
+	qut.Enqueue(q2)
+	qut.Enqueue(q3)
+
+	pos, err := qut.Move(q3, 0)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 0)
+	test.AssertQueueOrder(qut, q3, q1, q2)
+
+	pos, err = qut.Move(q3, 1)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 1)
+	test.AssertQueueOrder(qut, q1, q3, q2)
+
+	pos, err = qut.Move(q1, 10)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 2)
+	test.AssertQueueOrder(qut, q3, q2, q1)
+
+	pos, err = qut.Move(q2, 1)
+	test.AssertNil(err)
+	test.AssertEqual(pos, 1)
+	test.AssertQueueOrder(qut, q3, q2, q1)
+
+	_, err = qut.Move(q4, 0)
+	test.AssertErrorContainedBy(err, NotFound)
+	test.AssertQueueSize(qut, 3)
 }
 
 func CommonTestPosition(t *testing.T, queue_under_test Queue) {
@@ -153,6 +339,30 @@ func CommonTestPosition(t *testing.T, queue_under_test Queue) {
 	test.AssertEqual(pos, 1)
 }
 
+func CommonTestReplace(t *testing.T, queue_under_test Queue) {
+	test := newQueueTest(t)
+	qut := NewTestQueue(queue_under_test)
+
+	qut.Enqueue(newQueueable("foo1", "bar1"))
+	qut.Enqueue(newQueueable("foo2", "bar2"))
+
+	then := time.Now().Add(-time.Minute).Round(time.Millisecond)
+	test.AssertNil(qut.Replace([]*TestQueueable{
+		newQueueable("foo3", "bar3"),
+		newQueueable("foo2", "bar2"),
+		newQueueable("foo4", "bar4"),
+	}, then))
+	test.AssertQueueOrder(qut, newQueueable("foo3", "bar3"),
+		newQueueable("foo2", "bar2"), newQueueable("foo4", "bar4"))
+	test.AssertNil(qut.q.Iter(func(index int, entry *Entry) bool {
+		test.Assert(entry.EnqueuedAt.Equal(then))
+		return false
+	}))
+
+	test.AssertNil(qut.Replace(nil, then))
+	test.AssertEmpty(qut)
+}
+
 func CommonTestRemove(t *testing.T, queue_under_test Queue) {
 	test := newQueueTest(t)
 	qut := NewTestQueue(queue_under_test)
@@ -232,6 +442,75 @@ func CommonTestSize(t *testing.T, queue_under_test Queue) {
 	test.AssertQueueSize(qut, 1)
 }
 
+// CommonTestWatch checks that bus delivers the events of a queue watched with
+// it.
+func CommonTestWatch(t *testing.T, queue_under_test Queue, bus EventBus) {
+	test := newQueueTest(t)
+	watched := Watch(queue_under_test, bus)
+	qut := NewTestQueue(watched)
+	sub, err := watched.Subscribe()
+	test.AssertNil(err)
+	defer sub.Close()
+
+	q1 := newQueueable("foo1", "bar1")
+	q2 := newQueueable("foo2", "bar2")
+	q3 := newQueueable("foo3", "bar3")
+
+	_, err = qut.Enqueue(q1)
+	test.AssertNil(err)
+	_, err = qut.Enqueue(q2)
+	test.AssertNil(err)
+	_, err = qut.Insert(0, q3)
+	test.AssertNil(err)
+	// Failed changes aren't published.
+	_, err = qut.Enqueue(q1)
+	test.AssertErrorContainedBy(err, AlreadyEnqueued)
+	_, err = qut.Move(q3, 2)
+	test.AssertNil(err)
+	test.AssertNil(qut.Remove(q1))
+	_, _, err = qut.DequeueN(1)
+	test.AssertNil(err)
+	test.AssertNil(qut.Clear())
+
+	expected := []struct {
+		event_type EventType
+		datum      *TestQueueable
+		pos        int
+	}{
+		{Enqueued, q1, 0},
+		{Enqueued, q2, 1},
+		{Enqueued, q3, 0},
+		{Moved, q3, 2},
+		{Removed, q1, 0},
+		{Dequeued, q2, 0},
+		{Cleared, nil, 0},
+	}
+	for _, want := range expected {
+		var event *Event
+		select {
+		case event = <-sub.Events():
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s event", want.event_type)
+		}
+		test.AssertEqual(event.Type, want.event_type)
+		test.AssertEqual(event.Position, want.pos)
+		test.Assert(!event.Time.IsZero())
+		if want.datum != nil {
+			var tq TestQueueable
+			test.AssertNil(json.Unmarshal(event.Datum, &tq))
+			test.AssertEqual(tq.Key_, want.datum.Key_)
+		}
+	}
+
+	test.AssertNil(sub.Close())
+	select {
+	case _, ok := <-sub.Events():
+		test.Assert(!ok)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the events channel to close")
+	}
+}
+
 //
 // Helpers
 //
@@ -282,6 +561,21 @@ func (t *queueTest) AssertQueueContains(queue *TestQueue, data ...*TestQueueable
 	t.AssertEqual(found, len(data))
 }
 
+func (t *queueTest) AssertQueueOrder(queue *TestQueue,
+	data ...*TestQueueable) {
+
+	actual := []string{}
+	queue.Iter(func(i int, x *TestQueueable) bool {
+		actual = append(actual, x.Key_)
+		return false
+	})
+	expected := []string{}
+	for _, datum := range data {
+		expected = append(expected, datum.Key_)
+	}
+	t.AssertEqual(strings.Join(actual, " "), strings.Join(expected, " "))
+}
+
 func (t *queueTest) AssertQueueDoesNotContain(queue *TestQueue,
 	datum *TestQueueable) {
 
@@ -327,6 +621,53 @@ func (q *TestQueue) DequeueN(n int) (
 	return taken, num_left, nil
 }
 
+// DequeueFit sizes each queueable by its value, which must be an integer.
+func (q *TestQueue) DequeueFit(n int) (
+	taken []TestQueueable, size_left int, err error) {
+
+	takens_bytes, size_left, err := q.q.DequeueFit(n, func(datum []byte) int {
+		tq := TestQueueable{}
+		logger.Errore(json.Unmarshal(datum, &tq))
+		size, err := strconv.Atoi(tq.Value)
+		logger.Errore(err)
+		return size
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+
+	for _, taken_bytes := range takens_bytes {
+		tq := TestQueueable{}
+		err := json.Unmarshal(taken_bytes, &tq)
+		if err != nil {
+			return nil, -1, err
+		}
+		taken = append(taken, tq)
+	}
+
+	return taken, size_left, nil
+}
+
+func (q *TestQueue) DequeueSelect(choose func([][]byte) []int) (
+	taken []TestQueueable, num_left int, err error) {
+
+	takens_bytes, num_left, err := q.q.DequeueSelect(choose)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	for _, taken_bytes := range takens_bytes {
+		tq := TestQueueable{}
+		err := json.Unmarshal(taken_bytes, &tq)
+		if err != nil {
+			return nil, -1, err
+		}
+		taken = append(taken, tq)
+	}
+
+	return taken, num_left, nil
+}
+
 func (q *TestQueue) Enqueue(datum *TestQueueable) (int, error) {
 	datum_bytes, err := json.Marshal(datum)
 	if err != nil {
@@ -336,14 +677,31 @@ func (q *TestQueue) Enqueue(datum *TestQueueable) (int, error) {
 	return q.q.Enqueue(datum_bytes)
 }
 
+func (q *TestQueue) Insert(pos int, datum *TestQueueable) (int, error) {
+	datum_bytes, err := json.Marshal(datum)
+	if err != nil {
+		return -1, err
+	}
+
+	return q.q.Insert(pos, datum_bytes)
+}
+
 func (q *TestQueue) Iter(fn func(int, *TestQueueable) bool) error {
-	return q.q.Iter(func(index int, datum []byte) bool {
+	return q.q.Iter(func(index int, entry *Entry) bool {
 		tq := &TestQueueable{}
-		logger.Errore(json.Unmarshal(datum, tq))
+		logger.Errore(json.Unmarshal(entry.Datum, tq))
 		return fn(index, tq)
 	})
 }
 
+func (q *TestQueue) Move(tq *TestQueueable, pos int) (int, error) {
+	tq_bytes, err := json.Marshal(tq)
+	if err != nil {
+		return -1, err
+	}
+	return q.q.Move(tq_bytes, pos)
+}
+
 func (q *TestQueue) Position(tq *TestQueueable) (int, error) {
 	tq_bytes, err := json.Marshal(tq)
 	if err != nil {
@@ -360,6 +718,21 @@ func (q *TestQueue) Remove(tq *TestQueueable) error {
 	return q.q.Remove(tq_bytes)
 }
 
+func (q *TestQueue) Replace(tqs []*TestQueueable, enqueued_at time.Time) error {
+	entries := []*Entry{}
+	for _, tq := range tqs {
+		tq_bytes, err := json.Marshal(tq)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &Entry{
+			Datum:      tq_bytes,
+			EnqueuedAt: enqueued_at,
+		})
+	}
+	return q.q.Replace(entries)
+}
+
 func (q *TestQueue) Size() (int, error) {
 	return q.q.Size()
 }
@@ -0,0 +1,124 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisqueue
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ewollesen/zenbot/queue"
+	redis "gopkg.in/redis.v5"
+)
+
+// subscriptionBuffer is the number of events a subscription holds before
+// receiving further events blocks.
+const subscriptionBuffer = 64
+
+// receiveRetryDelay is how long a subscription waits after failing to receive
+// a message before trying again.
+const receiveRetryDelay = time.Second
+
+// eventBus delivers events over a redis pub/sub channel, so that subscribers
+// in every process sharing the redis server receive them.
+type eventBus struct {
+	client  *redis.Client
+	channel string
+}
+
+var _ queue.EventBus = (*eventBus)(nil)
+
+func NewEventBus(client *redis.Client, channel string) *eventBus {
+	return &eventBus{
+		client:  client,
+		channel: channel,
+	}
+}
+
+func (b *eventBus) Publish(event *queue.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(b.channel, string(payload)).Err()
+}
+
+func (b *eventBus) Subscribe() (queue.Subscription, error) {
+	pubsub, err := b.client.Subscribe(b.channel)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		pubsub: pubsub,
+		events: make(chan *queue.Event, subscriptionBuffer),
+		done:   make(chan struct{}),
+	}
+	go sub.receive()
+	return sub, nil
+}
+
+type subscription struct {
+	pubsub    *redis.PubSub
+	events    chan *queue.Event
+	done      chan struct{}
+	close_one sync.Once
+}
+
+func (s *subscription) receive() {
+	defer close(s.events)
+	for {
+		msg, err := s.pubsub.ReceiveMessage()
+		if err != nil {
+			// The client reconnects by itself, so errors are
+			// only logged, unless the subscription was closed.
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			logger.Warne(err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(receiveRetryDelay):
+			}
+			continue
+		}
+
+		event := &queue.Event{}
+		if err = json.Unmarshal([]byte(msg.Payload), event); err != nil {
+			logger.Warne(err)
+			continue
+		}
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *subscription) Events() <-chan *queue.Event {
+	return s.events
+}
+
+func (s *subscription) Close() (err error) {
+	s.close_one.Do(func() {
+		close(s.done)
+		err = s.pubsub.Close()
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisqueue
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ewollesen/zenbot/queue"
+	redis "gopkg.in/redis.v5"
+)
+
+// listQueue is the list based implementation that RedisQueue replaced, kept
+// to benchmark against, and to test migration from. It stores its data in a
+// redis list, and the time each datum was enqueued in a companion hash, in
+// nanoseconds.
+type listQueue struct {
+	client *redis.Client
+	key    string
+}
+
+func newListQueue(client *redis.Client, key string) *listQueue {
+	return &listQueue{
+		client: client,
+		key:    key,
+	}
+}
+
+func (q *listQueue) Clear() error {
+	return q.client.Del(q.key, q.timesKey()).Err()
+}
+
+func (q *listQueue) DequeueN(n int) (taken [][]byte, num_left int, err error) {
+	var size int64
+	err = q.client.Watch(func(tx *redis.Tx) error {
+		strs, err := tx.LRange(q.key, 0, int64(n-1)).Result()
+		if err != nil {
+			return err
+		}
+
+		size, err = tx.LLen(q.key).Result()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Pipelined(func(pipe *redis.Pipeline) error {
+			for _, str := range strs {
+				taken = append(taken, []byte(str))
+				pipe.LRem(q.key, 0, str)
+				pipe.HDel(q.timesKey(), str)
+			}
+			return nil
+		})
+		return err
+	}, q.key, q.timesKey())
+	if err == redis.TxFailedErr {
+		return q.DequeueN(n)
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return taken, int(size) - len(taken), nil
+}
+
+func (q *listQueue) Enqueue(datum []byte) (pos int, err error) {
+	var new_len int64
+	err = q.client.Watch(func(tx *redis.Tx) error {
+		cur_pos, err := q.position(tx, datum)
+		if err != nil {
+			return err
+		}
+		if cur_pos >= 0 {
+			return queue.AlreadyEnqueued.NewWith(
+				fmt.Sprintf("%+v in position %d",
+					datum, cur_pos+1),
+				queue.SetPosition(cur_pos))
+		}
+
+		cmds, err := tx.Pipelined(func(pipe *redis.Pipeline) error {
+			pipe.RPush(q.key, datum)
+			pipe.HSet(q.timesKey(), string(datum),
+				time.Now().UnixNano())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		new_len, err = cmds[0].(*redis.IntCmd).Result()
+		return err
+	}, q.key, q.timesKey())
+	if err == redis.TxFailedErr {
+		return q.Enqueue(datum)
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	return int(new_len) - 1, nil
+}
+
+func (q *listQueue) Position(datum []byte) (pos int, err error) {
+	return q.position(q.client, datum)
+}
+
+func (q *listQueue) position(cmd redis.Cmdable, datum []byte) (
+	pos int, err error) {
+
+	items, err := cmd.LRange(q.key, 0, -1).Result()
+	if err != nil {
+		return -1, err
+	}
+	for i, item := range items {
+		if bytes.Equal(datum, []byte(item)) {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+func (q *listQueue) Remove(datum []byte) error {
+	return q.client.Watch(func(tx *redis.Tx) error {
+		_, err := tx.Pipelined(func(pipe *redis.Pipeline) error {
+			pipe.LRem(q.key, 0, datum)
+			pipe.HDel(q.timesKey(), string(datum))
+			return nil
+		})
+		return err
+	}, q.key, q.timesKey())
+}
+
+func (q *listQueue) timesKey() string {
+	return q.key + ".enqueued_at"
+}
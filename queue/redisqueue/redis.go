@@ -15,8 +15,10 @@
 package redisqueue
 
 import (
-	"bytes"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/ewollesen/zenbot/queue"
 	"github.com/spacemonkeygo/errors"
@@ -24,9 +26,22 @@ import (
 	redis "gopkg.in/redis.v5"
 )
 
+// maxRetries bounds how many times an optimistic transaction is retried when
+// the queue changes under it.
+const maxRetries = 10
+
+// RedisQueue stores its data in a redis sorted set, scored by each datum's
+// place in the queue, and the time each datum was enqueued, in microseconds,
+// in a companion sorted set. Each operation is a single Lua script, so it's
+// atomic, and takes O(log n) time, plus the number of entries it returns.
 type RedisQueue struct {
-	client *redis.Client
-	key    string
+	client  *redis.Client
+	key     string
+	max_age time.Duration
+	now     func() time.Time
+
+	migrate_mu sync.Mutex
+	migrated   bool
 }
 
 var _ queue.Queue = (*RedisQueue)(nil)
@@ -34,91 +49,482 @@ var _ queue.Queue = (*RedisQueue)(nil)
 var (
 	Error  = errors.NewClass("redisqueue")
 	logger = spacelog.GetLogger()
+
+	TooManyRetries = Error.NewClass("too many retries")
+)
+
+// pruneLua is prepended to the scripts. prune drops entries enqueued before
+// cutoff, unless it's zero. KEYS[1] is the queue and KEYS[2] the enqueue
+// times.
+const pruneLua = `
+local function prune(cutoff)
+	if tonumber(cutoff) <= 0 then
+		return
+	end
+	local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", "(" .. cutoff)
+	for _, datum in ipairs(expired) do
+		redis.call("ZREM", KEYS[1], datum)
+	end
+	if #expired > 0 then
+		redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. cutoff)
+	end
+end
+`
+
+// placeLua is prepended to scripts that put a datum at a given position. The
+// datum is scored halfway between its new neighbours. Once the scores are
+// too close together to split, they're renumbered, which is O(n), but rare.
+const placeLua = `
+local function score(rank)
+	return tonumber(redis.call("ZRANGE", KEYS[1], rank, rank, "WITHSCORES")[2])
+end
+
+local function place(datum, pos)
+	local size = redis.call("ZCARD", KEYS[1])
+	pos = math.max(0, math.min(pos, size))
+	local new_score
+	if size == 0 then
+		new_score = 0
+	elseif pos == 0 then
+		new_score = score(0) - 1
+	elseif pos == size then
+		new_score = score(-1) + 1
+	else
+		local before, after = score(pos - 1), score(pos)
+		new_score = before + (after - before) / 2
+		if new_score <= before or new_score >= after then
+			local members = redis.call("ZRANGE", KEYS[1], 0, -1)
+			for i, member in ipairs(members) do
+				redis.call("ZADD", KEYS[1], i, member)
+			end
+			return place(datum, pos)
+		end
+	end
+	redis.call("ZADD", KEYS[1], string.format("%.17g", new_score), datum)
+	return pos
+end
+`
+
+var (
+	// ARGV: datum, enqueued at, cutoff. Returns {already enqueued, pos}.
+	enqueueScript = redis.NewScript(pruneLua + `
+prune(ARGV[3])
+local rank = redis.call("ZRANK", KEYS[1], ARGV[1])
+if rank then
+	return {1, rank}
+end
+local last = redis.call("ZREVRANGE", KEYS[1], 0, 0, "WITHSCORES")
+local new_score = 0
+if #last > 0 then
+	new_score = tonumber(last[2]) + 1
+end
+redis.call("ZADD", KEYS[1], string.format("%.17g", new_score), ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return {0, redis.call("ZCARD", KEYS[1]) - 1}
+`)
+
+	// ARGV: datum, pos, enqueued at, cutoff. Returns {already enqueued,
+	// pos}.
+	insertScript = redis.NewScript(pruneLua + placeLua + `
+prune(ARGV[4])
+local rank = redis.call("ZRANK", KEYS[1], ARGV[1])
+if rank then
+	return {1, rank}
+end
+local pos = place(ARGV[1], tonumber(ARGV[2]))
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+return {0, pos}
+`)
+
+	// ARGV: datum, pos, cutoff. Returns {not found, pos}.
+	moveScript = redis.NewScript(pruneLua + placeLua + `
+prune(ARGV[3])
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return {1, -1}
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+return {0, place(ARGV[1], tonumber(ARGV[2]))}
+`)
+
+	// ARGV: n, cutoff. Returns {taken, num left}.
+	dequeueNScript = redis.NewScript(pruneLua + `
+prune(ARGV[2])
+local n = tonumber(ARGV[1])
+local taken = {}
+if n > 0 then
+	taken = redis.call("ZRANGE", KEYS[1], 0, n - 1)
+end
+if #taken > 0 then
+	redis.call("ZREMRANGEBYRANK", KEYS[1], 0, #taken - 1)
+end
+for _, datum in ipairs(taken) do
+	redis.call("ZREM", KEYS[2], datum)
+end
+return {taken, redis.call("ZCARD", KEYS[1])}
+`)
+
+	// ARGV: n, cutoff, then datum, size pairs. Takes the sized data that
+	// fit, front first, leaving any data enqueued since they were sized.
+	// Returns {taken, size left, unsized data}.
+	dequeueFitScript = redis.NewScript(pruneLua + `
+prune(ARGV[2])
+local sizes = {}
+for i = 3, #ARGV, 2 do
+	sizes[ARGV[i]] = tonumber(ARGV[i + 1])
+end
+local remaining = tonumber(ARGV[1])
+local taken, size_left, unsized = {}, 0, {}
+for _, datum in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	local size = sizes[datum]
+	if not size then
+		table.insert(unsized, datum)
+	elseif size > remaining then
+		size_left = size_left + size
+	else
+		table.insert(taken, datum)
+		remaining = remaining - size
+	end
+end
+for _, datum in ipairs(taken) do
+	redis.call("ZREM", KEYS[1], datum)
+	redis.call("ZREM", KEYS[2], datum)
+end
+return {taken, size_left, unsized}
+`)
+
+	// ARGV: cutoff. Returns the entries as datum, enqueued at pairs.
+	iterScript = redis.NewScript(pruneLua + `
+prune(ARGV[1])
+local entries = {}
+for _, datum in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	table.insert(entries, datum)
+	table.insert(entries, redis.call("ZSCORE", KEYS[2], datum) or "")
+end
+return entries
+`)
+
+	// ARGV: datum, cutoff. Returns the datum's position, or -1.
+	positionScript = redis.NewScript(pruneLua + `
+prune(ARGV[2])
+local rank = redis.call("ZRANK", KEYS[1], ARGV[1])
+if rank then
+	return rank
+end
+return -1
+`)
+
+	// ARGV: cutoff.
+	pruneScript = redis.NewScript(pruneLua + `
+prune(ARGV[1])
+return redis.call("ZCARD", KEYS[1])
+`)
+
+	// ARGV: datum. Returns the number of entries removed.
+	removeScript = redis.NewScript(`
+redis.call("ZREM", KEYS[2], ARGV[1])
+return redis.call("ZREM", KEYS[1], ARGV[1])
+`)
+
+	// ARGV: datum, enqueued at pairs, with an empty enqueued at for none.
+	replaceScript = redis.NewScript(`
+redis.call("DEL", KEYS[1], KEYS[2])
+for i = 1, #ARGV, 2 do
+	redis.call("ZADD", KEYS[1], (i - 1) / 2, ARGV[i])
+	if ARGV[i + 1] ~= "" then
+		redis.call("ZADD", KEYS[2], ARGV[i + 1], ARGV[i])
+	end
+end
+return #ARGV / 2
+`)
+
+	// moveQueueScript renames the queue at KEYS[1], along with its enqueue
+	// times and legacy enqueue times, KEYS[2] and KEYS[3], to KEYS[4],
+	// KEYS[5] and KEYS[6], unless there's already a queue there. Returns 1
+	// if the queue was moved.
+	moveQueueScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 or redis.call("EXISTS", KEYS[4]) == 1 then
+	return 0
+end
+for i = 1, 3 do
+	if redis.call("EXISTS", KEYS[i]) == 1 then
+		redis.call("RENAME", KEYS[i], KEYS[i + 3])
+	end
+end
+return 1
+`)
+
+	// migrateScript converts a queue from the list and hash of enqueue
+	// times, in nanoseconds, used by earlier versions. KEYS[3] is the
+	// hash.
+	migrateScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "list" then
+	return 0
+end
+local items = redis.call("LRANGE", KEYS[1], 0, -1)
+redis.call("DEL", KEYS[1], KEYS[2])
+for i, datum in ipairs(items) do
+	redis.call("ZADD", KEYS[1], i - 1, datum)
+	local nanos = redis.call("HGET", KEYS[3], datum)
+	if nanos and #nanos > 3 then
+		redis.call("ZADD", KEYS[2], string.sub(nanos, 1, -4), datum)
+	end
+end
+redis.call("DEL", KEYS[3])
+return #items
+`)
 )
 
 func New(client *redis.Client, key string) *RedisQueue {
 	return &RedisQueue{
 		client: client,
 		key:    key,
+		now:    time.Now,
+	}
+}
+
+// Move moves the queue kept at from, which may be in the list format used by
+// earlier versions, to to, unless there's already a queue there. It returns
+// true if the queue was moved.
+func Move(client *redis.Client, from, to string) (moved bool, err error) {
+	keys := []string{}
+	for _, key := range []string{from, to} {
+		keys = append(keys, key, key+".times", key+".enqueued_at")
+	}
+	result, err := moveQueueScript.Run(client, keys).Result()
+	if err != nil {
+		return false, err
+	}
+	return result.(int64) == 1, nil
+}
+
+// SetMaxAge causes entries that have been queued for longer than max_age to be
+// dropped from the queue. A max_age of zero, the default, disables expiry.
+func (q *RedisQueue) SetMaxAge(max_age time.Duration) {
+	q.max_age = max_age
+}
+
+// run runs script against the queue's keys, once the queue's been migrated.
+func (q *RedisQueue) run(script *redis.Script, args ...interface{}) (
+	interface{}, error) {
+
+	if err := q.migrate(); err != nil {
+		return nil, err
+	}
+	return script.Run(q.client, []string{q.key, q.timesKey()},
+		args...).Result()
+}
+
+func (q *RedisQueue) migrate() error {
+	q.migrate_mu.Lock()
+	defer q.migrate_mu.Unlock()
+	if q.migrated {
+		return nil
+	}
+
+	migrated, err := migrateScript.Run(q.client, []string{q.key,
+		q.timesKey(), q.key + ".enqueued_at"}).Result()
+	if err != nil {
+		return err
+	}
+	if n, _ := migrated.(int64); n > 0 {
+		logger.Infof("migrated %d entries of queue %s", n, q.key)
+	}
+	q.migrated = true
+	return nil
+}
+
+// cutoff returns the time before which entries have expired, in
+// microseconds, or zero if entries don't expire.
+func (q *RedisQueue) cutoff() int64 {
+	if q.max_age <= 0 {
+		return 0
+	}
+	return micros(q.now().Add(-q.max_age))
+}
+
+// watch runs fn in an optimistic transaction on the queue, retrying a
+// bounded number of times if the queue changes under it.
+func (q *RedisQueue) watch(fn func(*redis.Tx) error) error {
+	for i := 0; i < maxRetries; i++ {
+		err := q.client.Watch(fn, q.key, q.timesKey())
+		if err != redis.TxFailedErr {
+			return err
+		}
+		logger.Warne(err)
 	}
+	return TooManyRetries.New("%s", q.key)
 }
 
 func (q *RedisQueue) Clear() error {
-	return q.client.LTrim(q.key, 1, 0).Err()
+	return q.client.Del(q.key, q.timesKey(), q.key+".enqueued_at").Err()
 }
 
 func (q *RedisQueue) DequeueN(n int) (taken [][]byte, num_left int, err error) {
-	var size int64
-	err = q.client.Watch(func(tx *redis.Tx) error {
-		strs, err := tx.LRange(q.key, 0, int64(n-1)).Result()
+	result, err := q.run(dequeueNScript, n, q.cutoff())
+	if err != nil {
+		return nil, -1, err
+	}
+	reply := result.([]interface{})
+	taken = [][]byte{}
+	for _, datum := range reply[0].([]interface{}) {
+		taken = append(taken, []byte(datum.(string)))
+	}
+
+	return taken, int(reply[1].(int64)), nil
+}
+
+// dequeueWith removes the entries chosen by choose, given the queue's
+// contents, in an optimistic transaction, as choose can't run in redis.
+func (q *RedisQueue) dequeueWith(choose func(items []string) []int) (
+	taken [][]byte, num_left int, err error) {
+
+	if _, err = q.run(pruneScript, q.cutoff()); err != nil {
+		return nil, -1, err
+	}
+
+	err = q.watch(func(tx *redis.Tx) error {
+		items, err := tx.ZRange(q.key, 0, -1).Result()
 		if err != nil {
 			return err
 		}
 
-		size, err = tx.LLen(q.key).Result()
-		if err != nil {
-			return err
+		chosen := make(map[int]bool)
+		for _, index := range choose(items) {
+			if index >= 0 && index < len(items) {
+				chosen[index] = true
+			}
 		}
 
+		taken, num_left = [][]byte{}, len(items)-len(chosen)
 		_, err = tx.Pipelined(func(pipe *redis.Pipeline) error {
-			for _, str := range strs {
-				taken = append(taken, []byte(str))
-				err = pipe.LRem(q.key, 0, str).Err()
-				if err != nil {
-					return err
+			for i, item := range items {
+				if !chosen[i] {
+					continue
 				}
+				taken = append(taken, []byte(item))
+				pipe.ZRem(q.key, item)
+				pipe.ZRem(q.timesKey(), item)
 			}
 			return nil
 		})
 		return err
-	}, q.key)
-	if err == redis.TxFailedErr {
-		logger.Warne(err)
-		return q.DequeueN(n)
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return taken, num_left, nil
+}
+
+// DequeueFit sizes the queue's data, then takes those that fit in a script,
+// so, unlike dequeueWith, it's never retried. Data enqueued after they were
+// sized are left in the queue, as if they'd been enqueued after the take.
+func (q *RedisQueue) DequeueFit(n int, size func([]byte) int) (
+	taken [][]byte, size_left int, err error) {
+
+	if err = q.migrate(); err != nil {
+		return nil, -1, err
 	}
+	items, err := q.client.ZRange(q.key, 0, -1).Result()
 	if err != nil {
 		return nil, -1, err
 	}
 
-	return taken, int(size) - len(taken), nil
+	args := make([]interface{}, 0, 2+2*len(items))
+	args = append(args, n, q.cutoff())
+	for _, item := range items {
+		args = append(args, item, size([]byte(item)))
+	}
+	result, err := q.run(dequeueFitScript, args...)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	reply := result.([]interface{})
+	taken = [][]byte{}
+	for _, datum := range reply[0].([]interface{}) {
+		taken = append(taken, []byte(datum.(string)))
+	}
+	size_left = int(reply[1].(int64))
+	for _, datum := range reply[2].([]interface{}) {
+		size_left += size([]byte(datum.(string)))
+	}
+
+	return taken, size_left, nil
 }
 
-func (q *RedisQueue) Enqueue(datum []byte) (pos int, err error) {
-	var new_len int64
-	err = q.client.Watch(func(tx *redis.Tx) error {
-		cur_pos, err := q.position(tx, datum)
-		if err != nil {
-			return err
-		}
-		if cur_pos >= 0 {
-			return queue.AlreadyEnqueued.NewWith(
-				fmt.Sprintf("%+v in position %d",
-					datum, cur_pos+1),
-				queue.SetPosition(pos))
+func (q *RedisQueue) DequeueSelect(choose func([][]byte) []int) (
+	taken [][]byte, num_left int, err error) {
+
+	return q.dequeueWith(func(items []string) []int {
+		data := make([][]byte, 0, len(items))
+		for _, item := range items {
+			data = append(data, []byte(item))
 		}
+		return choose(data)
+	})
+}
 
-		new_len, err = tx.RPush(q.key, datum).Result()
-		return err
-	}, q.key)
-	if err == redis.TxFailedErr {
-		logger.Warne(err)
-		return q.Enqueue(datum)
+func (q *RedisQueue) Enqueue(datum []byte) (pos int, err error) {
+	result, err := q.run(enqueueScript, datum, micros(q.now()),
+		q.cutoff())
+	if err != nil {
+		return -1, err
+	}
+
+	return placed(result, datum)
+}
+
+// placed interprets the {already enqueued, pos} reply of the enqueue and
+// insert scripts.
+func placed(result interface{}, datum []byte) (int, error) {
+	reply := result.([]interface{})
+	pos := int(reply[1].(int64))
+	if reply[0].(int64) != 0 {
+		return -1, queue.AlreadyEnqueued.NewWith(
+			fmt.Sprintf("%+v in position %d", datum, pos+1),
+			queue.SetPosition(pos))
+	}
+	return pos, nil
+}
+
+func (q *RedisQueue) Replace(entries []*queue.Entry) error {
+	args := make([]interface{}, 0, 2*len(entries))
+	for _, entry := range entries {
+		enqueued_at := ""
+		if !entry.EnqueuedAt.IsZero() {
+			enqueued_at = strconv.FormatInt(micros(entry.EnqueuedAt),
+				10)
+		}
+		args = append(args, entry.Datum, enqueued_at)
 	}
+
+	_, err := q.run(replaceScript, args...)
+	return err
+}
+
+func (q *RedisQueue) Insert(pos int, datum []byte) (new_pos int, err error) {
+	result, err := q.run(insertScript, datum, pos, micros(q.now()),
+		q.cutoff())
 	if err != nil {
 		return -1, err
 	}
 
-	return int(new_len) - 1, nil
+	return placed(result, datum)
 }
 
-func (q *RedisQueue) Iter(fn func(int, []byte) bool) error {
-	items, err := q.client.LRange(q.key, 0, -1).Result()
+func (q *RedisQueue) Iter(fn func(int, *queue.Entry) bool) error {
+	result, err := q.run(iterScript, q.cutoff())
 	if err != nil {
 		return err
 	}
 
-	for i, item := range items {
-		if fn(i, []byte(item)) {
+	reply := result.([]interface{})
+	for i := 0; i+1 < len(reply); i += 2 {
+		if fn(i/2, &queue.Entry{
+			Datum:      []byte(reply[i].(string)),
+			EnqueuedAt: parseMicros(reply[i+1].(string)),
+		}) {
 			break
 		}
 	}
@@ -126,32 +532,62 @@ func (q *RedisQueue) Iter(fn func(int, []byte) bool) error {
 	return nil
 }
 
-func (q *RedisQueue) Position(datum []byte) (pos int, err error) {
-	return q.position(q.client, datum)
-}
-
-func (q *RedisQueue) position(cmd redis.Cmdable, datum []byte) (
-	pos int, err error) {
-
-	items, err := cmd.LRange(q.key, 0, -1).Result()
+func (q *RedisQueue) Move(datum []byte, pos int) (new_pos int, err error) {
+	result, err := q.run(moveScript, datum, pos, q.cutoff())
 	if err != nil {
 		return -1, err
 	}
 
-	for i, item := range items {
-		if bytes.Equal(datum, []byte(item)) {
-			return i, nil
-		}
+	reply := result.([]interface{})
+	if reply[0].(int64) != 0 {
+		return -1, queue.NotFound.New("")
 	}
+	return int(reply[1].(int64)), nil
+}
 
-	return -1, nil
+func (q *RedisQueue) Position(datum []byte) (pos int, err error) {
+	result, err := q.run(positionScript, datum, q.cutoff())
+	if err != nil {
+		return -1, err
+	}
+	return int(result.(int64)), nil
 }
 
 func (q *RedisQueue) Remove(datum []byte) error {
-	return q.client.LRem(q.key, 0, datum).Err()
+	result, err := q.run(removeScript, datum)
+	if err != nil {
+		return err
+	}
+	if result.(int64) == 0 {
+		return queue.NotFound.New("")
+	}
+	return nil
 }
 
 func (q *RedisQueue) Size() (int, error) {
-	s, err := q.client.LLen(q.key).Result()
-	return int(s), err
+	result, err := q.run(pruneScript, q.cutoff())
+	if err != nil {
+		return -1, err
+	}
+	return int(result.(int64)), nil
+}
+
+func (q *RedisQueue) timesKey() string {
+	return q.key + ".times"
+}
+
+// micros returns t as microseconds since the epoch, which, unlike
+// nanoseconds, a redis score can hold exactly.
+func micros(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// parseMicros parses a score set by micros. Redis may format scores in
+// exponent notation, so they're parsed as floats, which hold them exactly.
+func parseMicros(stamp string) time.Time {
+	us, err := strconv.ParseFloat(stamp, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(us)*int64(time.Microsecond))
 }
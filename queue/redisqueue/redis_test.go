@@ -15,11 +15,13 @@
 package redisqueue
 
 import (
+	"fmt"
 	"testing"
 
 	redis "gopkg.in/redis.v5"
 
 	"github.com/ewollesen/zenbot/queue"
+	"github.com/ewollesen/zenbot/zentest"
 )
 
 var keyPrefix = "test.zenbot.queue"
@@ -32,14 +34,36 @@ func TestDequeueN(t *testing.T) {
 	queue.CommonTestDequeueN(t, New(redisTestClient(t), keyPrefix))
 }
 
+func TestDequeueFit(t *testing.T) {
+	queue.CommonTestDequeueFit(t, New(redisTestClient(t), keyPrefix))
+}
+
+func TestDequeueSelect(t *testing.T) {
+	queue.CommonTestDequeueSelect(t, New(redisTestClient(t), keyPrefix))
+}
+
 func TestEnqueue(t *testing.T) {
 	queue.CommonTestEnqueue(t, New(redisTestClient(t), keyPrefix))
 }
 
+func TestExpiry(t *testing.T) {
+	q := New(redisTestClient(t), keyPrefix)
+	q.SetMaxAge(queue.TestMaxAge)
+	queue.CommonTestExpiry(t, q)
+}
+
+func TestInsert(t *testing.T) {
+	queue.CommonTestInsert(t, New(redisTestClient(t), keyPrefix))
+}
+
 func TestIter(t *testing.T) {
 	queue.CommonTestIter(t, New(redisTestClient(t), keyPrefix))
 }
 
+func TestMove(t *testing.T) {
+	queue.CommonTestMove(t, New(redisTestClient(t), keyPrefix))
+}
+
 func TestPosition(t *testing.T) {
 	queue.CommonTestPosition(t, New(redisTestClient(t), keyPrefix))
 }
@@ -51,17 +75,240 @@ func TestRemove(t *testing.T) {
 	queue.CommonTestRemoveLast(t, New(redisTestClient(t), keyPrefix))
 }
 
+func TestReplace(t *testing.T) {
+	queue.CommonTestReplace(t, New(redisTestClient(t), keyPrefix))
+}
+
 func TestSize(t *testing.T) {
 	queue.CommonTestSize(t, New(redisTestClient(t), keyPrefix))
 }
 
-func redisTestClient(t *testing.T) *redis.Client {
+func TestWatch(t *testing.T) {
+	client := redisTestClient(t)
+	queue.CommonTestWatch(t, New(client, keyPrefix),
+		NewEventBus(client, keyPrefix+".events"))
+}
+
+func TestMigrate(t *testing.T) {
+	test := zentest.New(t)
+	client := redisTestClient(t)
+	legacy := newListQueue(client, keyPrefix)
+	for _, datum := range []string{"foo", "bar", "baz"} {
+		_, err := legacy.Enqueue([]byte(datum))
+		test.AssertNil(err)
+	}
+
+	q := New(client, keyPrefix)
+	pos, err := q.Position([]byte("baz"))
+	test.AssertNil(err)
+	test.AssertEqual(pos, 2)
+	test.AssertNil(q.Iter(func(index int, entry *queue.Entry) bool {
+		test.Assert(!entry.EnqueuedAt.IsZero())
+		return false
+	}))
+	exists, err := client.Exists(keyPrefix + ".enqueued_at").Result()
+	test.AssertNil(err)
+	test.Assert(!exists)
+}
+
+func TestMoveQueue(t *testing.T) {
+	test := zentest.New(t)
+	client := redisTestClient(t)
+	to := keyPrefix + ".moved"
+	test.AssertNil(client.Del(to, to+".times").Err())
+	legacy := newListQueue(client, keyPrefix)
+	for _, datum := range []string{"foo", "bar"} {
+		_, err := legacy.Enqueue([]byte(datum))
+		test.AssertNil(err)
+	}
+
+	moved, err := Move(client, keyPrefix, to)
+	test.AssertNil(err)
+	test.Assert(moved)
+	pos, err := New(client, to).Position([]byte("bar"))
+	test.AssertNil(err)
+	test.AssertEqual(pos, 1)
+	exists, err := client.Exists(keyPrefix).Result()
+	test.AssertNil(err)
+	test.Assert(!exists)
+
+	// A queue already at the destination isn't overwritten.
+	_, err = legacy.Enqueue([]byte("baz"))
+	test.AssertNil(err)
+	moved, err = Move(client, keyPrefix, to)
+	test.AssertNil(err)
+	test.Assert(!moved)
+	test.AssertNil(client.Del(to, to+".times").Err())
+}
+
+func TestInsertSplitsScores(t *testing.T) {
+	test := zentest.New(t)
+	q := New(redisTestClient(t), keyPrefix)
+	_, err := q.Enqueue([]byte("first"))
+	test.AssertNil(err)
+	_, err = q.Enqueue([]byte("last"))
+	test.AssertNil(err)
+
+	// Repeatedly inserting at the same position exhausts the gap between
+	// its neighbours' scores, forcing them to be renumbered.
+	for i := 0; i < 100; i++ {
+		pos, err := q.Insert(1, []byte(fmt.Sprint(i)))
+		test.AssertNil(err)
+		test.AssertEqual(pos, 1)
+	}
+	pos, err := q.Position([]byte("99"))
+	test.AssertNil(err)
+	test.AssertEqual(pos, 1)
+	pos, err = q.Position([]byte("last"))
+	test.AssertNil(err)
+	test.AssertEqual(pos, 101)
+}
+
+// The benchmarks compare each operation on a queue of benchmarkSize entries
+// with the list based implementation it replaced, where there was one.
+const benchmarkSize = 1000
+
+func BenchmarkEnqueue(b *testing.B) {
+	benchmarkEnqueue(b, New(redisTestClient(b), keyPrefix))
+}
+
+func BenchmarkEnqueueList(b *testing.B) {
+	benchmarkEnqueue(b, newListQueue(redisTestClient(b), keyPrefix))
+}
+
+func BenchmarkPosition(b *testing.B) {
+	benchmarkPosition(b, New(redisTestClient(b), keyPrefix))
+}
+
+func BenchmarkPositionList(b *testing.B) {
+	benchmarkPosition(b, newListQueue(redisTestClient(b), keyPrefix))
+}
+
+func BenchmarkRemove(b *testing.B) {
+	benchmarkRemove(b, New(redisTestClient(b), keyPrefix))
+}
+
+func BenchmarkRemoveList(b *testing.B) {
+	benchmarkRemove(b, newListQueue(redisTestClient(b), keyPrefix))
+}
+
+func BenchmarkDequeueN(b *testing.B) {
+	benchmarkDequeueN(b, New(redisTestClient(b), keyPrefix))
+}
+
+func BenchmarkDequeueNList(b *testing.B) {
+	benchmarkDequeueN(b, newListQueue(redisTestClient(b), keyPrefix))
+}
+
+// BenchmarkDequeueFit measures takes without fair rotation, which use
+// DequeueFit, rather than DequeueN, in case the queue holds parties.
+func BenchmarkDequeueFit(b *testing.B) {
+	q := New(redisTestClient(b), keyPrefix)
+	size := func(datum []byte) int { return 1 }
+	benchmarkDequeue(b, q, func() error {
+		_, _, err := q.DequeueFit(12, size)
+		return err
+	})
+}
+
+// BenchmarkDequeueSelect measures takes with fair rotation or roles.
+func BenchmarkDequeueSelect(b *testing.B) {
+	q := New(redisTestClient(b), keyPrefix)
+	benchmarkDequeue(b, q, func() error {
+		_, _, err := q.DequeueSelect(func(data [][]byte) (chosen []int) {
+			for i := 0; i < 12 && i < len(data); i++ {
+				chosen = append(chosen, i)
+			}
+			return chosen
+		})
+		return err
+	})
+}
+
+// benchmarkQueue is the subset of queue.Queue implemented by listQueue.
+type benchmarkQueue interface {
+	Clear() error
+	DequeueN(n int) ([][]byte, int, error)
+	Enqueue(datum []byte) (int, error)
+	Position(datum []byte) (int, error)
+	Remove(datum []byte) error
+}
+
+func fill(b *testing.B, q benchmarkQueue, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := q.Enqueue([]byte(fmt.Sprint("filler", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkEnqueue(b *testing.B, q benchmarkQueue) {
+	fill(b, q, benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := q.Enqueue([]byte(fmt.Sprint(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkPosition(b *testing.B, q benchmarkQueue) {
+	fill(b, q, benchmarkSize)
+	last := []byte(fmt.Sprint("filler", benchmarkSize-1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := q.Position(last); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkRemove(b *testing.B, q benchmarkQueue) {
+	fill(b, q, benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		datum := []byte(fmt.Sprint(i))
+		if _, err := q.Enqueue(datum); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err := q.Remove(datum); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDequeueN(b *testing.B, q benchmarkQueue) {
+	benchmarkDequeue(b, q, func() error {
+		_, _, err := q.DequeueN(12)
+		return err
+	})
+}
+
+// benchmarkDequeue times dequeue on a freshly filled queue.
+func benchmarkDequeue(b *testing.B, q benchmarkQueue, dequeue func() error) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := q.Clear(); err != nil {
+			b.Fatal(err)
+		}
+		fill(b, q, benchmarkSize)
+		b.StartTimer()
+		if err := dequeue(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func redisTestClient(t testing.TB) *redis.Client {
 	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
 	if client == nil {
 		t.SkipNow()
 	}
 
-	err := client.Del(keyPrefix).Err()
+	err := client.Del(keyPrefix, keyPrefix+".times",
+		keyPrefix+".enqueued_at").Err()
 	if err != nil {
 		t.SkipNow()
 	}
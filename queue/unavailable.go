@@ -0,0 +1,84 @@
+// Copyright 2016 Eric Wollesen <ericw at xmtp dot net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+// Unavailable is the class of errors returned by an unavailable queue.
+var Unavailable = Error.NewClass("unavailable")
+
+// unavailableQueue fails every operation, eg because the queue's file couldn't
+// be loaded, so that the queue is refused, rather than silently replaced by an
+// empty one.
+type unavailableQueue struct {
+	err error
+}
+
+var _ Queue = (*unavailableQueue)(nil)
+
+// NewUnavailable returns a queue whose every operation fails with err.
+func NewUnavailable(err error) Queue {
+	return &unavailableQueue{err: Unavailable.Wrap(err)}
+}
+
+func (q *unavailableQueue) Clear() error {
+	return q.err
+}
+
+func (q *unavailableQueue) DequeueN(n int) ([][]byte, int, error) {
+	return nil, -1, q.err
+}
+
+func (q *unavailableQueue) DequeueFit(n int, size func([]byte) int) (
+	[][]byte, int, error) {
+
+	return nil, -1, q.err
+}
+
+func (q *unavailableQueue) DequeueSelect(choose func([][]byte) []int) (
+	[][]byte, int, error) {
+
+	return nil, -1, q.err
+}
+
+func (q *unavailableQueue) Enqueue(datum []byte) (int, error) {
+	return -1, q.err
+}
+
+func (q *unavailableQueue) Insert(pos int, datum []byte) (int, error) {
+	return -1, q.err
+}
+
+func (q *unavailableQueue) Iter(fn func(int, *Entry) bool) error {
+	return q.err
+}
+
+func (q *unavailableQueue) Move(datum []byte, pos int) (int, error) {
+	return -1, q.err
+}
+
+func (q *unavailableQueue) Position(datum []byte) (int, error) {
+	return -1, q.err
+}
+
+func (q *unavailableQueue) Remove(datum []byte) error {
+	return q.err
+}
+
+func (q *unavailableQueue) Replace(entries []*Entry) error {
+	return q.err
+}
+
+func (q *unavailableQueue) Size() (int, error) {
+	return -1, q.err
+}
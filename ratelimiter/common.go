@@ -23,5 +23,10 @@ var (
 
 type RateLimiter interface {
 	Clear() error
+	// ClearPrefix clears the limits of the ids that start with prefix.
+	ClearPrefix(prefix string) error
 	Limit(id string) (func() error, error)
+	// Snapshot returns a function that restores the limits as they are now,
+	// eg to undo a Clear. Limits set since the snapshot are kept.
+	Snapshot() func() error
 }
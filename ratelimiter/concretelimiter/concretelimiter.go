@@ -15,6 +15,7 @@
 package concretelimiter
 
 import (
+	"strings"
 	"sync"
 	"time"
 
@@ -49,6 +50,39 @@ func (l *rateLimiter) Clear() error {
 	return nil
 }
 
+func (l *rateLimiter) ClearPrefix(prefix string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id := range l.timestamps {
+		if strings.HasPrefix(id, prefix) {
+			delete(l.timestamps, id)
+		}
+	}
+	return nil
+}
+
+func (l *rateLimiter) Snapshot() func() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	saved := make(map[string]time.Time, len(l.timestamps))
+	for id, at := range l.timestamps {
+		saved[id] = at
+	}
+
+	return func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		for id, at := range saved {
+			if at.After(l.timestamps[id]) {
+				l.timestamps[id] = at
+			}
+		}
+		return nil
+	}
+}
+
 func (l *rateLimiter) Limit(id string) (func() error, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
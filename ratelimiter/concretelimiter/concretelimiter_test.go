@@ -30,6 +30,31 @@ func TestClear(t *testing.T) {
 	test.AssertNil(err)
 }
 
+func TestClearPrefix(t *testing.T) {
+	test, lim := newLimTest(t)
+	test.setLimit("1:foo")
+	test.setLimit("2:foo")
+	test.AssertNil(lim.ClearPrefix("1:"))
+	_, err := lim.Limit("1:foo")
+	test.AssertNil(err)
+	_, err = lim.Limit("2:foo")
+	test.AssertErrorContainedBy(err, ratelimiter.TooSoon)
+}
+
+func TestSnapshot(t *testing.T) {
+	test, lim := newLimTest(t)
+	test.setLimit("foo")
+	restore := lim.Snapshot()
+	test.AssertNil(lim.Clear())
+	test.setLimit("bar")
+
+	test.AssertNil(restore())
+	_, err := lim.Limit("foo")
+	test.AssertErrorContainedBy(err, ratelimiter.TooSoon)
+	_, err = lim.Limit("bar")
+	test.AssertErrorContainedBy(err, ratelimiter.TooSoon)
+}
+
 func TestLimit(t *testing.T) {
 	test, lim := newLimTest(t)
 
@@ -17,8 +17,10 @@ package mocklimiter
 import "github.com/ewollesen/zenbot/ratelimiter"
 
 type mockRateLimiter struct {
-	Clears int
-	Limits int
+	Clears   int
+	Prefixes []string
+	Limits   int
+	Restores int
 }
 
 var _ ratelimiter.RateLimiter = (*mockRateLimiter)(nil)
@@ -32,6 +34,18 @@ func (l *mockRateLimiter) Clear() error {
 	return nil
 }
 
+func (l *mockRateLimiter) ClearPrefix(prefix string) error {
+	l.Prefixes = append(l.Prefixes, prefix)
+	return nil
+}
+
+func (l *mockRateLimiter) Snapshot() func() error {
+	return func() error {
+		l.Restores++
+		return nil
+	}
+}
+
 func (l *mockRateLimiter) Limit(id string) (func() error, error) {
 	return func() error {
 		l.Limits++